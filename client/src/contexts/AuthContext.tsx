@@ -1,5 +1,5 @@
 import React, { createContext, useContext, useState, useEffect, ReactNode, useMemo } from 'react';
-import { apiGet } from '../utils/api';
+import { apiGet, apiPost } from '../utils/api';
 
 interface User {
   id: number;
@@ -21,7 +21,7 @@ interface AuthContextType {
   isAuthenticated: boolean;
   isSeller: boolean;
   isInitialized: boolean;
-  login: (token: string, user: User) => void;
+  login: (token: string, user: User, refreshToken?: string) => void;
   logout: () => void;
   updateUserData: (userData: Partial<User>) => void;
   refreshUserData: () => Promise<void>;
@@ -32,6 +32,25 @@ interface AuthContextType {
 
 const AuthContext = createContext<AuthContextType | undefined>(undefined);
 
+/**
+ * Reads the user ID from the subject claim of a JWT access token.
+ * The signature is verified by the server; this is only used for routing.
+ * @param token - JWT access token
+ * @returns The user ID, or null if the token cannot be decoded
+ */
+export const getUserIdFromToken = (token: string): number | null => {
+  const parts = token.split('.');
+  if (parts.length !== 3) return null;
+
+  try {
+    const payload = parts[1].replace(/-/g, '+').replace(/_/g, '/');
+    const claims = JSON.parse(atob(payload.padEnd(payload.length + ((4 - (payload.length % 4)) % 4), '=')));
+    return parseInt(claims.sub, 10) || null;
+  } catch (error) {
+    return null;
+  }
+};
+
 interface AuthProviderProps {
   children: ReactNode;
 }
@@ -47,13 +66,7 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
   // Extract userId from token for consistent API access
   const userId = useMemo(() => {
     if (!token) return null;
-    
-    // Token format is "<userId>_<username>_<timestamp>"
-    const parts = token.split('_');
-    if (parts.length < 1) return null;
-    
-    // Make sure we return a number for consistency
-    return parseInt(parts[0], 10) || null;
+    return getUserIdFromToken(token);
   }, [token]);
 
   // Fallback to user object id if needed
@@ -105,14 +118,16 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
   }, []);
 
   // Login function - stores user data in localStorage
-  const login = (token: string, userData: User) => {
+  const login = (token: string, userData: User, refreshToken?: string) => {
     localStorage.setItem('token', token);
     localStorage.setItem('user', JSON.stringify(userData));
+    if (refreshToken) {
+      localStorage.setItem('refreshToken', refreshToken);
+    }
     
-    // Validate token format
-    const parts = token.split('_');
-    if (parts.length >= 1 && parts[0]) {
-      const tokenUserId = parseInt(parts[0], 10);
+    // Validate token subject
+    const tokenUserId = getUserIdFromToken(token);
+    if (tokenUserId !== null) {
       // If token userId doesn't match user object id, log a warning
       if (tokenUserId !== userData.id) {
         console.warn('Token userId does not match user object id!', 
@@ -124,9 +139,16 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     setIsAuthenticated(true);
   };
 
-  // Logout function - removes user data from localStorage
+  // Logout function - revokes the server session and removes user data from localStorage
   const logout = () => {
+    const storedToken = localStorage.getItem('token');
+    if (storedToken) {
+      apiPost('logout', {}, storedToken).catch(() => {
+        // The session may already be expired or revoked
+      });
+    }
     localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
     localStorage.removeItem('user');
     setUser(null);
     setIsAuthenticated(false);
@@ -151,15 +173,14 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     }
 
     try {
-      // Extract user ID from token (format: "<userId>_<username>_<timestamp>")
-      const parts = storedToken.split('_');
-      if (parts.length < 1) {
+      // Extract user ID from the token's subject claim
+      const userIdFromToken = getUserIdFromToken(storedToken);
+      if (userIdFromToken === null) {
         console.error('Invalid token format');
         logout();
         return;
       }
 
-      const userIdFromToken = parts[0];
       console.log('Refreshing data for user ID:', userIdFromToken);
 
       try {
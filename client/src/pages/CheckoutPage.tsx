@@ -79,6 +79,7 @@ const CheckoutPage: React.FC = () => {
     phone: false,
   });
   const [loading, setLoading] = useState(false);
+  const [reservationId, setReservationId] = useState<number | null>(null);
   const [orderSuccess, setOrderSuccess] = useState(false);
   const [orderId, setOrderId] = useState<string | null>(null);
   const [orderDetails, setOrderDetails] = useState<{
@@ -184,6 +185,10 @@ const CheckoutPage: React.FC = () => {
       return;
     }
     
+    if (activeStep === 0) {
+      reserveCartItems();
+    }
+
     if (activeStep === 1) {
       handlePlaceOrder();
     } else {
@@ -191,6 +196,23 @@ const CheckoutPage: React.FC = () => {
     }
   };
 
+  // Hold the cart's stock while the buyer enters payment details
+  const reserveCartItems = async () => {
+    const token = localStorage.getItem('token');
+    if (!token) return;
+
+    try {
+      const response = await apiPost<{reservation: {id: number}}>('reservations', {
+        items: cartItems.map(item => ({ productId: item.id, quantity: item.quantity })),
+      }, token);
+      setReservationId(response.reservation.id);
+    } catch (error) {
+      // Stock is still checked when the order is placed
+      console.warn('Could not reserve cart items:', error);
+      setReservationId(null);
+    }
+  };
+
   const handleBack = () => {
     setActiveStep((prevStep) => prevStep - 1);
   };
@@ -213,6 +235,7 @@ const CheckoutPage: React.FC = () => {
       // Create the order data matching our API format with detailed shipping info
       const orderData = {
         orderItems: orderItems,
+        reservationId: reservationId ?? undefined,
         shippingDetails: {
           fullName: shippingAddress.fullName,
           addressLine1: shippingAddress.addressLine1,
@@ -248,12 +271,23 @@ const CheckoutPage: React.FC = () => {
             totalPrice: number;
           }>;
         };
+        payment?: {
+          status: string;
+          paymentUrl?: string;
+        };
       }
       
       const response = await apiPost<OrderResponse>('orders', orderData, token);
       
       console.log('Order created successfully:', response);
       
+      // Send the buyer to the provider's payment page if payment isn't done yet
+      if (response.payment?.paymentUrl) {
+        clearCart();
+        window.location.assign(response.payment.paymentUrl);
+        return;
+      }
+      
       // Set order success and ID
       setOrderSuccess(true);
       setOrderId(response.order.id.toString());
@@ -24,6 +24,7 @@ interface LocationState {
 // Define the response type for login API
 interface LoginResponse {
   token: string;
+  refreshToken?: string;
   user: {
     id: number;
     username: string;
@@ -133,7 +134,7 @@ const LoginPage: React.FC = () => {
       console.log('Login successful, user data received');
       
       // Store the complete user profile in localStorage via the AuthContext login function
-      login(data.token, data.user);
+      login(data.token, data.user, data.refreshToken);
       
       // Show success message briefly before redirecting
       setSuccessMessage(t('auth.loginSuccess'));
@@ -46,6 +46,7 @@ interface Product {
   description: string;
   price: number;
   stock: number;
+  availableStock?: number; // Stock minus other buyers' checkout reservations
   image: string;
   category: string;
   status: string;
@@ -140,7 +141,8 @@ const ProductDetailPage: React.FC = () => {
       try {
         // Use apiGet utility instead of fetch for product details
         const data = await apiGet<{product: Product}>(`products/${id}`);
-        setProduct(data.product);
+        // Only offer what isn't held by other buyers' checkouts
+        setProduct({ ...data.product, stock: data.product.availableStock ?? data.product.stock });
         
         // Fetch shop details if we have a shopId
         if (data.product.shopId) {
@@ -1,6 +1,6 @@
 import React, { useState, useEffect, useCallback } from 'react';
 import { useTranslation } from 'react-i18next';
-import { useAuth } from '../contexts/AuthContext';
+import { useAuth, getUserIdFromToken } from '../contexts/AuthContext';
 import {
   Container,
   Box,
@@ -223,14 +223,12 @@ const ProductManagementPage: React.FC = () => {
         throw new Error(t('auth.tokenNotFound'));
       }
       
-      // Extract user ID from token (format: "<userId>_<username>_<timestamp>")
-      const parts = token.split('_');
-      if (parts.length < 1) {
+      // Extract user ID from the token's subject claim
+      const userId = getUserIdFromToken(token);
+      if (userId === null) {
         throw new Error(t('auth.invalidToken'));
       }
       
-      const userId = parts[0];
-      
       // Use apiGet instead of fetch
       try {
         const data = await apiGet<{shops: Shop[]}>(`users/${userId}/shops`, token);
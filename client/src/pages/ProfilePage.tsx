@@ -23,7 +23,7 @@ import SaveIcon from '@mui/icons-material/Save';
 import CancelIcon from '@mui/icons-material/Cancel';
 import { useTranslation } from 'react-i18next';
 import { useUser } from '../hooks/useUser';
-import { useAuth } from '../contexts/AuthContext';
+import { useAuth, getUserIdFromToken } from '../contexts/AuthContext';
 import { apiPut } from '../utils/api';
 
 // Importing the User interface from useUser.ts
@@ -158,14 +158,12 @@ const ProfilePage: React.FC = () => {
         throw new Error(t('auth.tokenNotFound'));
       }
       
-      // Extract user ID from token (format: "<userId>_<username>_<timestamp>")
-      const parts = token.split('_');
-      if (parts.length < 1) {
+      // Extract user ID from the token's subject claim
+      const userId = getUserIdFromToken(token);
+      if (userId === null) {
         throw new Error(t('auth.invalidToken'));
       }
       
-      const userId = parts[0];
-      
       // Use apiPut instead of fetch
       const data = await apiPut<{user: User}>(`users/${userId}`, formData, token);
       
@@ -236,14 +234,12 @@ const ProfilePage: React.FC = () => {
           throw new Error(t('auth.tokenNotFound'));
         }
         
-        // Extract user ID from token (format: "<userId>_<username>_<timestamp>")
-        const parts = token.split('_');
-        if (parts.length < 1) {
+        // Extract user ID from the token's subject claim
+        const userId = getUserIdFromToken(token);
+        if (userId === null) {
           throw new Error(t('auth.invalidToken'));
         }
         
-        const userId = parts[0];
-        
         // Use apiPut instead of fetch
         const data = await apiPut<{user: User}>(`users/${userId}/avatar`, { avatar: dataUrl }, token);
         
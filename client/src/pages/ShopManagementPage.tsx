@@ -22,7 +22,7 @@ import {
   styled
 } from '@mui/material';
 import { useTranslation } from 'react-i18next';
-import { useAuth } from '../contexts/AuthContext';
+import { useAuth, getUserIdFromToken } from '../contexts/AuthContext';
 import AddBusinessIcon from '@mui/icons-material/AddBusiness';
 import EditIcon from '@mui/icons-material/Edit';
 import StoreIcon from '@mui/icons-material/Store';
@@ -233,15 +233,7 @@ const ShopManagementPage: React.FC = () => {
       }
       
       // Try to extract userId from token
-      const parts = storedToken.split('_');
-      if (parts.length < 1) {
-        console.log('Cannot fetch shop data: invalid token format');
-        setLoading(false);
-        setInitialLoadAttempted(true);
-        return;
-      }
-      
-      const tokenUserId = parseInt(parts[0], 10);
+      const tokenUserId = getUserIdFromToken(storedToken);
       if (!tokenUserId) {
         console.log('Cannot fetch shop data: invalid userId in token');
         setLoading(false);
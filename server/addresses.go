@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// loadUserAddress loads an address from the user's address book
+func loadUserAddress(db *gorm.DB, userID, addressID uint) (*models.Address, error) {
+	var address models.Address
+	err := db.Where("id = ? AND user_id = ?", addressID, userID).First(&address).Error
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// defaultAddress returns the user's default address for shipping or
+// billing, or nil when there isn't one
+func defaultAddress(db *gorm.DB, userID uint, column string) (*models.Address, error) {
+	var address models.Address
+	err := db.Where("user_id = ? AND "+column+" = ?", userID, true).First(&address).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// resolveCheckoutAddresses works out the shipping and billing addresses of
+// an order from the checkout request and the buyer's address book
+func (a *app) resolveCheckoutAddresses(user *models.User, selection checkoutAddresses) (shipping, billing models.AddressFields, err error) {
+	// pick returns the address given by ID, entered details or the default
+	pick := func(addressID uint, details *models.AddressFields, defaultColumn string) (*models.AddressFields, error) {
+		if addressID != 0 {
+			address, err := loadUserAddress(a.db, user.ID, addressID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, &orderError{http.StatusBadRequest, "Address not found in your address book"}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &address.AddressFields, nil
+		}
+		if details != nil && !details.IsZero() {
+			return details, nil
+		}
+		address, err := defaultAddress(a.db, user.ID, defaultColumn)
+		if err != nil || address == nil {
+			return nil, err
+		}
+		return &address.AddressFields, nil
+	}
+
+	shippingFields, err := pick(selection.ShippingAddressID, &selection.ShippingDetails, "is_default_shipping")
+	if err != nil {
+		return shipping, billing, err
+	}
+	if shippingFields == nil || !shippingFields.IsComplete() {
+		return shipping, billing, &orderError{http.StatusBadRequest, "Complete shipping details are required"}
+	}
+
+	billingFields, err := pick(selection.BillingAddressID, selection.BillingDetails, "is_default_billing")
+	if err != nil {
+		return shipping, billing, err
+	}
+	if billingFields == nil {
+		billingFields = shippingFields
+	}
+	if !billingFields.IsComplete() {
+		return shipping, billing, &orderError{http.StatusBadRequest, "Complete billing details are required"}
+	}
+
+	return *shippingFields, *billingFields, nil
+}
+
+// saveAddress stores the address, keeping at most one default shipping and
+// one default billing address per user. A user's first address becomes the
+// default for both.
+func saveAddress(tx *gorm.DB, address *models.Address) error {
+	var count int64
+	if err := tx.Model(&models.Address{}).
+		Where("user_id = ? AND id <> ?", address.UserID, address.ID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		address.IsDefaultShipping = true
+		address.IsDefaultBilling = true
+	}
+
+	if err := tx.Save(address).Error; err != nil {
+		return err
+	}
+
+	// Take the default flags away from the user's other addresses
+	others := tx.Model(&models.Address{}).Where("user_id = ? AND id <> ?", address.UserID, address.ID)
+	if address.IsDefaultShipping {
+		if err := others.Session(&gorm.Session{}).Update("is_default_shipping", false).Error; err != nil {
+			return err
+		}
+	}
+	if address.IsDefaultBilling {
+		if err := others.Session(&gorm.Session{}).Update("is_default_billing", false).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addressRequest is the body for creating or updating an address
+type addressRequest struct {
+	Label string `json:"label"`
+	models.AddressFields
+	IsDefaultShipping bool `json:"isDefaultShipping"`
+	IsDefaultBilling  bool `json:"isDefaultBilling"`
+}
+
+// Address handlers; access is limited to the user themselves or an admin by
+// RequireSelfOrAdmin
+
+func (a *app) getUserAddresses(c *gin.Context) {
+	userID := c.Param("id")
+
+	var addresses []models.Address
+	if err := a.db.Where("user_id = ?", userID).
+		Order("is_default_shipping DESC, id").Find(&addresses).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch addresses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"addresses": addresses})
+}
+
+func (a *app) createUserAddress(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var addressRequest addressRequest
+	if err := c.ShouldBindJSON(&addressRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if !addressRequest.AddressFields.IsComplete() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name, address line, city, state, postal code and country are required"})
+		return
+	}
+
+	address := models.Address{
+		UserID:            uint(userID),
+		Label:             addressRequest.Label,
+		AddressFields:     addressRequest.AddressFields,
+		IsDefaultShipping: addressRequest.IsDefaultShipping,
+		IsDefaultBilling:  addressRequest.IsDefaultBilling,
+	}
+	err = withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			return saveAddress(tx, &address)
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create address"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Address created successfully",
+		"address": address,
+	})
+}
+
+func (a *app) updateUserAddress(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	addressID, err := strconv.Atoi(c.Param("addressId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address ID"})
+		return
+	}
+
+	address, err := loadUserAddress(a.db, uint(userID), uint(addressID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+
+	var addressRequest addressRequest
+	if err := c.ShouldBindJSON(&addressRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if !addressRequest.AddressFields.IsComplete() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name, address line, city, state, postal code and country are required"})
+		return
+	}
+
+	// Orders keep their own copy of the address, so editing it is safe
+	address.Label = addressRequest.Label
+	address.AddressFields = addressRequest.AddressFields
+	address.IsDefaultShipping = addressRequest.IsDefaultShipping
+	address.IsDefaultBilling = addressRequest.IsDefaultBilling
+	err = withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			return saveAddress(tx, address)
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Address updated successfully",
+		"address": address,
+	})
+}
+
+func (a *app) deleteUserAddress(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	addressID, err := strconv.Atoi(c.Param("addressId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address ID"})
+		return
+	}
+
+	address, err := loadUserAddress(a.db, uint(userID), uint(addressID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+	if err := a.db.Delete(address).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Address deleted successfully"})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type addressResponse struct {
+	Address models.Address `json:"address"`
+}
+
+func TestAddressBookDefaults(t *testing.T) {
+	env := newTestEnv(t)
+	buyer := env.createUser("buyer", models.Buyer)
+	other := env.createUser("other", models.Buyer)
+	token := env.login(buyer)
+	path := fmt.Sprintf("/api/users/%d/addresses", buyer.ID)
+
+	home := testShippingDetails()
+	home["label"] = "Home"
+	var first addressResponse
+	env.do(http.MethodPost, path, token, home, http.StatusCreated, &first)
+	if !first.Address.IsDefaultShipping || !first.Address.IsDefaultBilling {
+		t.Errorf("first address = %+v, want default for shipping and billing", first.Address)
+	}
+
+	// Incomplete addresses are refused
+	env.do(http.MethodPost, path, token, gin.H{"fullName": "No Street"}, http.StatusBadRequest, nil)
+
+	work := testShippingDetails()
+	work["label"] = "Work"
+	work["addressLine2"] = "Floor 3"
+	work["isDefaultShipping"] = true
+	var second addressResponse
+	env.do(http.MethodPost, path, token, work, http.StatusCreated, &second)
+
+	var listed struct {
+		Addresses []models.Address `json:"addresses"`
+	}
+	env.do(http.MethodGet, path, token, nil, http.StatusOK, &listed)
+	if len(listed.Addresses) != 2 {
+		t.Fatalf("listed %d addresses, want 2", len(listed.Addresses))
+	}
+	for _, address := range listed.Addresses {
+		wantShipping := address.ID == second.Address.ID
+		if address.IsDefaultShipping != wantShipping || address.IsDefaultBilling == wantShipping {
+			t.Errorf("address %s = shipping %v billing %v, want the new one for shipping only",
+				address.Label, address.IsDefaultShipping, address.IsDefaultBilling)
+		}
+	}
+
+	// The address book is private
+	env.do(http.MethodGet, path, env.login(other), nil, http.StatusForbidden, nil)
+	env.do(http.MethodDelete, fmt.Sprintf("/api/users/%d/addresses/%d", other.ID, first.Address.ID),
+		env.login(other), nil, http.StatusNotFound, nil)
+
+	env.do(http.MethodDelete, fmt.Sprintf("%s/%d", path, first.Address.ID), token, nil, http.StatusOK, nil)
+	env.do(http.MethodGet, path, token, nil, http.StatusOK, &listed)
+	if len(listed.Addresses) != 1 {
+		t.Errorf("listed %d addresses after deleting one, want 1", len(listed.Addresses))
+	}
+}
+
+func TestOrderSnapshotsAddresses(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	other := env.createUser("other", models.Buyer)
+	product := env.createProduct(seller, "Chair", 70, 5)
+	token := env.login(buyer)
+	path := fmt.Sprintf("/api/users/%d/addresses", buyer.ID)
+
+	saved := testShippingDetails()
+	saved["addressLine2"] = "Apartment 4"
+	saved["phone"] = "555-0100"
+	var created addressResponse
+	env.do(http.MethodPost, path, token, saved, http.StatusCreated, &created)
+
+	// Without address details the default address is used, and billing
+	// can be given separately
+	request := orderRequest(gin.H{"productId": product.ID, "quantity": 1})
+	delete(request, "shippingDetails")
+	billing := testShippingDetails()
+	billing["fullName"] = "Accounts Payable"
+	request["billingDetails"] = billing
+	var placed struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", token, request, http.StatusCreated, &placed)
+
+	shipping := placed.Order.ShippingDetails
+	if shipping.AddressLine2 != "Apartment 4" || shipping.Phone != "555-0100" {
+		t.Errorf("shipping details = %+v, want the saved address with its second line and phone", shipping)
+	}
+	if placed.Order.BillingDetails.FullName != "Accounts Payable" {
+		t.Errorf("billing details = %+v, want the separate billing address", placed.Order.BillingDetails)
+	}
+
+	// Editing the address book doesn't change the order
+	moved := testShippingDetails()
+	moved["addressLine1"] = "1 New Street"
+	env.do(http.MethodPut, fmt.Sprintf("%s/%d", path, created.Address.ID), token, moved, http.StatusOK, nil)
+	var order models.Order
+	env.db.First(&order, placed.Order.ID)
+	if order.ShippingDetails.AddressLine1 == "1 New Street" || order.ShippingDetails.AddressLine2 != "Apartment 4" {
+		t.Errorf("order shipping details = %+v, want the address as it was at checkout", order.ShippingDetails)
+	}
+
+	// Other people's addresses can't be picked
+	var foreign addressResponse
+	env.do(http.MethodPost, fmt.Sprintf("/api/users/%d/addresses", other.ID), env.login(other),
+		testShippingDetails(), http.StatusCreated, &foreign)
+	request = orderRequest(gin.H{"productId": product.ID, "quantity": 1})
+	request["shippingAddressId"] = foreign.Address.ID
+	env.do(http.MethodPost, "/api/orders", token, request, http.StatusBadRequest, nil)
+}
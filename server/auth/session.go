@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+	"tobe_shop/server/models"
+
+	"gorm.io/gorm"
+)
+
+// Errors returned by the session store
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+	ErrRefreshTokenExpired = errors.New("refresh token has expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+	ErrSessionRevoked      = errors.New("session has been revoked")
+)
+
+// Reasons recorded on revoked sessions
+const (
+	RevokedRotated = "rotated"
+	RevokedLogout  = "logout"
+	RevokedReuse   = "reuse_detected"
+)
+
+// SessionMeta describes the client a session was created for
+type SessionMeta struct {
+	UserAgent string
+	IPAddress string
+}
+
+// SessionStore persists hashed refresh tokens in the sessions table
+type SessionStore struct {
+	db  *gorm.DB
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewSessionStore returns a store issuing refresh tokens valid for ttl
+func NewSessionStore(db *gorm.DB, ttl time.Duration) *SessionStore {
+	return &SessionStore{db: db, ttl: ttl, now: time.Now}
+}
+
+// Create starts a new session family for the user and returns the raw
+// refresh token. Only its hash is stored.
+func (s *SessionStore) Create(userID uint, meta SessionMeta) (string, *models.Session, error) {
+	familyID, err := randomID()
+	if err != nil {
+		return "", nil, err
+	}
+	return s.create(s.db, userID, familyID, meta)
+}
+
+// Rotate exchanges a refresh token for a new one in the same family. Using a
+// token that was already rotated revokes the whole family, since it means
+// the token has leaked.
+func (s *SessionStore) Rotate(refreshToken string, meta SessionMeta) (string, *models.Session, error) {
+	var newToken string
+	var newSession *models.Session
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var current models.Session
+		if err := tx.Where("token_hash = ?", HashRefreshToken(refreshToken)).First(&current).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRefreshTokenInvalid
+			}
+			return err
+		}
+
+		if current.RevokedAt != nil {
+			if current.RevokedReason == RevokedRotated {
+				return ErrRefreshTokenReused
+			}
+			return ErrSessionRevoked
+		}
+		if !s.now().Before(current.ExpiresAt) {
+			return ErrRefreshTokenExpired
+		}
+
+		// Revoke conditionally so two concurrent refreshes can't both succeed
+		now := s.now()
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND revoked_at IS NULL", current.ID).
+			Updates(map[string]interface{}{"revoked_at": now, "revoked_reason": RevokedRotated})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+
+		token, session, err := s.create(tx, current.UserID, current.FamilyID, meta)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.Session{}).Where("id = ?", current.ID).
+			Update("replaced_by_id", session.ID).Error; err != nil {
+			return err
+		}
+
+		newToken, newSession = token, session
+		return nil
+	})
+
+	if errors.Is(err, ErrRefreshTokenReused) {
+		if revokeErr := s.revokeFamilyOf(refreshToken); revokeErr != nil {
+			return "", nil, revokeErr
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return newToken, newSession, nil
+}
+
+// RevokeFamily revokes every session created from the same login
+func (s *SessionStore) RevokeFamily(familyID string, reason string) error {
+	return s.db.Model(&models.Session{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Updates(map[string]interface{}{"revoked_at": s.now(), "revoked_reason": reason}).Error
+}
+
+// RevokeUser revokes every session belonging to the user
+func (s *SessionStore) RevokeUser(userID uint, reason string) (int64, error) {
+	result := s.db.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Updates(map[string]interface{}{"revoked_at": s.now(), "revoked_reason": reason})
+	return result.RowsAffected, result.Error
+}
+
+// IsActive reports whether the family still has a live session. Access
+// tokens carry their family ID so logout takes effect immediately.
+func (s *SessionStore) IsActive(familyID string) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.Session{}).
+		Where("family_id = ? AND revoked_at IS NULL AND expires_at > ?", familyID, s.now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// FindByRefreshToken returns the session for a raw refresh token
+func (s *SessionStore) FindByRefreshToken(refreshToken string) (*models.Session, error) {
+	var session models.Session
+	if err := s.db.Where("token_hash = ?", HashRefreshToken(refreshToken)).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRefreshTokenInvalid
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SessionStore) revokeFamilyOf(refreshToken string) error {
+	session, err := s.FindByRefreshToken(refreshToken)
+	if err != nil {
+		return err
+	}
+	return s.RevokeFamily(session.FamilyID, RevokedReuse)
+}
+
+func (s *SessionStore) create(db *gorm.DB, userID uint, familyID string, meta SessionMeta) (string, *models.Session, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	session := models.Session{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: HashRefreshToken(token),
+		ExpiresAt: s.now().Add(s.ttl),
+		UserAgent: truncate(meta.UserAgent, 255),
+		IPAddress: truncate(meta.IPAddress, 45),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return "", nil, err
+	}
+	return token, &session, nil
+}
+
+// HashRefreshToken returns the hex SHA-256 digest stored for a refresh token
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RefreshErrorCode returns the machine-readable code sent to clients for a
+// session error
+func RefreshErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrRefreshTokenExpired):
+		return "refresh_token_expired"
+	case errors.Is(err, ErrRefreshTokenReused):
+		return "refresh_token_reused"
+	case errors.Is(err, ErrSessionRevoked):
+		return "session_revoked"
+	default:
+		return "refresh_token_invalid"
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
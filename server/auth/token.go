@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"tobe_shop/server/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Errors returned by ParseAccessToken. Each one maps to a distinct code
+// via ErrorCode so clients can tell an expired session from a forged token.
+var (
+	ErrTokenMalformed        = errors.New("token is malformed")
+	ErrTokenExpired          = errors.New("token has expired")
+	ErrTokenNotYetValid      = errors.New("token is not valid yet")
+	ErrTokenSignatureInvalid = errors.New("token signature is invalid")
+	ErrTokenUnknownKey       = errors.New("token was signed with an unknown key")
+	ErrTokenInvalidIssuer    = errors.New("token issuer is invalid")
+	ErrTokenInvalidAudience  = errors.New("token audience is invalid")
+	ErrTokenInvalidSubject   = errors.New("token subject is invalid")
+)
+
+// Key is an HMAC signing key identified by the "kid" token header
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Config holds the settings used to issue and verify access tokens
+type Config struct {
+	// Keys lists every key accepted for verification. Keep retired keys here
+	// until all tokens they signed have expired, then remove them.
+	Keys []Key
+	// ActiveKeyID selects the key used to sign new tokens
+	ActiveKeyID    string
+	Issuer         string
+	Audience       string
+	AccessTokenTTL time.Duration
+}
+
+// Claims are the claims carried by an access token
+type Claims struct {
+	Username string      `json:"username"`
+	Role     models.Role `json:"role"`
+	// SessionID is the refresh-token session family the token belongs to
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the user ID stored in the subject claim
+func (c *Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return 0, ErrTokenInvalidSubject
+	}
+	return uint(id), nil
+}
+
+// Manager issues and verifies HMAC-signed JWT access tokens
+type Manager struct {
+	keys   map[string][]byte
+	active string
+	config Config
+	now    func() time.Time
+}
+
+// NewManager validates the config and returns a token manager
+func NewManager(cfg Config) (*Manager, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("at least one signing key is required")
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		return nil, errors.New("access token TTL must be positive")
+	}
+
+	keys := make(map[string][]byte, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		if key.ID == "" {
+			return nil, errors.New("signing key ID must not be empty")
+		}
+		if len(key.Secret) < 32 {
+			return nil, fmt.Errorf("signing key %q must be at least 32 bytes", key.ID)
+		}
+		if _, exists := keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate signing key ID %q", key.ID)
+		}
+		keys[key.ID] = key.Secret
+	}
+
+	active := cfg.ActiveKeyID
+	if active == "" {
+		active = cfg.Keys[0].ID
+	}
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active signing key %q is not configured", active)
+	}
+
+	return &Manager{keys: keys, active: active, config: cfg, now: time.Now}, nil
+}
+
+// IssueAccessToken signs a new access token for the user and session family
+// with the active key
+func (m *Manager) IssueAccessToken(user *models.User, sessionID string) (string, time.Time, error) {
+	now := m.now()
+	expiresAt := now.Add(m.config.AccessTokenTTL)
+
+	tokenID, err := randomID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	claims := Claims{
+		Username:  user.Username,
+		Role:      user.Role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Issuer:    m.config.Issuer,
+			Audience:  jwt.ClaimStrings{m.config.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = m.active
+
+	signed, err := token.SignedString(m.keys[m.active])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseAccessToken verifies the signature, expiry, issuer and audience of
+// a token and returns its claims
+func (m *Manager) ParseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, m.keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(m.config.Issuer),
+		jwt.WithAudience(m.config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithTimeFunc(m.now),
+	)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if _, err := claims.UserID(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (m *Manager) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := m.keys[kid]
+	if !ok {
+		return nil, ErrTokenUnknownKey
+	}
+	return key, nil
+}
+
+// translateError maps jwt library errors onto the package errors
+func translateError(err error) error {
+	switch {
+	case errors.Is(err, ErrTokenUnknownKey):
+		return ErrTokenUnknownKey
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ErrTokenSignatureInvalid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return ErrTokenInvalidIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return ErrTokenInvalidAudience
+	default:
+		return ErrTokenMalformed
+	}
+}
+
+// ErrorCode returns the machine-readable code sent to clients for a token error
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return "token_expired"
+	case errors.Is(err, ErrTokenNotYetValid):
+		return "token_not_yet_valid"
+	case errors.Is(err, ErrTokenSignatureInvalid):
+		return "token_signature_invalid"
+	case errors.Is(err, ErrTokenUnknownKey):
+		return "token_unknown_key"
+	case errors.Is(err, ErrTokenInvalidIssuer):
+		return "token_invalid_issuer"
+	case errors.Is(err, ErrTokenInvalidAudience):
+		return "token_invalid_audience"
+	case errors.Is(err, ErrTokenInvalidSubject):
+		return "token_invalid_subject"
+	case errors.Is(err, ErrSessionRevoked):
+		return "session_revoked"
+	default:
+		return "token_malformed"
+	}
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+	"tobe_shop/server/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	currentKey  = Key{ID: "2024-06", Secret: bytes.Repeat([]byte("c"), 32)}
+	previousKey = Key{ID: "2024-01", Secret: bytes.Repeat([]byte("p"), 32)}
+)
+
+func newTestManager(t *testing.T, cfg Config) *Manager {
+	t.Helper()
+	if cfg.Issuer == "" {
+		cfg.Issuer = "tobe-shop"
+	}
+	if cfg.Audience == "" {
+		cfg.Audience = "tobe-shop-client"
+	}
+	if cfg.AccessTokenTTL == 0 {
+		cfg.AccessTokenTTL = 15 * time.Minute
+	}
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func issue(t *testing.T, m *Manager) string {
+	t.Helper()
+	token, _, err := m.IssueAccessToken(&models.User{ID: 7, Username: "alice", Role: models.Seller}, "family-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// signed signs claims for user 7 with the method, key and kid given
+func signed(t *testing.T, method jwt.SigningMethod, key interface{}, kid string) string {
+	t.Helper()
+	now := time.Now()
+	token := jwt.NewWithClaims(method, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "7",
+			Issuer:    "tobe-shop",
+			Audience:  jwt.ClaimStrings{"tobe-shop-client"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	})
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseAccessToken(t *testing.T) {
+	m := newTestManager(t, Config{Keys: []Key{currentKey}})
+
+	claims, err := m.ParseAccessToken(issue(t, m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := claims.UserID(); id != 7 || claims.Username != "alice" || claims.Role != models.Seller || claims.SessionID != "family-1" {
+		t.Errorf("claims = %+v, want alice (7), seller, in family-1", claims)
+	}
+}
+
+func TestParseAccessTokenRejects(t *testing.T) {
+	m := newTestManager(t, Config{Keys: []Key{currentKey}})
+
+	expired := newTestManager(t, Config{Keys: []Key{currentKey}})
+	expired.now = func() time.Time { return time.Now().Add(-time.Hour) }
+
+	// Change a character in the middle of the signature; the last one may
+	// only carry padding bits
+	tampered := issue(t, m)
+	i := strings.LastIndex(tampered, ".") + 10
+	c := byte('A')
+	if tampered[i] == 'A' {
+		c = 'B'
+	}
+	tampered = tampered[:i] + string(c) + tampered[i+1:]
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+		code  string
+	}{
+		{"expired", issue(t, expired), ErrTokenExpired, "token_expired"},
+		{"tampered signature", tampered, ErrTokenSignatureInvalid, "token_signature_invalid"},
+		{"alg none", signed(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, currentKey.ID), ErrTokenSignatureInvalid, "token_signature_invalid"},
+		{"RS256", signed(t, jwt.SigningMethodRS256, rsaKey, currentKey.ID), ErrTokenSignatureInvalid, "token_signature_invalid"},
+		{"other issuer", issue(t, newTestManager(t, Config{Keys: []Key{currentKey}, Issuer: "elsewhere"})), ErrTokenInvalidIssuer, "token_invalid_issuer"},
+		{"other audience", issue(t, newTestManager(t, Config{Keys: []Key{currentKey}, Audience: "admin-console"})), ErrTokenInvalidAudience, "token_invalid_audience"},
+		{"unknown kid", issue(t, newTestManager(t, Config{Keys: []Key{previousKey}})), ErrTokenUnknownKey, "token_unknown_key"},
+		{"garbage", "not.a.token", ErrTokenMalformed, "token_malformed"},
+	}
+	for _, tt := range tests {
+		claims, err := m.ParseAccessToken(tt.token)
+		if claims != nil || err != tt.want {
+			t.Errorf("%s: ParseAccessToken = %+v, %v; want %v", tt.name, claims, err, tt.want)
+		}
+		if code := ErrorCode(err); code != tt.code {
+			t.Errorf("%s: ErrorCode = %q, want %q", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestParseAccessTokenAfterKeyRotation(t *testing.T) {
+	before := newTestManager(t, Config{Keys: []Key{previousKey}})
+	token := issue(t, before)
+
+	// The new key signs from now on; the previous one still verifies
+	after := newTestManager(t, Config{Keys: []Key{currentKey, previousKey}, ActiveKeyID: currentKey.ID})
+	if _, err := after.ParseAccessToken(token); err != nil {
+		t.Errorf("token signed with the previous key: %v", err)
+	}
+	if _, err := before.ParseAccessToken(issue(t, after)); err != ErrTokenUnknownKey {
+		t.Errorf("token signed with the new key before rotation: %v, want ErrTokenUnknownKey", err)
+	}
+
+	// Once the previous key is retired its tokens are refused
+	retired := newTestManager(t, Config{Keys: []Key{currentKey}})
+	if _, err := retired.ParseAccessToken(token); err != ErrTokenUnknownKey {
+		t.Errorf("token signed with a retired key: %v, want ErrTokenUnknownKey", err)
+	}
+}
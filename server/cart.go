@@ -0,0 +1,620 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// cartTokenHeader carries the token of an anonymous cart. It is returned
+// whenever an anonymous cart is created and sent back on later requests,
+// including login so the cart can be merged into the user's cart.
+const cartTokenHeader = "X-Cart-Token"
+
+// Issues reported on cart lines when they are revalidated
+const (
+	cartIssueUnavailable       = "unavailable"
+	cartIssueOutOfStock        = "out_of_stock"
+	cartIssueInsufficientStock = "insufficient_stock"
+	cartIssuePriceChanged      = "price_changed"
+)
+
+// cartIssueMixedCurrencies is reported on the cart when its products are
+// priced in more than one currency. An order is charged at a single rate,
+// so such a cart has to be checked out in parts.
+const cartIssueMixedCurrencies = "mixed_currencies"
+
+// cartLine is a cart item checked against the product's current price and
+// available stock
+type cartLine struct {
+	ID             uint                   `json:"id"`
+	ProductID      uint                   `json:"productId"`
+	Product        *models.Product        `json:"product,omitempty"`
+	VariantID      uint                   `json:"variantId,omitempty"`
+	Variant        *models.ProductVariant `json:"variant,omitempty"`
+	Quantity       int                    `json:"quantity"`
+	UnitPrice      money.Money            `json:"unitPrice"`
+	PriceAtAdd     money.Money            `json:"priceAtAdd"`
+	TotalPrice     money.Money            `json:"totalPrice"`
+	AvailableStock int                    `json:"availableStock"`
+	Issues         []string               `json:"issues"`
+}
+
+// cartView is the cart as returned by the cart endpoints
+type cartView struct {
+	ID        uint       `json:"id,omitempty"`
+	Items     []cartLine `json:"items"`
+	ItemCount int        `json:"itemCount"`
+	// Subtotals has the subtotal per currency the lines are priced in.
+	// While there is only one, it is also given as Subtotal in Currency.
+	Subtotals map[string]money.Money `json:"subtotals"`
+	Subtotal  money.Money            `json:"subtotal"`
+	Currency  string                 `json:"currency,omitempty"`
+	// CanCheckout is false while any line is unavailable or short of stock,
+	// or the lines are priced in more than one currency
+	CanCheckout bool     `json:"canCheckout"`
+	Issues      []string `json:"issues"`
+}
+
+func newCartToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// findCart returns the signed-in user's cart, or the anonymous cart named by
+// the cart token header. When the cart doesn't exist it is created if create
+// is set, otherwise nil is returned.
+func (a *app) findCart(c *gin.Context, create bool) (*models.Cart, error) {
+	var cart models.Cart
+
+	user, signedIn := middleware.CurrentUser(c)
+	query := a.db
+	if signedIn {
+		query = query.Where("user_id = ?", user.ID)
+	} else if token := c.GetHeader(cartTokenHeader); token != "" {
+		query = query.Where("token = ? AND user_id IS NULL", token)
+	} else {
+		query = nil
+	}
+
+	if query != nil {
+		err := query.First(&cart).Error
+		if err == nil {
+			return &cart, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	if !create {
+		return nil, nil
+	}
+
+	token, err := newCartToken()
+	if err != nil {
+		return nil, err
+	}
+	cart = models.Cart{Token: token}
+	if signedIn {
+		cart.UserID = &user.ID
+	}
+	if err := a.db.Create(&cart).Error; err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// viewCart loads the cart's items and revalidates them against the current
+// product prices and available stock
+func (a *app) viewCart(cart *models.Cart) (*cartView, error) {
+	view := &cartView{Items: []cartLine{}, Subtotals: map[string]money.Money{}, Issues: []string{}}
+	if cart == nil {
+		return view, nil
+	}
+	view.ID = cart.ID
+
+	var items []models.CartItem
+	if err := a.db.Preload("Product").Where("cart_id = ?", cart.ID).Order("id").Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	var products []models.Product
+	for _, item := range items {
+		if item.Product != nil {
+			products = append(products, *item.Product)
+		}
+	}
+	if err := fillAvailableStock(a.db, products); err != nil {
+		return nil, err
+	}
+	if err := applySalePrices(a.db, products, time.Now()); err != nil {
+		return nil, err
+	}
+	available := make(map[uint]int, len(products))
+	prices := make(map[uint]money.Money, len(products))
+	productIDs := make([]uint, len(products))
+	for i, product := range products {
+		available[product.ID] = product.AvailableStock
+		prices[product.ID] = product.Price
+		productIDs[i] = product.ID
+	}
+
+	// Products sold by variant are stocked and priced per variant
+	var variants []models.ProductVariant
+	if len(productIDs) > 0 {
+		if err := a.db.Where("product_id IN ?", productIDs).Find(&variants).Error; err != nil {
+			return nil, err
+		}
+	}
+	variantsByID := make(map[uint]*models.ProductVariant, len(variants))
+	soldByVariant := make(map[uint]bool)
+	variantIDs := make([]uint, len(variants))
+	for i := range variants {
+		variantsByID[variants[i].ID] = &variants[i]
+		soldByVariant[variants[i].ProductID] = true
+		variantIDs[i] = variants[i].ID
+	}
+	variantHolds, err := activeVariantHolds(a.db, variantIDs, 0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	view.CanCheckout = len(items) > 0
+	for _, item := range items {
+		line := cartLine{
+			ID:         item.ID,
+			ProductID:  item.ProductID,
+			Product:    item.Product,
+			VariantID:  item.VariantID,
+			Quantity:   item.Quantity,
+			PriceAtAdd: item.PriceAtAdd,
+			Issues:     []string{},
+		}
+
+		// Deleted or withdrawn products can't be bought, nor can deleted
+		// variants or products that have since become sold by variant
+		line.Variant = variantsByID[item.VariantID]
+		if item.Product == nil || item.Product.Status != models.Available ||
+			(line.Variant == nil && (item.VariantID != 0 || soldByVariant[item.ProductID])) {
+			line.Issues = append(line.Issues, cartIssueUnavailable)
+			view.CanCheckout = false
+			view.Items = append(view.Items, line)
+			continue
+		}
+
+		item.Product.AvailableStock = available[item.ProductID]
+		item.Product.Price = prices[item.ProductID]
+		line.UnitPrice = variantPrice(item.Product, line.Variant)
+		line.TotalPrice = line.UnitPrice.Times(item.Quantity)
+		line.AvailableStock = item.Product.AvailableStock
+		if line.Variant != nil {
+			line.Variant.Price = line.UnitPrice
+			line.Variant.AvailableStock = line.Variant.Stock - variantHolds[line.Variant.ID]
+			if line.Variant.AvailableStock < 0 {
+				line.Variant.AvailableStock = 0
+			}
+			line.AvailableStock = line.Variant.AvailableStock
+		}
+
+		switch {
+		case line.AvailableStock == 0:
+			line.Issues = append(line.Issues, cartIssueOutOfStock)
+			view.CanCheckout = false
+		case line.AvailableStock < item.Quantity:
+			line.Issues = append(line.Issues, cartIssueInsufficientStock)
+			view.CanCheckout = false
+		}
+		if line.UnitPrice != item.PriceAtAdd {
+			line.Issues = append(line.Issues, cartIssuePriceChanged)
+		}
+
+		view.Items = append(view.Items, line)
+		view.ItemCount += item.Quantity
+		currency := line.TotalPrice.Currency
+		view.Subtotals[currency] = view.Subtotals[currency].Add(line.TotalPrice)
+	}
+
+	switch len(view.Subtotals) {
+	case 0:
+	case 1:
+		for currency, subtotal := range view.Subtotals {
+			view.Currency = currency
+			view.Subtotal = subtotal
+		}
+	default:
+		view.Issues = append(view.Issues, cartIssueMixedCurrencies)
+		view.CanCheckout = false
+	}
+
+	return view, nil
+}
+
+// respondCart writes the revalidated cart, along with the token of an
+// anonymous cart so the client can keep using it
+func (a *app) respondCart(c *gin.Context, status int, cart *models.Cart) {
+	view, err := a.viewCart(cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	response := gin.H{"cart": view}
+	if cart != nil && cart.UserID == nil {
+		response["cartToken"] = cart.Token
+	}
+	c.JSON(status, response)
+}
+
+// loadCartProduct loads a product that can be put in a cart with its
+// available stock and sale price filled in. For products sold by variant
+// these are the ones of the variant, which is returned as well.
+func (a *app) loadCartProduct(c *gin.Context, productID, variantID uint) (*models.Product, *models.ProductVariant, bool) {
+	var product models.Product
+	if err := a.db.First(&product, productID).Error; err != nil || product.Status != models.Available {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return nil, nil, false
+	}
+
+	variant, err := loadOrderVariant(a.db, &product, variantID)
+	var orderErr *orderError
+	if errors.As(err, &orderErr) {
+		c.JSON(orderErr.status, gin.H{"error": orderErr.message})
+		return nil, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get product variants"})
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	products := []models.Product{product}
+	if err := fillAvailableStock(a.db, products); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check stock"})
+		return nil, nil, false
+	}
+	if err := applySalePrices(a.db, products, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sale prices"})
+		return nil, nil, false
+	}
+	if variant != nil {
+		holds, err := activeVariantHolds(a.db, []uint{variant.ID}, 0, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check stock"})
+			return nil, nil, false
+		}
+		products[0].Price = variantPrice(&products[0], variant)
+		products[0].AvailableStock = variant.Stock - holds[variant.ID]
+		if products[0].AvailableStock < 0 {
+			products[0].AvailableStock = 0
+		}
+	}
+	return &products[0], variant, true
+}
+
+// Cart handlers
+func (a *app) getCartItems(c *gin.Context) {
+	cart, err := a.findCart(c, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	a.respondCart(c, http.StatusOK, cart)
+}
+
+func (a *app) addCartItem(c *gin.Context) {
+	var input struct {
+		ProductID uint `json:"productId" binding:"required"`
+		VariantID uint `json:"variantId"`
+		Quantity  int  `json:"quantity"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if input.Quantity == 0 {
+		input.Quantity = 1
+	}
+	if input.Quantity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity must be at least 1"})
+		return
+	}
+
+	product, variant, ok := a.loadCartProduct(c, input.ProductID, input.VariantID)
+	if !ok {
+		return
+	}
+
+	cart, err := a.findCart(c, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	// Adding a product that is already in the cart increases its quantity
+	var item models.CartItem
+	err = a.db.Where("cart_id = ? AND product_id = ? AND variant_id = ?", cart.ID, product.ID, input.VariantID).First(&item).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+	quantity := item.Quantity + input.Quantity
+
+	if quantity > product.AvailableStock {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          fmt.Sprintf("Not enough stock for product %s. Available: %d, Requested: %d", stockName(product, variant), product.AvailableStock, quantity),
+			"availableStock": product.AvailableStock,
+		})
+		return
+	}
+
+	item.CartID = cart.ID
+	item.ProductID = product.ID
+	item.VariantID = input.VariantID
+	item.Quantity = quantity
+	item.PriceAtAdd = product.Price
+	if err := a.db.Save(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add item to cart"})
+		return
+	}
+
+	a.respondCart(c, http.StatusOK, cart)
+}
+
+// loadCartItem loads the item named by the :itemId parameter from the
+// caller's cart
+func (a *app) loadCartItem(c *gin.Context) (*models.Cart, *models.CartItem, bool) {
+	itemID, err := strconv.Atoi(c.Param("itemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cart item ID"})
+		return nil, nil, false
+	}
+
+	cart, err := a.findCart(c, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return nil, nil, false
+	}
+	if cart == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart item not found"})
+		return nil, nil, false
+	}
+
+	var item models.CartItem
+	if err := a.db.Where("cart_id = ?", cart.ID).First(&item, itemID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart item not found"})
+		return nil, nil, false
+	}
+	return cart, &item, true
+}
+
+func (a *app) updateCartItem(c *gin.Context) {
+	cart, item, ok := a.loadCartItem(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Quantity *int `json:"quantity" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if *input.Quantity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity can't be negative"})
+		return
+	}
+
+	// Setting the quantity to zero removes the item
+	if *input.Quantity == 0 {
+		if err := a.db.Delete(item).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from cart"})
+			return
+		}
+		a.respondCart(c, http.StatusOK, cart)
+		return
+	}
+
+	product, variant, ok := a.loadCartProduct(c, item.ProductID, item.VariantID)
+	if !ok {
+		return
+	}
+	if *input.Quantity > product.AvailableStock {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          fmt.Sprintf("Not enough stock for product %s. Available: %d, Requested: %d", stockName(product, variant), product.AvailableStock, *input.Quantity),
+			"availableStock": product.AvailableStock,
+		})
+		return
+	}
+
+	// Updating an item also acknowledges its current price
+	item.Quantity = *input.Quantity
+	item.PriceAtAdd = product.Price
+	if err := a.db.Save(item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart item"})
+		return
+	}
+
+	a.respondCart(c, http.StatusOK, cart)
+}
+
+func (a *app) deleteCartItem(c *gin.Context) {
+	cart, item, ok := a.loadCartItem(c)
+	if !ok {
+		return
+	}
+
+	if err := a.db.Delete(item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from cart"})
+		return
+	}
+
+	a.respondCart(c, http.StatusOK, cart)
+}
+
+func (a *app) clearCart(c *gin.Context) {
+	cart, err := a.findCart(c, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	if cart != nil {
+		if err := a.db.Where("cart_id = ?", cart.ID).Delete(&models.CartItem{}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear cart"})
+			return
+		}
+	}
+
+	a.respondCart(c, http.StatusOK, cart)
+}
+
+// checkoutCart places an order for everything in the user's cart. The cart
+// is emptied in the same transaction that creates the order.
+func (a *app) checkoutCart(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var checkoutRequest struct {
+		ReservationID uint `json:"reservationId"`
+		checkoutAddresses
+		ShippingMethods map[uint]uint `json:"shippingMethods"`
+		Currency        string        `json:"currency"`
+		CouponCode      string        `json:"couponCode"`
+		PaymentInfo     paymentInfo   `json:"paymentInfo"`
+	}
+	if err := c.ShouldBindJSON(&checkoutRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	// Work out the shipping and billing addresses
+	shipping, billing, err := a.resolveCheckoutAddresses(user, checkoutRequest.checkoutAddresses)
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	cart, err := a.findCart(c, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	var items []models.CartItem
+	if cart != nil {
+		if err := a.db.Where("cart_id = ?", cart.ID).Order("id").Find(&items).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+			return
+		}
+	}
+	if len(items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart is empty"})
+		return
+	}
+
+	orderItems := make([]orderItemRequest, len(items))
+	for i, item := range items {
+		orderItems[i] = orderItemRequest{ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity}
+	}
+
+	order, charge, err := a.placeOrder(c.Request.Context(), user, orderInput{
+		Items:           orderItems,
+		Shipping:        shipping,
+		Billing:         billing,
+		ShippingMethods: checkoutRequest.ShippingMethods,
+		ReservationID:   checkoutRequest.ReservationID,
+		CartID:          cart.ID,
+		Currency:        checkoutRequest.Currency,
+		CouponCode:      checkoutRequest.CouponCode,
+		PaymentInfo:     checkoutRequest.PaymentInfo,
+	})
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	respondPlacedOrder(c, order, charge)
+}
+
+// mergeAnonymousCart moves the items of the anonymous cart with the given
+// token into the user's cart. Quantities of products in both carts are
+// added up; stock is checked again when the cart is read.
+func mergeAnonymousCart(db *gorm.DB, userID uint, token string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var anonymous models.Cart
+		if err := tx.Preload("Items").Where("token = ? AND user_id IS NULL", token).First(&anonymous).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		var cart models.Cart
+		err := tx.Preload("Items").Where("user_id = ?", userID).First(&cart).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// The user has no cart yet, so the anonymous one becomes theirs
+			return tx.Model(&anonymous).Update("user_id", userID).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		existing := make(map[stockKey]*models.CartItem, len(cart.Items))
+		for i := range cart.Items {
+			existing[stockKey{cart.Items[i].ProductID, cart.Items[i].VariantID}] = &cart.Items[i]
+		}
+
+		for _, item := range anonymous.Items {
+			if line, ok := existing[stockKey{item.ProductID, item.VariantID}]; ok {
+				line.Quantity += item.Quantity
+				if err := tx.Save(line).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Model(&models.CartItem{}).Where("id = ?", item.ID).Update("cart_id", cart.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("cart_id = ?", anonymous.ID).Delete(&models.CartItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&anonymous).Error
+	})
+}
+
+// mergeCartOnLogin merges the anonymous cart sent with a login or
+// registration request into the user's cart. Failing to merge doesn't fail
+// the login.
+func (a *app) mergeCartOnLogin(c *gin.Context, user *models.User) {
+	token := c.GetHeader(cartTokenHeader)
+	if token == "" {
+		return
+	}
+
+	if err := mergeAnonymousCart(a.db, user.ID, token); err != nil {
+		log.Printf("Failed to merge cart into cart of user %d: %v", user.ID, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type cartResponse struct {
+	Cart      cartView `json:"cart"`
+	CartToken string   `json:"cartToken"`
+}
+
+func TestAnonymousCartIsMergedOnLogin(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	mug := env.createProduct(seller, "Mug", 12, 10)
+	tea := env.createProduct(seller, "Tea", 5, 10)
+
+	// The signed-in user already has a mug in their cart
+	token := env.login(buyer)
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": mug.ID, "quantity": 1}, http.StatusOK, nil)
+	env.do(http.MethodPost, "/api/logout", token, nil, http.StatusOK, nil)
+
+	// Shopping anonymously creates a cart identified by its token
+	var anonymous cartResponse
+	env.do(http.MethodPost, "/api/cart/items", "", gin.H{"productId": mug.ID, "quantity": 2}, http.StatusOK, &anonymous)
+	if anonymous.CartToken == "" {
+		t.Fatal("anonymous cart has no token")
+	}
+	header := http.Header{cartTokenHeader: {anonymous.CartToken}}
+	env.doWithHeader(http.MethodPost, "/api/cart/items", "", header, gin.H{"productId": tea.ID, "quantity": 3}, http.StatusOK, &anonymous)
+	if anonymous.Cart.ItemCount != 5 {
+		t.Fatalf("anonymous item count = %d, want 5", anonymous.Cart.ItemCount)
+	}
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	env.doWithHeader(http.MethodPost, "/api/login", "", header,
+		gin.H{"email": buyer.Email, "password": testPassword}, http.StatusOK, &login)
+
+	var merged cartResponse
+	env.do(http.MethodGet, "/api/cart/items", login.Token, nil, http.StatusOK, &merged)
+	quantities := map[uint]int{}
+	for _, line := range merged.Cart.Items {
+		quantities[line.ProductID] = line.Quantity
+	}
+	if quantities[mug.ID] != 3 || quantities[tea.ID] != 3 {
+		t.Errorf("merged quantities = %v, want 3 mugs and 3 teas", quantities)
+	}
+	if merged.CartToken != "" {
+		t.Error("user cart should not expose a cart token")
+	}
+
+	// The anonymous cart is gone
+	var count int64
+	env.db.Model(&models.Cart{}).Where("token = ?", anonymous.CartToken).Count(&count)
+	if count != 0 {
+		t.Errorf("anonymous cart still exists")
+	}
+}
+
+func TestCartRevalidatesAndChecksOut(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	lamp := env.createProduct(seller, "Lamp", 40, 5)
+	token := env.login(buyer)
+
+	var added cartResponse
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": lamp.ID, "quantity": 6}, http.StatusConflict, nil)
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": lamp.ID, "quantity": 4}, http.StatusOK, &added)
+	if len(added.Cart.Items) != 1 || !added.Cart.CanCheckout {
+		t.Fatalf("cart = %+v, want one line ready for checkout", added.Cart)
+	}
+
+	// The seller raises the price and sells stock elsewhere
+	env.db.Model(&models.Product{}).Where("id = ?", lamp.ID).Updates(map[string]interface{}{"price_minor": 4500, "stock": 2})
+
+	var revalidated cartResponse
+	env.do(http.MethodGet, "/api/cart/items", token, nil, http.StatusOK, &revalidated)
+	line := revalidated.Cart.Items[0]
+	if line.UnitPrice != usd(45) || line.PriceAtAdd != usd(40) || line.AvailableStock != 2 {
+		t.Errorf("line = %+v, want price 45 (was 40) with 2 available", line)
+	}
+	if fmt.Sprint(line.Issues) != fmt.Sprint([]string{cartIssueInsufficientStock, cartIssuePriceChanged}) {
+		t.Errorf("issues = %v", line.Issues)
+	}
+	if revalidated.Cart.CanCheckout {
+		t.Error("cart short of stock should not be ready for checkout")
+	}
+
+	checkout := gin.H{"shippingDetails": testShippingDetails()}
+	env.do(http.MethodPost, "/api/cart/checkout", token, checkout, http.StatusBadRequest, nil)
+
+	env.do(http.MethodPut, fmt.Sprintf("/api/cart/items/%d", line.ID), token, gin.H{"quantity": 2}, http.StatusOK, nil)
+
+	var placed struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/cart/checkout", token, checkout, http.StatusCreated, &placed)
+	if placed.Order.Total != usd(90) || len(placed.Order.OrderItems) != 1 {
+		t.Errorf("order = %+v, want one line totalling 90", placed.Order)
+	}
+
+	var emptied cartResponse
+	env.do(http.MethodGet, "/api/cart/items", token, nil, http.StatusOK, &emptied)
+	if len(emptied.Cart.Items) != 0 {
+		t.Errorf("cart has %d items after checkout, want 0", len(emptied.Cart.Items))
+	}
+}
+
+func TestCartWithProductsInTwoCurrencies(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	euroSeller := env.createUser("euro-seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	mug := env.createProduct(seller, "Mug", 12, 10)
+	cup := env.createProduct(euroSeller, "Cup", 10, 10)
+	env.db.Model(&models.Shop{}).Where("id = ?", euroSeller.ShopID).Update("currency", "EUR")
+	env.db.Model(&models.Product{}).Where("id = ?", cup.ID).Update("price_currency", "EUR")
+	token := env.login(buyer)
+
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": mug.ID, "quantity": 1}, http.StatusOK, nil)
+	var added struct {
+		Cart struct {
+			Items       []cartLine         `json:"items"`
+			Subtotals   map[string]float64 `json:"subtotals"`
+			Currency    string             `json:"currency"`
+			CanCheckout bool               `json:"canCheckout"`
+			Issues      []string           `json:"issues"`
+		} `json:"cart"`
+	}
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": cup.ID, "quantity": 2}, http.StatusOK, &added)
+	if added.Cart.Subtotals["USD"] != 12 || added.Cart.Subtotals["EUR"] != 20 || added.Cart.Currency != "" {
+		t.Errorf("subtotals = %v in %q, want 12 USD and 20 EUR apart", added.Cart.Subtotals, added.Cart.Currency)
+	}
+	if added.Cart.CanCheckout || fmt.Sprint(added.Cart.Issues) != fmt.Sprint([]string{cartIssueMixedCurrencies}) {
+		t.Errorf("cart can check out %v with issues %v, want mixed currencies to block checkout", added.Cart.CanCheckout, added.Cart.Issues)
+	}
+	env.do(http.MethodGet, "/api/cart/items", token, nil, http.StatusOK, nil)
+	env.do(http.MethodPost, "/api/cart/checkout", token, gin.H{"shippingDetails": testShippingDetails()}, http.StatusBadRequest, nil)
+
+	// With the euro line gone the cart is in a single currency again
+	var remaining cartResponse
+	env.do(http.MethodDelete, fmt.Sprintf("/api/cart/items/%d", added.Cart.Items[1].ID), token, nil, http.StatusOK, &remaining)
+	if remaining.Cart.Subtotal != usd(12) || remaining.Cart.Currency != "USD" || !remaining.Cart.CanCheckout {
+		t.Errorf("cart = %+v, want 12 USD ready for checkout", remaining.Cart)
+	}
+}
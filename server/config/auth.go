@@ -0,0 +1,96 @@
+package config
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"tobe_shop/server/auth"
+
+	"gorm.io/gorm"
+)
+
+// LoadAuth builds the access token manager and refresh-token session store
+// from environment variables:
+//
+//	JWT_SIGNING_KEYS       comma-separated "kid:secret" pairs accepted for verification
+//	JWT_ACTIVE_KEY_ID      kid used to sign new tokens (defaults to the first key)
+//	JWT_ISSUER             iss claim (defaults to "tobe-shop")
+//	JWT_AUDIENCE           aud claim (defaults to "tobe-shop-client")
+//	JWT_ACCESS_TOKEN_TTL   access token lifetime, e.g. "15m" (defaults to 15m)
+//	JWT_REFRESH_TOKEN_TTL  refresh token lifetime (defaults to 720h)
+//
+// Sessions are stored in db. When no keys are configured a random
+// development key is generated, so tokens will not survive a server restart.
+func LoadAuth(db *gorm.DB) (*auth.Manager, *auth.SessionStore) {
+	cfg, err := authConfigFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load auth config:", err)
+	}
+
+	refreshTTL := 30 * 24 * time.Hour
+	if ttl := os.Getenv("JWT_REFRESH_TOKEN_TTL"); ttl != "" {
+		refreshTTL, err = time.ParseDuration(ttl)
+		if err != nil || refreshTTL <= 0 {
+			log.Fatal("Invalid JWT_REFRESH_TOKEN_TTL:", ttl)
+		}
+	}
+
+	manager, err := auth.NewManager(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize token manager:", err)
+	}
+
+	log.Printf("Token manager initialized with %d signing key(s), active key %q", len(cfg.Keys), cfg.ActiveKeyID)
+
+	return manager, auth.NewSessionStore(db, refreshTTL)
+}
+
+func authConfigFromEnv() (auth.Config, error) {
+	cfg := auth.Config{
+		ActiveKeyID:    os.Getenv("JWT_ACTIVE_KEY_ID"),
+		Issuer:         envOrDefault("JWT_ISSUER", "tobe-shop"),
+		Audience:       envOrDefault("JWT_AUDIENCE", "tobe-shop-client"),
+		AccessTokenTTL: 15 * time.Minute,
+	}
+
+	if ttl := os.Getenv("JWT_ACCESS_TOKEN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid JWT_ACCESS_TOKEN_TTL: %w", err)
+		}
+		cfg.AccessTokenTTL = d
+	}
+
+	if raw := os.Getenv("JWT_SIGNING_KEYS"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok {
+				return cfg, fmt.Errorf("invalid JWT_SIGNING_KEYS entry, expected kid:secret")
+			}
+			cfg.Keys = append(cfg.Keys, auth.Key{ID: kid, Secret: []byte(secret)})
+		}
+	} else {
+		log.Println("WARNING: JWT_SIGNING_KEYS is not set, using a random development key")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return cfg, err
+		}
+		cfg.Keys = []auth.Key{{ID: "dev", Secret: secret}}
+	}
+
+	if cfg.ActiveKeyID == "" {
+		cfg.ActiveKeyID = cfg.Keys[0].ID
+	}
+
+	return cfg, nil
+}
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -12,30 +12,80 @@ var DB *gorm.DB
 
 // ConnectDatabase initializes database connection
 func ConnectDatabase() {
-	database, err := gorm.Open(sqlite.Open("tobe_shop.db"), &gorm.Config{})
+	// Wait for locks held by concurrent writers instead of failing immediately
+	database, err := OpenDatabase("tobe_shop.db?_busy_timeout=5000")
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
 	log.Println("Connected to database successfully")
 
+	DB = database
+}
+
+// OpenDatabase opens the SQLite database at dsn and migrates the models.
+// Tests pass an in-memory DSN such as "file:test?mode=memory&cache=shared".
+func OpenDatabase(dsn string) (*gorm.DB, error) {
+	database, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
 	// Auto Migrate the models
-	err = database.AutoMigrate(
+	if err := Migrate(database); err != nil {
+		return nil, err
+	}
+
+	log.Println("Database migrated successfully")
+
+	return database, nil
+}
+
+// Migrate creates or updates the tables for every model
+func Migrate(database *gorm.DB) error {
+	err := database.AutoMigrate(
 		&models.User{},
+		&models.Address{},
+		&models.Session{},
 		&models.Shop{},
 		&models.Product{},
+		&models.ProductOption{},
+		&models.ProductVariant{},
+		&models.PriceHistory{},
+		&models.SalePrice{},
+		&models.InventoryMovement{},
 		&models.Order{},
 		&models.OrderItem{},
+		&models.TaxRule{},
+		&models.ExchangeRate{},
+		&models.Coupon{},
+		&models.CouponRedemption{},
+		&models.ShopOrder{},
+		&models.ShippingMethod{},
+		&models.Shipment{},
+		&models.TrackingEvent{},
+		&models.OrderStatusHistory{},
+		&models.Reservation{},
+		&models.ReservationItem{},
+		&models.Cart{},
+		&models.CartItem{},
 		&models.Invoice{},
+		&models.Payment{},
+		&models.PaymentEvent{},
+		&models.ReturnRequest{},
+		&models.CreditNote{},
+		&models.PaymentRefund{},
 	)
-
 	if err != nil {
-		log.Fatal("Failed to migrate database:", err)
+		return err
+	}
+	if err := migrateFloatAmounts(database); err != nil {
+		return err
 	}
 
-	log.Println("Database migrated successfully")
-
-	DB = database
+	// Cart items are unique per variant; the index that took their place
+	// allowed a product only once per cart
+	return database.Exec("DROP INDEX IF EXISTS idx_cart_item_product").Error
 }
 
 // GetDB returns the database connection
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SeedExchangeRates loads the exchange rates from the file named by
+// EXCHANGE_RATES_FILE (defaults to config/exchange_rates.csv) into the
+// exchange_rates table. The file is either CSV with base, quote and rate
+// columns or a JSON array of rates; reloading it updates the rates of the
+// same currency pairs. A missing file leaves the table as it is.
+func SeedExchangeRates(db *gorm.DB) {
+	path := envOrDefault("EXCHANGE_RATES_FILE", "config/exchange_rates.csv")
+	rates, err := readExchangeRates(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No exchange rates file at %s, keeping the current exchange rates", path)
+		return
+	}
+	if err != nil {
+		log.Fatal("Failed to load exchange rates:", err)
+	}
+
+	if len(rates) > 0 {
+		err = db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "base"}, {Name: "quote"}},
+			DoUpdates: clause.AssignmentColumns([]string{"rate", "updated_at"}),
+		}).Create(&rates).Error
+		if err != nil {
+			log.Fatal("Failed to seed exchange rates:", err)
+		}
+	}
+
+	log.Printf("Seeded %d exchange rate(s) from %s", len(rates), path)
+}
+
+// readExchangeRates parses and checks an exchange rates file
+func readExchangeRates(path string) ([]models.ExchangeRate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rates []models.ExchangeRate
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &rates); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if rates, err = parseExchangeRatesCSV(string(data)); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range rates {
+		rate := &rates[i]
+		rate.Base = strings.ToUpper(strings.TrimSpace(rate.Base))
+		rate.Quote = strings.ToUpper(strings.TrimSpace(rate.Quote))
+		if !money.IsCurrency(rate.Base) || !money.IsCurrency(rate.Quote) || rate.Base == rate.Quote || rate.Rate <= 0 {
+			return nil, fmt.Errorf("%s: rate %d needs two different currency codes and a positive rate", path, i+1)
+		}
+	}
+	return rates, nil
+}
+
+// parseExchangeRatesCSV reads base,quote,rate rows. A first row that isn't
+// a rate is taken to be the header.
+func parseExchangeRatesCSV(data string) ([]models.ExchangeRate, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = 3
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var rates []models.ExchangeRate
+	for i, record := range records {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid rate %q", i+1, record[2])
+		}
+		rates = append(rates, models.ExchangeRate{Base: record[0], Quote: record[1], Rate: rate})
+	}
+	return rates, nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"tobe_shop/server/money"
+
+	"gorm.io/gorm"
+)
+
+// floatAmount is an amount column from before amounts were stored as
+// integer minor units, and the prefix of the columns that replace it
+type floatAmount struct {
+	Table  string
+	Column string
+	Prefix string
+}
+
+var floatAmounts = []floatAmount{
+	{"products", "price", "price_"},
+	{"orders", "total", "total_"},
+	{"orders", "shipping_cost", "shipping_cost_"},
+	{"orders", "tax", "tax_"},
+	{"order_items", "price", "price_"},
+	{"order_items", "total_price", "total_price_"},
+	{"order_items", "tax", "tax_"},
+	{"shop_orders", "subtotal", "subtotal_"},
+	{"shop_orders", "shipping_cost", "shipping_cost_"},
+	{"shop_orders", "tax", "tax_"},
+	{"shop_orders", "total", "total_"},
+	{"shipping_methods", "base_rate", "base_rate_"},
+	{"shipping_methods", "per_kg_rate", "per_kg_rate_"},
+	{"shipping_methods", "free_over_amount", "free_over_amount_"},
+	{"cart_items", "price_at_add", "price_at_add_"},
+	{"invoices", "amount", "amount_"},
+	{"invoices", "tax", "tax_"},
+	{"invoices", "total_amount", "total_amount_"},
+	{"invoices", "amount_paid", "amount_paid_"},
+	{"invoices", "amount_credited", "amount_credited_"},
+	{"payments", "amount", "amount_"},
+	{"payments", "amount_refunded", "amount_refunded_"},
+	{"payment_events", "amount", "amount_"},
+	{"return_requests", "refund_amount", "refund_amount_"},
+	{"credit_notes", "amount", "amount_"},
+	{"payment_refunds", "amount", "amount_"},
+}
+
+// migrateFloatAmounts moves amounts stored as floating point numbers into
+// the minor unit and currency columns that replaced them, then drops the
+// old columns. Everything was charged in the default currency until then,
+// so amounts are scaled by its minor unit. Tables without the old columns
+// are left alone, which makes running it again a no-op.
+func migrateFloatAmounts(database *gorm.DB) error {
+	factor := int64(math.Pow10(money.Exponent(money.DefaultCurrency)))
+	migrated := 0
+	for _, amount := range floatAmounts {
+		if !database.Migrator().HasColumn(amount.Table, amount.Column) {
+			continue
+		}
+		err := database.Transaction(func(tx *gorm.DB) error {
+			err := tx.Exec(fmt.Sprintf("UPDATE %s SET %sminor = CAST(ROUND(%s * ?) AS INTEGER), %scurrency = ?",
+				amount.Table, amount.Prefix, amount.Column, amount.Prefix), factor, money.DefaultCurrency).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", amount.Table, amount.Column)).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migrating %s.%s: %w", amount.Table, amount.Column, err)
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		log.Printf("Converted %d amount column(s) to minor units", migrated)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+	"tobe_shop/server/money"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrateFloatAmounts(t *testing.T) {
+	database, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := database.DB()
+	defer sqlDB.Close()
+
+	// The tables as the original models created them, amounts as floats
+	type legacyProduct struct {
+		gorm.Model
+		Name        string  `gorm:"size:100;not null"`
+		Description string  `gorm:"size:500"`
+		Price       float64 `gorm:"not null"`
+		Stock       int     `gorm:"not null"`
+		Image       string  `gorm:"size:255"`
+		Category    string  `gorm:"size:50"`
+		Status      string  `gorm:"size:20;not null"`
+		ShopID      uint
+	}
+	type legacyOrder struct {
+		gorm.Model
+		UserID          uint
+		Total           float64 `gorm:"not null"`
+		Status          string  `gorm:"size:20;not null"`
+		PaymentID       string  `gorm:"size:100"`
+		ShippingAddress string  `gorm:"size:255"`
+		BillingAddress  string  `gorm:"size:255"`
+		InvoiceID       uint
+	}
+	if err := database.Table("products").AutoMigrate(&legacyProduct{}); err != nil {
+		t.Fatalf("create legacy products: %v", err)
+	}
+	if err := database.Table("orders").AutoMigrate(&legacyOrder{}); err != nil {
+		t.Fatalf("create legacy orders: %v", err)
+	}
+
+	// Amounts that floats don't hold exactly; 0.1+0.2 is added at run time so
+	// it comes out as 0.30000000000000004
+	tenth := 0.1
+	for _, product := range []legacyProduct{{Name: "Lamp", Price: 19.99}, {Name: "Pen", Price: tenth + 0.2}, {Name: "Sofa", Price: 1234.5}} {
+		product.Stock, product.Status = 1, "available"
+		if err := database.Table("products").Create(&product).Error; err != nil {
+			t.Fatalf("seed product: %v", err)
+		}
+	}
+	if err := database.Table("orders").Create(&legacyOrder{UserID: 1, Total: 39.98, Status: "pending"}).Error; err != nil {
+		t.Fatalf("seed order: %v", err)
+	}
+
+	// Legacy amounts were all in the default currency
+	want := map[string]money.Money{
+		"Lamp": money.New(1999, money.DefaultCurrency),
+		"Pen":  money.New(30, money.DefaultCurrency),
+		"Sofa": money.New(123450, money.DefaultCurrency),
+	}
+	check := func() {
+		t.Helper()
+		var products []struct {
+			Name          string
+			PriceMinor    int64
+			PriceCurrency string
+		}
+		database.Table("products").Select("name, price_minor, price_currency").Find(&products)
+		if len(products) != len(want) {
+			t.Fatalf("%d products, want %d", len(products), len(want))
+		}
+		for _, product := range products {
+			if got := money.New(product.PriceMinor, product.PriceCurrency); got != want[product.Name] {
+				t.Errorf("%s price = %d %s, want %d %s", product.Name, got.Minor, got.Currency, want[product.Name].Minor, want[product.Name].Currency)
+			}
+		}
+
+		var total struct {
+			TotalMinor    int64
+			TotalCurrency string
+		}
+		database.Table("orders").Select("total_minor, total_currency").Take(&total)
+		if total.TotalMinor != 3998 || total.TotalCurrency != money.DefaultCurrency {
+			t.Errorf("order total = %d %s, want 3998 %s", total.TotalMinor, total.TotalCurrency, money.DefaultCurrency)
+		}
+
+		for _, column := range []struct{ table, name string }{{"products", "price"}, {"orders", "total"}} {
+			if database.Migrator().HasColumn(column.table, column.name) {
+				t.Errorf("%s.%s was not dropped", column.table, column.name)
+			}
+		}
+	}
+
+	if err := Migrate(database); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	check()
+
+	// Running it again finds nothing left to convert
+	if err := Migrate(database); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	check()
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"crypto/rand"
+	"log"
+	"os"
+	"strconv"
+	"tobe_shop/server/payments"
+)
+
+// LoadPayments sets up the payment gateways from environment variables:
+//
+//	PAYMENT_PROVIDER            gateway used for new charges, "fake" or "alipay"
+//	FAKE_PAYMENTS_SECRET        key signing fake gateway callbacks (random when unset)
+//	FAKE_PAYMENTS_AUTO_CONFIRM  whether fake charges succeed immediately (defaults to false)
+//	ALIPAY_APP_ID               enables the Alipay gateway
+//	ALIPAY_PRIVATE_KEY          app private key signing requests
+//	ALIPAY_PUBLIC_KEY           Alipay public key verifying responses and callbacks
+//	ALIPAY_GATEWAY_URL          defaults to the production gateway
+//	ALIPAY_NOTIFY_URL           callback URL, e.g. https://shop.example.com/api/payments/webhook/alipay
+//	ALIPAY_RETURN_URL           page the buyer returns to after paying
+//
+// The fake gateway settles charges without taking any money, so it is only
+// registered when PAYMENT_PROVIDER=fake. Without PAYMENT_PROVIDER, Alipay is
+// used when configured; otherwise development servers fall back to the fake
+// gateway and release servers (GIN_MODE=release) refuse to start.
+func LoadPayments() *payments.Registry {
+	provider := os.Getenv("PAYMENT_PROVIDER")
+	appID := os.Getenv("ALIPAY_APP_ID")
+	if provider == "" {
+		switch {
+		case appID != "":
+			provider = "alipay"
+		case os.Getenv("GIN_MODE") == "release":
+			log.Fatal("PAYMENT_PROVIDER must be set in release mode")
+		default:
+			log.Println("WARNING: PAYMENT_PROVIDER is not set, using the fake payment gateway")
+			provider = "fake"
+		}
+	}
+
+	var gateways []payments.Gateway
+	if provider == "fake" {
+		gateways = append(gateways, loadFakePayments())
+	}
+
+	if appID != "" {
+		alipay, err := payments.NewAlipay(payments.AlipayConfig{
+			AppID:           appID,
+			PrivateKey:      os.Getenv("ALIPAY_PRIVATE_KEY"),
+			AlipayPublicKey: os.Getenv("ALIPAY_PUBLIC_KEY"),
+			GatewayURL:      os.Getenv("ALIPAY_GATEWAY_URL"),
+			NotifyURL:       os.Getenv("ALIPAY_NOTIFY_URL"),
+			ReturnURL:       os.Getenv("ALIPAY_RETURN_URL"),
+		})
+		if err != nil {
+			log.Fatal("Failed to initialize Alipay:", err)
+		}
+		gateways = append(gateways, alipay)
+	}
+
+	registry := payments.NewRegistry(gateways...)
+	if err := registry.SetDefault(provider); err != nil {
+		log.Fatalf("Payment provider %q is not configured", provider)
+	}
+
+	log.Printf("Payment gateways %v initialized, charging through %q", registry.Names(), provider)
+
+	return registry
+}
+
+func loadFakePayments() *payments.Fake {
+	secret := []byte(os.Getenv("FAKE_PAYMENTS_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal("Failed to generate fake payments secret:", err)
+		}
+	}
+	autoConfirm := false
+	if value := os.Getenv("FAKE_PAYMENTS_AUTO_CONFIRM"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatal("Invalid FAKE_PAYMENTS_AUTO_CONFIRM:", value)
+		}
+		autoConfirm = parsed
+	}
+	return payments.NewFake(secret, autoConfirm)
+}
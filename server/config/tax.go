@@ -0,0 +1,62 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"tobe_shop/server/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SeedTaxRules loads the tax rules from the JSON file named by
+// TAX_RULES_FILE (defaults to config/tax_rules.json) into the tax_rules
+// table. Rules are matched on country, region and category, so editing the
+// file and restarting updates them; rules added to the table by other means
+// are kept. A missing file leaves the table as it is.
+func SeedTaxRules(db *gorm.DB) {
+	path := envOrDefault("TAX_RULES_FILE", "config/tax_rules.json")
+	rules, err := readTaxRules(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No tax rules file at %s, keeping the current tax rules", path)
+		return
+	}
+	if err != nil {
+		log.Fatal("Failed to load tax rules:", err)
+	}
+
+	if len(rules) > 0 {
+		err = db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "country"}, {Name: "region"}, {Name: "category"}},
+			DoUpdates: clause.AssignmentColumns([]string{"name", "rate", "inclusive", "updated_at"}),
+		}).Create(&rules).Error
+		if err != nil {
+			log.Fatal("Failed to seed tax rules:", err)
+		}
+	}
+
+	log.Printf("Seeded %d tax rule(s) from %s", len(rules), path)
+}
+
+// readTaxRules parses and checks a tax rules file
+func readTaxRules(path string) ([]models.TaxRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []models.TaxRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, rule := range rules {
+		if rule.Name == "" || rule.Rate < 0 || rule.Rate >= 1 {
+			return nil, fmt.Errorf("%s: rule %d needs a name and a rate between 0 and 1", path, i+1)
+		}
+	}
+	return rules, nil
+}
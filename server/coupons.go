@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// couponLine is an order line a coupon may take something off
+type couponLine struct {
+	ShopID    uint
+	ProductID uint
+	Category  string
+	Amount    money.Money
+}
+
+// loadCoupon returns the coupon with code
+func loadCoupon(tx *gorm.DB, code string) (*models.Coupon, error) {
+	var coupon models.Coupon
+	err := tx.Where("code = ?", models.NormalizeCouponCode(code)).First(&coupon).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, &orderError{http.StatusBadRequest, "Unknown coupon code: " + code}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// couponAmountIn converts an amount set on a coupon into the currency of the
+// order it is used on
+func couponAmountIn(tx *gorm.DB, coupon *models.Coupon, amount money.Money, currency string) (money.Money, error) {
+	if amount.IsZero() || amount.Currency == "" || amount.Currency == currency {
+		return money.New(amount.Minor, currency), nil
+	}
+	rates, err := loadExchangeRates(tx)
+	if err != nil {
+		return money.Money{}, err
+	}
+	rate, ok := findExchangeRate(rates, amount.Currency, currency)
+	if !ok {
+		return money.Money{}, &orderError{http.StatusBadRequest, fmt.Sprintf("Coupon %s can't be used on orders in %s", coupon.Code, currency)}
+	}
+	return amount.Convert(currency, rate), nil
+}
+
+// couponDiscounts checks that user may use the coupon on the lines and
+// works out what it takes off each of them, in currency. A fixed discount
+// is spread over the lines it applies to in proportion to their amounts.
+// userID is 0 for buyers who haven't logged in, whose own usage isn't
+// checked.
+func couponDiscounts(tx *gorm.DB, coupon *models.Coupon, userID uint, lines []couponLine, currency string, now time.Time) ([]money.Money, error) {
+	if !coupon.ValidAt(now) {
+		return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("Coupon %s is not valid at this time", coupon.Code)}
+	}
+	if coupon.UsageLimit > 0 && coupon.UsedCount >= coupon.UsageLimit {
+		return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("Coupon %s has been used up", coupon.Code)}
+	}
+	if userID != 0 && coupon.PerUserLimit > 0 {
+		var used int64
+		if err := tx.Model(&models.CouponRedemption{}).
+			Where("coupon_id = ? AND user_id = ?", coupon.ID, userID).Count(&used).Error; err != nil {
+			return nil, err
+		}
+		if used >= int64(coupon.PerUserLimit) {
+			return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("You have already used coupon %s", coupon.Code)}
+		}
+	}
+
+	// Add up the lines the coupon applies to
+	eligible := money.Zero(currency)
+	last := -1
+	for i, line := range lines {
+		if coupon.AppliesTo(line.ShopID, line.ProductID, line.Category) {
+			eligible = eligible.Add(line.Amount)
+			last = i
+		}
+	}
+	if last < 0 {
+		return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("Coupon %s doesn't apply to any of the items", coupon.Code)}
+	}
+	minimum, err := couponAmountIn(tx, coupon, coupon.MinOrderValue, currency)
+	if err != nil {
+		return nil, err
+	}
+	if eligible.Cmp(minimum) < 0 {
+		return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("Coupon %s needs items worth at least %s", coupon.Code, minimum)}
+	}
+
+	discounts := make([]money.Money, len(lines))
+	for i := range discounts {
+		discounts[i] = money.Zero(currency)
+	}
+	switch coupon.Type {
+	case models.CouponPercentage:
+		for i, line := range lines {
+			if coupon.AppliesTo(line.ShopID, line.ProductID, line.Category) {
+				discounts[i] = line.Amount.Scale(coupon.Percent / 100)
+			}
+		}
+	case models.CouponFixed:
+		amount, err := couponAmountIn(tx, coupon, coupon.Amount, currency)
+		if err != nil {
+			return nil, err
+		}
+		// Never more than the items cost; the last line takes the rounding
+		remaining := amount.Min(eligible)
+		total := remaining
+		for i, line := range lines {
+			if !coupon.AppliesTo(line.ShopID, line.ProductID, line.Category) {
+				continue
+			}
+			if i == last {
+				discounts[i] = remaining
+				break
+			}
+			discounts[i] = total.Scale(float64(line.Amount.Minor) / float64(eligible.Minor))
+			remaining = remaining.Sub(discounts[i])
+		}
+	}
+	return discounts, nil
+}
+
+// redeemCoupon counts the coupon as used by the order. Both usage limits are
+// checked again in the same conditional update, so another checkout can't
+// have used the coupon up, or used the buyer's share of it, in the meantime.
+func redeemCoupon(tx *gorm.DB, coupon *models.Coupon, order *models.Order) error {
+	used := tx.Table("coupon_redemptions").Select("COUNT(*)").
+		Where("coupon_id = ? AND user_id = ?", coupon.ID, order.UserID)
+	result := tx.Model(&models.Coupon{}).
+		Where("id = ? AND (usage_limit = 0 OR used_count < usage_limit)", coupon.ID).
+		Where("per_user_limit = 0 OR per_user_limit > (?)", used).
+		Update("used_count", gorm.Expr("used_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if err := tx.First(coupon, coupon.ID).Error; err != nil {
+			return err
+		}
+		if coupon.UsageLimit > 0 && coupon.UsedCount >= coupon.UsageLimit {
+			return &orderError{http.StatusConflict, fmt.Sprintf("Coupon %s has been used up", coupon.Code)}
+		}
+		return &orderError{http.StatusConflict, fmt.Sprintf("You have already used coupon %s", coupon.Code)}
+	}
+	return tx.Create(&models.CouponRedemption{
+		CouponID: coupon.ID,
+		UserID:   order.UserID,
+		OrderID:  order.ID,
+		Discount: order.Discount,
+	}).Error
+}
+
+// releaseCoupon gives back the use of the coupon of a cancelled order
+func releaseCoupon(tx *gorm.DB, order *models.Order) error {
+	if order.CouponID == nil {
+		return nil
+	}
+	result := tx.Where("order_id = ?", order.ID).Delete(&models.CouponRedemption{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return tx.Model(&models.Coupon{}).Where("id = ? AND used_count > 0", *order.CouponID).
+		Update("used_count", gorm.Expr("used_count - 1")).Error
+}
+
+// validateCoupon checks the settings of a coupon
+func validateCoupon(coupon *models.Coupon) string {
+	switch {
+	case coupon.Code == "":
+		return "Code is required"
+	case !coupon.Type.IsValid():
+		return "Unknown coupon type: " + string(coupon.Type)
+	case coupon.Type == models.CouponPercentage && (coupon.Percent <= 0 || coupon.Percent > 100):
+		return "Percent must be between 0 and 100"
+	case coupon.Type == models.CouponFixed && !coupon.Amount.IsPositive():
+		return "Fixed coupons need an amount"
+	case coupon.MinOrderValue.IsNegative():
+		return "Minimum order value can't be negative"
+	case coupon.UsageLimit < 0 || coupon.PerUserLimit < 0:
+		return "Usage limits can't be negative"
+	case coupon.StartsAt != nil && coupon.EndsAt != nil && !coupon.EndsAt.After(*coupon.StartsAt):
+		return "A coupon must end after it starts"
+	}
+	return ""
+}
+
+// couponRequest is the body for creating or updating a coupon
+type couponRequest struct {
+	Code          string            `json:"code"`
+	Description   string            `json:"description"`
+	Type          models.CouponType `json:"type"`
+	Percent       float64           `json:"percent"`
+	Amount        money.Money       `json:"amount"`
+	Category      string            `json:"category"`
+	ProductID     *uint             `json:"productId"`
+	MinOrderValue money.Money       `json:"minOrderValue"`
+	UsageLimit    int               `json:"usageLimit"`
+	PerUserLimit  int               `json:"perUserLimit"`
+	StartsAt      *time.Time        `json:"startsAt"`
+	EndsAt        *time.Time        `json:"endsAt"`
+	Active        *bool             `json:"active"`
+}
+
+// newCouponRequest returns a request for amounts in currency
+func newCouponRequest(currency string) couponRequest {
+	zero := money.Zero(currency)
+	return couponRequest{Amount: zero, MinOrderValue: zero}
+}
+
+// apply copies the request onto the coupon
+func (r *couponRequest) apply(coupon *models.Coupon) {
+	coupon.Code = models.NormalizeCouponCode(r.Code)
+	coupon.Description = r.Description
+	coupon.Type = r.Type
+	coupon.Percent = r.Percent
+	coupon.Amount = r.Amount
+	coupon.Category = r.Category
+	coupon.ProductID = r.ProductID
+	coupon.MinOrderValue = r.MinOrderValue
+	coupon.UsageLimit = r.UsageLimit
+	coupon.PerUserLimit = r.PerUserLimit
+	coupon.StartsAt = r.StartsAt
+	coupon.EndsAt = r.EndsAt
+	if r.Active != nil {
+		coupon.Active = *r.Active
+	}
+}
+
+// saveCoupon binds the request onto the coupon, checks it and stores it.
+// It writes the response itself.
+func (a *app) saveCoupon(c *gin.Context, coupon *models.Coupon, currency string, status int) {
+	couponRequest := newCouponRequest(currency)
+	if err := c.ShouldBindJSON(&couponRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	couponRequest.apply(coupon)
+	if problem := validateCoupon(coupon); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	// A shop's coupons can only be for its own products
+	if coupon.ProductID != nil {
+		query := a.db.Model(&models.Product{}).Where("id = ?", *coupon.ProductID)
+		if coupon.ShopID != nil {
+			query = query.Where("shop_id = ?", *coupon.ShopID)
+		}
+		var count int64
+		if err := query.Count(&count).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check coupon product"})
+			return
+		}
+		if count == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product not found: " + strconv.FormatUint(uint64(*coupon.ProductID), 10)})
+			return
+		}
+	}
+
+	// Codes stay taken by deleted coupons, so they aren't mistaken for them
+	var taken int64
+	if err := a.db.Unscoped().Model(&models.Coupon{}).
+		Where("code = ? AND id <> ?", coupon.Code, coupon.ID).Count(&taken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save coupon"})
+		return
+	}
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Coupon code already exists: " + coupon.Code})
+		return
+	}
+
+	if err := a.db.Save(coupon).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save coupon"})
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"message": "Coupon saved successfully",
+		"coupon":  coupon,
+	})
+}
+
+// couponScope limits a query to the shop's coupons, or to site-wide coupons
+// when shop is nil
+func couponScope(tx *gorm.DB, shop *models.Shop) *gorm.DB {
+	if shop == nil {
+		return tx.Where("shop_id IS NULL")
+	}
+	return tx.Where("shop_id = ?", shop.ID)
+}
+
+// Coupon handlers
+
+// listCoupons writes the coupons of the shop, or the site-wide ones
+func (a *app) listCoupons(c *gin.Context, shop *models.Shop) {
+	var coupons []models.Coupon
+	if err := couponScope(a.db, shop).Order("id").Find(&coupons).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get coupons"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"coupons": coupons})
+}
+
+// updateCoupon changes the coupon named by the :couponId parameter
+func (a *app) updateCoupon(c *gin.Context, shop *models.Shop, currency string) {
+	var coupon models.Coupon
+	if err := couponScope(a.db, shop).Where("id = ?", c.Param("couponId")).First(&coupon).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Coupon not found"})
+		return
+	}
+	if coupon.Amount.Currency != "" {
+		currency = coupon.Amount.Currency
+	}
+	a.saveCoupon(c, &coupon, currency, http.StatusOK)
+}
+
+// deleteCoupon deletes the coupon named by the :couponId parameter. Orders
+// keep the code and discount they were placed with.
+func (a *app) deleteCoupon(c *gin.Context, shop *models.Shop) {
+	result := couponScope(a.db, shop).Where("id = ?", c.Param("couponId")).Delete(&models.Coupon{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete coupon"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Coupon not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Coupon deleted successfully"})
+}
+
+func (a *app) getShopCoupons(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+	a.listCoupons(c, shop)
+}
+
+func (a *app) createShopCoupon(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+	a.saveCoupon(c, &models.Coupon{ShopID: &shop.ID, Active: true}, shop.Currency, http.StatusCreated)
+}
+
+func (a *app) updateShopCoupon(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+	a.updateCoupon(c, shop, shop.Currency)
+}
+
+func (a *app) deleteShopCoupon(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+	a.deleteCoupon(c, shop)
+}
+
+// Site-wide coupons are managed by admins, which RequireRole checks
+
+func (a *app) getSiteCoupons(c *gin.Context) {
+	a.listCoupons(c, nil)
+}
+
+func (a *app) createSiteCoupon(c *gin.Context) {
+	a.saveCoupon(c, &models.Coupon{Active: true}, money.DefaultCurrency, http.StatusCreated)
+}
+
+func (a *app) updateSiteCoupon(c *gin.Context) {
+	a.updateCoupon(c, nil, money.DefaultCurrency)
+}
+
+func (a *app) deleteSiteCoupon(c *gin.Context) {
+	a.deleteCoupon(c, nil)
+}
+
+// validateCouponCode tells a buyer before checkout whether a coupon can be
+// used on the items and what it takes off them
+func (a *app) validateCouponCode(c *gin.Context) {
+	var validateRequest struct {
+		Code       string             `json:"code" binding:"required"`
+		OrderItems []orderItemRequest `json:"orderItems"`
+		Currency   string             `json:"currency"`
+	}
+	if err := c.ShouldBindJSON(&validateRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if len(validateRequest.OrderItems) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one item is required"})
+		return
+	}
+	currency, err := parseCurrency(validateRequest.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Anonymous buyers can check a coupon too, just not their own usage of it
+	var userID uint
+	if user, ok := middleware.CurrentUser(c); ok {
+		userID = user.ID
+	}
+
+	coupon, err := loadCoupon(a.db, validateRequest.Code)
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	// Price the items the way the order would
+	var lines []couponLine
+	var base string
+	rate := 1.0
+	for _, item := range validateRequest.OrderItems {
+		var product models.Product
+		if err := a.db.First(&product, item.ProductID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product not found: " + strconv.FormatUint(uint64(item.ProductID), 10)})
+			return
+		}
+		if err := applySalePrice(a.db, &product, time.Now()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sale prices"})
+			return
+		}
+		variant, err := loadOrderVariant(a.db, &product, item.VariantID)
+		if err != nil {
+			respondOrderError(c, err)
+			return
+		}
+		if base == "" {
+			base = product.Price.Currency
+			if currency, rate, err = checkoutRate(a.db, base, currency); err != nil {
+				respondOrderError(c, err)
+				return
+			}
+		} else if product.Price.Currency != base {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Product %s is priced in %s, not %s; order it separately",
+				product.Name, product.Price.Currency, base)})
+			return
+		}
+		lines = append(lines, couponLine{
+			ShopID:    product.ShopID,
+			ProductID: product.ID,
+			Category:  product.Category,
+			Amount:    variantPrice(&product, variant).Convert(currency, rate).Times(item.Quantity),
+		})
+	}
+
+	discounts, err := couponDiscounts(a.db, coupon, userID, lines, currency, time.Now())
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	total := money.Zero(currency)
+	items := make([]gin.H, len(lines))
+	for i, line := range lines {
+		total = total.Add(discounts[i])
+		items[i] = gin.H{"productId": line.ProductID, "discount": discounts[i]}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"valid": true,
+		"coupon": gin.H{
+			"code":        coupon.Code,
+			"description": coupon.Description,
+			"type":        coupon.Type,
+			"percent":     coupon.Percent,
+			"endsAt":      coupon.EndsAt,
+		},
+		"currency": currency,
+		"discount": total,
+		"items":    items,
+	})
+}
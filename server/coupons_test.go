@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCouponDiscounts(t *testing.T) {
+	env := newTestEnv(t)
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+	shopID := uint(1)
+	lines := []couponLine{
+		{ShopID: 1, ProductID: 1, Category: "Books", Amount: usd(30)},
+		{ShopID: 1, ProductID: 2, Category: "Toys & Games", Amount: usd(20)},
+		{ShopID: 2, ProductID: 3, Category: "Books", Amount: usd(10)},
+	}
+	tests := []struct {
+		name    string
+		coupon  models.Coupon
+		want    []float64
+		wantErr bool
+	}{
+		{
+			name:   "percentage off everything",
+			coupon: models.Coupon{Type: models.CouponPercentage, Percent: 10, Active: true},
+			want:   []float64{3, 2, 1},
+		},
+		{
+			name:   "percentage off a category",
+			coupon: models.Coupon{Type: models.CouponPercentage, Percent: 15, Category: "books", Active: true},
+			want:   []float64{4.5, 0, 1.5},
+		},
+		{
+			// 10 over 30 and 20 of the first shop, the last line takes the rounding
+			name:   "fixed amount spread over a shop's lines",
+			coupon: models.Coupon{Type: models.CouponFixed, Amount: usd(10), ShopID: &shopID, Active: true},
+			want:   []float64{6, 4, 0},
+		},
+		{
+			name:   "fixed amount no more than the items",
+			coupon: models.Coupon{Type: models.CouponFixed, Amount: usd(50), Category: "Toys & Games", Active: true},
+			want:   []float64{0, 20, 0},
+		},
+		{
+			name:    "below the minimum order value",
+			coupon:  models.Coupon{Type: models.CouponPercentage, Percent: 10, MinOrderValue: usd(100), Active: true},
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			coupon:  models.Coupon{Type: models.CouponPercentage, Percent: 10, EndsAt: &yesterday, Active: true},
+			wantErr: true,
+		},
+		{
+			name:    "used up",
+			coupon:  models.Coupon{Type: models.CouponPercentage, Percent: 10, UsageLimit: 5, UsedCount: 5, Active: true},
+			wantErr: true,
+		},
+		{
+			name:    "nothing it applies to",
+			coupon:  models.Coupon{Type: models.CouponPercentage, Percent: 10, Category: "Beauty", Active: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := couponDiscounts(env.db, &tt.coupon, 0, lines, money.DefaultCurrency, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("discounts = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("couponDiscounts: %v", err)
+			}
+			for i, discount := range got {
+				if discount != usd(tt.want[i]) {
+					t.Errorf("line %d discount = %v, want %v", i, discount, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOrderWithCoupon(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	book := env.createProduct(seller, "Book", 40, 10)
+	puzzle := env.createProduct(seller, "Puzzle", 20, 10)
+	env.db.Model(book).Update("category", "Books")
+	sellerToken := env.login(seller)
+	buyerToken := env.login(buyer)
+
+	// The shop gives 25% off books, once per buyer
+	env.do(http.MethodPost, fmt.Sprintf("/api/shops/%d/coupons", seller.ShopID), sellerToken,
+		gin.H{"code": "books25", "type": models.CouponPercentage, "percent": 25, "category": "Books", "perUserLimit": 1},
+		http.StatusCreated, nil)
+	env.do(http.MethodPost, fmt.Sprintf("/api/shops/%d/coupons", seller.ShopID), sellerToken,
+		gin.H{"code": "BOOKS25", "type": models.CouponFixed, "amount": 5}, http.StatusConflict, nil)
+	env.do(http.MethodPost, "/api/coupons", sellerToken,
+		gin.H{"code": "SITEWIDE", "type": models.CouponFixed, "amount": 5}, http.StatusForbidden, nil)
+
+	items := []gin.H{{"productId": book.ID, "quantity": 2}, {"productId": puzzle.ID, "quantity": 1}}
+	var checked struct {
+		Valid    bool    `json:"valid"`
+		Discount float64 `json:"discount"`
+	}
+	env.do(http.MethodPost, "/api/coupons/validate", "", gin.H{"code": "Books25", "orderItems": items}, http.StatusOK, &checked)
+	if !checked.Valid || checked.Discount != 20 {
+		t.Errorf("validate = %+v, want 20 off", checked)
+	}
+
+	request := orderRequest(items...)
+	request["couponCode"] = "books25"
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken, request, http.StatusCreated, &created)
+
+	var order models.Order
+	env.db.Preload("OrderItems").Preload("Invoice").Preload("ShopOrders").First(&order, created.Order.ID)
+	if order.CouponCode != "BOOKS25" || order.Discount != usd(20) || order.Total != usd(80) {
+		t.Errorf("order %s discount %v total %v, want BOOKS25 taking 20 off 100", order.CouponCode, order.Discount, order.Total)
+	}
+	if order.OrderItems[0].Discount != usd(20) || order.OrderItems[1].Discount != usd(0) {
+		t.Errorf("line discounts %v and %v, want 20 on the books only", order.OrderItems[0].Discount, order.OrderItems[1].Discount)
+	}
+	if order.Invoice.Discount != usd(20) || order.Invoice.TotalAmount != usd(80) {
+		t.Errorf("invoice discount %v total %v, want 20 and 80", order.Invoice.Discount, order.Invoice.TotalAmount)
+	}
+	if part := order.ShopOrders[0]; part.Discount != usd(20) || part.Total != usd(80) {
+		t.Errorf("shop order discount %v total %v, want 20 and 80", part.Discount, part.Total)
+	}
+
+	// Returning a book refunds what was paid for it
+	var returned struct {
+		Return models.ReturnRequest `json:"return"`
+	}
+	env.do(http.MethodPost, fmt.Sprintf("/api/orders/%d/returns", order.ID), buyerToken,
+		gin.H{"orderItemId": order.OrderItems[0].ID, "quantity": 1, "reason": "Duplicate"}, http.StatusCreated, &returned)
+	if returned.Return.RefundAmount != usd(30) {
+		t.Errorf("refund amount = %v, want 30 after the discount", returned.Return.RefundAmount)
+	}
+
+	// The buyer has used the coupon
+	env.do(http.MethodPost, "/api/orders", buyerToken, request, http.StatusBadRequest, nil)
+	var coupon models.Coupon
+	env.db.Where("code = ?", "BOOKS25").First(&coupon)
+	if coupon.UsedCount != 1 {
+		t.Errorf("used count = %d, want 1", coupon.UsedCount)
+	}
+
+	// A checkout that passed the check before the first order was placed is
+	// still held to the buyer's limit when it redeems the coupon
+	racing := models.Order{UserID: buyer.ID}
+	racing.ID = order.ID + 1
+	err := redeemCoupon(env.db, &coupon, &racing)
+	var refused *orderError
+	if !errors.As(err, &refused) || refused.status != http.StatusConflict {
+		t.Errorf("second redemption = %v, want a conflict", err)
+	}
+	env.db.First(&coupon, coupon.ID)
+	if coupon.UsedCount != 1 {
+		t.Errorf("used count = %d after the refused redemption, want 1", coupon.UsedCount)
+	}
+}
+
+func TestCancelledOrderReleasesCoupon(t *testing.T) {
+	env := newTestEnv(t)
+	env.gateway.AutoConfirm = false
+	admin := env.createUser("admin", models.Admin)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	lamp := env.createProduct(seller, "Lamp", 30, 10)
+	buyerToken := env.login(buyer)
+
+	env.do(http.MethodPost, "/api/coupons", env.login(admin),
+		gin.H{"code": "WELCOME", "type": models.CouponFixed, "amount": 5, "usageLimit": 1}, http.StatusCreated, nil)
+
+	request := orderRequest(gin.H{"productId": lamp.ID, "quantity": 1})
+	request["couponCode"] = "WELCOME"
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken, request, http.StatusCreated, &created)
+	env.do(http.MethodPost, "/api/orders", buyerToken, request, http.StatusBadRequest, nil)
+
+	env.do(http.MethodPut, fmt.Sprintf("/api/orders/%d", created.Order.ID), buyerToken,
+		gin.H{"status": models.Cancelled}, http.StatusOK, nil)
+	env.do(http.MethodPost, "/api/orders", buyerToken, request, http.StatusCreated, nil)
+}
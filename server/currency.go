@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errNoExchangeRate = errors.New("no exchange rate")
+
+// loadExchangeRates returns every exchange rate
+func loadExchangeRates(tx *gorm.DB) ([]models.ExchangeRate, error) {
+	var rates []models.ExchangeRate
+	err := tx.Order("id").Find(&rates).Error
+	return rates, err
+}
+
+// findExchangeRate returns what one unit of from buys of to, using the
+// rate for the opposite direction when only that one is known
+func findExchangeRate(rates []models.ExchangeRate, from, to string) (float64, bool) {
+	if from == to {
+		return 1, true
+	}
+	for _, rate := range rates {
+		if rate.Base == from && rate.Quote == to {
+			return rate.Rate, true
+		}
+	}
+	for _, rate := range rates {
+		if rate.Base == to && rate.Quote == from && rate.Rate > 0 {
+			return 1 / rate.Rate, true
+		}
+	}
+	return 0, false
+}
+
+// parseCurrency checks a currency code given by a client, returning it in
+// upper case. An empty code is returned as is.
+func parseCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code != "" && !money.IsCurrency(code) {
+		return "", fmt.Errorf("invalid currency: %s", code)
+	}
+	return code, nil
+}
+
+// convertPrices fills in the currency of the products' prices and, when a
+// currency is asked for, converts the prices into it
+func convertPrices(tx *gorm.DB, products []models.Product, currency string) error {
+	var rates []models.ExchangeRate
+	if currency != "" {
+		var err error
+		if rates, err = loadExchangeRates(tx); err != nil {
+			return err
+		}
+	}
+
+	for i := range products {
+		product := &products[i]
+		if currency != "" && currency != product.Price.Currency {
+			rate, ok := findExchangeRate(rates, product.Price.Currency, currency)
+			if !ok {
+				return fmt.Errorf("%w from %s to %s", errNoExchangeRate, product.Price.Currency, currency)
+			}
+			base := product.Price
+			product.BasePrice = &base
+			product.Price = base.Convert(currency, rate)
+			if product.RegularPrice != nil {
+				regular := product.RegularPrice.Convert(currency, rate)
+				product.RegularPrice = &regular
+			}
+			for j := range product.Variants {
+				product.Variants[j].Price = product.Variants[j].Price.Convert(currency, rate)
+			}
+		}
+		product.Currency = product.Price.Currency
+	}
+	return nil
+}
+
+// showPrices converts the products' prices for display in currency. It
+// writes the error response itself.
+func (a *app) showPrices(c *gin.Context, products []models.Product, currency string) bool {
+	err := convertPrices(a.db, products, currency)
+	if errors.Is(err, errNoExchangeRate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Prices can't be shown in " + currency + ": " + err.Error()})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to convert prices"})
+		return false
+	}
+	return true
+}
+
+// checkoutRate returns the currency an order of products priced in base is
+// charged in and the rate to convert their prices at. Without a wanted
+// currency the order is charged in base.
+func checkoutRate(tx *gorm.DB, base, wanted string) (string, float64, error) {
+	if wanted == "" || wanted == base {
+		return base, 1, nil
+	}
+	rates, err := loadExchangeRates(tx)
+	if err != nil {
+		return "", 0, err
+	}
+	rate, ok := findExchangeRate(rates, base, wanted)
+	if !ok {
+		return "", 0, &orderError{http.StatusBadRequest, fmt.Sprintf("Orders can't be paid in %s: no exchange rate from %s", wanted, base)}
+	}
+	return wanted, rate, nil
+}
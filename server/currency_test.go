@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFindExchangeRate(t *testing.T) {
+	rates := []models.ExchangeRate{
+		{Base: "USD", Quote: "CNY", Rate: 8},
+		{Base: "EUR", Quote: "USD", Rate: 1.25},
+	}
+	tests := []struct {
+		from, to string
+		want     float64
+		wantOK   bool
+	}{
+		{"USD", "CNY", 8, true},
+		{"CNY", "USD", 0.125, true},
+		{"USD", "EUR", 0.8, true},
+		{"USD", "USD", 1, true},
+		{"CNY", "EUR", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := findExchangeRate(rates, tt.from, tt.to)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("findExchangeRate(%s, %s) = %v, %v, want %v, %v", tt.from, tt.to, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestProductPricesInCurrency(t *testing.T) {
+	env := newTestEnv(t)
+	env.db.Create(&models.ExchangeRate{Base: "USD", Quote: "CNY", Rate: 7.5})
+	seller := env.createUser("seller", models.Seller)
+	lamp := env.createProduct(seller, "Lamp", 19.99, 5)
+
+	var shown struct {
+		Product struct {
+			Price     float64  `json:"price"`
+			Currency  string   `json:"currency"`
+			BasePrice *float64 `json:"basePrice"`
+		} `json:"product"`
+	}
+	env.do(http.MethodGet, fmt.Sprintf("/api/products/%d?currency=cny", lamp.ID), "", nil, http.StatusOK, &shown)
+	if shown.Product.Price != 149.93 || shown.Product.Currency != "CNY" || shown.Product.BasePrice == nil || *shown.Product.BasePrice != 19.99 {
+		t.Errorf("product = %+v, want 149.93 CNY converted from 19.99", shown.Product)
+	}
+
+	env.do(http.MethodGet, "/api/products", "", nil, http.StatusOK, &struct{}{})
+	env.do(http.MethodGet, "/api/products?currency=GBP", "", nil, http.StatusBadRequest, nil)
+	env.do(http.MethodGet, "/api/products?currency=dollars", "", nil, http.StatusBadRequest, nil)
+}
+
+func TestOrderChargedInCurrency(t *testing.T) {
+	env := newTestEnv(t)
+	env.db.Create(&models.ExchangeRate{Base: "USD", Quote: "CNY", Rate: 7.5})
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	lamp := env.createProduct(seller, "Lamp", 19.99, 5)
+
+	request := orderRequest(gin.H{"productId": lamp.ID, "quantity": 2})
+	request["currency"] = "CNY"
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", env.login(buyer), request, http.StatusCreated, &created)
+
+	var order models.Order
+	env.db.Preload("OrderItems").Preload("Invoice").First(&order, created.Order.ID)
+	if order.Currency != "CNY" || order.BaseCurrency != "USD" || order.ExchangeRate != 7.5 {
+		t.Errorf("order charged in %s from %s at %v, want CNY from USD at 7.5", order.Currency, order.BaseCurrency, order.ExchangeRate)
+	}
+	if order.OrderItems[0].Price != money.New(14993, "CNY") || order.Total != money.New(29986, "CNY") {
+		t.Errorf("order line %v, total %v, want 149.93 CNY each and 299.86 CNY", order.OrderItems[0].Price, order.Total)
+	}
+	if order.Invoice == nil || order.Invoice.TotalAmount != order.Total {
+		t.Errorf("invoice = %+v, want it to charge %v", order.Invoice, order.Total)
+	}
+
+	// Without a rate the order can't be paid in the currency
+	request["currency"] = "GBP"
+	env.do(http.MethodPost, "/api/orders", env.login(buyer), request, http.StatusBadRequest, nil)
+}
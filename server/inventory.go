@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errInsufficientStock = errors.New("not enough stock")
+
+// adjustStock changes a product's stock by delta inside tx and records the
+// change in the inventory ledger. movement supplies the type, order, variant,
+// actor and note; the quantities are filled in here. With a variant, the
+// variant's stock changes as well. Decrements are conditional on enough
+// stock being left and fail with errInsufficientStock otherwise.
+func adjustStock(tx *gorm.DB, productID uint, delta int, movement models.InventoryMovement) (*models.InventoryMovement, error) {
+	if movement.VariantID != nil {
+		if err := adjustVariantStock(tx, productID, *movement.VariantID, delta); err != nil {
+			return nil, err
+		}
+	}
+
+	// Products may have been soft-deleted since the order was placed
+	query := tx.Unscoped().Model(&models.Product{}).Where("id = ?", productID)
+	if delta < 0 {
+		query = query.Where("stock >= ?", -delta)
+	}
+	result := query.Update("stock", gorm.Expr("stock + ?", delta))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		if err := tx.Unscoped().Model(&models.Product{}).Where("id = ?", productID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, errInsufficientStock
+		}
+		return nil, fmt.Errorf("product %d not found", productID)
+	}
+
+	var product models.Product
+	if err := tx.Unscoped().Select("id", "stock").First(&product, productID).Error; err != nil {
+		return nil, err
+	}
+
+	movement.ProductID = productID
+	movement.Quantity = delta
+	movement.StockAfter = product.Stock
+	movement.StockBefore = product.Stock - delta
+	if err := tx.Create(&movement).Error; err != nil {
+		return nil, err
+	}
+	return &movement, nil
+}
+
+// restockOrder returns every item of the order to stock inside tx, recording a
+// ledger entry per item
+func restockOrder(tx *gorm.DB, order *models.Order, movementType models.MovementType, actor *models.User, note string) error {
+	var items []models.OrderItem
+	if err := tx.Where("order_id = ?", order.ID).Find(&items).Error; err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		movement := models.InventoryMovement{
+			Type:      movementType,
+			OrderID:   &order.ID,
+			VariantID: item.VariantID,
+			Note:      note,
+		}
+		if actor != nil {
+			movement.ActorID = &actor.ID
+		}
+		if _, err := adjustStock(tx, item.ProductID, item.Quantity, movement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setStock moves a product's stock to target inside tx, booking the
+// difference in the inventory ledger. It returns nil if nothing changed.
+func setStock(tx *gorm.DB, productID uint, target int, movement models.InventoryMovement) (*models.InventoryMovement, error) {
+	var product models.Product
+	if err := tx.Unscoped().Select("id", "stock").First(&product, productID).Error; err != nil {
+		return nil, err
+	}
+	if product.Stock == target {
+		return nil, nil
+	}
+	return adjustStock(tx, productID, target-product.Stock, movement)
+}
+
+// ledgerBalance sums every movement recorded for the product. It equals
+// Product.Stock as long as all stock changes went through the ledger.
+func ledgerBalance(db *gorm.DB, productID uint) (int, error) {
+	var balance int
+	err := db.Model(&models.InventoryMovement{}).
+		Where("product_id = ?", productID).
+		Select("COALESCE(SUM(quantity), 0)").
+		Scan(&balance).Error
+	return balance, err
+}
+
+// backfillInventoryLedger books an opening balance for products created
+// before the ledger existed, so their history starts from their current stock
+func backfillInventoryLedger(db *gorm.DB) error {
+	var products []models.Product
+	err := db.Unscoped().
+		Where("stock <> 0 AND NOT EXISTS (SELECT 1 FROM inventory_movements WHERE inventory_movements.product_id = products.id)").
+		Find(&products).Error
+	if err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		movement := models.InventoryMovement{
+			ProductID:   product.ID,
+			Type:        models.MovementImport,
+			Quantity:    product.Stock,
+			StockBefore: 0,
+			StockAfter:  product.Stock,
+			Note:        "Opening balance",
+		}
+		if err := db.Create(&movement).Error; err != nil {
+			return err
+		}
+	}
+
+	if len(products) > 0 {
+		log.Printf("Booked opening inventory balance for %d product(s)", len(products))
+	}
+	return nil
+}
+
+// loadManagedProduct loads the product in the :id parameter and checks that
+// the user owns its shop or is an admin. It writes the error response itself.
+func (a *app) loadManagedProduct(c *gin.Context, user *models.User) (*models.Product, bool) {
+	var product models.Product
+	if err := a.db.First(&product, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return nil, false
+	}
+
+	if user.Role == models.Admin {
+		return &product, true
+	}
+
+	var shop models.Shop
+	if err := a.db.First(&shop, product.ShopID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shop information"})
+		return nil, false
+	}
+	if shop.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only manage products from your own shop"})
+		return nil, false
+	}
+
+	return &product, true
+}
+
+func (a *app) createStockAdjustment(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, ok := a.loadManagedProduct(c, user)
+	if !ok {
+		return
+	}
+
+	var adjustment struct {
+		Quantity int                 `json:"quantity" binding:"required"`
+		Type     models.MovementType `json:"type"`
+		Note     string              `json:"note"`
+		// VariantID is required for products sold by variant
+		VariantID uint `json:"variantId"`
+	}
+	if err := c.ShouldBindJSON(&adjustment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	if adjustment.Type == "" {
+		adjustment.Type = models.MovementAdjustment
+	}
+	if !adjustment.Type.IsManual() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Type must be manual_adjustment, import or correction"})
+		return
+	}
+
+	// Products sold by variant are stocked per variant
+	variant, err := loadOrderVariant(a.db, product, adjustment.VariantID)
+	var orderErr *orderError
+	if errors.As(err, &orderErr) {
+		c.JSON(orderErr.status, gin.H{"error": orderErr.message})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get product variants"})
+		return
+	}
+	var variantID *uint
+	if variant != nil {
+		variantID = &variant.ID
+	}
+
+	var movement *models.InventoryMovement
+	err = withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			movement, err = adjustStock(tx, product.ID, adjustment.Quantity, models.InventoryMovement{
+				Type:      adjustment.Type,
+				VariantID: variantID,
+				ActorID:   &user.ID,
+				Note:      adjustment.Note,
+			})
+			return err
+		})
+	})
+	if errors.Is(err, errInsufficientStock) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Adjustment would make stock negative"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to adjust stock"})
+		return
+	}
+
+	product.Stock = movement.StockAfter
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Stock adjusted successfully",
+		"movement": movement,
+		"product":  product,
+	})
+}
+
+func (a *app) getStockHistory(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, ok := a.loadManagedProduct(c, user)
+	if !ok {
+		return
+	}
+
+	// Parse pagination parameters
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	query := a.db.Model(&models.InventoryMovement{}).Where("product_id = ?", product.ID)
+	if movementType := c.Query("type"); movementType != "" {
+		query = query.Where("type = ?", movementType)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count stock movements"})
+		return
+	}
+
+	var movements []models.InventoryMovement
+	if err := query.Preload("Actor").
+		Order("created_at DESC, id DESC").
+		Offset(offset).Limit(limit).
+		Find(&movements).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stock history"})
+		return
+	}
+
+	// Verify the stored stock against the ledger
+	balance, err := ledgerBalance(a.db, product.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute ledger balance"})
+		return
+	}
+
+	totalPages := int(math.Ceil(float64(total) / float64(limit)))
+
+	c.JSON(http.StatusOK, gin.H{
+		"movements":     movements,
+		"stock":         product.Stock,
+		"ledgerBalance": balance,
+		"inSync":        balance == product.Stock,
+		"pagination": gin.H{
+			"total":      total,
+			"totalPages": totalPages,
+			"page":       page,
+			"limit":      limit,
+		},
+	})
+}
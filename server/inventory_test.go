@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStockLedgerTracksEveryChange(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	env.createProduct(seller, "Placeholder", 1, 0) // creates the seller's shop
+	sellerToken := env.login(seller)
+
+	var created struct {
+		Product models.Product `json:"product"`
+	}
+	env.do(http.MethodPost, "/api/products", sellerToken,
+		gin.H{"name": "Kettle", "price": 25, "stock": 10}, http.StatusCreated, &created)
+	productPath := fmt.Sprintf("/api/products/%d", created.Product.ID)
+
+	env.do(http.MethodPost, productPath+"/stock-adjustments", sellerToken,
+		gin.H{"quantity": -3, "note": "Damaged in warehouse"}, http.StatusCreated, nil)
+	env.do(http.MethodPost, productPath+"/stock-adjustments", sellerToken,
+		gin.H{"quantity": -8}, http.StatusBadRequest, nil)
+	env.do(http.MethodPost, productPath+"/stock-adjustments", sellerToken,
+		gin.H{"quantity": 1, "type": models.MovementSale}, http.StatusBadRequest, nil)
+
+	env.do(http.MethodPost, "/api/orders", env.login(buyer),
+		orderRequest(gin.H{"productId": created.Product.ID, "quantity": 2}), http.StatusCreated, nil)
+
+	env.do(http.MethodPut, productPath, sellerToken, gin.H{"stock": 20}, http.StatusOK, nil)
+
+	var history struct {
+		Movements     []models.InventoryMovement `json:"movements"`
+		Stock         int                        `json:"stock"`
+		LedgerBalance int                        `json:"ledgerBalance"`
+		InSync        bool                       `json:"inSync"`
+	}
+	env.do(http.MethodGet, productPath+"/stock-history", sellerToken, nil, http.StatusOK, &history)
+
+	if history.Stock != 20 || !history.InSync {
+		t.Errorf("stock = %d, ledger = %d, in sync = %v; want 20 in sync", history.Stock, history.LedgerBalance, history.InSync)
+	}
+
+	// Newest first: correction 5 -> 20, sale 7 -> 5, adjustment 10 -> 7, import 0 -> 10
+	want := []struct {
+		typ    models.MovementType
+		before int
+		after  int
+	}{
+		{models.MovementCorrection, 5, 20},
+		{models.MovementSale, 7, 5},
+		{models.MovementAdjustment, 10, 7},
+		{models.MovementImport, 0, 10},
+	}
+	if len(history.Movements) != len(want) {
+		t.Fatalf("history has %d movements, want %d", len(history.Movements), len(want))
+	}
+	for i, w := range want {
+		m := history.Movements[i]
+		if m.Type != w.typ || m.StockBefore != w.before || m.StockAfter != w.after {
+			t.Errorf("movement[%d] = %s %d -> %d, want %s %d -> %d", i, m.Type, m.StockBefore, m.StockAfter, w.typ, w.before, w.after)
+		}
+	}
+
+	// Leaving stock out of an edit keeps it, while an explicit 0 sells the
+	// product out
+	env.do(http.MethodPut, productPath, sellerToken, gin.H{"name": "Steel kettle"}, http.StatusOK, nil)
+	env.do(http.MethodPut, productPath, sellerToken, gin.H{"stock": 0}, http.StatusOK, nil)
+	env.do(http.MethodGet, productPath+"/stock-history", sellerToken, nil, http.StatusOK, &history)
+	if history.Stock != 0 || !history.InSync || len(history.Movements) != len(want)+1 {
+		t.Errorf("stock = %d with %d movements, in sync = %v; want 0 after one more correction", history.Stock, len(history.Movements), history.InSync)
+	} else if m := history.Movements[0]; m.Type != models.MovementCorrection || m.StockBefore != 20 || m.StockAfter != 0 {
+		t.Errorf("movement[0] = %s %d -> %d, want correction 20 -> 0", m.Type, m.StockBefore, m.StockAfter)
+	}
+
+	// Buyers can't see or change another shop's stock
+	env.do(http.MethodGet, productPath+"/stock-history", env.login(buyer), nil, http.StatusForbidden, nil)
+}
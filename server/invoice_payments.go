@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errInvoiceVoid = errors.New("invoice is void")
+	errOverpayment = errors.New("payment exceeds the outstanding balance")
+)
+
+// outstandingAmount returns what is still owed on the invoice
+func outstandingAmount(invoice *models.Invoice) money.Money {
+	return invoice.TotalAmount.Sub(invoice.AmountPaid)
+}
+
+// recordPayment saves a payment against the invoice inside tx. A succeeded
+// payment is credited to the invoice straight away; pending ones wait for
+// settlePayment. actor is nil for payments confirmed by the system.
+func recordPayment(tx *gorm.DB, invoice *models.Invoice, payment *models.Payment, actor *models.User) error {
+	if invoice.Status == models.Void {
+		return errInvoiceVoid
+	}
+
+	succeeded := payment.Status == models.PaymentSucceeded
+	if succeeded {
+		if err := creditInvoice(tx, invoice, payment.Amount); err != nil {
+			return err
+		}
+		if payment.PaidAt == nil {
+			now := time.Now()
+			payment.PaidAt = &now
+		}
+	}
+
+	payment.InvoiceID = invoice.ID
+	if actor != nil {
+		payment.RecordedByID = &actor.ID
+	}
+	if err := tx.Create(payment).Error; err != nil {
+		return err
+	}
+
+	if !succeeded {
+		return nil
+	}
+	return refreshInvoiceStatus(tx, invoice, actor)
+}
+
+// settlePayment records the provider's outcome for a pending payment. A
+// succeeded payment is credited to its invoice; a failed one cancels the
+// order if it is still waiting for payment, returning its stock. Payments
+// that were already settled are left alone, so repeated or late outcomes
+// are harmless.
+func settlePayment(tx *gorm.DB, payment *models.Payment, status models.PaymentStatus, actor *models.User) error {
+	if status == models.PaymentPending {
+		return nil
+	}
+
+	updates := map[string]interface{}{"status": status}
+	now := time.Now()
+	if status == models.PaymentSucceeded {
+		updates["paid_at"] = now
+	}
+	result := tx.Model(&models.Payment{}).
+		Where("id = ? AND status = ?", payment.ID, models.PaymentPending).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return tx.First(payment, payment.ID).Error
+	}
+	payment.Status = status
+	if status == models.PaymentSucceeded {
+		payment.PaidAt = &now
+	}
+
+	var invoice models.Invoice
+	if err := tx.First(&invoice, payment.InvoiceID).Error; err != nil {
+		return err
+	}
+
+	if status == models.PaymentSucceeded {
+		if err := creditInvoice(tx, &invoice, payment.Amount); err != nil {
+			return err
+		}
+		return refreshInvoiceStatus(tx, &invoice, actor)
+	}
+
+	var order models.Order
+	if err := tx.First(&order, invoice.OrderID).Error; err != nil {
+		return err
+	}
+	if order.Status != models.Pending {
+		return nil
+	}
+	return changeOrderStatus(tx, &order, models.Cancelled, actor, "Payment failed")
+}
+
+// failPendingPayments gives up the payments of the invoice still waiting for
+// their provider, e.g. because the order was cancelled or the invoice was
+// paid another way. Their charges are
+// closed at the provider once the change is committed.
+func failPendingPayments(tx *gorm.DB, invoiceID uint) error {
+	return tx.Model(&models.Payment{}).
+		Where("invoice_id = ? AND status = ?", invoiceID, models.PaymentPending).
+		Update("status", models.PaymentFailed).Error
+}
+
+// creditInvoice adds amount to what has been paid on the invoice with a
+// conditional update, so concurrent payments can't together pay more than
+// the total
+func creditInvoice(tx *gorm.DB, invoice *models.Invoice, amount money.Money) error {
+	result := tx.Model(&models.Invoice{}).
+		Where("id = ? AND status <> ? AND amount_paid_minor + ? <= total_amount_minor",
+			invoice.ID, models.Void, amount.Minor).
+		Updates(map[string]interface{}{
+			"amount_paid_minor":    gorm.Expr("amount_paid_minor + ?", amount.Minor),
+			"amount_paid_currency": amount.Currency,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	if err := tx.First(invoice, invoice.ID).Error; err != nil {
+		return err
+	}
+	if invoice.Status == models.Void {
+		return errInvoiceVoid
+	}
+	return errOverpayment
+}
+
+// refreshInvoiceStatus brings the invoice status in line with what has been
+// paid. Paying the invoice in full gives up its other pending payments, so
+// they can't later be rejected as overpayments, and moves a pending order to
+// paid.
+func refreshInvoiceStatus(tx *gorm.DB, invoice *models.Invoice, actor *models.User) error {
+	if err := tx.First(invoice, invoice.ID).Error; err != nil {
+		return err
+	}
+	status := models.InvoiceStatusFor(invoice.AmountPaid, invoice.TotalAmount)
+	if status != invoice.Status {
+		if err := tx.Model(invoice).Update("status", status).Error; err != nil {
+			return err
+		}
+	}
+
+	if status != models.FullyPaid {
+		return nil
+	}
+	if err := failPendingPayments(tx, invoice.ID); err != nil {
+		return err
+	}
+	var order models.Order
+	if err := tx.First(&order, invoice.OrderID).Error; err != nil {
+		return err
+	}
+	if order.Status != models.Pending {
+		return nil
+	}
+	return changeOrderStatus(tx, &order, models.Paid, actor, fmt.Sprintf("Invoice %s paid", invoice.Number))
+}
+
+// Payment handlers
+func (a *app) getInvoicePayments(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	invoice, ok := a.loadVisibleInvoice(c, user)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"payments":    invoice.Payments,
+		"amountPaid":  invoice.AmountPaid,
+		"outstanding": outstandingAmount(invoice),
+		"status":      invoice.Status,
+	})
+}
+
+func (a *app) createInvoicePayment(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	invoice, ok := a.loadVisibleInvoice(c, user)
+	if !ok {
+		return
+	}
+
+	var paymentRequest struct {
+		Amount            money.Money          `json:"amount"`
+		Method            models.PaymentMethod `json:"method" binding:"required"`
+		ProviderReference string               `json:"providerReference"`
+		Status            models.PaymentStatus `json:"status"`
+		Note              string               `json:"note"`
+	}
+	// Payments are in the currency of the invoice
+	paymentRequest.Amount.Currency = invoice.TotalAmount.Currency
+	if err := c.ShouldBindJSON(&paymentRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if paymentRequest.Status == "" {
+		paymentRequest.Status = models.PaymentSucceeded
+	}
+
+	// Validate payment
+	if !paymentRequest.Amount.IsPositive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be positive"})
+		return
+	}
+	if !paymentRequest.Method.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown payment method: " + string(paymentRequest.Method)})
+		return
+	}
+	if !paymentRequest.Status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown payment status: " + string(paymentRequest.Status)})
+		return
+	}
+	// Nothing settles a payment recorded by hand later on, so it is
+	// recorded once its outcome is known
+	if paymentRequest.Status == models.PaymentPending {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payments recorded by hand must be succeeded or failed"})
+		return
+	}
+
+	// Charges the buyer could still pay are closed if this payment settles
+	// the invoice
+	var openCharges []models.Payment
+	if err := a.db.Where("invoice_id = ? AND status = ? AND provider <> ''", invoice.ID, models.PaymentPending).
+		Find(&openCharges).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invoice payments"})
+		return
+	}
+
+	var payment models.Payment
+	err := withBusyRetry(func() error {
+		payment = models.Payment{
+			Amount:            paymentRequest.Amount,
+			Method:            paymentRequest.Method,
+			ProviderReference: paymentRequest.ProviderReference,
+			Status:            paymentRequest.Status,
+			Note:              paymentRequest.Note,
+		}
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			return recordPayment(tx, invoice, &payment, user)
+		})
+	})
+	switch {
+	case errors.Is(err, errInvoiceVoid):
+		c.JSON(http.StatusConflict, gin.H{"error": "Invoice is void and can't take payments"})
+		return
+	case errors.Is(err, errOverpayment):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":       fmt.Sprintf("Payment of %s exceeds the outstanding balance of %s", payment.Amount, outstandingAmount(invoice)),
+			"outstanding": outstandingAmount(invoice),
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payment"})
+		return
+	}
+	if invoice.Status == models.FullyPaid {
+		a.closeCharges(c.Request.Context(), openCharges)
+	}
+
+	a.db.Where("invoice_id = ?", invoice.ID).Order("id").Find(&invoice.Payments)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Payment recorded successfully",
+		"payment": payment,
+		"invoice": invoice,
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"tobe_shop/server/models"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createPendingOrder inserts an unpaid order for the product with its invoice
+func (e *testEnv) createPendingOrder(buyer *models.User, product *models.Product, quantity int) *models.Order {
+	e.t.Helper()
+	total := product.Price.Times(quantity)
+	order := models.Order{
+		UserID: buyer.ID,
+		Status: models.Pending,
+		Total:  total,
+		OrderItems: []models.OrderItem{
+			{ProductID: product.ID, Quantity: quantity, Price: product.Price, TotalPrice: total},
+		},
+	}
+	if err := e.db.Create(&order).Error; err != nil {
+		e.t.Fatalf("create order: %v", err)
+	}
+	if err := createInvoice(e.db, &order, time.Now()); err != nil {
+		e.t.Fatalf("create invoice: %v", err)
+	}
+	return &order
+}
+
+func TestPartialPaymentsSettleInvoice(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	admin := env.createUser("admin", models.Admin)
+	product := env.createProduct(seller, "Desk", 50, 5)
+	order := env.createPendingOrder(buyer, product, 2)
+	adminToken := env.login(admin)
+	path := fmt.Sprintf("/api/invoices/%d/payments", order.InvoiceID)
+
+	// Payments received outside the site are recorded by an admin; neither
+	// the buyer nor a seller can mark the invoice paid
+	env.do(http.MethodPost, path, env.login(buyer), gin.H{"amount": 100, "method": "cash"}, http.StatusForbidden, nil)
+	env.do(http.MethodPost, path, env.login(seller), gin.H{"amount": 100, "method": "cash"}, http.StatusForbidden, nil)
+
+	var paid struct {
+		Invoice models.Invoice `json:"invoice"`
+	}
+	env.do(http.MethodPost, path, adminToken,
+		gin.H{"amount": 40, "method": "bank_transfer", "providerReference": "TX-1"}, http.StatusCreated, &paid)
+	if paid.Invoice.Status != models.PartiallyPaid || paid.Invoice.AmountPaid != usd(40) {
+		t.Errorf("invoice = %s with %s paid, want partially_paid with 40", paid.Invoice.Status, paid.Invoice.AmountPaid)
+	}
+
+	// Failed payments are kept but don't count, and overpaying is rejected
+	env.do(http.MethodPost, path, adminToken,
+		gin.H{"amount": 60, "method": "card", "status": "failed"}, http.StatusCreated, nil)
+	env.do(http.MethodPost, path, adminToken,
+		gin.H{"amount": 60, "method": "card", "status": "pending"}, http.StatusBadRequest, nil)
+	env.do(http.MethodPost, path, adminToken, gin.H{"amount": 60.01, "method": "card"}, http.StatusBadRequest, nil)
+
+	env.do(http.MethodPost, path, adminToken, gin.H{"amount": 60, "method": "card"}, http.StatusCreated, &paid)
+	if paid.Invoice.Status != models.FullyPaid || len(paid.Invoice.Payments) != 3 {
+		t.Errorf("invoice = %s with %d payments, want fully_paid with 3", paid.Invoice.Status, len(paid.Invoice.Payments))
+	}
+
+	var reloaded models.Order
+	env.db.First(&reloaded, order.ID)
+	if reloaded.Status != models.Paid {
+		t.Errorf("order status = %s, want paid", reloaded.Status)
+	}
+
+	env.do(http.MethodPost, path, adminToken, gin.H{"amount": 1, "method": "cash"}, http.StatusBadRequest, nil)
+
+	// Void invoices take no payments
+	voided := env.createPendingOrder(buyer, product, 1)
+	env.db.Model(&models.Invoice{}).Where("id = ?", voided.InvoiceID).Update("status", models.Void)
+	env.do(http.MethodPost, fmt.Sprintf("/api/invoices/%d/payments", voided.InvoiceID), adminToken,
+		gin.H{"amount": 10, "method": "cash"}, http.StatusConflict, nil)
+}
+
+func TestManualPaymentSupersedesGatewayCharge(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	admin := env.createUser("admin", models.Admin)
+	product := env.createProduct(seller, "Chair", 30, 5)
+	adminToken := env.login(admin)
+
+	// Settling the invoice by hand closes the charge the buyer hasn't paid
+	order, reference := env.placePendingOrder(buyer, product, 1)
+	env.do(http.MethodPost, fmt.Sprintf("/api/invoices/%d/payments", order.InvoiceID), adminToken,
+		gin.H{"amount": 30, "method": "bank_transfer"}, http.StatusCreated, nil)
+	charge, err := env.gateway.QueryCharge(context.Background(), reference)
+	if err != nil || charge.Status != payments.StatusFailed {
+		t.Errorf("charge = %+v, %v; want closed", charge, err)
+	}
+	var payment models.Payment
+	env.db.Where("provider_reference = ?", reference).First(&payment)
+	if payment.Status != models.PaymentFailed {
+		t.Errorf("gateway payment status = %s, want failed", payment.Status)
+	}
+
+	// A buyer who paid at the gateway as well gets that payment back rather
+	// than having it rejected as an overpayment
+	order, reference = env.placePendingOrder(buyer, product, 1)
+	env.gateway.Complete(reference, payments.StatusSucceeded)
+	env.do(http.MethodPost, fmt.Sprintf("/api/invoices/%d/payments", order.InvoiceID), adminToken,
+		gin.H{"amount": 30, "method": "bank_transfer"}, http.StatusCreated, nil)
+	body, signature := env.gateway.Callback("evt-twice", reference, payments.StatusSucceeded, usd(30), time.Now())
+	env.sendCallback(body, signature, http.StatusOK)
+
+	var event models.PaymentEvent
+	env.db.Where("event_id = ?", "evt-twice").First(&event)
+	var paid models.Payment
+	env.db.Where("provider_reference = ?", reference).First(&paid)
+	if event.Result != models.EventRefunded || paid.AmountRefunded != usd(30) {
+		t.Errorf("event %s, payment with %s refunded; want refunded in full", event.Result, paid.AmountRefunded)
+	}
+	var invoice models.Invoice
+	env.db.First(&invoice, order.InvoiceID)
+	if invoice.Status != models.FullyPaid || invoice.AmountPaid != usd(30) {
+		t.Errorf("invoice = %s with %s paid, want fully_paid with 30", invoice.Status, invoice.AmountPaid)
+	}
+}
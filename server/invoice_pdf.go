@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+	"tobe_shop/server/pdf"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// invoiceLabels holds the invoice PDF labels in the client's locales. Labels
+// shared with the client use the same wording as its translation files.
+var invoiceLabels = map[string]map[string]string{
+	"en": {
+		"title":           "Invoice",
+		"invoiceNumber":   "Invoice Number",
+		"orderNumber":     "Order Number",
+		"issueDate":       "Issue Date",
+		"dueDate":         "Due Date",
+		"status":          "Status",
+		"soldBy":          "Sold By",
+		"billingAddress":  "Billing Address",
+		"shippingAddress": "Shipping Address",
+		"item":            "Item",
+		"quantity":        "Quantity",
+		"price":           "Price",
+		"total":           "Total",
+		"subtotal":        "Subtotal",
+		"discount":        "Discount",
+		"shipping":        "Shipping",
+		"tax":             "Tax",
+		"page":            "Page %d of %d",
+		"thankYou":        "Thank you for shopping with TobeShop",
+		"unpaid":          "Unpaid",
+		"partially_paid":  "Partially Paid",
+		"fully_paid":      "Paid",
+		"void":            "Void",
+	},
+	"zh": {
+		"title":           "发票",
+		"invoiceNumber":   "发票号码",
+		"orderNumber":     "订单号",
+		"issueDate":       "开票日期",
+		"dueDate":         "到期日期",
+		"status":          "状态",
+		"soldBy":          "商店",
+		"billingAddress":  "账单地址",
+		"shippingAddress": "收货地址",
+		"item":            "商品",
+		"quantity":        "数量",
+		"price":           "价格",
+		"total":           "总计",
+		"subtotal":        "小计",
+		"discount":        "优惠",
+		"shipping":        "运费",
+		"tax":             "税费",
+		"page":            "第 %d 页，共 %d 页",
+		"thankYou":        "感谢您在 TobeShop 购物",
+		"unpaid":          "未支付",
+		"partially_paid":  "部分支付",
+		"fully_paid":      "已支付",
+		"void":            "已作废",
+	},
+}
+
+// invoiceLanguage picks the PDF language from the lang query parameter,
+// falling back to the Accept-Language header and then English
+func invoiceLanguage(c *gin.Context) string {
+	lang := strings.ToLower(c.Query("lang"))
+	if lang == "" {
+		lang = strings.ToLower(c.GetHeader("Accept-Language"))
+	}
+	if strings.HasPrefix(lang, "zh") {
+		return "zh"
+	}
+	return "en"
+}
+
+// invoiceDocument is everything printed on an invoice
+type invoiceDocument struct {
+	Invoice *models.Invoice
+	Buyer   *models.User
+	Shops   []models.Shop
+}
+
+// loadInvoiceDocument loads the buyer and the shops selling the items of the
+// invoice's order. Deleted products and shops still appear on old invoices.
+func loadInvoiceDocument(db *gorm.DB, invoice *models.Invoice) (*invoiceDocument, error) {
+	doc := &invoiceDocument{Invoice: invoice}
+
+	var buyer models.User
+	if err := db.Unscoped().First(&buyer, invoice.Order.UserID).Error; err != nil {
+		return nil, err
+	}
+	doc.Buyer = &buyer
+
+	var productIDs []uint
+	for _, item := range invoice.Order.OrderItems {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	var products []models.Product
+	if err := db.Unscoped().Find(&products, productIDs).Error; err != nil {
+		return nil, err
+	}
+	productsByID := make(map[uint]*models.Product, len(products))
+	var shopIDs []uint
+	for i := range products {
+		productsByID[products[i].ID] = &products[i]
+		shopIDs = append(shopIDs, products[i].ShopID)
+	}
+	for i := range invoice.Order.OrderItems {
+		invoice.Order.OrderItems[i].Product = productsByID[invoice.Order.OrderItems[i].ProductID]
+	}
+
+	if err := db.Unscoped().Order("id").Find(&doc.Shops, shopIDs).Error; err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Invoice PDF layout, in points
+const (
+	invoiceMargin     = 50.0
+	invoiceRight      = pdf.PageWidth - invoiceMargin
+	invoiceBottom     = 90.0
+	invoiceLineHeight = 14.0
+)
+
+// renderInvoicePDF lays the invoice out on as many A4 pages as its items need
+func renderInvoicePDF(doc *invoiceDocument, lang string) ([]byte, error) {
+	labels := invoiceLabels[lang]
+	invoice := doc.Invoice
+	order := invoice.Order
+
+	document := pdf.New()
+	document.Title = fmt.Sprintf("%s %s", labels["title"], invoice.Number)
+	page := document.AddPage()
+	y := pdf.PageHeight - 70
+
+	// Title and invoice details
+	page.Text(invoiceMargin, y, 24, pdf.Bold, labels["title"])
+	page.TextRight(invoiceRight, y, 14, pdf.Bold, "TobeShop")
+	y -= 32
+
+	details := [][2]string{
+		{labels["invoiceNumber"], invoice.Number},
+		{labels["orderNumber"], fmt.Sprintf("#%d", order.ID)},
+		{labels["issueDate"], invoice.IssueDate.Format("2006-01-02")},
+		{labels["dueDate"], invoice.DueDate.Format("2006-01-02")},
+		{labels["status"], labels[string(invoice.Status)]},
+	}
+	for _, detail := range details {
+		page.Text(invoiceMargin, y, 10, pdf.Bold, detail[0])
+		page.Text(invoiceMargin+110, y, 10, pdf.Regular, detail[1])
+		y -= invoiceLineHeight
+	}
+	y -= 16
+
+	// Seller, billing and shipping addresses side by side
+	columnWidth := (invoiceRight - invoiceMargin - 40) / 3
+	var sellerLines []string
+	for _, shop := range doc.Shops {
+		sellerLines = append(sellerLines, shop.Name)
+		if shop.Address != "" {
+			sellerLines = append(sellerLines, pdf.WrapText(shop.Address, columnWidth, 9, pdf.Regular)...)
+		}
+	}
+	buyerName := strings.TrimSpace(doc.Buyer.FirstName + " " + doc.Buyer.LastName)
+	billingLines := addressLines(order.BillingDetails, order.BillingAddress, columnWidth)
+	if order.BillingDetails.IsZero() {
+		billingLines = append([]string{buyerName}, billingLines...)
+	}
+	shippingLines := addressLines(order.ShippingDetails, order.ShippingAddress, columnWidth)
+
+	blocks := []struct {
+		label string
+		lines []string
+	}{
+		{labels["soldBy"], sellerLines},
+		{labels["billingAddress"], billingLines},
+		{labels["shippingAddress"], shippingLines},
+	}
+	lowest := y
+	for i, block := range blocks {
+		x := invoiceMargin + float64(i)*(columnWidth+20)
+		page.Text(x, y, 10, pdf.Bold, block.label)
+		blockY := y - invoiceLineHeight
+		for _, line := range block.lines {
+			page.Text(x, blockY, 9, pdf.Regular, line)
+			blockY -= 12
+		}
+		if blockY < lowest {
+			lowest = blockY
+		}
+	}
+	y = lowest - 20
+
+	// Item table, continued on new pages as needed
+	const (
+		quantityRight = 370.0
+		priceRight    = 460.0
+	)
+	itemWidth := quantityRight - invoiceMargin - 60
+	tableHeader := func() {
+		page.FillRect(invoiceMargin, y-6, invoiceRight-invoiceMargin, 20, 0.92)
+		page.Text(invoiceMargin+4, y, 10, pdf.Bold, labels["item"])
+		page.TextRight(quantityRight, y, 10, pdf.Bold, labels["quantity"])
+		page.TextRight(priceRight, y, 10, pdf.Bold, labels["price"])
+		page.TextRight(invoiceRight-4, y, 10, pdf.Bold, labels["total"])
+		y -= 22
+	}
+	tableHeader()
+
+	for _, item := range order.OrderItems {
+		name := fmt.Sprintf("#%d", item.ProductID)
+		if item.Product != nil {
+			name = item.Product.Name
+		}
+		if item.VariantTitle != "" {
+			name += " (" + item.VariantTitle + ")"
+		}
+		nameLines := pdf.WrapText(name, itemWidth, 10, pdf.Regular)
+
+		if y-float64(len(nameLines))*invoiceLineHeight < invoiceBottom {
+			page = document.AddPage()
+			y = pdf.PageHeight - 70
+			tableHeader()
+		}
+
+		page.TextRight(quantityRight, y, 10, pdf.Regular, fmt.Sprintf("%d", item.Quantity))
+		page.TextRight(priceRight, y, 10, pdf.Regular, formatInvoiceAmount(item.Price))
+		page.TextRight(invoiceRight-4, y, 10, pdf.Regular, formatInvoiceAmount(item.TotalPrice))
+		for _, line := range nameLines {
+			page.Text(invoiceMargin+4, y, 10, pdf.Regular, line)
+			y -= invoiceLineHeight
+		}
+		y -= 4
+		page.Line(invoiceMargin, y+8, invoiceRight, y+8, 0.3)
+	}
+
+	// Totals
+	if y-5*18 < invoiceBottom {
+		page = document.AddPage()
+		y = pdf.PageHeight - 70
+	}
+	y -= 10
+	type totalRow struct {
+		label  string
+		amount money.Money
+		style  pdf.Style
+	}
+	totals := []totalRow{{labels["subtotal"], invoice.Amount.Sub(order.ShippingCost).Add(invoice.Discount), pdf.Regular}}
+	if invoice.Discount.IsPositive() {
+		label := labels["discount"]
+		if order.CouponCode != "" {
+			label += " (" + order.CouponCode + ")"
+		}
+		totals = append(totals, totalRow{label, money.Zero(invoice.Discount.Currency).Sub(invoice.Discount), pdf.Regular})
+	}
+	totals = append(totals,
+		totalRow{labels["shipping"], order.ShippingCost, pdf.Regular},
+		totalRow{labels["tax"], invoice.Tax, pdf.Regular},
+		totalRow{labels["total"], invoice.TotalAmount, pdf.Bold},
+	)
+	for _, total := range totals {
+		page.TextRight(priceRight, y, 11, total.style, total.label)
+		page.TextRight(invoiceRight-4, y, 11, total.style, formatInvoiceAmount(total.amount))
+		y -= 18
+	}
+
+	// Footer on every page
+	pages := document.Pages()
+	for i, p := range pages {
+		p.Line(invoiceMargin, 60, invoiceRight, 60, 0.5)
+		p.Text(invoiceMargin, 45, 8, pdf.Regular, labels["thankYou"])
+		p.TextRight(invoiceRight, 45, 8, pdf.Regular, fmt.Sprintf(labels["page"], i+1, len(pages)))
+	}
+
+	var out bytes.Buffer
+	if _, err := document.WriteTo(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// formatInvoiceAmount writes dollar amounts the way they always were and
+// other currencies by their code
+func formatInvoiceAmount(amount money.Money) string {
+	if amount.Currency == "USD" || amount.Currency == "" {
+		if amount.IsNegative() {
+			return "-$" + amount.Decimal()[1:]
+		}
+		return "$" + amount.Decimal()
+	}
+	return amount.String()
+}
+
+func (a *app) getInvoicePDF(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	invoice, ok := a.loadVisibleInvoice(c, user)
+	if !ok {
+		return
+	}
+
+	doc, err := loadInvoiceDocument(a.db, invoice)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invoice details"})
+		return
+	}
+
+	content, err := renderInvoicePDF(doc, invoiceLanguage(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render invoice"})
+		return
+	}
+
+	filename := invoice.Number + ".pdf"
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Data(http.StatusOK, "application/pdf", content)
+}
+
+// addressLines returns an order address wrapped to width, falling back to
+// the flattened string of orders placed before addresses were structured
+func addressLines(details models.AddressFields, flattened string, width float64) []string {
+	if details.IsZero() {
+		return pdf.WrapText(flattened, width, 9, pdf.Regular)
+	}
+	var lines []string
+	for _, line := range details.Lines() {
+		lines = append(lines, pdf.WrapText(line, width, 9, pdf.Regular)...)
+	}
+	return lines
+}
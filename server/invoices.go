@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// invoicePaymentTerm is how long after issue an invoice falls due
+const invoicePaymentTerm = 14 * 24 * time.Hour
+
+// createInvoice issues an unpaid invoice for a newly placed order and links
+// it to the order. The invoice amount is the order total without its tax.
+func createInvoice(tx *gorm.DB, order *models.Order, now time.Time) error {
+	invoice := models.Invoice{
+		OrderID:        order.ID,
+		Amount:         order.Total.Sub(order.Tax),
+		Tax:            order.Tax,
+		Discount:       order.Discount,
+		TotalAmount:    order.Total,
+		AmountPaid:     money.Zero(order.Total.Currency),
+		AmountCredited: money.Zero(order.Total.Currency),
+		Status:         models.Unpaid,
+		IssueDate:      now,
+		DueDate:        now.Add(invoicePaymentTerm),
+	}
+
+	if err := tx.Create(&invoice).Error; err != nil {
+		return err
+	}
+
+	// Number invoices by issue date and ID, e.g. INV-20240131-000042
+	invoice.Number = fmt.Sprintf("INV-%s-%06d", now.Format("20060102"), invoice.ID)
+	if err := tx.Model(&invoice).Update("number", invoice.Number).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(order).Update("invoice_id", invoice.ID).Error; err != nil {
+		return err
+	}
+	order.InvoiceID = invoice.ID
+	order.Invoice = &invoice
+	return nil
+}
+
+// voidOrderInvoice voids the invoice of a cancelled order
+func voidOrderInvoice(tx *gorm.DB, order *models.Order) error {
+	return tx.Model(&models.Invoice{}).
+		Where("order_id = ? AND status <> ?", order.ID, models.Void).
+		Update("status", models.Void).Error
+}
+
+// visibleInvoices scopes an invoice query to the invoices the user may see:
+// those of their own orders and, for sellers, of orders containing their
+// products. Admins see every invoice. view narrows it to "buyer" or "seller".
+func visibleInvoices(query *gorm.DB, user *models.User, view string) *gorm.DB {
+	buyerOrders := query.Session(&gorm.Session{NewDB: true}).Model(&models.Order{}).
+		Select("id").
+		Where("user_id = ?", user.ID)
+	sellerOrders := query.Session(&gorm.Session{NewDB: true}).Table("order_items").
+		Select("order_items.order_id").
+		Joins("JOIN products ON products.id = order_items.product_id").
+		Joins("JOIN shops ON shops.id = products.shop_id").
+		Where("order_items.deleted_at IS NULL AND shops.user_id = ?", user.ID)
+
+	switch view {
+	case "buyer":
+		return query.Where("invoices.order_id IN (?)", buyerOrders)
+	case "seller":
+		return query.Where("invoices.order_id IN (?)", sellerOrders)
+	}
+	if user.Role == models.Admin {
+		return query
+	}
+	return query.Where("invoices.order_id IN (?) OR invoices.order_id IN (?)", buyerOrders, sellerOrders)
+}
+
+// Invoice handlers
+func (a *app) getInvoices(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	// Parse pagination parameters
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+
+	// Calculate offset
+	offset := (page - 1) * limit
+
+	view := c.Query("view")
+	if view != "" && view != "buyer" && view != "seller" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "view must be buyer or seller"})
+		return
+	}
+
+	query := visibleInvoices(a.db.Model(&models.Invoice{}), user, view)
+
+	// Apply filters
+	if status := c.Query("status"); status != "" {
+		query = query.Where("invoices.status = ?", status)
+	}
+	if orderID := c.Query("orderId"); orderID != "" {
+		query = query.Where("invoices.order_id = ?", orderID)
+	}
+	if from := c.Query("from"); from != "" {
+		date, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date like 2006-01-02"})
+			return
+		}
+		query = query.Where("invoices.issue_date >= ?", date)
+	}
+	if to := c.Query("to"); to != "" {
+		date, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date like 2006-01-02"})
+			return
+		}
+		query = query.Where("invoices.issue_date < ?", date.AddDate(0, 0, 1))
+	}
+
+	// Count total invoices
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count invoices"})
+		return
+	}
+
+	// Get paginated invoices with their orders
+	var invoices []models.Invoice
+	if err := query.Preload("Order").
+		Offset(offset).Limit(limit).
+		Order("invoices.issue_date DESC, invoices.id DESC").
+		Find(&invoices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get invoices"})
+		return
+	}
+
+	// Calculate total pages
+	totalPages := int(math.Ceil(float64(total) / float64(limit)))
+
+	// Return invoices with pagination info
+	c.JSON(http.StatusOK, gin.H{
+		"invoices": invoices,
+		"pagination": gin.H{
+			"total":      total,
+			"totalPages": totalPages,
+			"page":       page,
+			"limit":      limit,
+		},
+	})
+}
+
+// loadVisibleInvoice loads the invoice named by the :id parameter with its
+// order, items, payments and credit notes, checking that the user may see it
+func (a *app) loadVisibleInvoice(c *gin.Context, user *models.User) (*models.Invoice, bool) {
+	invoiceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID"})
+		return nil, false
+	}
+
+	var invoice models.Invoice
+	if err := a.db.Preload("Order").Preload("Order.OrderItems").Preload("Order.OrderItems.Product").
+		Preload("Payments", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("CreditNotes", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("CreditNotes.Refunds").
+		First(&invoice, invoiceID).Error; err != nil || invoice.Order == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return nil, false
+	}
+
+	// The buyer, sellers of the order's items and admins can see the invoice
+	canView, err := a.canViewOrder(user, invoice.Order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check invoice permissions"})
+		return nil, false
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this invoice"})
+		return nil, false
+	}
+	return &invoice, true
+}
+
+func (a *app) getInvoice(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	invoice, ok := a.loadVisibleInvoice(c, user)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invoice": invoice})
+}
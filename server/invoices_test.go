@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type invoiceListResponse struct {
+	Invoices   []models.Invoice `json:"invoices"`
+	Pagination struct {
+		Total int64 `json:"total"`
+	} `json:"pagination"`
+}
+
+func TestOrderInvoiceIsVisibleToBuyerAndSeller(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	otherSeller := env.createUser("other-seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	stranger := env.createUser("stranger", models.Buyer)
+	product := env.createProduct(seller, "Kettle", 30, 5)
+	env.createProduct(otherSeller, "Toaster", 50, 5)
+	buyerToken := env.login(buyer)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 2}), http.StatusCreated, &created)
+	if created.Order.InvoiceID == 0 {
+		t.Fatal("order has no invoice")
+	}
+
+	var fetched struct {
+		Invoice models.Invoice `json:"invoice"`
+	}
+	invoicePath := fmt.Sprintf("/api/invoices/%d", created.Order.InvoiceID)
+	env.do(http.MethodGet, invoicePath, buyerToken, nil, http.StatusOK, &fetched)
+	invoice := fetched.Invoice
+	if invoice.OrderID != created.Order.ID || invoice.TotalAmount != usd(60) || invoice.Number == "" {
+		t.Errorf("invoice = %+v, want total 60 for order %d with a number", invoice, created.Order.ID)
+	}
+	if invoice.Status != models.FullyPaid || !invoice.DueDate.After(invoice.IssueDate) {
+		t.Errorf("invoice status = %s, issued %v due %v", invoice.Status, invoice.IssueDate, invoice.DueDate)
+	}
+
+	cases := []struct {
+		user  *models.User
+		query string
+		want  int64
+	}{
+		{buyer, "", 1},
+		{buyer, "?view=seller", 0},
+		{seller, "?view=seller", 1},
+		{seller, "?view=buyer", 0},
+		{otherSeller, "", 0},
+		{stranger, "", 0},
+		{buyer, "?status=unpaid", 0},
+	}
+	tokens := map[uint]string{buyer.ID: buyerToken}
+	for _, tc := range cases {
+		token, ok := tokens[tc.user.ID]
+		if !ok {
+			token = env.login(tc.user)
+			tokens[tc.user.ID] = token
+		}
+		var list invoiceListResponse
+		env.do(http.MethodGet, "/api/invoices"+tc.query, token, nil, http.StatusOK, &list)
+		if list.Pagination.Total != tc.want || len(list.Invoices) != int(tc.want) {
+			t.Errorf("%s GET /api/invoices%s: total = %d, want %d", tc.user.Username, tc.query, list.Pagination.Total, tc.want)
+		}
+	}
+
+	env.do(http.MethodGet, invoicePath, tokens[seller.ID], nil, http.StatusOK, nil)
+	env.do(http.MethodGet, invoicePath, tokens[stranger.ID], nil, http.StatusForbidden, nil)
+
+	// Cancelling an unpaid order voids its invoice
+	pending, _ := env.placePendingOrder(buyer, product, 1)
+	env.do(http.MethodPut, fmt.Sprintf("/api/orders/%d", pending.ID), buyerToken,
+		gin.H{"status": models.Cancelled}, http.StatusOK, nil)
+	env.do(http.MethodGet, fmt.Sprintf("/api/invoices/%d", pending.InvoiceID), buyerToken, nil, http.StatusOK, &fetched)
+	if fetched.Invoice.Status != models.Void {
+		t.Errorf("invoice status after cancel = %s, want void", fetched.Invoice.Status)
+	}
+}
+
+func TestInvoicePDFIsRenderedInRequestedLanguage(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	stranger := env.createUser("stranger", models.Buyer)
+	product := env.createProduct(seller, "Silk Scarf", 25, 5)
+	buyerToken := env.login(buyer)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+	path := fmt.Sprintf("/api/invoices/%d/pdf", created.Order.InvoiceID)
+
+	w := env.do(http.MethodGet, path, buyerToken, nil, http.StatusOK, nil)
+	body := w.Body.String()
+	if w.Header().Get("Content-Type") != "application/pdf" || !strings.HasPrefix(body, "%PDF-") {
+		t.Fatalf("response is not a PDF: %s %q", w.Header().Get("Content-Type"), body)
+	}
+	for _, want := range []string{"(Invoice) Tj", "(Silk Scarf) Tj", "($25.00) Tj", "(seller's shop) Tj"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("English PDF is missing %s", want)
+		}
+	}
+
+	// 发票 (invoice) in UCS-2
+	w = env.do(http.MethodGet, path+"?lang=zh", buyerToken, nil, http.StatusOK, nil)
+	if !strings.Contains(w.Body.String(), "<53D17968> Tj") {
+		t.Error("Chinese PDF is missing its title")
+	}
+
+	env.do(http.MethodGet, path, env.login(stranger), nil, http.StatusForbidden, nil)
+}
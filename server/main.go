@@ -2,9 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
-	"fmt"
 	"io"
 	"log"
 	"math"
@@ -12,16 +12,30 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"tobe_shop/server/auth"
 	"tobe_shop/server/config"
 	"tobe_shop/server/middleware"
 	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+	"tobe_shop/server/payments"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-var db *gorm.DB
+// app holds the dependencies shared by every handler
+type app struct {
+	db       *gorm.DB
+	tokens   *auth.Manager
+	sessions *auth.SessionStore
+	gateways *payments.Registry
+}
+
+func newApp(database *gorm.DB, tokens *auth.Manager, sessions *auth.SessionStore, gateways *payments.Registry) *app {
+	return &app{db: database, tokens: tokens, sessions: sessions, gateways: gateways}
+}
 
 func main() {
 	// Parse command line flags
@@ -31,6 +45,46 @@ func main() {
 	// Initialize database
 	config.ConnectDatabase()
 
+	// Give products created before the inventory ledger an opening balance
+	if err := backfillInventoryLedger(config.DB); err != nil {
+		log.Fatal("Failed to backfill inventory ledger:", err)
+	}
+
+	// Split orders placed before shop orders between their shops
+	if err := backfillShopOrders(config.DB); err != nil {
+		log.Fatal("Failed to backfill shop orders:", err)
+	}
+
+	// Load the tax rules and exchange rates from their config files
+	config.SeedTaxRules(config.DB)
+	config.SeedExchangeRates(config.DB)
+
+	// Release checkout reservations once they expire
+	startReservationSweeper(context.Background(), config.DB, time.Minute)
+
+	// Initialize access token signing keys and the session store
+	tokens, sessions := config.LoadAuth(config.DB)
+
+	// Initialize the payment gateways
+	gateways := config.LoadPayments()
+
+	a := newApp(config.DB, tokens, sessions, gateways)
+
+	// Send refunds again that their payment provider hasn't settled
+	a.startRefundSweeper(context.Background(), time.Minute)
+
+	r := a.router()
+
+	// Start the server
+	serverAddr := ":" + *port
+	log.Println("Server starting on http://localhost" + serverAddr)
+	if err := r.Run(serverAddr); err != nil {
+		log.Fatal("Failed to start server:", err)
+	}
+}
+
+// router sets up the Gin engine with every API route
+func (a *app) router() *gin.Engine {
 	// Set up Gin
 	r := gin.Default()
 
@@ -38,7 +92,7 @@ func main() {
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Cart-Token")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
@@ -49,6 +103,9 @@ func main() {
 		c.Next()
 	})
 
+	authRequired := middleware.AuthMiddleware(a.db, a.tokens, a.sessions)
+	authOptional := middleware.OptionalAuthMiddleware(a.db, a.tokens, a.sessions)
+
 	// API routes
 	api := r.Group("/api")
 	{
@@ -56,39 +113,108 @@ func main() {
 		log.Println("Registering API routes...")
 
 		// Auth routes
-		api.POST("/register", registerUser)
-		api.POST("/login", loginUser)
+		api.POST("/register", a.registerUser)
+		api.POST("/login", a.loginUser)
+		api.POST("/token/refresh", a.refreshAccessToken)
+		api.POST("/logout", authRequired, a.logoutUser)
+		api.POST("/logout-all", authRequired, a.logoutAllSessions)
 
 		// Product routes
-		api.GET("/products", getProducts)
-		api.GET("/products/:id", getProduct)
-		api.POST("/products", middleware.AuthMiddleware(), createProduct)
-		api.PUT("/products/:id", middleware.AuthMiddleware(), updateProduct)
-		api.DELETE("/products/:id", middleware.AuthMiddleware(), deleteProduct)
+		api.GET("/products", a.getProducts)
+		api.GET("/products/:id", a.getProduct)
+		api.POST("/products", authRequired, middleware.RequireRole(models.Seller), a.createProduct)
+		api.PUT("/products/:id", authRequired, middleware.RequireRole(models.Seller), a.updateProduct)
+		api.DELETE("/products/:id", authRequired, middleware.RequireRole(models.Seller), a.deleteProduct)
+		api.POST("/products/:id/stock-adjustments", authRequired, middleware.RequireRole(models.Seller), a.createStockAdjustment)
+		api.GET("/products/:id/stock-history", authRequired, middleware.RequireRole(models.Seller), a.getStockHistory)
+		api.GET("/products/:id/price-history", a.getPriceHistory)
+		api.POST("/products/:id/sales", authRequired, middleware.RequireRole(models.Seller), a.createSalePrice)
+		api.DELETE("/products/:id/sales/:saleId", authRequired, middleware.RequireRole(models.Seller), a.deleteSalePrice)
+		api.PUT("/products/:id/options", authRequired, middleware.RequireRole(models.Seller), a.setProductOptions)
+		api.POST("/products/:id/variants", authRequired, middleware.RequireRole(models.Seller), a.createProductVariant)
+		api.PUT("/products/:id/variants/:variantId", authRequired, middleware.RequireRole(models.Seller), a.updateProductVariant)
+		api.DELETE("/products/:id/variants/:variantId", authRequired, middleware.RequireRole(models.Seller), a.deleteProductVariant)
 
 		// Shop routes
 		log.Println("Registering shop routes...")
-		api.GET("/shops", getShops)
-		api.GET("/shops/:id", getShop)
-		api.POST("/shops", middleware.AuthMiddleware(), createShop)
-		api.PUT("/shops/:id", middleware.AuthMiddleware(), updateShop)
-		api.GET("/users/:id/shops", middleware.AuthMiddleware(), getUserShops)
+		api.GET("/shops", a.getShops)
+		api.GET("/shops/:id", a.getShop)
+		api.POST("/shops", authRequired, a.createShop)
+		api.PUT("/shops/:id", authRequired, middleware.RequireRole(models.Seller), a.updateShop)
+		api.GET("/users/:id/shops", authRequired, middleware.RequireSelfOrAdmin("id"), a.getUserShops)
+
+		// Address book routes
+		api.GET("/users/:id/addresses", authRequired, middleware.RequireSelfOrAdmin("id"), a.getUserAddresses)
+		api.POST("/users/:id/addresses", authRequired, middleware.RequireSelfOrAdmin("id"), a.createUserAddress)
+		api.PUT("/users/:id/addresses/:addressId", authRequired, middleware.RequireSelfOrAdmin("id"), a.updateUserAddress)
+		api.DELETE("/users/:id/addresses/:addressId", authRequired, middleware.RequireSelfOrAdmin("id"), a.deleteUserAddress)
+
+		api.GET("/shops/:id/orders", authRequired, a.getShopOrders)
+		api.PUT("/shops/:id/orders/:shopOrderId", authRequired, a.updateShopOrder)
+		api.GET("/shops/:id/shipping-methods", a.getShippingMethods)
+		api.POST("/shops/:id/shipping-methods", authRequired, a.createShippingMethod)
+		api.PUT("/shops/:id/shipping-methods/:methodId", authRequired, a.updateShippingMethod)
+		api.DELETE("/shops/:id/shipping-methods/:methodId", authRequired, a.deleteShippingMethod)
+		api.GET("/shops/:id/coupons", authRequired, a.getShopCoupons)
+		api.POST("/shops/:id/coupons", authRequired, a.createShopCoupon)
+		api.PUT("/shops/:id/coupons/:couponId", authRequired, a.updateShopCoupon)
+		api.DELETE("/shops/:id/coupons/:couponId", authRequired, a.deleteShopCoupon)
 		log.Println("Shop routes registered!")
 
+		// Shipping routes; quotes are priced before the order is placed
+		api.POST("/shipping/quote", a.quoteShipping)
+		api.GET("/orders/:id/shipments", authRequired, a.getOrderShipments)
+		api.POST("/shipments/:id/events", authRequired, a.addTrackingEvent)
+
+		// Coupon routes; buyers check a code before checkout, admins manage
+		// the site-wide coupons
+		api.POST("/coupons/validate", authOptional, a.validateCouponCode)
+		api.GET("/coupons", authRequired, middleware.RequireRole(models.Admin), a.getSiteCoupons)
+		api.POST("/coupons", authRequired, middleware.RequireRole(models.Admin), a.createSiteCoupon)
+		api.PUT("/coupons/:couponId", authRequired, middleware.RequireRole(models.Admin), a.updateSiteCoupon)
+		api.DELETE("/coupons/:couponId", authRequired, middleware.RequireRole(models.Admin), a.deleteSiteCoupon)
+
 		// Order routes
-		api.GET("/orders", getOrders)
-		api.GET("/orders/:id", getOrder)
-		api.POST("/orders", createOrder)
-		api.PUT("/orders/:id", updateOrder)
+		api.GET("/orders", authRequired, a.getOrders)
+		api.GET("/orders/:id", authRequired, a.getOrder)
+		api.POST("/orders", authRequired, a.createOrder)
+		api.PUT("/orders/:id", authRequired, a.updateOrder)
+		api.GET("/orders/:id/history", authRequired, a.getOrderStatusHistory)
+		api.POST("/orders/:id/payment/sync", authRequired, a.syncOrderPayment)
+
+		// Return routes
+		api.GET("/orders/:id/returns", authRequired, a.getOrderReturns)
+		api.POST("/orders/:id/returns", authRequired, a.createReturn)
+		api.GET("/returns/:id", authRequired, a.getReturn)
+		api.PUT("/returns/:id", authRequired, a.updateReturn)
+
+		// Reservation routes
+		api.POST("/reservations", authRequired, a.createReservation)
+		api.GET("/reservations/:id", authRequired, a.getReservation)
+		api.DELETE("/reservations/:id", authRequired, a.releaseReservation)
+
+		// Cart routes, open to anonymous carts identified by X-Cart-Token
+		api.GET("/cart/items", authOptional, a.getCartItems)
+		api.POST("/cart/items", authOptional, a.addCartItem)
+		api.PUT("/cart/items/:itemId", authOptional, a.updateCartItem)
+		api.DELETE("/cart/items/:itemId", authOptional, a.deleteCartItem)
+		api.DELETE("/cart/items", authOptional, a.clearCart)
+		api.POST("/cart/checkout", authRequired, a.checkoutCart)
 
 		// Invoice routes
-		api.GET("/invoices", getInvoices)
-		api.GET("/invoices/:id", getInvoice)
+		api.GET("/invoices", authRequired, a.getInvoices)
+		api.GET("/invoices/:id", authRequired, a.getInvoice)
+		api.GET("/invoices/:id/pdf", authRequired, a.getInvoicePDF)
+		api.GET("/invoices/:id/payments", authRequired, a.getInvoicePayments)
+		api.POST("/invoices/:id/payments", authRequired, middleware.RequireRole(models.Admin), a.createInvoicePayment)
+
+		// Payment provider callbacks, authenticated by their signature
+		api.POST("/payments/webhook/:provider", a.receivePaymentWebhook)
 
 		// User routes
-		api.GET("/users/:id", middleware.AuthMiddleware(), getUser)
-		api.PUT("/users/:id", middleware.AuthMiddleware(), updateUser)
-		api.PUT("/users/:id/avatar", middleware.AuthMiddleware(), updateUserAvatar)
+		api.GET("/users/:id", authRequired, middleware.RequireSelfOrAdmin("id"), a.getUser)
+		api.PUT("/users/:id", authRequired, middleware.RequireSelfOrAdmin("id"), a.updateUser)
+		api.PUT("/users/:id/avatar", authRequired, middleware.RequireSelfOrAdmin("id"), a.updateUserAvatar)
 
 		// Simple health check endpoint
 		api.GET("/health", func(c *gin.Context) {
@@ -98,16 +224,11 @@ func main() {
 		})
 	}
 
-	// Start the server
-	serverAddr := ":" + *port
-	log.Println("Server starting on http://localhost" + serverAddr)
-	if err := r.Run(serverAddr); err != nil {
-		log.Fatal("Failed to start server:", err)
-	}
+	return r
 }
 
 // Auth handlers
-func registerUser(c *gin.Context) {
+func (a *app) registerUser(c *gin.Context) {
 	// Debug message
 	log.Println("DEBUG: registerUser function called")
 
@@ -187,6 +308,11 @@ func registerUser(c *gin.Context) {
 	// Set role if provided, otherwise default to buyer
 	if role, exists := rawData["role"]; exists && role != "" {
 		if roleStr, ok := role.(string); ok {
+			// Admin accounts can't be self-registered
+			if models.Role(roleStr) != models.Buyer && models.Role(roleStr) != models.Seller {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be buyer or seller"})
+				return
+			}
 			user.Role = models.Role(roleStr)
 			log.Printf("DEBUG: Set role to: %s\n", user.Role)
 		} else {
@@ -246,7 +372,7 @@ func registerUser(c *gin.Context) {
 
 	// Check if username already exists
 	var existingUser models.User
-	if err := config.DB.Where("username = ?", user.Username).First(&existingUser).Error; err == nil {
+	if err := a.db.Where("username = ?", user.Username).First(&existingUser).Error; err == nil {
 		log.Printf("DEBUG: Username %s already exists\n", user.Username)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Username already exists",
@@ -255,7 +381,7 @@ func registerUser(c *gin.Context) {
 	}
 
 	// Check if email already exists
-	if err := config.DB.Where("email = ?", user.Email).First(&existingUser).Error; err == nil {
+	if err := a.db.Where("email = ?", user.Email).First(&existingUser).Error; err == nil {
 		log.Printf("DEBUG: Email %s already exists\n", user.Email)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Email already exists",
@@ -275,7 +401,7 @@ func registerUser(c *gin.Context) {
 	user.Password = string(hashedPassword)
 
 	// Create the user in the database
-	if err := config.DB.Create(&user).Error; err != nil {
+	if err := a.db.Create(&user).Error; err != nil {
 		log.Printf("DEBUG: Error creating user: %s\n", err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Error creating user: " + err.Error(),
@@ -283,8 +409,18 @@ func registerUser(c *gin.Context) {
 		return
 	}
 
-	// Generate token for the new user
-	token := fmt.Sprintf("%d_%s_%d", user.ID, user.Email, time.Now().Unix())
+	// Start a session and generate tokens for the new user
+	tokens, err := a.issueSession(c, &user)
+	if err != nil {
+		log.Printf("DEBUG: Error issuing token: %s\n", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Error generating token",
+		})
+		return
+	}
+
+	// Keep what the user put in their cart before signing up
+	a.mergeCartOnLogin(c, &user)
 
 	// Return success response with user data and token
 	c.JSON(http.StatusCreated, gin.H{
@@ -297,11 +433,14 @@ func registerUser(c *gin.Context) {
 			"lastName":  user.LastName,
 			"role":      user.Role,
 		},
-		"token": token,
+		"token":            tokens.AccessToken,
+		"expiresAt":        tokens.ExpiresAt,
+		"refreshToken":     tokens.RefreshToken,
+		"refreshExpiresAt": tokens.RefreshExpiresAt,
 	})
 }
 
-func loginUser(c *gin.Context) {
+func (a *app) loginUser(c *gin.Context) {
 	var loginData struct {
 		Email    string `json:"email" binding:"required"`
 		Password string `json:"password" binding:"required"`
@@ -324,7 +463,7 @@ func loginUser(c *gin.Context) {
 
 	// Find user by email
 	var user models.User
-	result := config.DB.Where("email = ?", loginData.Email).First(&user)
+	result := a.db.Where("email = ?", loginData.Email).First(&user)
 	if result.Error != nil {
 		// Don't reveal if the email exists or not for security reasons
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
@@ -341,30 +480,159 @@ func loginUser(c *gin.Context) {
 	// Optionally load any relationships if needed
 	// For example, if the user is a seller, you might want to load their shop
 	if user.Role == models.Seller {
-		config.DB.Model(&user).Association("Shop").Find(&user.Shop)
+		a.db.Model(&user).Association("Shop").Find(&user.Shop)
 	}
 
-	// Create a simple token (in a real app, use JWT)
-	token := fmt.Sprintf("%d_%s_%d", user.ID, user.Username, time.Now().Unix())
+	// Start a session and issue a signed access token
+	tokens, err := a.issueSession(c, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	// Keep what the user put in their cart before logging in
+	a.mergeCartOnLogin(c, &user)
 
 	// Don't send password to client
 	user.Password = ""
 
 	// Return user data and token
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"token":   token,
-		"user":    user,
+		"message":          "Login successful",
+		"token":            tokens.AccessToken,
+		"expiresAt":        tokens.ExpiresAt,
+		"refreshToken":     tokens.RefreshToken,
+		"refreshExpiresAt": tokens.RefreshExpiresAt,
+		"user":             user,
+	})
+}
+
+// sessionTokens is the token pair returned on login, registration and refresh
+type sessionTokens struct {
+	AccessToken      string
+	ExpiresAt        time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// issueSession starts a new refresh-token session for the user and signs an
+// access token bound to it
+func (a *app) issueSession(c *gin.Context, user *models.User) (*sessionTokens, error) {
+	refreshToken, session, err := a.sessions.Create(user.ID, sessionMetaFromRequest(c))
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, expiresAt, err := a.tokens.IssueAccessToken(user, session.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionTokens{
+		AccessToken:      accessToken,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+func sessionMetaFromRequest(c *gin.Context) auth.SessionMeta {
+	return auth.SessionMeta{
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+}
+
+func (a *app) refreshAccessToken(c *gin.Context) {
+	var refreshData struct {
+		RefreshToken string `json:"refreshToken" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&refreshData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Rotate the refresh token; reuse of an old token revokes the whole family
+	refreshToken, session, err := a.sessions.Rotate(refreshData.RefreshToken, sessionMetaFromRequest(c))
+	if err != nil {
+		if errors.Is(err, auth.ErrRefreshTokenInvalid) || errors.Is(err, auth.ErrRefreshTokenExpired) ||
+			errors.Is(err, auth.ErrRefreshTokenReused) || errors.Is(err, auth.ErrSessionRevoked) {
+			log.Printf("Refresh rejected: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token: " + err.Error(), "code": auth.RefreshErrorCode(err)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	var user models.User
+	if err := a.db.First(&user, session.UserID).Error; err != nil {
+		a.sessions.RevokeFamily(session.FamilyID, auth.RevokedLogout)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found", "code": "token_user_not_found"})
+		return
+	}
+
+	accessToken, expiresAt, err := a.tokens.IssueAccessToken(&user, session.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":            accessToken,
+		"expiresAt":        expiresAt,
+		"refreshToken":     refreshToken,
+		"refreshExpiresAt": session.ExpiresAt,
+	})
+}
+
+// logoutUser revokes the session the current access token belongs to
+func (a *app) logoutUser(c *gin.Context) {
+	sessionID := c.GetString("sessionId")
+
+	if err := a.sessions.RevokeFamily(sessionID, auth.RevokedLogout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// logoutAllSessions revokes every session of the current user on all devices
+func (a *app) logoutAllSessions(c *gin.Context) {
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	revoked, err := a.sessions.RevokeUser(user.ID, auth.RevokedLogout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "Logged out from all sessions",
+		"revokedSessions": revoked,
 	})
 }
 
 // Product handlers
-func getProducts(c *gin.Context) {
+func (a *app) getProducts(c *gin.Context) {
 	var products []models.Product
 	var count int64
 
+	// Prices are shown in the shop's currency unless another one is asked for
+	currency, err := parseCurrency(c.Query("currency"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Initialize query builder
-	query := config.DB
+	query := a.db
 
 	// Check if shopId filter is provided
 	shopId := c.Query("shopId")
@@ -415,13 +683,14 @@ func getProducts(c *gin.Context) {
 		}
 	}
 
-	// Handle sorting
+	// Handle sorting, by the price products sell at now
+	now := time.Now()
 	sort := c.Query("sort")
 	switch sort {
 	case "priceLow":
-		query = query.Order("price asc")
+		query = query.Order(clause.OrderBy{Expression: clause.Expr{SQL: effectivePriceSQL + " asc", Vars: []interface{}{now, now}}})
 	case "priceHigh":
-		query = query.Order("price desc")
+		query = query.Order(clause.OrderBy{Expression: clause.Expr{SQL: effectivePriceSQL + " desc", Vars: []interface{}{now, now}}})
 	case "name":
 		query = query.Order("name asc")
 	case "newest":
@@ -443,6 +712,19 @@ func getProducts(c *gin.Context) {
 		return
 	}
 
+	// Subtract stock held by checkout reservations
+	if err := fillAvailableStock(a.db, products); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute available stock"})
+		return
+	}
+	if err := applySalePrices(a.db, products, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sale prices"})
+		return
+	}
+	if !a.showPrices(c, products, currency) {
+		return
+	}
+
 	// Calculate total pages
 	totalPages := int(math.Ceil(float64(count) / float64(limit)))
 
@@ -457,36 +739,51 @@ func getProducts(c *gin.Context) {
 	})
 }
 
-func getProduct(c *gin.Context) {
+func (a *app) getProduct(c *gin.Context) {
 	id := c.Param("id")
 	var product models.Product
 
-	if err := config.DB.First(&product, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	currency, err := parseCurrency(c.Query("currency"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"product": product})
-}
+	if err := a.db.First(&product, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
 
-func createProduct(c *gin.Context) {
-	// Get user ID from context (set by auth middleware)
-	userID, exists := c.Get("userId")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	// Subtract stock held by checkout reservations
+	products := []models.Product{product}
+	if err := fillAvailableStock(a.db, products); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute available stock"})
+		return
+	}
+	now := time.Now()
+	if err := applySalePrices(a.db, products, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sale prices"})
 		return
 	}
 
-	// Get user info to check if seller
-	var user models.User
-	if err := config.DB.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user information"})
+	// The option matrix and the variants to pick from
+	if err := fillVariants(a.db, &products[0], now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get product variants"})
 		return
 	}
+	if !a.showPrices(c, products, currency) {
+		return
+	}
+	product = products[0]
 
-	// Only sellers can create products
-	if user.Role != models.Seller {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only sellers can create products"})
+	c.JSON(http.StatusOK, gin.H{"product": product})
+}
+
+func (a *app) createProduct(c *gin.Context) {
+	// Get user from context (set by auth middleware, role checked by RequireRole)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
@@ -500,7 +797,11 @@ func createProduct(c *gin.Context) {
 	// Log received data for debugging
 	log.Printf("Received product data: %+v", product)
 
+	// Options and variants are added through their own endpoints
+	product.Options, product.Variants = nil, nil
+
 	// Check if a shop ID is provided in the request
+	var shop models.Shop
 	if product.ShopID == 0 {
 		// If not provided, check if user has a shop
 		if user.ShopID == 0 {
@@ -509,40 +810,86 @@ func createProduct(c *gin.Context) {
 		}
 		// Use the user's shop ID if product doesn't specify one
 		product.ShopID = user.ShopID
+		if err := a.db.First(&shop, product.ShopID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid shop ID"})
+			return
+		}
 	} else {
 		// If product contains a shopId, verify that the shop exists
-		var shop models.Shop
-		if err := config.DB.First(&shop, product.ShopID).Error; err != nil {
+		if err := a.db.First(&shop, product.ShopID).Error; err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid shop ID"})
 			return
 		}
 
 		// Ensure the user owns this shop
-		if shop.UserID != user.ID {
+		if shop.UserID != user.ID && user.Role != models.Admin {
 			log.Printf("User ID: %d, Shop UserID: %d", user.ID, shop.UserID)
 			c.JSON(http.StatusForbidden, gin.H{"error": "You can only create products for your own shop"})
 			return
 		}
 	}
 
+	// Products are priced in the currency of their shop; the price was read
+	// before the shop was known
+	if product.Price.Currency != shop.Currency {
+		price, err := money.Parse(product.Price.Decimal(), shop.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+			return
+		}
+		product.Price = price
+	}
+
 	// Set default status if not provided
 	if product.Status == "" {
 		product.Status = models.Available
 	}
 
-	// Save to database
-	if err := config.DB.Create(&product).Error; err != nil {
+	// Reject negative stock
+	if product.Stock < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stock cannot be negative"})
+		return
+	}
+	if product.Weight < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weight cannot be negative"})
+		return
+	}
+
+	// Save to database, booking the initial stock through the inventory ledger
+	// and starting the price history
+	initialStock := product.Stock
+	product.Stock = 0
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&product).Error; err != nil {
+			return err
+		}
+		opening := models.Product{ID: product.ID, Price: money.Zero(product.Price.Currency)}
+		if err := recordPriceChange(tx, &opening, product.Price, &user.ID); err != nil {
+			return err
+		}
+		if initialStock == 0 {
+			return nil
+		}
+		_, err := adjustStock(tx, product.ID, initialStock, models.InventoryMovement{
+			Type:    models.MovementImport,
+			ActorID: &user.ID,
+			Note:    "Initial stock",
+		})
+		return err
+	})
+	if err != nil {
 		log.Printf("Error creating product: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
 		return
 	}
+	product.Stock = initialStock
 
 	c.JSON(http.StatusCreated, gin.H{"product": product})
 }
 
-func updateProduct(c *gin.Context) {
-	// Get user ID from context (set by auth middleware)
-	userID, exists := c.Get("userId")
+func (a *app) updateProduct(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
@@ -553,58 +900,105 @@ func updateProduct(c *gin.Context) {
 	var product models.Product
 
 	// Get the existing product
-	if err := config.DB.First(&product, id).Error; err != nil {
+	if err := a.db.First(&product, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 		return
 	}
 
-	// Get user info
-	var user models.User
-	if err := config.DB.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user information"})
-		return
-	}
-
 	// Get shop info for the product
 	var shop models.Shop
-	if err := config.DB.First(&shop, product.ShopID).Error; err != nil {
+	if err := a.db.First(&shop, product.ShopID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shop information"})
 		return
 	}
 
 	// Verify user owns the shop that owns this product
-	if shop.UserID != user.ID {
+	if shop.UserID != user.ID && user.Role != models.Admin {
 		log.Printf("User ID: %d, Shop UserID: %d, Product ShopID: %d", user.ID, shop.UserID, product.ShopID)
 		c.JSON(http.StatusForbidden, gin.H{"error": "You can only update products from your own shop"})
 		return
 	}
 
-	// Parse the JSON request body for updated fields
-	var updatedProduct models.Product
-	if err := c.ShouldBindJSON(&updatedProduct); err != nil {
+	// Parse the JSON request body for updated fields, reading the price in
+	// the shop's currency. Stock is read on its own so that setting it to 0
+	// can be told apart from leaving it out.
+	var updateRequest struct {
+		models.Product
+		Stock *int `json:"stock"`
+	}
+	updateRequest.Price.Currency = shop.Currency
+	if err := c.ShouldBindJSON(&updateRequest); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	updatedProduct := updateRequest.Product
 
-	// Update fields while preserving ShopID
+	// Update fields while preserving ShopID. Options and variants are
+	// changed through their own endpoints.
 	shopID := product.ShopID
 	updatedProduct.ShopID = shopID
+	updatedProduct.Options, updatedProduct.Variants = nil, nil
+
+	if updateRequest.Stock != nil && *updateRequest.Stock < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stock cannot be negative"})
+		return
+	}
+	if updatedProduct.Weight < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weight cannot be negative"})
+		return
+	}
 
-	// Update in database (only specified fields)
-	if err := config.DB.Model(&product).Updates(updatedProduct).Error; err != nil {
+	// Stock is never overwritten directly; a changed value is booked as a
+	// correction in the inventory ledger. Products sold by variant keep
+	// their stock per variant.
+	newStock := updateRequest.Stock
+	if newStock != nil && *newStock != product.Stock {
+		sold, err := hasVariants(a.db, product.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get product variants"})
+			return
+		}
+		if sold {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Stock of a product with variants is set per variant"})
+			return
+		}
+	}
+
+	// Update in database (only specified fields). A new price goes into the
+	// price history.
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if !updatedProduct.Price.IsZero() {
+			if err := recordPriceChange(tx, &product, updatedProduct.Price, &user.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&product).Updates(updatedProduct).Error; err != nil {
+			return err
+		}
+		if newStock == nil {
+			return nil
+		}
+		_, err := setStock(tx, product.ID, *newStock, models.InventoryMovement{
+			Type:    models.MovementCorrection,
+			ActorID: &user.ID,
+			Note:    "Stock edited on product",
+		})
+		return err
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
 		return
 	}
 
 	// Get updated product from DB
-	config.DB.First(&product, id)
+	a.db.First(&product, id)
 
 	c.JSON(http.StatusOK, gin.H{"product": product})
 }
 
-func deleteProduct(c *gin.Context) {
-	// Get user ID from context (set by auth middleware)
-	userID, exists := c.Get("userId")
+func (a *app) deleteProduct(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
@@ -615,34 +1009,27 @@ func deleteProduct(c *gin.Context) {
 	var product models.Product
 
 	// Get the existing product
-	if err := config.DB.First(&product, id).Error; err != nil {
+	if err := a.db.First(&product, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 		return
 	}
 
-	// Get user info
-	var user models.User
-	if err := config.DB.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user information"})
-		return
-	}
-
 	// Get shop info for the product
 	var shop models.Shop
-	if err := config.DB.First(&shop, product.ShopID).Error; err != nil {
+	if err := a.db.First(&shop, product.ShopID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shop information"})
 		return
 	}
 
 	// Verify user owns the shop that owns this product
-	if shop.UserID != user.ID {
+	if shop.UserID != user.ID && user.Role != models.Admin {
 		log.Printf("User ID: %d, Shop UserID: %d, Product ShopID: %d", user.ID, shop.UserID, product.ShopID)
 		c.JSON(http.StatusForbidden, gin.H{"error": "You can only delete products from your own shop"})
 		return
 	}
 
 	// Delete from database (soft delete by default with GORM)
-	if err := config.DB.Delete(&product).Error; err != nil {
+	if err := a.db.Delete(&product).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete product"})
 		return
 	}
@@ -651,10 +1038,10 @@ func deleteProduct(c *gin.Context) {
 }
 
 // Shop handlers
-func getShops(c *gin.Context) {
+func (a *app) getShops(c *gin.Context) {
 	var shops []models.Shop
 
-	if err := config.DB.Find(&shops).Error; err != nil {
+	if err := a.db.Find(&shops).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shops"})
 		return
 	}
@@ -666,12 +1053,12 @@ func getShops(c *gin.Context) {
 		var productCount int64
 
 		// Get product count for this shop
-		if err := config.DB.Model(&models.Product{}).Where("shop_id = ?", shop.ID).Count(&productCount).Error; err != nil {
+		if err := a.db.Model(&models.Product{}).Where("shop_id = ?", shop.ID).Count(&productCount).Error; err != nil {
 			// If error counting products, just set count to 0
 			productCount = 0
 		}
 
-		if err := config.DB.Where("id = ?", shop.UserID).First(&owner).Error; err != nil {
+		if err := a.db.Where("id = ?", shop.UserID).First(&owner).Error; err != nil {
 			// If we can't find the owner, just continue with the shop data
 			shopsWithOwners = append(shopsWithOwners, gin.H{
 				"id":           shop.ID,
@@ -679,6 +1066,7 @@ func getShops(c *gin.Context) {
 				"description":  shop.Description,
 				"logo":         shop.Logo,
 				"address":      shop.Address,
+				"currency":     shop.Currency,
 				"userId":       shop.UserID,
 				"createdAt":    shop.CreatedAt,
 				"updatedAt":    shop.UpdatedAt,
@@ -692,6 +1080,7 @@ func getShops(c *gin.Context) {
 				"description":  shop.Description,
 				"logo":         shop.Logo,
 				"address":      shop.Address,
+				"currency":     shop.Currency,
 				"userId":       shop.UserID,
 				"createdAt":    shop.CreatedAt,
 				"updatedAt":    shop.UpdatedAt,
@@ -711,33 +1100,12 @@ func getShops(c *gin.Context) {
 }
 
 // Get shops for a specific user
-func getUserShops(c *gin.Context) {
+func (a *app) getUserShops(c *gin.Context) {
+	// Access is limited to the user themselves or an admin by RequireSelfOrAdmin
 	userID := c.Param("id")
 
-	// Verify current user has permission to view this user's shops
-	currentUserIDValue, exists := c.Get("userId")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userId not found in context"})
-		return
-	}
-
-	currentUserID, ok := currentUserIDValue.(string)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid userId format in context"})
-		return
-	}
-
-	// Log the request details for debugging
-	log.Printf("User %s requesting shops for user %s", currentUserID, userID)
-
-	// Only allow users to see their own shops
-	if currentUserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to view other users' shops"})
-		return
-	}
-
 	var shops []models.Shop
-	if err := config.DB.Where("user_id = ?", userID).Find(&shops).Error; err != nil {
+	if err := a.db.Where("user_id = ?", userID).Find(&shops).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user shops"})
 		return
 	}
@@ -749,7 +1117,7 @@ func getUserShops(c *gin.Context) {
 
 	// Get the shop owner details
 	var owner models.User
-	if err := config.DB.First(&owner, userID).Error; err != nil {
+	if err := a.db.First(&owner, userID).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Shop owner not found"})
 		return
 	}
@@ -763,6 +1131,7 @@ func getUserShops(c *gin.Context) {
 			"description": shop.Description,
 			"logo":        shop.Logo,
 			"address":     shop.Address,
+			"currency":    shop.Currency,
 			"userId":      shop.UserID,
 			"createdAt":   shop.CreatedAt,
 			"updatedAt":   shop.UpdatedAt,
@@ -779,18 +1148,18 @@ func getUserShops(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"shops": formattedShops})
 }
 
-func getShop(c *gin.Context) {
+func (a *app) getShop(c *gin.Context) {
 	id := c.Param("id")
 	var shop models.Shop
 
-	if err := config.DB.First(&shop, id).Error; err != nil {
+	if err := a.db.First(&shop, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Shop not found"})
 		return
 	}
 
 	// Get the owner information
 	var owner models.User
-	if err := config.DB.Where("id = ?", shop.UserID).First(&owner).Error; err == nil {
+	if err := a.db.Where("id = ?", shop.UserID).First(&owner).Error; err == nil {
 		c.JSON(http.StatusOK, gin.H{
 			"shop": gin.H{
 				"id":          shop.ID,
@@ -798,6 +1167,7 @@ func getShop(c *gin.Context) {
 				"description": shop.Description,
 				"logo":        shop.Logo,
 				"address":     shop.Address,
+				"currency":    shop.Currency,
 				"userId":      shop.UserID,
 				"createdAt":   shop.CreatedAt,
 				"updatedAt":   shop.UpdatedAt,
@@ -817,39 +1187,22 @@ func getShop(c *gin.Context) {
 	}
 }
 
-func createShop(c *gin.Context) {
+func (a *app) createShop(c *gin.Context) {
 	log.Println("createShop endpoint hit!")
 
-	// Get current user from token
-	userIDValue, exists := c.Get("userId")
-	log.Printf("userIDValue exists: %v, value: %v, type: %T", exists, userIDValue, userIDValue)
-
-	// Convert userId from string to int
-	userIDStr, ok := userIDValue.(string)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid userId format in context"})
-		return
-	}
-
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse userId"})
+	// Get current user from context
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
 	// Log the userId for debugging
-	log.Printf("Creating shop for user ID: %d", userID)
-
-	// Check if user exists
-	var user models.User
-	if err := config.DB.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
-		return
-	}
+	log.Printf("Creating shop for user ID: %d", user.ID)
 
 	// Check if user already has a shop
 	var existingShop models.Shop
-	if err := config.DB.Where("user_id = ?", userID).First(&existingShop).Error; err == nil {
+	if err := a.db.Where("user_id = ?", user.ID).First(&existingShop).Error; err == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User already has a shop"})
 		return
 	}
@@ -860,12 +1213,21 @@ func createShop(c *gin.Context) {
 		Description string `json:"description"`
 		Logo        string `json:"logo"`
 		Address     string `json:"address"`
+		Currency    string `json:"currency"`
 	}
 
 	if err := c.ShouldBindJSON(&shopInput); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	currency, err := parseCurrency(shopInput.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
 
 	// Create shop with user ID
 	shop := models.Shop{
@@ -874,18 +1236,21 @@ func createShop(c *gin.Context) {
 		Description: shopInput.Description,
 		Logo:        shopInput.Logo,
 		Address:     shopInput.Address,
+		Currency:    currency,
 	}
 
-	if err := config.DB.Create(&shop).Error; err != nil {
+	if err := a.db.Create(&shop).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shop"})
 		return
 	}
 
-	// Update user's role to seller and add shopID if not already set
-	if user.Role != "seller" {
-		user.Role = "seller"
+	// Update user's role to seller (admins keep their role) and link the shop
+	if user.Role != models.Seller || user.ShopID == 0 {
+		if user.Role != models.Admin {
+			user.Role = models.Seller
+		}
 		user.ShopID = shop.ID
-		if err := config.DB.Save(&user).Error; err != nil {
+		if err := a.db.Save(user).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user role"})
 			return
 		}
@@ -897,42 +1262,29 @@ func createShop(c *gin.Context) {
 	})
 }
 
-func updateShop(c *gin.Context) {
-	// Get current user from token
-	userIDValue, exists := c.Get("userId")
+func (a *app) updateShop(c *gin.Context) {
+	// Get current user from context
+	user, exists := middleware.CurrentUser(c)
 	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userId not found in context"})
-		return
-	}
-
-	// Convert userId from string to int
-	userIDStr, ok := userIDValue.(string)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid userId format in context"})
-		return
-	}
-
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse userId"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
 	// Log the userId for debugging
-	log.Printf("Updating shop for user ID: %d", userID)
+	log.Printf("Updating shop for user ID: %d", user.ID)
 
 	// Get shop ID from URL
 	shopID := c.Param("id")
 
 	// Check if shop exists and belongs to the user
 	var shop models.Shop
-	if err := config.DB.First(&shop, shopID).Error; err != nil {
+	if err := a.db.First(&shop, shopID).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Shop not found"})
 		return
 	}
 
 	// Verify shop ownership
-	if shop.UserID != uint(userID) {
+	if shop.UserID != user.ID && user.Role != models.Admin {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to update this shop"})
 		return
 	}
@@ -943,12 +1295,18 @@ func updateShop(c *gin.Context) {
 		Description string `json:"description"`
 		Logo        string `json:"logo"`
 		Address     string `json:"address"`
+		Currency    string `json:"currency"`
 	}
 
 	if err := c.ShouldBindJSON(&shopInput); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	currency, err := parseCurrency(shopInput.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Update only non-empty fields
 	updates := make(map[string]interface{})
@@ -964,275 +1322,47 @@ func updateShop(c *gin.Context) {
 	if shopInput.Address != "" {
 		updates["address"] = shopInput.Address
 	}
-
-	// Update the shop
-	if err := config.DB.Model(&shop).Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update shop"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Shop updated successfully",
-		"shop":    shop,
-	})
-}
-
-// Order handlers
-func getOrders(c *gin.Context) {
-	// Get user ID from token
-	userID, err := getUserIDFromToken(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
-		return
-	}
-
-	// Parse pagination parameters
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-
-	// Calculate offset
-	offset := (page - 1) * limit
-
-	// Get orders from database
-	var orders []models.Order
-	var total int64
-
-	// Count total orders
-	if err := db.Model(&models.Order{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count orders"})
-		return
-	}
-
-	// Get paginated orders with associated products
-	if err := db.Preload("OrderItems").Preload("OrderItems.Product").
-		Where("user_id = ?", userID).
-		Offset(offset).Limit(limit).
-		Order("created_at DESC").
-		Find(&orders).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get orders"})
-		return
-	}
-
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(total) / float64(limit)))
-
-	// Return orders with pagination info
-	c.JSON(http.StatusOK, gin.H{
-		"orders": orders,
-		"pagination": gin.H{
-			"total":      total,
-			"totalPages": totalPages,
-			"page":       page,
-			"limit":      limit,
-		},
-	})
-}
-
-func getOrder(c *gin.Context) {
-	// Get user ID from token
-	userID, err := getUserIDFromToken(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
-		return
-	}
-
-	// Get order ID from URL
-	orderID, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
-		return
-	}
-
-	// Get order from database
-	var order models.Order
-	if err := db.Preload("OrderItems").Preload("OrderItems.Product").
-		First(&order, orderID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
-		return
-	}
-
-	// Check if order belongs to the user
-	if order.UserID != uint(userID) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this order"})
-		return
-	}
-
-	// Return order
-	c.JSON(http.StatusOK, gin.H{"order": order})
-}
-
-func createOrder(c *gin.Context) {
-	// Get user ID from token
-	userID, err := getUserIDFromToken(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
-		return
-	}
-
-	// Parse request
-	var orderRequest struct {
-		OrderItems []struct {
-			ProductID uint `json:"productId"`
-			Quantity  int  `json:"quantity"`
-		} `json:"orderItems"`
-		ShippingDetails struct {
-			FullName     string `json:"fullName"`
-			AddressLine1 string `json:"addressLine1"`
-			AddressLine2 string `json:"addressLine2"`
-			City         string `json:"city"`
-			State        string `json:"state"`
-			PostalCode   string `json:"postalCode"`
-			Country      string `json:"country"`
-			Phone        string `json:"phone"`
-		} `json:"shippingDetails"`
-		PaymentInfo struct {
-			BankCode string `json:"bankCode"`
-			VssCode  string `json:"vssCode"`
-		} `json:"paymentInfo"`
-	}
-
-	if err := c.ShouldBindJSON(&orderRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
-		return
-	}
-
-	// Check if there are order items
-	if len(orderRequest.OrderItems) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Order must contain at least one item"})
-		return
-	}
-
-	// Validate shipping address
-	if orderRequest.ShippingDetails.FullName == "" ||
-		orderRequest.ShippingDetails.AddressLine1 == "" ||
-		orderRequest.ShippingDetails.City == "" ||
-		orderRequest.ShippingDetails.State == "" ||
-		orderRequest.ShippingDetails.PostalCode == "" ||
-		orderRequest.ShippingDetails.Country == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Complete shipping details are required"})
-		return
-	}
-
-	// Format the shipping and billing addresses
-	shippingAddress := fmt.Sprintf("%s, %s, %s, %s, %s, %s",
-		orderRequest.ShippingDetails.FullName,
-		orderRequest.ShippingDetails.AddressLine1,
-		orderRequest.ShippingDetails.City,
-		orderRequest.ShippingDetails.State,
-		orderRequest.ShippingDetails.PostalCode,
-		orderRequest.ShippingDetails.Country)
-
-	// Use shipping address as billing address too
-	billingAddress := shippingAddress
-
-	// Create the order
-	order := models.Order{
-		UserID:          uint(userID),
-		Status:          models.Pending,
-		ShippingAddress: shippingAddress,
-		BillingAddress:  billingAddress,
-		OrderItems:      []models.OrderItem{},
-	}
-
-	// Start a transaction
-	tx := db.Begin()
-
-	// Calculate total and create order items
-	var total float64 = 0
-	for _, item := range orderRequest.OrderItems {
-		// Get product to confirm price and check stock
-		var product models.Product
-		if err := tx.First(&product, item.ProductID).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Product not found: " + strconv.FormatUint(uint64(item.ProductID), 10)})
+	if currency != "" && currency != shop.Currency {
+		// Prices and shipping rates are stored in the shop's currency, so it
+		// can only change before there are any
+		var productCount, methodCount int64
+		if err := a.db.Model(&models.Product{}).Where("shop_id = ?", shop.ID).Count(&productCount).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update shop"})
 			return
 		}
-
-		// Check if there's enough stock
-		if product.Stock < item.Quantity {
-			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("Not enough stock for product %s. Available: %d, Requested: %d",
-					product.Name, product.Stock, item.Quantity),
-			})
+		if err := a.db.Model(&models.ShippingMethod{}).Where("shop_id = ?", shop.ID).Count(&methodCount).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update shop"})
 			return
 		}
-
-		// Calculate total price for item
-		itemTotalPrice := product.Price * float64(item.Quantity)
-
-		// Create order item
-		orderItem := models.OrderItem{
-			ProductID:  item.ProductID,
-			Quantity:   item.Quantity,
-			Price:      product.Price,
-			TotalPrice: itemTotalPrice,
+		if productCount > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The currency of a shop with products can't be changed"})
+			return
 		}
-
-		order.OrderItems = append(order.OrderItems, orderItem)
-		total += itemTotalPrice
-
-		// Update product stock
-		product.Stock -= item.Quantity
-		if err := tx.Save(&product).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product stock: " + err.Error()})
+		if methodCount > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The currency of a shop with shipping methods can't be changed"})
 			return
 		}
+		updates["currency"] = currency
 	}
 
-	// Set the total
-	order.Total = total
-
-	// Simulate payment processing
-	// In a real system, we would actually process the payment
-	// but since this is a fake implementation, we'll just simulate it
-	// and always return success
-	paymentID := fmt.Sprintf("PAY-%d-%d", userID, time.Now().Unix())
-	order.PaymentID = paymentID
-	order.Status = models.Paid
-
-	// Create the order
-	if err := tx.Create(&order).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order: " + err.Error()})
-		return
-	}
-
-	// Commit the transaction
-	if err := tx.Commit().Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction: " + err.Error()})
+	// Update the shop
+	if err := a.db.Model(&shop).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update shop"})
 		return
 	}
 
-	// Return the created order
-	c.JSON(http.StatusCreated, gin.H{
-		"message": "Order created successfully",
-		"order":   order,
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Shop updated successfully",
+		"shop":    shop,
 	})
 }
 
-func updateOrder(c *gin.Context) {
-	id := c.Param("id")
-	c.JSON(http.StatusOK, gin.H{"message": "Update order endpoint", "id": id})
-}
-
-// Invoice handlers
-func getInvoices(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"message": "Get all invoices endpoint"})
-}
-
-func getInvoice(c *gin.Context) {
-	id := c.Param("id")
-	c.JSON(http.StatusOK, gin.H{"message": "Get invoice endpoint", "id": id})
-}
-
 // User handlers
-func getUser(c *gin.Context) {
+func (a *app) getUser(c *gin.Context) {
 	userID := c.Param("id")
 	var user models.User
 
-	if err := config.DB.First(&user, userID).Error; err != nil {
+	if err := a.db.First(&user, userID).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
@@ -1243,12 +1373,12 @@ func getUser(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
-func updateUser(c *gin.Context) {
+func (a *app) updateUser(c *gin.Context) {
 	userID := c.Param("id")
 	var user models.User
 
 	// Find user
-	if err := config.DB.First(&user, userID).Error; err != nil {
+	if err := a.db.First(&user, userID).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
@@ -1271,7 +1401,7 @@ func updateUser(c *gin.Context) {
 	// Check if username or email is already taken (if being changed)
 	if updateData.Username != user.Username {
 		var count int64
-		config.DB.Model(&models.User{}).Where("username = ?", updateData.Username).Count(&count)
+		a.db.Model(&models.User{}).Where("username = ?", updateData.Username).Count(&count)
 		if count > 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Username is already taken"})
 			return
@@ -1280,7 +1410,7 @@ func updateUser(c *gin.Context) {
 
 	if updateData.Email != user.Email {
 		var count int64
-		config.DB.Model(&models.User{}).Where("email = ?", updateData.Email).Count(&count)
+		a.db.Model(&models.User{}).Where("email = ?", updateData.Email).Count(&count)
 		if count > 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Email is already taken"})
 			return
@@ -1296,7 +1426,7 @@ func updateUser(c *gin.Context) {
 	user.Address = updateData.Address
 
 	// Save changes
-	if err := config.DB.Save(&user).Error; err != nil {
+	if err := a.db.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 		return
 	}
@@ -1310,12 +1440,12 @@ func updateUser(c *gin.Context) {
 	})
 }
 
-func updateUserAvatar(c *gin.Context) {
+func (a *app) updateUserAvatar(c *gin.Context) {
 	userID := c.Param("id")
 	var user models.User
 
 	// Find user
-	if err := config.DB.First(&user, userID).Error; err != nil {
+	if err := a.db.First(&user, userID).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
@@ -1339,7 +1469,7 @@ func updateUserAvatar(c *gin.Context) {
 	user.Avatar = avatarData.Avatar
 
 	// Save changes
-	if err := config.DB.Save(&user).Error; err != nil {
+	if err := a.db.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user avatar"})
 		return
 	}
@@ -1352,28 +1482,3 @@ func updateUserAvatar(c *gin.Context) {
 		"user":    user,
 	})
 }
-
-func getUserIDFromToken(c *gin.Context) (int, error) {
-	// Get token from header
-	tokenString := c.GetHeader("Authorization")
-	if tokenString == "" {
-		return 0, errors.New("authorization header is required")
-	}
-
-	// Remove Bearer prefix
-	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-
-	// Extract user ID from token (format: "<userId>_<username>_<timestamp>")
-	parts := strings.Split(tokenString, "_")
-	if len(parts) < 1 {
-		return 0, errors.New("invalid token format")
-	}
-
-	// Parse user ID to integer
-	userID, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return 0, errors.New("invalid user ID in token")
-	}
-
-	return userID, nil
-}
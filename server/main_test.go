@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tobe_shop/server/auth"
+	"tobe_shop/server/config"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const testPassword = "secret123"
+
+// testEnv is an app wired to its own in-memory SQLite database
+type testEnv struct {
+	t      *testing.T
+	db     *gorm.DB
+	router *gin.Engine
+	// app is the app behind router, for running its background jobs
+	app *app
+	// gateway is the fake payment provider; charges succeed right away
+	// unless AutoConfirm is turned off
+	gateway *payments.Fake
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	database, err := config.OpenDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	sqlDB, err := database.DB()
+	if err != nil {
+		t.Fatalf("get sql db: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	tokens, err := auth.NewManager(auth.Config{
+		Keys:           []auth.Key{{ID: "test", Secret: []byte("test-signing-key-0123456789abcdef")}},
+		Issuer:         "tobe-shop-test",
+		Audience:       "tobe-shop-test",
+		AccessTokenTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("create token manager: %v", err)
+	}
+	sessions := auth.NewSessionStore(database, time.Hour)
+
+	gateway := payments.NewFake([]byte("test-payments-secret"), true)
+	gateways := payments.NewRegistry(gateway)
+	a := newApp(database, tokens, sessions, gateways)
+
+	return &testEnv{
+		t:       t,
+		db:      database,
+		router:  a.router(),
+		app:     a,
+		gateway: gateway,
+	}
+}
+
+// createUser inserts a user with testPassword
+func (e *testEnv) createUser(username string, role models.Role) *models.User {
+	e.t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		e.t.Fatalf("hash password: %v", err)
+	}
+	user := models.User{
+		Username:  username,
+		Email:     username + "@example.com",
+		Password:  string(hash),
+		Role:      role,
+		FirstName: username,
+		LastName:  "Test",
+	}
+	if err := e.db.Create(&user).Error; err != nil {
+		e.t.Fatalf("create user: %v", err)
+	}
+	return &user
+}
+
+// usd returns amount in the default currency
+func usd(amount float64) money.Money {
+	return money.FromFloat(amount, money.DefaultCurrency)
+}
+
+// createProduct inserts a shop owned by seller (if needed) and a product in it
+func (e *testEnv) createProduct(seller *models.User, name string, price float64, stock int) *models.Product {
+	e.t.Helper()
+	if seller.ShopID == 0 {
+		shop := models.Shop{Name: seller.Username + "'s shop", UserID: seller.ID}
+		if err := e.db.Create(&shop).Error; err != nil {
+			e.t.Fatalf("create shop: %v", err)
+		}
+		seller.ShopID = shop.ID
+		if err := e.db.Save(seller).Error; err != nil {
+			e.t.Fatalf("link shop: %v", err)
+		}
+	}
+	product := models.Product{
+		Name:   name,
+		Price:  usd(price),
+		Stock:  stock,
+		Status: models.Available,
+		ShopID: seller.ShopID,
+	}
+	if err := e.db.Create(&product).Error; err != nil {
+		e.t.Fatalf("create product: %v", err)
+	}
+	return &product
+}
+
+// login authenticates through the API and returns the access token
+func (e *testEnv) login(user *models.User) string {
+	e.t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	e.do(http.MethodPost, "/api/login", "", gin.H{"email": user.Email, "password": testPassword}, http.StatusOK, &resp)
+	return resp.Token
+}
+
+// do sends a JSON request, checks the status code and decodes the response
+func (e *testEnv) do(method, path, token string, body interface{}, wantStatus int, out interface{}) *httptest.ResponseRecorder {
+	e.t.Helper()
+	return e.doWithHeader(method, path, token, nil, body, wantStatus, out)
+}
+
+// doWithHeader is do with extra request headers
+func (e *testEnv) doWithHeader(method, path, token string, header http.Header, body interface{}, wantStatus int, out interface{}) *httptest.ResponseRecorder {
+	e.t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			e.t.Fatalf("encode body: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+
+	if w.Code != wantStatus {
+		e.t.Fatalf("%s %s: status = %d, want %d, body: %s", method, path, w.Code, wantStatus, w.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			e.t.Fatalf("decode response: %v", err)
+		}
+	}
+	return w
+}
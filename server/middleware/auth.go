@@ -4,62 +4,97 @@ import (
 	"log"
 	"net/http"
 	"strings"
-	"tobe_shop/server/config"
+	"tobe_shop/server/auth"
 	"tobe_shop/server/models"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-// AuthMiddleware verifies the token in the Authorization header
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware verifies the token in the Authorization header, checks that
+// its session is still active and loads the user from db
+func AuthMiddleware(db *gorm.DB, tokens *auth.Manager, sessions *auth.SessionStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		log.Println("Auth middleware activated for:", c.Request.URL.Path)
 
-		authHeader := c.GetHeader("Authorization")
-		log.Printf("Authorization header: %s", authHeader)
-
-		if authHeader == "" {
+		if c.GetHeader("Authorization") == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
 			c.Abort()
 			return
 		}
 
-		// Extract the token from the Authorization header
-		// Format: "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header format must be Bearer <token>"})
-			c.Abort()
+		authenticate(c, db, tokens, sessions)
+	}
+}
+
+// OptionalAuthMiddleware lets anonymous requests through, but authenticates
+// requests that do carry an Authorization header exactly like AuthMiddleware,
+// rejecting invalid tokens rather than treating them as anonymous
+func OptionalAuthMiddleware(db *gorm.DB, tokens *auth.Manager, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
 			return
 		}
 
-		tokenString := parts[1]
-		log.Printf("Token extracted: %s", tokenString)
+		authenticate(c, db, tokens, sessions)
+	}
+}
 
-		// In a real app, this would validate a JWT token
-		// Here we're using a simple token format: "<userId>_<username>_<timestamp>"
-		parts = strings.Split(tokenString, "_")
-		if len(parts) != 3 {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token format"})
-			c.Abort()
-			return
-		}
+// authenticate checks the Authorization header and sets the current user in
+// the context, aborting with 401 when the token or its session is not valid
+func authenticate(c *gin.Context, db *gorm.DB, tokens *auth.Manager, sessions *auth.SessionStore) {
+	authHeader := c.GetHeader("Authorization")
 
-		userID := parts[0]
-		log.Printf("User ID extracted from token: %s", userID)
+	// Extract the token from the Authorization header
+	// Format: "Bearer <token>"
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header format must be Bearer <token>"})
+		c.Abort()
+		return
+	}
 
-		// Find user in the database
-		var user models.User
-		if err := config.DB.First(&user, userID).Error; err != nil {
-			log.Printf("Failed to find user with ID: %s, error: %v", userID, err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
-		}
+	tokenString := parts[1]
 
-		// Set the user ID in the context
-		c.Set("userId", userID)
-		log.Printf("Set userId in context: %s", userID)
-		c.Next()
+	// Verify signature, expiry, issuer and audience of the JWT
+	claims, err := tokens.ParseAccessToken(tokenString)
+	if err != nil {
+		log.Printf("Rejected token: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: " + err.Error(), "code": auth.ErrorCode(err)})
+		c.Abort()
+		return
 	}
+
+	userID := claims.Subject
+	log.Printf("User ID extracted from token: %s", userID)
+
+	// Reject tokens whose session was logged out or revoked
+	active, err := sessions.IsActive(claims.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify session"})
+		c.Abort()
+		return
+	}
+	if !active {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked", "code": "session_revoked"})
+		c.Abort()
+		return
+	}
+
+	// Find user in the database
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		log.Printf("Failed to find user with ID: %s, error: %v", userID, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token", "code": "token_user_not_found"})
+		c.Abort()
+		return
+	}
+
+	// Set the user, user ID and session in the context
+	c.Set(CurrentUserKey, &user)
+	c.Set("userId", userID)
+	c.Set("sessionId", claims.SessionID)
+	log.Printf("Set userId in context: %s", userID)
+	c.Next()
 }
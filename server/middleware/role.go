@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CurrentUserKey is the gin context key holding the authenticated *models.User
+const CurrentUserKey = "currentUser"
+
+// CurrentUser returns the user stored in the context by AuthMiddleware
+func CurrentUser(c *gin.Context) (*models.User, bool) {
+	value, exists := c.Get(CurrentUserKey)
+	if !exists {
+		return nil, false
+	}
+	user, ok := value.(*models.User)
+	return user, ok && user != nil
+}
+
+// RequireRole allows the request only if the authenticated user has one of
+// the given roles. Admins are always allowed. Must run after AuthMiddleware.
+func RequireRole(roles ...models.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := CurrentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		if user.Role == models.Admin {
+			c.Next()
+			return
+		}
+		for _, role := range roles {
+			if user.Role == role {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You do not have permission to perform this action"})
+	}
+}
+
+// RequireAdmin allows the request only for admins
+func RequireAdmin() gin.HandlerFunc {
+	return RequireRole()
+}
+
+// RequireSelfOrAdmin allows the request only if the user ID in the named URL
+// parameter is the authenticated user's, or the user is an admin
+func RequireSelfOrAdmin(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := CurrentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		if user.Role == models.Admin {
+			c.Next()
+			return
+		}
+
+		targetID, err := strconv.ParseUint(c.Param(param), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		if uint(targetID) != user.ID {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You can only access your own account"})
+			return
+		}
+
+		c.Next()
+	}
+}
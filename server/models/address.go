@@ -0,0 +1,67 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// AddressFields is a postal address. Address book entries and the address
+// snapshots kept on orders share it.
+type AddressFields struct {
+	FullName     string `gorm:"size:100" json:"fullName"`
+	AddressLine1 string `gorm:"size:255" json:"addressLine1"`
+	AddressLine2 string `gorm:"size:255" json:"addressLine2"`
+	City         string `gorm:"size:100" json:"city"`
+	State        string `gorm:"size:100" json:"state"`
+	PostalCode   string `gorm:"size:20" json:"postalCode"`
+	Country      string `gorm:"size:100" json:"country"`
+	Phone        string `gorm:"size:30" json:"phone"`
+}
+
+// IsComplete reports whether every required field is filled in; the second
+// address line and the phone number are optional
+func (f AddressFields) IsComplete() bool {
+	return f.FullName != "" && f.AddressLine1 != "" && f.City != "" &&
+		f.State != "" && f.PostalCode != "" && f.Country != ""
+}
+
+// IsZero reports whether no field is filled in
+func (f AddressFields) IsZero() bool {
+	return f == AddressFields{}
+}
+
+// Lines returns the address as it is written on a parcel
+func (f AddressFields) Lines() []string {
+	locality := strings.TrimSpace(f.State + " " + f.PostalCode)
+	if f.City != "" && locality != "" {
+		locality = f.City + ", " + locality
+	} else {
+		locality = f.City + locality
+	}
+
+	var lines []string
+	for _, line := range []string{f.FullName, f.AddressLine1, f.AddressLine2, locality, f.Country, f.Phone} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// String returns the address on one line
+func (f AddressFields) String() string {
+	return strings.Join(f.Lines(), ", ")
+}
+
+// Address is an entry in a user's address book. At most one address per
+// user is the default for shipping and one for billing.
+type Address struct {
+	ID                uint      `gorm:"primarykey" json:"id"`
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+	UserID            uint      `gorm:"not null;index" json:"userId"`
+	Label             string    `gorm:"size:50" json:"label"`
+	AddressFields     `gorm:"embedded"`
+	IsDefaultShipping bool `gorm:"not null;default:false" json:"isDefaultShipping"`
+	IsDefaultBilling  bool `gorm:"not null;default:false" json:"isDefaultBilling"`
+}
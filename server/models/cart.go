@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+	"tobe_shop/server/money"
+)
+
+// Cart is a shopping cart kept on the server. A signed-in user has one cart;
+// anonymous carts have no user and are identified by their Token until they
+// are merged into a user's cart at login.
+type Cart struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	UserID    *uint      `gorm:"uniqueIndex" json:"userId,omitempty"`
+	Token     string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Items     []CartItem `json:"items"`
+}
+
+type CartItem struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	CartID    uint      `gorm:"not null;uniqueIndex:idx_cart_item_variant" json:"cartId"`
+	ProductID uint      `gorm:"not null;uniqueIndex:idx_cart_item_variant" json:"productId"`
+	Product   *Product  `json:"product,omitempty"`
+	// VariantID is the variant of a product sold by variant, or 0
+	VariantID uint `gorm:"not null;default:0;uniqueIndex:idx_cart_item_variant" json:"variantId,omitempty"`
+	Quantity  int  `gorm:"not null" json:"quantity"`
+	// PriceAtAdd is the unit price the buyer saw when the item was added or
+	// last updated, so price changes can be pointed out before checkout
+	PriceAtAdd money.Money `gorm:"embedded;embeddedPrefix:price_at_add_" json:"priceAtAdd"`
+}
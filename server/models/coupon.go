@@ -0,0 +1,98 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"tobe_shop/server/money"
+
+	"gorm.io/gorm"
+)
+
+// CouponType is how a coupon works out its discount
+type CouponType string
+
+const (
+	// CouponPercentage takes Percent off the price of the items it applies to
+	CouponPercentage CouponType = "percentage"
+	// CouponFixed takes Amount off the items it applies to, together
+	CouponFixed CouponType = "fixed"
+)
+
+// IsValid reports whether t is a known coupon type
+func (t CouponType) IsValid() bool {
+	switch t {
+	case CouponPercentage, CouponFixed:
+		return true
+	}
+	return false
+}
+
+// Coupon is a discount code buyers enter at checkout. Coupons of a shop
+// only apply to its products, site-wide coupons (no ShopID) to any; either
+// can be narrowed to a product category or a single product.
+type Coupon struct {
+	ID          uint           `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	Code        string         `gorm:"size:50;not null;uniqueIndex" json:"code"`
+	Description string         `gorm:"size:255" json:"description"`
+	Type        CouponType     `gorm:"size:20;not null" json:"type"`
+	// Percent is the discount of percentage coupons, e.g. 10 for 10% off
+	Percent float64 `gorm:"not null;default:0" json:"percent"`
+	// Amount is the discount of fixed coupons
+	Amount    money.Money `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	ShopID    *uint       `gorm:"index" json:"shopId,omitempty"`
+	Category  string      `gorm:"size:50;not null;default:''" json:"category"`
+	ProductID *uint       `json:"productId,omitempty"`
+	// MinOrderValue is what the items the coupon applies to must cost at
+	// least
+	MinOrderValue money.Money `gorm:"embedded;embeddedPrefix:min_order_value_" json:"minOrderValue"`
+	// UsageLimit and PerUserLimit cap how often the coupon is used in all
+	// and by one buyer; 0 means no limit
+	UsageLimit   int        `gorm:"not null;default:0" json:"usageLimit"`
+	PerUserLimit int        `gorm:"not null;default:0" json:"perUserLimit"`
+	UsedCount    int        `gorm:"not null;default:0" json:"usedCount"`
+	StartsAt     *time.Time `json:"startsAt,omitempty"`
+	EndsAt       *time.Time `json:"endsAt,omitempty"`
+	Active       bool       `gorm:"not null" json:"active"`
+}
+
+// NormalizeCouponCode returns code the way coupon codes are stored: trimmed
+// and in upper case
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ValidAt reports whether the coupon can be used at now
+func (c *Coupon) ValidAt(now time.Time) bool {
+	if !c.Active {
+		return false
+	}
+	if c.StartsAt != nil && now.Before(*c.StartsAt) {
+		return false
+	}
+	return c.EndsAt == nil || now.Before(*c.EndsAt)
+}
+
+// AppliesTo reports whether the coupon applies to a product of category
+// sold by a shop
+func (c *Coupon) AppliesTo(shopID, productID uint, category string) bool {
+	if c.ShopID != nil && *c.ShopID != shopID {
+		return false
+	}
+	if c.ProductID != nil && *c.ProductID != productID {
+		return false
+	}
+	return c.Category == "" || strings.EqualFold(c.Category, category)
+}
+
+// CouponRedemption records a coupon used on an order, for the usage limits
+type CouponRedemption struct {
+	ID        uint        `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time   `json:"createdAt"`
+	CouponID  uint        `gorm:"not null;index" json:"couponId"`
+	UserID    uint        `gorm:"not null;index" json:"userId"`
+	OrderID   uint        `gorm:"not null;uniqueIndex" json:"orderId"`
+	Discount  money.Money `gorm:"embedded;embeddedPrefix:discount_" json:"discount"`
+}
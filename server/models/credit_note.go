@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+	"tobe_shop/server/money"
+)
+
+// CreditNote reduces what is owed on an invoice, e.g. for returned goods.
+// The money it gives back is refunded against the invoice's payments.
+type CreditNote struct {
+	ID              uint            `gorm:"primarykey" json:"id"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+	Number          string          `gorm:"size:32;index" json:"number"`
+	InvoiceID       uint            `gorm:"not null;index" json:"invoiceId"`
+	ReturnRequestID *uint           `gorm:"index" json:"returnRequestId,omitempty"`
+	Amount          money.Money     `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Reason          string          `gorm:"size:255" json:"reason,omitempty"`
+	IssueDate       time.Time       `json:"issueDate"`
+	Refunds         []PaymentRefund `json:"refunds,omitempty"`
+}
+
+// PaymentRefund is the part of a credit note paid back against one payment.
+// Payments taken through a provider are refunded through it; others are
+// refunded by hand. Payments that arrive for an order that was cancelled
+// meanwhile are refunded in full without a credit note.
+type PaymentRefund struct {
+	ID           uint        `gorm:"primarykey" json:"id"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	CreditNoteID *uint       `gorm:"index" json:"creditNoteId,omitempty"`
+	PaymentID    uint        `gorm:"not null;index" json:"paymentId"`
+	Amount       money.Money `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Provider     string      `gorm:"size:30" json:"provider,omitempty"`
+	// RefundReference is the shop's ID for the refund at the provider
+	RefundReference string `gorm:"size:100;uniqueIndex" json:"refundReference"`
+	// Status is pending until the provider has paid the refund back.
+	// Refunds paid back by hand are succeeded from the start.
+	Status PaymentStatus `gorm:"size:20;not null;default:succeeded" json:"status"`
+}
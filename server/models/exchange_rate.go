@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// ExchangeRate is what one unit of the Base currency buys of the Quote
+// currency, e.g. base USD, quote CNY and rate 7.1
+type ExchangeRate struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Base      string    `gorm:"size:3;not null;uniqueIndex:idx_exchange_rate" json:"base"`
+	Quote     string    `gorm:"size:3;not null;uniqueIndex:idx_exchange_rate" json:"quote"`
+	Rate      float64   `gorm:"not null" json:"rate"`
+}
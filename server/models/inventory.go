@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+)
+
+type MovementType string
+
+const (
+	MovementSale          MovementType = "sale"
+	MovementCancelRestock MovementType = "cancel_restock"
+	MovementReturnRestock MovementType = "return_restock"
+	MovementAdjustment    MovementType = "manual_adjustment"
+	MovementImport        MovementType = "import"
+	MovementCorrection    MovementType = "correction"
+)
+
+// IsManual reports whether sellers may record movements of this type by hand
+func (t MovementType) IsManual() bool {
+	switch t {
+	case MovementAdjustment, MovementImport, MovementCorrection:
+		return true
+	}
+	return false
+}
+
+// InventoryMovement is one entry of the inventory ledger. Quantity is the
+// signed change applied to the product's stock.
+type InventoryMovement struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	ProductID uint      `gorm:"not null;index" json:"productId"`
+	// VariantID is set for changes of a variant's stock, which change the
+	// product's stock by the same quantity
+	VariantID   *uint        `gorm:"index" json:"variantId,omitempty"`
+	Type        MovementType `gorm:"size:30;not null" json:"type"`
+	Quantity    int          `gorm:"not null" json:"quantity"`
+	StockBefore int          `gorm:"not null" json:"stockBefore"`
+	StockAfter  int          `gorm:"not null" json:"stockAfter"`
+	OrderID     *uint        `gorm:"index" json:"orderId,omitempty"`
+	ActorID     *uint        `json:"actorId,omitempty"`
+	Actor       *User        `json:"actor,omitempty"`
+	Note        string       `gorm:"size:255" json:"note,omitempty"`
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"time"
+	"tobe_shop/server/money"
 
 	"gorm.io/gorm"
 )
@@ -13,18 +14,39 @@ const (
 	PartiallyPaid InvoiceStatus = "partially_paid"
 	FullyPaid     InvoiceStatus = "fully_paid"
 	Void          InvoiceStatus = "void"
+	// Credited invoices have been cancelled out entirely by credit notes
+	Credited InvoiceStatus = "credited"
 )
 
+// InvoiceStatusFor returns the status of an invoice for total of which paid
+// has been received
+func InvoiceStatusFor(paid, total money.Money) InvoiceStatus {
+	switch {
+	case paid.Cmp(total) >= 0:
+		return FullyPaid
+	case paid.IsPositive():
+		return PartiallyPaid
+	}
+	return Unpaid
+}
+
 type Invoice struct {
 	gorm.Model
-	OrderID     uint          `json:"orderId"`
-	Order       *Order        `json:"order,omitempty"`
-	Amount      float64       `gorm:"not null" json:"amount"`
-	Tax         float64       `gorm:"not null" json:"tax"`
-	TotalAmount float64       `gorm:"not null" json:"totalAmount"`
-	Status      InvoiceStatus `gorm:"size:20;not null" json:"status"`
-	DueDate     time.Time     `json:"dueDate"`
-	IssueDate   time.Time     `json:"issueDate"`
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	Number      string      `gorm:"size:32;index" json:"number"`
+	OrderID     uint        `json:"orderId"`
+	Order       *Order      `json:"order,omitempty"`
+	Amount      money.Money `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Tax         money.Money `gorm:"embedded;embeddedPrefix:tax_" json:"tax"`
+	Discount    money.Money `gorm:"embedded;embeddedPrefix:discount_" json:"discount"`
+	TotalAmount money.Money `gorm:"embedded;embeddedPrefix:total_amount_" json:"totalAmount"`
+	AmountPaid  money.Money `gorm:"embedded;embeddedPrefix:amount_paid_" json:"amountPaid"`
+	// AmountCredited is the total of the invoice's credit notes
+	AmountCredited money.Money   `gorm:"embedded;embeddedPrefix:amount_credited_" json:"amountCredited"`
+	Status         InvoiceStatus `gorm:"size:20;not null" json:"status"`
+	DueDate        time.Time     `json:"dueDate"`
+	IssueDate      time.Time     `json:"issueDate"`
+	Payments       []Payment     `json:"payments,omitempty"`
+	CreditNotes    []CreditNote  `json:"creditNotes,omitempty"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
 }
@@ -2,6 +2,7 @@ package models
 
 import (
 	"time"
+	"tobe_shop/server/money"
 
 	"gorm.io/gorm"
 )
@@ -14,32 +15,79 @@ const (
 	Shipped   OrderStatus = "shipped"
 	Delivered OrderStatus = "delivered"
 	Cancelled OrderStatus = "cancelled"
+	// Refunded orders have been paid back in full through returns
+	Refunded OrderStatus = "refunded"
 )
 
 type Order struct {
 	gorm.Model
-	UserID          uint        `json:"userId"`
-	User            *User       `json:"user,omitempty"`
-	OrderItems      []OrderItem `json:"orderItems"`
-	Total           float64     `gorm:"not null" json:"total"`
+	UserID       uint        `json:"userId"`
+	User         *User       `json:"user,omitempty"`
+	OrderItems   []OrderItem `json:"orderItems"`
+	Total        money.Money `gorm:"embedded;embeddedPrefix:total_" json:"total"`
+	ShippingCost money.Money `gorm:"embedded;embeddedPrefix:shipping_cost_" json:"shippingCost"`
+	Tax          money.Money `gorm:"embedded;embeddedPrefix:tax_" json:"tax"`
+	// Discount is what the coupon named by CouponCode took off the items
+	Discount   money.Money `gorm:"embedded;embeddedPrefix:discount_" json:"discount"`
+	CouponID   *uint       `json:"couponId,omitempty"`
+	CouponCode string      `gorm:"size:50" json:"couponCode,omitempty"`
+	// Currency is what the buyer is charged in. The products were priced in
+	// BaseCurrency and converted at ExchangeRate when the order was placed.
+	Currency        string      `gorm:"size:3;not null;default:'USD'" json:"currency"`
+	BaseCurrency    string      `gorm:"size:3;not null;default:'USD'" json:"baseCurrency"`
+	ExchangeRate    float64     `gorm:"not null;default:1" json:"exchangeRate"`
 	Status          OrderStatus `gorm:"size:20;not null" json:"status"`
 	PaymentID       string      `gorm:"size:100" json:"paymentId"`
 	ShippingAddress string      `gorm:"size:255" json:"shippingAddress"`
 	BillingAddress  string      `gorm:"size:255" json:"billingAddress"`
-	InvoiceID       uint        `json:"invoiceId"`
-	Invoice         *Invoice    `json:"invoice,omitempty"`
+	// ShippingDetails and BillingDetails snapshot the addresses at checkout,
+	// so later address book changes don't rewrite past orders
+	ShippingDetails AddressFields `gorm:"embedded;embeddedPrefix:shipping_" json:"shippingDetails"`
+	BillingDetails  AddressFields `gorm:"embedded;embeddedPrefix:billing_" json:"billingDetails"`
+	InvoiceID       uint          `json:"invoiceId"`
+	Invoice         *Invoice      `json:"invoice,omitempty"`
+	ShopOrders      []ShopOrder   `json:"shopOrders,omitempty"`
 	CreatedAt       time.Time
 	UpdatedAt       time.Time
 }
 
 type OrderItem struct {
 	gorm.Model
-	OrderID    uint     `json:"orderId"`
-	ProductID  uint     `json:"productId"`
-	Product    *Product `json:"product,omitempty"`
-	Quantity   int      `gorm:"not null" json:"quantity"`
-	Price      float64  `gorm:"not null" json:"price"`
-	TotalPrice float64  `gorm:"not null" json:"totalPrice"`
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
+	OrderID     uint     `json:"orderId"`
+	ShopOrderID *uint    `gorm:"index" json:"shopOrderId,omitempty"`
+	ProductID   uint     `json:"productId"`
+	Product     *Product `json:"product,omitempty"`
+	// VariantID is set for products sold by variant; SKU and VariantTitle
+	// keep what was ordered should the variant change later
+	VariantID    *uint           `gorm:"index" json:"variantId,omitempty"`
+	Variant      *ProductVariant `json:"variant,omitempty"`
+	SKU          string          `gorm:"size:64" json:"sku,omitempty"`
+	VariantTitle string          `gorm:"size:160" json:"variantTitle,omitempty"`
+	Quantity     int             `gorm:"not null" json:"quantity"`
+	Price        money.Money     `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+	TotalPrice   money.Money     `gorm:"embedded;embeddedPrefix:total_price_" json:"totalPrice"`
+	// Discount is the order's coupon discount on the line, taken off
+	// TotalPrice before tax
+	Discount money.Money `gorm:"embedded;embeddedPrefix:discount_" json:"discount"`
+	TaxRate  float64     `gorm:"not null;default:0" json:"taxRate"`
+	Tax      money.Money `gorm:"embedded;embeddedPrefix:tax_" json:"tax"`
+	// TaxInclusive tells whether Tax is part of TotalPrice or charged on top
+	TaxInclusive bool `gorm:"not null;default:false" json:"taxInclusive"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// ChargedFor returns what the buyer paid for quantity of the item: its
+// price less its share of the discount, plus its share of any tax charged
+// on top of the price
+func (i *OrderItem) ChargedFor(quantity int) money.Money {
+	amount := i.Price.Times(quantity)
+	if i.Quantity > 0 {
+		share := float64(quantity) / float64(i.Quantity)
+		amount = amount.Sub(i.Discount.Scale(share))
+		if !i.TaxInclusive {
+			amount = amount.Add(i.Tax.Scale(share))
+		}
+	}
+	return amount
 }
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Cancelled and Refunded are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	Pending:   {Paid, Cancelled},
+	Paid:      {Shipped, Cancelled, Refunded},
+	Shipped:   {Delivered, Refunded},
+	Delivered: {Refunded},
+}
+
+// IsValid reports whether the status is one of the known order statuses
+func (s OrderStatus) IsValid() bool {
+	switch s {
+	case Pending, Paid, Shipped, Delivered, Cancelled, Refunded:
+		return true
+	}
+	return false
+}
+
+// NextStatuses returns the statuses the order may move to from s
+func (s OrderStatus) NextStatuses() []OrderStatus {
+	return orderTransitions[s]
+}
+
+// CanTransitionTo reports whether moving from s to next is allowed
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleasesStock reports whether moving an order into s returns its items to
+// stock. Refunded orders don't: their items are restocked one return at a
+// time as the goods come back.
+func (s OrderStatus) ReleasesStock() bool {
+	return s == Cancelled
+}
+
+// OrderStatusHistory records one status change of an order
+type OrderStatusHistory struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	OrderID   uint      `gorm:"not null;index" json:"orderId"`
+	// ShopOrderID is set for changes of one shop's part of the order
+	ShopOrderID *uint       `gorm:"index" json:"shopOrderId,omitempty"`
+	FromStatus  OrderStatus `gorm:"size:20" json:"fromStatus"`
+	ToStatus    OrderStatus `gorm:"size:20;not null" json:"toStatus"`
+	ChangedByID *uint       `json:"changedById,omitempty"`
+	ChangedBy   *User       `json:"changedBy,omitempty"`
+	Reason      string      `gorm:"size:255" json:"reason,omitempty"`
+}
+
+// TableName keeps the history in a singular table name
+func (OrderStatusHistory) TableName() string {
+	return "order_status_history"
+}
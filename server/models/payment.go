@@ -0,0 +1,63 @@
+package models
+
+import (
+	"time"
+	"tobe_shop/server/money"
+)
+
+type PaymentStatus string
+
+const (
+	PaymentPending   PaymentStatus = "pending"
+	PaymentSucceeded PaymentStatus = "succeeded"
+	PaymentFailed    PaymentStatus = "failed"
+)
+
+// IsValid reports whether s is a known payment status
+func (s PaymentStatus) IsValid() bool {
+	switch s {
+	case PaymentPending, PaymentSucceeded, PaymentFailed:
+		return true
+	}
+	return false
+}
+
+type PaymentMethod string
+
+const (
+	PaymentCard         PaymentMethod = "card"
+	PaymentBankTransfer PaymentMethod = "bank_transfer"
+	PaymentCash         PaymentMethod = "cash"
+	PaymentAlipay       PaymentMethod = "alipay"
+)
+
+// IsValid reports whether m is a known payment method
+func (m PaymentMethod) IsValid() bool {
+	switch m {
+	case PaymentCard, PaymentBankTransfer, PaymentCash, PaymentAlipay:
+		return true
+	}
+	return false
+}
+
+// Payment is money received, or attempted, against an invoice. Only
+// succeeded payments count towards the invoice's AmountPaid.
+type Payment struct {
+	ID        uint          `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+	InvoiceID uint          `gorm:"not null;index" json:"invoiceId"`
+	Amount    money.Money   `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	Method    PaymentMethod `gorm:"size:30;not null" json:"method"`
+	// Provider is the payment gateway that handled the payment, empty for
+	// payments recorded by hand
+	Provider          string        `gorm:"size:30" json:"provider,omitempty"`
+	ProviderReference string        `gorm:"size:100;index" json:"providerReference,omitempty"`
+	Status            PaymentStatus `gorm:"size:20;not null" json:"status"`
+	PaidAt            *time.Time    `json:"paidAt,omitempty"`
+	// AmountRefunded is how much of the payment has been given back
+	AmountRefunded money.Money `gorm:"embedded;embeddedPrefix:amount_refunded_" json:"amountRefunded"`
+	RecordedByID   *uint       `json:"recordedById,omitempty"`
+	RecordedBy     *User       `json:"recordedBy,omitempty"`
+	Note           string      `gorm:"size:255" json:"note,omitempty"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+	"tobe_shop/server/money"
+)
+
+type PaymentEventResult string
+
+const (
+	// EventApplied events changed the state of their payment
+	EventApplied PaymentEventResult = "applied"
+	// EventIgnored events arrived for a payment that was already settled,
+	// or reported no final outcome
+	EventIgnored PaymentEventResult = "ignored"
+	// EventUnmatched events name a charge the shop doesn't know
+	EventUnmatched PaymentEventResult = "unmatched"
+	// EventRejected events contradict the payment, e.g. report another
+	// amount, or can't be applied to its invoice any more
+	EventRejected PaymentEventResult = "rejected"
+	// EventRefunded events report a payment for an order that was
+	// cancelled meanwhile; the money is refunded
+	EventRefunded PaymentEventResult = "refunded"
+)
+
+// PaymentEvent is a verified callback received from a payment provider,
+// kept exactly as it arrived for audit. The provider's event ID is unique
+// per provider, so a callback delivered twice is only processed once.
+type PaymentEvent struct {
+	ID         uint               `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	Provider   string             `gorm:"size:30;not null;uniqueIndex:idx_payment_event" json:"provider"`
+	EventID    string             `gorm:"size:128;not null;uniqueIndex:idx_payment_event" json:"eventId"`
+	Reference  string             `gorm:"size:100;index" json:"reference"`
+	Status     string             `gorm:"size:20" json:"status"`
+	Amount     money.Money        `gorm:"embedded;embeddedPrefix:amount_" json:"amount"`
+	OccurredAt time.Time          `json:"occurredAt"`
+	PaymentID  *uint              `gorm:"index" json:"paymentId,omitempty"`
+	Result     PaymentEventResult `gorm:"size:20" json:"result"`
+	Detail     string             `gorm:"size:255" json:"detail,omitempty"`
+	Payload    string             `gorm:"type:text" json:"payload"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+	"tobe_shop/server/money"
+
+	"gorm.io/gorm"
+)
+
+// PriceHistory records a change of a product's regular price. The first
+// entry of a product is the price it was created with.
+type PriceHistory struct {
+	ID            uint        `gorm:"primarykey" json:"id"`
+	CreatedAt     time.Time   `json:"createdAt"`
+	ProductID     uint        `gorm:"not null;index" json:"productId"`
+	PreviousPrice money.Money `gorm:"embedded;embeddedPrefix:previous_price_" json:"previousPrice"`
+	Price         money.Money `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+	// The history is shown on the public product page, so who changed the
+	// price is kept to the database
+	ChangedByID *uint `json:"-"`
+}
+
+// TableName keeps the history in a singular table name
+func (PriceHistory) TableName() string {
+	return "price_history"
+}
+
+// SalePrice is a reduced price a product sells at from StartsAt until
+// EndsAt. A product has at most one sale running at a time.
+type SalePrice struct {
+	ID          uint           `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	ProductID   uint           `gorm:"not null;index" json:"productId"`
+	Price       money.Money    `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+	StartsAt    time.Time      `gorm:"not null;index" json:"startsAt"`
+	EndsAt      time.Time      `gorm:"not null;index" json:"endsAt"`
+	CreatedByID *uint          `json:"-"`
+}
+
+// RunsAt reports whether the sale is on at the given time
+func (s *SalePrice) RunsAt(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
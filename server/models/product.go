@@ -2,6 +2,7 @@ package models
 
 import (
 	"time"
+	"tobe_shop/server/money"
 
 	"gorm.io/gorm"
 )
@@ -21,12 +22,30 @@ type Product struct {
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"deletedAt,omitempty"`
 	Name        string         `gorm:"size:100;not null" json:"name"`
 	Description string         `gorm:"size:500" json:"description"`
-	Price       float64        `gorm:"not null" json:"price"`
+	Price       money.Money    `gorm:"embedded;embeddedPrefix:price_" json:"price"`
 	Stock       int            `gorm:"not null" json:"stock"`
-	Image       string         `gorm:"size:255" json:"image"`   // Single main image URL
-	Category    string         `gorm:"size:50" json:"category"` // Product category
+	Weight      float64        `gorm:"not null;default:0" json:"weight"` // Shipping weight in kg
+	Image       string         `gorm:"size:255" json:"image"`            // Single main image URL
+	Category    string         `gorm:"size:50" json:"category"`          // Product category
 	Status      ProductStatus  `gorm:"size:20;not null" json:"status"`
 	ShopID      uint           `json:"shopId"`
 	Shop        *Shop          `json:"shop,omitempty"`
 	OrderItems  []*OrderItem   `json:"orderItems,omitempty"`
+	// Options and Variants are set for products sold in sizes, colours and
+	// the like
+	Options  []ProductOption  `json:"options,omitempty"`
+	Variants []ProductVariant `json:"variants,omitempty"`
+
+	// AvailableStock is Stock minus active checkout reservations. It is
+	// computed per request and not stored.
+	AvailableStock int `gorm:"-" json:"availableStock"`
+	// Currency is the currency Price is shown in. When the buyer asked for
+	// another currency than the shop's, BasePrice is the price in the shop's
+	// currency. Both are filled in per request.
+	Currency  string       `gorm:"-" json:"currency"`
+	BasePrice *money.Money `gorm:"-" json:"basePrice,omitempty"`
+	// While a sale is on, Price is the sale price and RegularPrice the price
+	// it returns to at SaleEndsAt. Filled in per request.
+	RegularPrice *money.Money `gorm:"-" json:"regularPrice,omitempty"`
+	SaleEndsAt   *time.Time   `gorm:"-" json:"saleEndsAt,omitempty"`
 }
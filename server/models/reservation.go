@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+)
+
+type ReservationStatus string
+
+const (
+	ReservationActive   ReservationStatus = "active"
+	ReservationConsumed ReservationStatus = "consumed"
+	ReservationReleased ReservationStatus = "released"
+	ReservationExpired  ReservationStatus = "expired"
+)
+
+// Reservation holds stock for a buyer during checkout until it expires or
+// is consumed by an order
+type Reservation struct {
+	ID        uint              `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	UserID    uint              `gorm:"not null;index" json:"userId"`
+	Status    ReservationStatus `gorm:"size:20;not null;index" json:"status"`
+	ExpiresAt time.Time         `gorm:"not null;index" json:"expiresAt"`
+	OrderID   *uint             `json:"orderId,omitempty"`
+	Items     []ReservationItem `json:"items"`
+}
+
+type ReservationItem struct {
+	ID            uint     `gorm:"primarykey" json:"id"`
+	ReservationID uint     `gorm:"not null;index" json:"reservationId"`
+	ProductID     uint     `gorm:"not null;index" json:"productId"`
+	Product       *Product `json:"product,omitempty"`
+	VariantID     *uint    `gorm:"index" json:"variantId,omitempty"`
+	Quantity      int      `gorm:"not null" json:"quantity"`
+}
+
+// IsHolding reports whether the reservation still holds its stock at now
+func (r *Reservation) IsHolding(now time.Time) bool {
+	return r.Status == ReservationActive && now.Before(r.ExpiresAt)
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"time"
+	"tobe_shop/server/money"
+)
+
+type ReturnStatus string
+
+const (
+	ReturnRequested ReturnStatus = "requested"
+	ReturnApproved  ReturnStatus = "approved"
+	ReturnRejected  ReturnStatus = "rejected"
+	ReturnReceived  ReturnStatus = "received"
+	ReturnRefunded  ReturnStatus = "refunded"
+)
+
+// returnTransitions lists the statuses a return may move to from each
+// status. Approved returns can be refunded without waiting for the goods,
+// e.g. when they aren't worth sending back. Rejected and Refunded are final.
+var returnTransitions = map[ReturnStatus][]ReturnStatus{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived, ReturnRefunded},
+	ReturnReceived:  {ReturnRefunded},
+}
+
+// IsValid reports whether the status is one of the known return statuses
+func (s ReturnStatus) IsValid() bool {
+	switch s {
+	case ReturnRequested, ReturnApproved, ReturnRejected, ReturnReceived, ReturnRefunded:
+		return true
+	}
+	return false
+}
+
+// NextStatuses returns the statuses the return may move to from s
+func (s ReturnStatus) NextStatuses() []ReturnStatus {
+	return returnTransitions[s]
+}
+
+// CanTransitionTo reports whether moving from s to next is allowed
+func (s ReturnStatus) CanTransitionTo(next ReturnStatus) bool {
+	for _, allowed := range returnTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ReturnRequest is a buyer's request to send back some of an order item
+// (RMA). RefundAmount starts at what was paid for the returned quantity and
+// may be lowered by the seller for a partial refund.
+type ReturnRequest struct {
+	ID           uint         `gorm:"primarykey" json:"id"`
+	CreatedAt    time.Time    `json:"createdAt"`
+	UpdatedAt    time.Time    `json:"updatedAt"`
+	OrderID      uint         `gorm:"not null;index" json:"orderId"`
+	OrderItemID  uint         `gorm:"not null;index" json:"orderItemId"`
+	OrderItem    *OrderItem   `json:"orderItem,omitempty"`
+	UserID       uint         `gorm:"not null;index" json:"userId"`
+	Quantity     int          `gorm:"not null" json:"quantity"`
+	Reason       string       `gorm:"size:255;not null" json:"reason"`
+	Status       ReturnStatus `gorm:"size:20;not null;index" json:"status"`
+	RefundAmount money.Money  `gorm:"embedded;embeddedPrefix:refund_amount_" json:"refundAmount"`
+	// Restocked is set once the returned goods are back in stock
+	Restocked    bool        `gorm:"not null;default:false" json:"restocked"`
+	SellerNote   string      `gorm:"size:255" json:"sellerNote,omitempty"`
+	ResolvedByID *uint       `json:"resolvedById,omitempty"`
+	CreditNoteID *uint       `json:"creditNoteId,omitempty"`
+	CreditNote   *CreditNote `json:"creditNote,omitempty"`
+}
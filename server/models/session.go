@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a refresh-token session. Every refresh rotates the token, so a
+// login produces a chain of sessions sharing the same FamilyID.
+type Session struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+	UserID        uint       `gorm:"not null;index" json:"userId"`
+	FamilyID      string     `gorm:"size:64;not null;index" json:"familyId"`
+	TokenHash     string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt     time.Time  `gorm:"not null" json:"expiresAt"`
+	RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+	RevokedReason string     `gorm:"size:30" json:"revokedReason,omitempty"`
+	ReplacedByID  *uint      `json:"replacedById,omitempty"`
+	UserAgent     string     `gorm:"size:255" json:"userAgent,omitempty"`
+	IPAddress     string     `gorm:"size:45" json:"ipAddress,omitempty"`
+}
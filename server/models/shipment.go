@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+)
+
+// TrackingStatus is where a shipment is on its way to the buyer
+type TrackingStatus string
+
+const (
+	TrackingShipped        TrackingStatus = "shipped"
+	TrackingInTransit      TrackingStatus = "in_transit"
+	TrackingOutForDelivery TrackingStatus = "out_for_delivery"
+	TrackingDelivered      TrackingStatus = "delivered"
+	TrackingException      TrackingStatus = "exception"
+)
+
+// IsValid reports whether s is a known tracking status
+func (s TrackingStatus) IsValid() bool {
+	switch s {
+	case TrackingShipped, TrackingInTransit, TrackingOutForDelivery, TrackingDelivered, TrackingException:
+		return true
+	}
+	return false
+}
+
+// Shipment is the parcel a shop sent for its part of an order
+type Shipment struct {
+	ID             uint            `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+	OrderID        uint            `gorm:"not null;index" json:"orderId"`
+	ShopOrderID    uint            `gorm:"not null;uniqueIndex" json:"shopOrderId"`
+	Carrier        string          `gorm:"size:50" json:"carrier"`
+	TrackingNumber string          `gorm:"size:100;index" json:"trackingNumber"`
+	ShippedAt      time.Time       `json:"shippedAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+	Events         []TrackingEvent `json:"events,omitempty"`
+}
+
+// TrackingEvent is a step of a shipment on its way to the buyer
+type TrackingEvent struct {
+	ID          uint           `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	ShipmentID  uint           `gorm:"not null;index" json:"shipmentId"`
+	Status      TrackingStatus `gorm:"size:20;not null" json:"status"`
+	Location    string         `gorm:"size:100" json:"location,omitempty"`
+	Description string         `gorm:"size:255" json:"description,omitempty"`
+	OccurredAt  time.Time      `gorm:"not null" json:"occurredAt"`
+}
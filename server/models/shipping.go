@@ -0,0 +1,62 @@
+package models
+
+import (
+	"math"
+	"time"
+	"tobe_shop/server/money"
+
+	"gorm.io/gorm"
+)
+
+// ShippingRateType is how a shipping method prices an order
+type ShippingRateType string
+
+const (
+	// RateFlat charges BaseRate per shop order
+	RateFlat ShippingRateType = "flat"
+	// RateWeight charges BaseRate plus PerKgRate for every started kilogram
+	RateWeight ShippingRateType = "weight_based"
+	// RateFreeOver charges BaseRate unless the items cost FreeOverAmount or more
+	RateFreeOver ShippingRateType = "free_over"
+)
+
+// IsValid reports whether t is a known rate type
+func (t ShippingRateType) IsValid() bool {
+	switch t {
+	case RateFlat, RateWeight, RateFreeOver:
+		return true
+	}
+	return false
+}
+
+// ShippingMethod is a way a shop ships its orders and what it charges
+type ShippingMethod struct {
+	ID             uint             `gorm:"primarykey" json:"id"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	UpdatedAt      time.Time        `json:"updatedAt"`
+	DeletedAt      gorm.DeletedAt   `gorm:"index" json:"-"`
+	ShopID         uint             `gorm:"not null;index" json:"shopId"`
+	Name           string           `gorm:"size:100;not null" json:"name"`
+	Carrier        string           `gorm:"size:50" json:"carrier"`
+	RateType       ShippingRateType `gorm:"size:20;not null" json:"rateType"`
+	BaseRate       money.Money      `gorm:"embedded;embeddedPrefix:base_rate_" json:"baseRate"`
+	PerKgRate      money.Money      `gorm:"embedded;embeddedPrefix:per_kg_rate_" json:"perKgRate"`
+	FreeOverAmount money.Money      `gorm:"embedded;embeddedPrefix:free_over_amount_" json:"freeOverAmount"`
+	EstimatedDays  int              `json:"estimatedDays"`
+	Active         bool             `gorm:"not null" json:"active"`
+}
+
+// Cost returns the shipping charge for items costing subtotal and weighing
+// weight kilograms
+func (m *ShippingMethod) Cost(subtotal money.Money, weight float64) money.Money {
+	cost := m.BaseRate
+	switch m.RateType {
+	case RateWeight:
+		cost = cost.Add(m.PerKgRate.Times(int(math.Ceil(weight))))
+	case RateFreeOver:
+		if subtotal.Cmp(m.FreeOverAmount) >= 0 {
+			cost = money.Zero(cost.Currency)
+		}
+	}
+	return cost
+}
@@ -16,5 +16,7 @@ type Shop struct {
 	Logo        string         `gorm:"size:255" json:"logo"`
 	Address     string         `gorm:"size:255" json:"address"`
 	UserID      uint           `json:"userId"`
-	Products    []*Product     `json:"products,omitempty"`
+	// Currency is the ISO 4217 code the shop prices its products in
+	Currency string     `gorm:"size:3;not null;default:'USD'" json:"currency"`
+	Products []*Product `json:"products,omitempty"`
 }
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+	"tobe_shop/server/money"
+)
+
+// ShopOrder is the part of an order fulfilled by one shop. Each shop ships
+// its own items, so the group has its own status and shipping; the order's
+// status follows once every group has moved on. ShippingMethod keeps the
+// name of the method chosen at checkout in case the shop changes it.
+type ShopOrder struct {
+	ID               uint        `gorm:"primarykey" json:"id"`
+	CreatedAt        time.Time   `json:"createdAt"`
+	UpdatedAt        time.Time   `json:"updatedAt"`
+	OrderID          uint        `gorm:"not null;index;uniqueIndex:idx_shop_order" json:"orderId"`
+	Order            *Order      `json:"order,omitempty"`
+	ShopID           uint        `gorm:"not null;index;uniqueIndex:idx_shop_order" json:"shopId"`
+	Shop             *Shop       `json:"shop,omitempty"`
+	Status           OrderStatus `gorm:"size:20;not null;index" json:"status"`
+	Subtotal         money.Money `gorm:"embedded;embeddedPrefix:subtotal_" json:"subtotal"`
+	ShippingMethodID *uint       `json:"shippingMethodId,omitempty"`
+	ShippingMethod   string      `gorm:"size:100" json:"shippingMethod,omitempty"`
+	ShippingCost     money.Money `gorm:"embedded;embeddedPrefix:shipping_cost_" json:"shippingCost"`
+	Tax              money.Money `gorm:"embedded;embeddedPrefix:tax_" json:"tax"`
+	Discount         money.Money `gorm:"embedded;embeddedPrefix:discount_" json:"discount"`
+	Total            money.Money `gorm:"embedded;embeddedPrefix:total_" json:"total"`
+	ShippedAt        *time.Time  `json:"shippedAt,omitempty"`
+	DeliveredAt      *time.Time  `json:"deliveredAt,omitempty"`
+	Items            []OrderItem `json:"items,omitempty"`
+	Shipment         *Shipment   `json:"shipment,omitempty"`
+}
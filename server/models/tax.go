@@ -0,0 +1,59 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"tobe_shop/server/money"
+)
+
+// TaxRule is a tax rate charged on goods shipped to a country, optionally
+// narrowed to a region (the address state) and a product category. Empty
+// fields match anything. Inclusive rates are already part of the product
+// price; exclusive rates are added on top of it.
+type TaxRule struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Name      string    `gorm:"size:50;not null" json:"name"`
+	Country   string    `gorm:"size:100;not null;default:'';uniqueIndex:idx_tax_rule" json:"country"`
+	Region    string    `gorm:"size:100;not null;default:'';uniqueIndex:idx_tax_rule" json:"region"`
+	Category  string    `gorm:"size:50;not null;default:'';uniqueIndex:idx_tax_rule" json:"category"`
+	// Rate is a fraction, e.g. 0.21 for 21%
+	Rate      float64 `gorm:"not null" json:"rate"`
+	Inclusive bool    `gorm:"not null" json:"inclusive"`
+}
+
+// Matches reports whether the rule applies to goods of category shipped to
+// country and region, ignoring case
+func (r *TaxRule) Matches(country, region, category string) bool {
+	match := func(field, value string) bool {
+		return field == "" || strings.EqualFold(field, strings.TrimSpace(value))
+	}
+	return match(r.Country, country) && match(r.Region, region) && match(r.Category, category)
+}
+
+// Specificity ranks matching rules so the most specific one wins: a region
+// beats a category, which beats the country alone
+func (r *TaxRule) Specificity() int {
+	specificity := 0
+	if r.Country != "" {
+		specificity += 4
+	}
+	if r.Region != "" {
+		specificity += 2
+	}
+	if r.Category != "" {
+		specificity++
+	}
+	return specificity
+}
+
+// Split returns the tax on a line costing amount and the net amount without
+// it
+func (r *TaxRule) Split(amount money.Money) (net, tax money.Money) {
+	if r.Inclusive {
+		net = amount.Scale(1 / (1 + r.Rate))
+		return net, amount.Sub(net)
+	}
+	return amount, amount.Scale(r.Rate)
+}
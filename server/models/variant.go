@@ -0,0 +1,81 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"tobe_shop/server/money"
+
+	"gorm.io/gorm"
+)
+
+// MaxProductOptions is how many options, such as size and colour, a product
+// can vary by
+const MaxProductOptions = 3
+
+// ProductOption names one of the options a product's variants differ in.
+// Position (1 to MaxProductOptions) tells which option value of the variants
+// it names.
+type ProductOption struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	ProductID uint      `gorm:"not null;uniqueIndex:idx_product_option" json:"productId"`
+	Position  int       `gorm:"not null;uniqueIndex:idx_product_option" json:"position"`
+	Name      string    `gorm:"size:50;not null" json:"name"`
+
+	// Values are the values the product's variants take for the option, in
+	// the order they first appear. Filled in per request.
+	Values []string `gorm:"-" json:"values"`
+}
+
+// ProductVariant is a SKU of a product: one combination of its option values,
+// with its own stock. A product with variants is sold by variant and its
+// Stock is the sum of theirs.
+type ProductVariant struct {
+	ID        uint           `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ProductID uint           `gorm:"not null;index" json:"productId"`
+	SKU       string         `gorm:"size:64;not null;uniqueIndex" json:"sku"`
+	Option1   string         `gorm:"size:50" json:"option1,omitempty"`
+	Option2   string         `gorm:"size:50" json:"option2,omitempty"`
+	Option3   string         `gorm:"size:50" json:"option3,omitempty"`
+	// PriceOverride replaces the product's price for the variant when it
+	// isn't zero. Product sales don't apply to variants with their own price.
+	PriceOverride money.Money `gorm:"embedded;embeddedPrefix:price_override_" json:"priceOverride"`
+	Stock         int         `gorm:"not null" json:"stock"`
+	Image         string      `gorm:"size:255" json:"image,omitempty"` // Falls back to the product image
+
+	// Price is what the variant sells at and AvailableStock its stock less
+	// active checkout reservations. Both are filled in per request.
+	Price          money.Money `gorm:"-" json:"price"`
+	AvailableStock int         `gorm:"-" json:"availableStock"`
+}
+
+// Options returns the variant's option values in option order
+func (v *ProductVariant) Options() []string {
+	var options []string
+	for _, value := range []string{v.Option1, v.Option2, v.Option3} {
+		if value != "" {
+			options = append(options, value)
+		}
+	}
+	return options
+}
+
+// SetOptions stores the option values, given in option order
+func (v *ProductVariant) SetOptions(values []string) {
+	slots := []*string{&v.Option1, &v.Option2, &v.Option3}
+	for i, slot := range slots {
+		*slot = ""
+		if i < len(values) {
+			*slot = values[i]
+		}
+	}
+}
+
+// Title names the variant by its option values, e.g. "M / Blue"
+func (v *ProductVariant) Title() string {
+	return strings.Join(v.Options(), " / ")
+}
@@ -0,0 +1,272 @@
+// Package money represents amounts of money as whole minor units (e.g.
+// cents) of an ISO 4217 currency, so sums never drift the way floating point
+// does. Every rounding of money in the shop happens here: amounts are
+// rounded half away from zero to the minor unit of their currency.
+package money
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of amounts given without one
+const DefaultCurrency = "USD"
+
+// exponents lists the currencies whose minor unit isn't a hundredth
+var exponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"BHD": 3,
+	"KWD": 3,
+	"OMR": 3,
+}
+
+// Exponent returns the number of decimals of the currency's minor unit
+func Exponent(currency string) int {
+	if exponent, ok := exponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// IsCurrency reports whether code looks like an ISO 4217 currency code:
+// three upper case letters
+func IsCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Money is an amount in minor units of Currency. Models store it as two
+// columns through gorm's embedded fields, e.g.
+//
+//	Price money.Money `gorm:"embedded;embeddedPrefix:price_" json:"price"`
+//
+// It encodes to JSON as a plain decimal number, as amounts always were.
+type Money struct {
+	Minor    int64  `gorm:"not null;default:0"`
+	Currency string `gorm:"size:3;not null;default:''"`
+}
+
+// New returns minor units of currency
+func New(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: currency}
+}
+
+// Zero returns nothing of currency
+func Zero(currency string) Money {
+	return Money{Currency: currency}
+}
+
+// FromFloat converts a decimal amount of currency, rounding it to the minor
+// unit. It is meant for amounts from outside, such as configuration.
+func FromFloat(amount float64, currency string) Money {
+	return Money{Minor: int64(math.Round(amount * math.Pow10(Exponent(currency)))), Currency: currency}
+}
+
+// Parse reads a decimal amount of currency such as "12.34" exactly,
+// rounding any digits beyond the minor unit
+func Parse(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if strings.ContainsAny(s, "eE") {
+		amount, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Money{}, fmt.Errorf("money: invalid amount %q", s)
+		}
+		return FromFloat(amount, currency), nil
+	}
+
+	negative := strings.HasPrefix(s, "-")
+	whole, fraction, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" && fraction == "" || !allDigits(whole) || !allDigits(fraction) {
+		return Money{}, fmt.Errorf("money: invalid amount %q", s)
+	}
+
+	exponent := Exponent(currency)
+	roundUp := false
+	if len(fraction) > exponent {
+		roundUp = fraction[exponent] >= '5'
+		fraction = fraction[:exponent]
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if whole+fraction == "" {
+		minor, err = 0, nil
+	}
+	if err != nil {
+		return Money{}, fmt.Errorf("money: invalid amount %q", s)
+	}
+	if roundUp {
+		minor++
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Float returns the amount in major units. Use it only to hand amounts to
+// code outside the shop; arithmetic stays in minor units.
+func (m Money) Float() float64 {
+	return float64(m.Minor) / math.Pow10(Exponent(m.Currency))
+}
+
+// Decimal formats the amount in major units with every decimal of the
+// minor unit, e.g. "12.30"
+func (m Money) Decimal() string {
+	exponent := Exponent(m.Currency)
+	minor := m.Minor
+	sign := ""
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	digits := strconv.FormatInt(minor, 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+// String formats the amount with its currency, e.g. "12.30 USD"
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.Currency
+}
+
+// IsZero reports whether the amount is nothing
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+// IsPositive reports whether the amount is more than nothing
+func (m Money) IsPositive() bool {
+	return m.Minor > 0
+}
+
+// IsNegative reports whether the amount is less than nothing
+func (m Money) IsNegative() bool {
+	return m.Minor < 0
+}
+
+// currencyWith returns the currency of an operation on m and o. An amount
+// without a currency takes the other one's; adding up different currencies
+// is a programming error.
+func (m Money) currencyWith(o Money) string {
+	switch {
+	case m.Currency == o.Currency || o.Currency == "":
+		return m.Currency
+	case m.Currency == "":
+		return o.Currency
+	}
+	panic(fmt.Sprintf("money: mixing %s with %s", m.Currency, o.Currency))
+}
+
+// Add returns m + o
+func (m Money) Add(o Money) Money {
+	return Money{Minor: m.Minor + o.Minor, Currency: m.currencyWith(o)}
+}
+
+// Sub returns m - o
+func (m Money) Sub(o Money) Money {
+	return Money{Minor: m.Minor - o.Minor, Currency: m.currencyWith(o)}
+}
+
+// Times returns m multiplied by a whole number, e.g. a quantity
+func (m Money) Times(n int) Money {
+	return Money{Minor: m.Minor * int64(n), Currency: m.Currency}
+}
+
+// Scale returns m multiplied by factor, e.g. a tax rate, rounded to the
+// minor unit
+func (m Money) Scale(factor float64) Money {
+	return Money{Minor: int64(math.Round(float64(m.Minor) * factor)), Currency: m.Currency}
+}
+
+// Convert returns m in currency at rate, the amount of currency one unit of
+// m's currency buys, rounded to the minor unit of currency
+func (m Money) Convert(currency string, rate float64) Money {
+	if currency == m.Currency {
+		return m
+	}
+	shift := math.Pow10(Exponent(currency) - Exponent(m.Currency))
+	return Money{Minor: int64(math.Round(float64(m.Minor) * rate * shift)), Currency: currency}
+}
+
+// Cmp compares m with o, returning -1, 0 or +1
+func (m Money) Cmp(o Money) int {
+	m.currencyWith(o)
+	switch {
+	case m.Minor < o.Minor:
+		return -1
+	case m.Minor > o.Minor:
+		return 1
+	}
+	return 0
+}
+
+// Min returns the smaller of m and o
+func (m Money) Min(o Money) Money {
+	if m.Cmp(o) > 0 {
+		return o
+	}
+	return m
+}
+
+// MarshalJSON encodes the amount as a decimal number in major units
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.Decimal()), nil
+}
+
+// UnmarshalJSON decodes a decimal number, or a string holding one, in major
+// units. The amount keeps the currency it already has, or gets the default
+// currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		unquoted, err := strconv.Unquote(string(data))
+		if err != nil {
+			return errors.New("money: invalid amount")
+		}
+		data = []byte(unquoted)
+	}
+
+	currency := m.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	parsed, err := Parse(string(data), currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
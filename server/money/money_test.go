@@ -0,0 +1,123 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     int64
+		wantErr  bool
+	}{
+		{"12.34", "USD", 1234, false},
+		{"12.3", "USD", 1230, false},
+		{"12", "USD", 1200, false},
+		{".5", "USD", 50, false},
+		{"-0.01", "USD", -1, false},
+		{"0.125", "USD", 13, false},
+		{"-0.125", "USD", -13, false},
+		{"0.124", "USD", 12, false},
+		{"1e2", "USD", 10000, false},
+		{"1500.6", "JPY", 1501, false},
+		{"1.2345", "KWD", 1235, false},
+		{"", "USD", 0, true},
+		{"-", "USD", 0, true},
+		{"12,34", "USD", 0, true},
+		{"abc", "USD", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (got.Minor != tt.want || got.Currency != tt.currency) {
+			t.Errorf("Parse(%q, %s) = %v, want %d minor units", tt.in, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(1234, "USD"), "12.34"},
+		{New(5, "USD"), "0.05"},
+		{New(0, "USD"), "0.00"},
+		{New(-150, "USD"), "-1.50"},
+		{New(1500, "JPY"), "1500"},
+		{New(1, "KWD"), "0.001"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Decimal(); got != tt.want {
+			t.Errorf("%d %s Decimal() = %q, want %q", tt.m.Minor, tt.m.Currency, got, tt.want)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	price := New(1999, "USD")
+	tests := []struct {
+		name string
+		got  Money
+		want Money
+	}{
+		{"times", price.Times(3), New(5997, "USD")},
+		{"add", price.Add(New(1, "USD")), New(2000, "USD")},
+		{"sub", price.Sub(New(2000, "USD")), New(-1, "USD")},
+		{"zero value takes the currency", Money{}.Add(price), price},
+		{"scale rounds half away from zero", New(50, "USD").Scale(0.21), New(11, "USD")},
+		{"scale negative", New(-50, "USD").Scale(0.21), New(-11, "USD")},
+		{"float sums drift, minor units don't", New(10, "USD").Add(New(20, "USD")), New(30, "USD")},
+		{"from float", FromFloat(0.1+0.2, "USD"), New(30, "USD")},
+		{"min", price.Min(New(100, "USD")), New(100, "USD")},
+		{"convert", price.Convert("CNY", 7.1), New(14193, "CNY")},
+		{"convert to a currency without cents", price.Convert("JPY", 150.5), New(3008, "JPY")},
+		{"convert from a currency without cents", New(3000, "JPY").Convert("USD", 0.0066), New(1980, "USD")},
+		{"convert to the same currency", price.Convert("USD", 2), price},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestMixingCurrenciesPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("adding USD to EUR didn't panic")
+		}
+	}()
+	New(100, "USD").Add(New(100, "EUR"))
+}
+
+func TestJSON(t *testing.T) {
+	var item struct {
+		Price Money `json:"price"`
+		Tax   Money `json:"tax"`
+	}
+	item.Tax.Currency = "EUR"
+	if err := json.Unmarshal([]byte(`{"price": 19.99, "tax": "4.2"}`), &item); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if item.Price != New(1999, DefaultCurrency) || item.Tax != New(420, "EUR") {
+		t.Errorf("decoded %v and %v, want 19.99 %s and 4.20 EUR", item.Price, item.Tax, DefaultCurrency)
+	}
+
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(encoded) != `{"price":19.99,"tax":4.20}` {
+		t.Errorf("encoded %s, want plain numbers", encoded)
+	}
+
+	if err := json.Unmarshal([]byte(`{"price": "lots"}`), &item); err == nil {
+		t.Error("decoding a word as an amount succeeded")
+	}
+}
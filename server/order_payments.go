@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// paymentMethodFor returns how buyers pay through the gateway
+func paymentMethodFor(gateway payments.Gateway) models.PaymentMethod {
+	if gateway.Name() == "alipay" {
+		return models.PaymentAlipay
+	}
+	return models.PaymentCard
+}
+
+// paymentStatusFor maps a provider status to the status of the payment
+func paymentStatusFor(status payments.Status) models.PaymentStatus {
+	switch status {
+	case payments.StatusSucceeded:
+		return models.PaymentSucceeded
+	case payments.StatusFailed:
+		return models.PaymentFailed
+	default:
+		return models.PaymentPending
+	}
+}
+
+// chargeOrder asks the gateway to collect the pending payment of a placed
+// order and settles the payment when the gateway decides straight away.
+// Orders the gateway can't charge are cancelled, returning their stock.
+func (a *app) chargeOrder(ctx context.Context, gateway payments.Gateway, order *models.Order, payment *models.Payment, info paymentInfo) (*payments.Charge, error) {
+	charge, err := gateway.CreateCharge(ctx, payments.ChargeRequest{
+		Reference: payment.ProviderReference,
+		Amount:    payment.Amount,
+		Subject:   fmt.Sprintf("TobeShop order #%d", order.ID),
+		BankCode:  info.BankCode,
+		VssCode:   info.VssCode,
+	})
+	if err != nil {
+		if settleErr := a.settleOrderPayment(order, payment, models.PaymentFailed); settleErr != nil {
+			return nil, settleErr
+		}
+		if errors.Is(err, payments.ErrUnsupportedCurrency) {
+			return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("Payment provider %s does not accept %s", gateway.Name(), payment.Amount.Currency)}
+		}
+		return nil, &orderError{http.StatusBadGateway, "Payment provider unavailable: " + err.Error()}
+	}
+
+	status := paymentStatusFor(charge.Status)
+	if err := a.settleOrderPayment(order, payment, status); err != nil {
+		return nil, err
+	}
+	if status == models.PaymentFailed {
+		return nil, &orderError{http.StatusPaymentRequired, "Payment was declined"}
+	}
+	return charge, nil
+}
+
+// settleOrderPayment settles the payment of an order and reloads the order
+// and its invoice to pick up the resulting status
+func (a *app) settleOrderPayment(order *models.Order, payment *models.Payment, status models.PaymentStatus) error {
+	if status == models.PaymentPending {
+		return nil
+	}
+	return withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			if err := settlePayment(tx, payment, status, nil); err != nil {
+				return err
+			}
+			if err := tx.First(order, order.ID).Error; err != nil {
+				return err
+			}
+			if order.Invoice == nil {
+				return nil
+			}
+			return tx.First(order.Invoice, order.InvoiceID).Error
+		})
+	})
+}
+
+// closeCharges closes the provider charges of payments that were given up,
+// so the buyer can't pay them any more. A charge paid before it could be
+// closed is refunded when its callback arrives.
+func (a *app) closeCharges(ctx context.Context, given []models.Payment) {
+	for _, payment := range given {
+		gateway, err := a.gateways.Get(payment.Provider)
+		if err == nil {
+			err = gateway.CloseCharge(ctx, payment.ProviderReference)
+		}
+		if err != nil {
+			log.Printf("Failed to close %s charge %s: %v", payment.Provider, payment.ProviderReference, err)
+		}
+	}
+}
+
+// Order payment handlers
+
+// syncOrderPayment asks the payment provider for the outcome of the order's
+// pending payment, for when its callback is late or lost
+func (a *app) syncOrderPayment(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var order models.Order
+	if err := a.db.First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	canView, err := a.canViewOrder(user, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check order permissions"})
+		return
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this order"})
+		return
+	}
+
+	// Find the payment started at checkout
+	var payment models.Payment
+	err = a.db.Where("invoice_id = ? AND provider_reference = ?", order.InvoiceID, order.PaymentID).
+		First(&payment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && payment.Provider == "") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order has no provider payment"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load payment"})
+		return
+	}
+
+	if payment.Status == models.PaymentPending {
+		gateway, err := a.gateways.Get(payment.Provider)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment provider " + payment.Provider + " is not configured"})
+			return
+		}
+		charge, err := gateway.QueryCharge(c.Request.Context(), payment.ProviderReference)
+		if err != nil && !errors.Is(err, payments.ErrUnknownCharge) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to query payment provider: " + err.Error()})
+			return
+		}
+		if err == nil {
+			if err := a.settleOrderPayment(&order, &payment, paymentStatusFor(charge.Status)); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to settle payment: " + err.Error()})
+				return
+			}
+		}
+	}
+
+	if err := a.db.First(&order, order.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load order"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"order":   order,
+		"payment": payment,
+	})
+}
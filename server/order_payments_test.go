@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeclinedPaymentCancelsOrder(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Kettle", 25, 4)
+
+	request := orderRequest(gin.H{"productId": product.ID, "quantity": 3})
+	request["paymentInfo"] = gin.H{"bankCode": "TEST", "vssCode": payments.FakeDeclineCode}
+	env.do(http.MethodPost, "/api/orders", env.login(buyer), request, http.StatusPaymentRequired, nil)
+
+	var order models.Order
+	if err := env.db.Preload("Invoice").First(&order).Error; err != nil {
+		t.Fatalf("load order: %v", err)
+	}
+	if order.Status != models.Cancelled || order.Invoice.Status != models.Void {
+		t.Errorf("order %s with invoice %s, want cancelled with a void invoice", order.Status, order.Invoice.Status)
+	}
+
+	var reloaded models.Product
+	env.db.First(&reloaded, product.ID)
+	if reloaded.Stock != 4 {
+		t.Errorf("stock = %d after declined payment, want 4", reloaded.Stock)
+	}
+
+	var payment models.Payment
+	env.db.Where("invoice_id = ?", order.InvoiceID).First(&payment)
+	if payment.Status != models.PaymentFailed || payment.Provider != "fake" {
+		t.Errorf("payment = %s via %q, want failed via fake", payment.Status, payment.Provider)
+	}
+}
+
+func TestSyncOrderPaymentSettlesPendingCharge(t *testing.T) {
+	env := newTestEnv(t)
+	env.gateway.AutoConfirm = false
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	other := env.createUser("other", models.Buyer)
+	product := env.createProduct(seller, "Toaster", 35, 2)
+	token := env.login(buyer)
+
+	var created struct {
+		Order   models.Order `json:"order"`
+		Payment struct {
+			Reference string          `json:"reference"`
+			Status    payments.Status `json:"status"`
+		} `json:"payment"`
+	}
+	env.do(http.MethodPost, "/api/orders", token,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+	if created.Order.Status != models.Pending || created.Payment.Status != payments.StatusPending {
+		t.Fatalf("order %s with payment %s, want both pending", created.Order.Status, created.Payment.Status)
+	}
+
+	path := fmt.Sprintf("/api/orders/%d/payment/sync", created.Order.ID)
+	env.do(http.MethodPost, path, env.login(other), nil, http.StatusForbidden, nil)
+
+	// Nothing changes while the buyer hasn't paid
+	var synced struct {
+		Order   models.Order   `json:"order"`
+		Payment models.Payment `json:"payment"`
+	}
+	env.do(http.MethodPost, path, token, nil, http.StatusOK, &synced)
+	if synced.Order.Status != models.Pending || synced.Payment.Status != models.PaymentPending {
+		t.Errorf("order %s with payment %s before paying, want both pending", synced.Order.Status, synced.Payment.Status)
+	}
+
+	if err := env.gateway.Complete(created.Payment.Reference, payments.StatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	env.do(http.MethodPost, path, token, nil, http.StatusOK, &synced)
+	if synced.Order.Status != models.Paid || synced.Payment.Status != models.PaymentSucceeded || synced.Payment.PaidAt == nil {
+		t.Errorf("order %s with payment %s after paying, want paid and succeeded", synced.Order.Status, synced.Payment.Status)
+	}
+
+	var invoice models.Invoice
+	env.db.First(&invoice, synced.Order.InvoiceID)
+	if invoice.Status != models.FullyPaid || invoice.AmountPaid != usd(35) {
+		t.Errorf("invoice = %s with %s paid, want fully_paid with 35", invoice.Status, invoice.AmountPaid)
+	}
+
+	// Syncing again is harmless
+	env.do(http.MethodPost, path, token, nil, http.StatusOK, &synced)
+	env.db.First(&invoice, synced.Order.InvoiceID)
+	if invoice.AmountPaid != usd(35) {
+		t.Errorf("amount paid = %s after syncing twice, want 35", invoice.AmountPaid)
+	}
+}
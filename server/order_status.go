@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errIllegalTransition = errors.New("illegal order status transition")
+	errStatusConflict    = errors.New("order status was changed by another request")
+	errShopOrderShipped  = errors.New("part of the order has already shipped")
+)
+
+// changeOrderStatus moves the order and its shop orders to status inside tx
+// and records the change in the order status history. Cancelling returns the
+// items to stock and voids the invoice in the same transaction. actor is nil for system-initiated changes.
+func changeOrderStatus(tx *gorm.DB, order *models.Order, to models.OrderStatus, actor *models.User, reason string) error {
+	from := order.Status
+	if !from.CanTransitionTo(to) {
+		return errIllegalTransition
+	}
+
+	// The goods of a shop that has shipped are on their way, so the order
+	// can't be cancelled and restocked as a whole any more
+	if to == models.Cancelled {
+		shipped, err := hasShippedShopOrders(tx, order.ID)
+		if err != nil {
+			return err
+		}
+		if shipped {
+			return errShopOrderShipped
+		}
+	}
+
+	// Only update if nobody changed the status since we read it
+	result := tx.Model(&models.Order{}).
+		Where("id = ? AND status = ?", order.ID, from).
+		Update("status", to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errStatusConflict
+	}
+
+	if err := recordOrderStatus(tx, order.ID, from, to, actor, reason); err != nil {
+		return err
+	}
+	if err := cascadeShopOrders(tx, order.ID, to); err != nil {
+		return err
+	}
+
+	if to.ReleasesStock() {
+		note := fmt.Sprintf("Order #%d %s", order.ID, to)
+		if err := restockOrder(tx, order, models.MovementCancelRestock, actor, note); err != nil {
+			return err
+		}
+	}
+
+	// A cancelled order is no longer owed, nor does it use up its coupon
+	if to == models.Cancelled {
+		if err := voidOrderInvoice(tx, order); err != nil {
+			return err
+		}
+		if err := failPendingPayments(tx, order.InvoiceID); err != nil {
+			return err
+		}
+		if err := releaseCoupon(tx, order); err != nil {
+			return err
+		}
+	}
+
+	order.Status = to
+	return nil
+}
+
+// recordOrderStatus appends an entry to the order status history
+func recordOrderStatus(tx *gorm.DB, orderID uint, from, to models.OrderStatus, actor *models.User, reason string) error {
+	history := models.OrderStatusHistory{
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		Reason:     reason,
+	}
+	if actor != nil {
+		history.ChangedByID = &actor.ID
+	}
+	return tx.Create(&history).Error
+}
+
+// isOrderSeller reports whether the user owns a shop selling any item in the order
+func (a *app) isOrderSeller(user *models.User, orderID uint) (bool, error) {
+	var count int64
+	err := a.db.Table("order_items").
+		Joins("JOIN products ON products.id = order_items.product_id").
+		Joins("JOIN shops ON shops.id = products.shop_id").
+		Where("order_items.order_id = ? AND order_items.deleted_at IS NULL AND shops.user_id = ?", orderID, user.ID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// canViewOrder reports whether the user is the buyer, a seller of its items or an admin
+func (a *app) canViewOrder(user *models.User, order *models.Order) (bool, error) {
+	if user.Role == models.Admin || order.UserID == user.ID {
+		return true, nil
+	}
+	return a.isOrderSeller(user, order.ID)
+}
+
+// canChangeOrderStatus applies the role rules for status changes: sellers of
+// all the items ship and deliver (sellers sharing the order do so for their
+// own shop order), buyers cancel until they have paid (a paid order is
+// given back through returns, which refund the money) and confirm
+// delivery, admins can do anything. Payment confirmation is left to admins.
+func (a *app) canChangeOrderStatus(user *models.User, order *models.Order, to models.OrderStatus) (bool, error) {
+	if user.Role == models.Admin {
+		return true, nil
+	}
+
+	isBuyer := order.UserID == user.ID
+	switch to {
+	case models.Cancelled:
+		return isBuyer && order.Status == models.Pending, nil
+	case models.Delivered:
+		if isBuyer {
+			return true, nil
+		}
+		return a.sellsWholeOrder(user, order.ID)
+	case models.Shipped:
+		return a.sellsWholeOrder(user, order.ID)
+	}
+	return false, nil
+}
+
+func (a *app) updateOrder(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	// Get order ID from URL
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var statusRequest struct {
+		Status models.OrderStatus `json:"status" binding:"required"`
+		Reason string             `json:"reason"`
+		// The shipment details apply when shipping the order
+		shipmentDetails
+	}
+	if err := c.ShouldBindJSON(&statusRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if !statusRequest.Status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status: " + string(statusRequest.Status)})
+		return
+	}
+
+	var order models.Order
+	if err := a.db.First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	canView, err := a.canViewOrder(user, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check order permissions"})
+		return
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to update this order"})
+		return
+	}
+
+	// Refunds go through returns, so the money is actually paid back
+	if statusRequest.Status == models.Refunded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Orders are refunded by refunding returns of their items"})
+		return
+	}
+
+	// Reject illegal transitions before checking who may perform them
+	if !order.Status.CanTransitionTo(statusRequest.Status) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":           fmt.Sprintf("Cannot change order status from %s to %s", order.Status, statusRequest.Status),
+			"currentStatus":   order.Status,
+			"allowedStatuses": order.Status.NextStatuses(),
+		})
+		return
+	}
+
+	allowed, err := a.canChangeOrderStatus(user, &order, statusRequest.Status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check order permissions"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("You are not allowed to mark this order as %s", statusRequest.Status)})
+		return
+	}
+
+	// Charges the buyer could still pay are closed once the order is cancelled
+	var openCharges []models.Payment
+	if statusRequest.Status == models.Cancelled {
+		if err := a.db.Where("invoice_id = ? AND status = ? AND provider <> ''", order.InvoiceID, models.PaymentPending).
+			Find(&openCharges).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load order payments"})
+			return
+		}
+	}
+
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		if err := changeOrderStatus(tx, &order, statusRequest.Status, user, statusRequest.Reason); err != nil {
+			return err
+		}
+		return applyShipmentDetails(tx, order.ID, statusRequest.Status, statusRequest.shipmentDetails)
+	})
+	if errors.Is(err, errStatusConflict) || errors.Is(err, errIllegalTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order status was changed by another request, please reload"})
+		return
+	}
+	if errors.Is(err, errShopOrderShipped) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Part of this order has already shipped and can't be cancelled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+		return
+	}
+	a.closeCharges(c.Request.Context(), openCharges)
+
+	// Reload the order with its items
+	a.db.Preload("OrderItems").Preload("OrderItems.Product").First(&order, orderID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Order status updated successfully",
+		"order":   order,
+	})
+}
+
+func (a *app) getOrderStatusHistory(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var order models.Order
+	if err := a.db.First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	canView, err := a.canViewOrder(user, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check order permissions"})
+		return
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this order"})
+		return
+	}
+
+	var history []models.OrderStatusHistory
+	if err := a.db.Preload("ChangedBy").Where("order_id = ?", order.ID).
+		Order("created_at ASC, id ASC").Find(&history).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get order status history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"history": history})
+}
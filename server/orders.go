@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// orderItemRequest is one line of an order as sent by the client
+type orderItemRequest struct {
+	ProductID uint `json:"productId"`
+	// VariantID is required for products sold by variant
+	VariantID uint `json:"variantId"`
+	Quantity  int  `json:"quantity"`
+}
+
+// orderInput is everything placeOrder needs besides the buyer
+type orderInput struct {
+	Items    []orderItemRequest
+	Shipping models.AddressFields
+	Billing  models.AddressFields
+	// ShippingMethods maps shops to the shipping method picked for their
+	// items; shops left out ship with their cheapest method
+	ShippingMethods map[uint]uint
+	// Currency is what the buyer pays in; without one the order is charged
+	// in the currency the products are priced in
+	Currency string
+	// CouponCode optionally names a coupon to take off the items
+	CouponCode string
+	// ReservationID optionally names a checkout reservation whose held
+	// stock the order consumes
+	ReservationID uint
+	// CartID optionally names the cart the order is checked out from; its
+	// items are removed together with creating the order
+	CartID uint
+	// PaymentInfo is passed on to the payment gateway
+	PaymentInfo paymentInfo
+}
+
+// checkoutAddresses picks the addresses of an order at checkout. Each one is
+// either entered with the order or taken from the buyer's address book;
+// without either the buyer's default address is used, and billing falls
+// back to the shipping address.
+type checkoutAddresses struct {
+	ShippingDetails   models.AddressFields  `json:"shippingDetails"`
+	ShippingAddressID uint                  `json:"shippingAddressId"`
+	BillingDetails    *models.AddressFields `json:"billingDetails"`
+	BillingAddressID  uint                  `json:"billingAddressId"`
+}
+
+// paymentInfo is the payment method entered at checkout
+type paymentInfo struct {
+	BankCode string `json:"bankCode"`
+	VssCode  string `json:"vssCode"`
+}
+
+// orderError is a placeOrder failure caused by the request rather than the
+// server, carrying the HTTP status to respond with
+type orderError struct {
+	status  int
+	message string
+}
+
+func (e *orderError) Error() string {
+	return e.message
+}
+
+// Order handlers
+func (a *app) getOrders(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	// Parse pagination parameters
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+
+	// Calculate offset
+	offset := (page - 1) * limit
+
+	// Get orders from database
+	var orders []models.Order
+	var total int64
+
+	// Count total orders
+	if err := a.db.Model(&models.Order{}).Where("user_id = ?", user.ID).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count orders"})
+		return
+	}
+
+	// Get paginated orders with associated products and shop orders
+	if err := a.db.Preload("OrderItems").Preload("OrderItems.Product").
+		Preload("ShopOrders").Preload("ShopOrders.Shop").
+		Where("user_id = ?", user.ID).
+		Offset(offset).Limit(limit).
+		Order("created_at DESC").
+		Find(&orders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get orders"})
+		return
+	}
+
+	// Calculate total pages
+	totalPages := int(math.Ceil(float64(total) / float64(limit)))
+
+	// Return orders with pagination info
+	c.JSON(http.StatusOK, gin.H{
+		"orders": orders,
+		"pagination": gin.H{
+			"total":      total,
+			"totalPages": totalPages,
+			"page":       page,
+			"limit":      limit,
+		},
+	})
+}
+func (a *app) getOrder(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	// Get order ID from URL
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	// Get order from database
+	var order models.Order
+	if err := a.db.Preload("OrderItems").Preload("OrderItems.Product").
+		Preload("ShopOrders").Preload("ShopOrders.Shop").
+		First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	// Check if the user is the buyer, a seller of its items or an admin
+	canView, err := a.canViewOrder(user, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check order permissions"})
+		return
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this order"})
+		return
+	}
+
+	// Return order
+	c.JSON(http.StatusOK, gin.H{"order": order})
+}
+
+func (a *app) createOrder(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	// Parse request
+	var orderRequest struct {
+		OrderItems    []orderItemRequest `json:"orderItems"`
+		ReservationID uint               `json:"reservationId"`
+		checkoutAddresses
+		ShippingMethods map[uint]uint `json:"shippingMethods"`
+		Currency        string        `json:"currency"`
+		CouponCode      string        `json:"couponCode"`
+		PaymentInfo     paymentInfo   `json:"paymentInfo"`
+	}
+
+	if err := c.ShouldBindJSON(&orderRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	// Work out the shipping and billing addresses
+	shipping, billing, err := a.resolveCheckoutAddresses(user, orderRequest.checkoutAddresses)
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	order, charge, err := a.placeOrder(c.Request.Context(), user, orderInput{
+		Items:           orderRequest.OrderItems,
+		Shipping:        shipping,
+		Billing:         billing,
+		ShippingMethods: orderRequest.ShippingMethods,
+		ReservationID:   orderRequest.ReservationID,
+		Currency:        orderRequest.Currency,
+		CouponCode:      orderRequest.CouponCode,
+		PaymentInfo:     orderRequest.PaymentInfo,
+	})
+	if err != nil {
+		respondOrderError(c, err)
+		return
+	}
+
+	// Return the created order
+	respondPlacedOrder(c, order, charge)
+}
+
+// respondOrderError writes the response for a placeOrder failure
+func respondOrderError(c *gin.Context, err error) {
+	var orderErr *orderError
+	switch {
+	case errors.As(err, &orderErr):
+		c.JSON(orderErr.status, gin.H{"error": orderErr.message})
+	case isBusyError(err):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The store is busy, please try again"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order: " + err.Error()})
+	}
+}
+
+// respondPlacedOrder writes the response for a placed order. Orders waiting
+// for payment on a hosted payment page come with its URL.
+func respondPlacedOrder(c *gin.Context, order *models.Order, charge *payments.Charge) {
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Order created successfully",
+		"order":   order,
+		"payment": gin.H{
+			"reference":  charge.Reference,
+			"status":     charge.Status,
+			"paymentUrl": charge.PaymentURL,
+		},
+	})
+}
+
+// placeOrder creates a pending order for the items inside a transaction and
+// then charges the buyer through the payment gateway. Stock is taken with a
+// conditional decrement, so concurrent checkouts can't oversell, and the
+// transaction is retried when SQLite reports the database busy. Stock held
+// by other buyers' reservations is not available to the order.
+func (a *app) placeOrder(ctx context.Context, user *models.User, input orderInput) (*models.Order, *payments.Charge, error) {
+	// Check if there are order items
+	if len(input.Items) == 0 {
+		return nil, nil, &orderError{http.StatusBadRequest, "Order must contain at least one item"}
+	}
+	for _, item := range input.Items {
+		if item.Quantity <= 0 {
+			return nil, nil, &orderError{http.StatusBadRequest, "Quantity must be at least 1"}
+		}
+	}
+
+	gateway := a.gateways.Default()
+	var order models.Order
+	var payment models.Payment
+	err := withBusyRetry(func() error {
+		order = models.Order{
+			UserID:          user.ID,
+			Status:          models.Pending,
+			ShippingAddress: input.Shipping.String(),
+			BillingAddress:  input.Billing.String(),
+			ShippingDetails: input.Shipping,
+			BillingDetails:  input.Billing,
+			OrderItems:      []models.OrderItem{},
+		}
+		payment = models.Payment{
+			Provider: gateway.Name(),
+			Method:   paymentMethodFor(gateway),
+			Status:   models.PaymentPending,
+		}
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			return buildOrder(tx, user, input, &order, &payment)
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	charge, err := a.chargeOrder(ctx, gateway, &order, &payment, input.PaymentInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &order, charge, nil
+}
+
+// buildOrder prices the items, takes them out of stock and saves the order
+// with its invoice and the pending payment for it
+func buildOrder(tx *gorm.DB, user *models.User, input orderInput, order *models.Order, payment *models.Payment) error {
+	now := time.Now()
+
+	var reservation *models.Reservation
+	if input.ReservationID != 0 {
+		var err error
+		if reservation, err = loadHoldingReservation(tx, user, input.ReservationID, now); err != nil {
+			return err
+		}
+	}
+
+	// Stock held for other checkouts can't be sold; the order's own
+	// reservation is left out so its held stock is available to it
+	productIDs := make([]uint, len(input.Items))
+	var variantIDs []uint
+	for i, item := range input.Items {
+		productIDs[i] = item.ProductID
+		if item.VariantID != 0 {
+			variantIDs = append(variantIDs, item.VariantID)
+		}
+	}
+	holds, err := activeHolds(tx, productIDs, input.ReservationID, now)
+	if err != nil {
+		return err
+	}
+	variantHolds, err := activeVariantHolds(tx, variantIDs, input.ReservationID, now)
+	if err != nil {
+		return err
+	}
+
+	currency, err := parseCurrency(input.Currency)
+	if err != nil {
+		return &orderError{http.StatusBadRequest, err.Error()}
+	}
+
+	// Calculate total and create order items
+	var total money.Money
+	requested := make(map[uint]int)
+	requestedVariants := make(map[uint]int)
+	requestedLines := make(map[stockKey]int)
+	productShops := make(map[uint]uint)
+	parcels := make(map[uint]*shopParcel)
+	var taxLines []taxLine
+	var couponLines []couponLine
+	for _, item := range input.Items {
+		// Get product to confirm price and check stock
+		var product models.Product
+		if err := tx.First(&product, item.ProductID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &orderError{http.StatusBadRequest, "Product not found: " + strconv.FormatUint(uint64(item.ProductID), 10)}
+			}
+			return err
+		}
+		// Products on sale sell at the sale price
+		if err := applySalePrice(tx, &product, now); err != nil {
+			return err
+		}
+		variant, err := loadOrderVariant(tx, &product, item.VariantID)
+		if err != nil {
+			return err
+		}
+
+		// Check if there's enough stock, counting repeated lines for the same
+		// product. The conditional decrement below is what actually guards
+		// against overselling; this only gives a friendlier message.
+		requested[product.ID] += item.Quantity
+		requestedLines[stockKey{product.ID, item.VariantID}] += item.Quantity
+		productShops[product.ID] = product.ShopID
+		available := product.Stock - holds[product.ID]
+		if available < requested[product.ID] {
+			if available < 0 {
+				available = 0
+			}
+			return &orderError{http.StatusBadRequest, fmt.Sprintf("Not enough stock for product %s. Available: %d, Requested: %d",
+				product.Name, available, requested[product.ID])}
+		}
+		if variant != nil {
+			requestedVariants[variant.ID] += item.Quantity
+			available := variant.Stock - variantHolds[variant.ID]
+			if available < requestedVariants[variant.ID] {
+				if available < 0 {
+					available = 0
+				}
+				return &orderError{http.StatusBadRequest, fmt.Sprintf("Not enough stock for product %s. Available: %d, Requested: %d",
+					stockName(&product, variant), available, requestedVariants[variant.ID])}
+			}
+		}
+
+		// The products are converted at a single rate, so they have to be
+		// priced in the same currency
+		if order.BaseCurrency == "" {
+			order.BaseCurrency = product.Price.Currency
+			if order.Currency, order.ExchangeRate, err = checkoutRate(tx, order.BaseCurrency, currency); err != nil {
+				return err
+			}
+		} else if product.Price.Currency != order.BaseCurrency {
+			return &orderError{http.StatusBadRequest, fmt.Sprintf("Product %s is priced in %s, not %s; order it separately",
+				product.Name, product.Price.Currency, order.BaseCurrency)}
+		}
+
+		// Calculate total price for item in the currency charged
+		basePrice := variantPrice(&product, variant)
+		price := basePrice.Convert(order.Currency, order.ExchangeRate)
+		itemTotalPrice := price.Times(item.Quantity)
+
+		// Create order item
+		orderItem := models.OrderItem{
+			ProductID:  item.ProductID,
+			Quantity:   item.Quantity,
+			Price:      price,
+			TotalPrice: itemTotalPrice,
+			Discount:   money.Zero(order.Currency),
+		}
+		if variant != nil {
+			orderItem.VariantID = &variant.ID
+			orderItem.SKU = variant.SKU
+			orderItem.VariantTitle = variant.Title()
+		}
+
+		order.OrderItems = append(order.OrderItems, orderItem)
+		total = total.Add(itemTotalPrice)
+		taxLines = append(taxLines, taxLine{Category: product.Category, Amount: itemTotalPrice})
+		couponLines = append(couponLines, couponLine{product.ShopID, product.ID, product.Category, itemTotalPrice})
+
+		parcel, ok := parcels[product.ShopID]
+		if !ok {
+			parcel = &shopParcel{ShopID: product.ShopID, Subtotal: money.Zero(product.Price.Currency)}
+			parcels[product.ShopID] = parcel
+		}
+		// Shipping rates are in the shop's currency
+		parcel.Subtotal = parcel.Subtotal.Add(basePrice.Times(item.Quantity))
+		parcel.Weight += product.Weight * float64(item.Quantity)
+	}
+
+	// Take the coupon off the items it applies to; tax is charged on what is
+	// left
+	order.Discount = money.Zero(order.Currency)
+	var coupon *models.Coupon
+	if input.CouponCode != "" {
+		if coupon, err = loadCoupon(tx, input.CouponCode); err != nil {
+			return err
+		}
+		discounts, err := couponDiscounts(tx, coupon, user.ID, couponLines, order.Currency, now)
+		if err != nil {
+			return err
+		}
+		for i, discount := range discounts {
+			order.OrderItems[i].Discount = discount
+			taxLines[i].Amount = taxLines[i].Amount.Sub(discount)
+			order.Discount = order.Discount.Add(discount)
+		}
+		order.CouponID = &coupon.ID
+		order.CouponCode = coupon.Code
+	}
+
+	// Work out the shipping of each shop's items
+	shipping, err := chooseShipping(tx, parcels, input.ShippingMethods)
+	if err != nil {
+		return err
+	}
+	order.ShippingCost = money.Zero(order.Currency)
+	for shopID, choice := range shipping {
+		choice.Cost = choice.Cost.Convert(order.Currency, order.ExchangeRate)
+		shipping[shopID] = choice
+		order.ShippingCost = order.ShippingCost.Add(choice.Cost)
+	}
+
+	// Work out the tax by where the order ships to
+	rules, err := loadTaxRules(tx)
+	if err != nil {
+		return err
+	}
+	taxes := calculateTax(rules, input.Shipping.Country, input.Shipping.State, order.Currency, taxLines)
+	for i, line := range taxes.Lines {
+		order.OrderItems[i].TaxRate = line.Rate
+		order.OrderItems[i].Tax = line.Tax
+		order.OrderItems[i].TaxInclusive = line.Inclusive
+	}
+	order.Tax = taxes.Tax
+
+	// Set the total, adding the tax that isn't included in the prices
+	order.Total = total.Sub(order.Discount).Add(taxes.Added).Add(order.ShippingCost)
+
+	// The order waits for the payment gateway to confirm payment
+	paymentID := fmt.Sprintf("PAY-%d-%d", user.ID, time.Now().UnixNano())
+	order.PaymentID = paymentID
+	order.Status = models.Pending
+
+	// Create the order and split it up between the shops fulfilling it
+	if err := tx.Create(order).Error; err != nil {
+		return err
+	}
+	if err := splitOrderByShop(tx, order, productShops, shipping); err != nil {
+		return err
+	}
+	if coupon != nil {
+		if err := redeemCoupon(tx, coupon, order); err != nil {
+			return err
+		}
+	}
+
+	// Issue the invoice for the order and start its payment
+	if err := createInvoice(tx, order, now); err != nil {
+		return err
+	}
+	payment.Amount = order.Total
+	payment.ProviderReference = paymentID
+	if err := recordPayment(tx, order.Invoice, payment, user); err != nil {
+		return err
+	}
+
+	// Take the items out of stock, recording each sale in the inventory ledger
+	for _, item := range order.OrderItems {
+		movement := models.InventoryMovement{
+			Type:      models.MovementSale,
+			OrderID:   &order.ID,
+			VariantID: item.VariantID,
+			ActorID:   &user.ID,
+			Note:      fmt.Sprintf("Order #%d", order.ID),
+		}
+		if _, err := adjustStock(tx, item.ProductID, -item.Quantity, movement); err != nil {
+			if errors.Is(err, errInsufficientStock) {
+				return &orderError{http.StatusConflict, fmt.Sprintf("Product %d sold out while placing the order", item.ProductID)}
+			}
+			return err
+		}
+	}
+
+	// Use up the reservation the stock was held by
+	if reservation != nil {
+		if err := consumeReservation(tx, reservation, requestedLines, order.ID); err != nil {
+			return err
+		}
+	}
+
+	// Empty the cart the order was checked out from
+	if input.CartID != 0 {
+		if err := tx.Where("cart_id = ?", input.CartID).Delete(&models.CartItem{}).Error; err != nil {
+			return err
+		}
+	}
+
+	// Start the order's status history
+	return recordOrderStatus(tx, order.ID, "", order.Status, user, "Order placed")
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testShippingDetails() gin.H {
+	return gin.H{
+		"fullName":     "Test Buyer",
+		"addressLine1": "1 Test Road",
+		"city":         "Shanghai",
+		"state":        "SH",
+		"postalCode":   "200000",
+		"country":      "CN",
+		"phone":        "123456",
+	}
+}
+
+func orderRequest(items ...gin.H) gin.H {
+	return gin.H{
+		"orderItems":      items,
+		"shippingDetails": testShippingDetails(),
+		"paymentInfo":     gin.H{"bankCode": "TEST", "vssCode": "123"},
+	}
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	shirt := env.createProduct(seller, "T-Shirt", 19.5, 10)
+	jeans := env.createProduct(seller, "Jeans", 40, 3)
+	token := env.login(buyer)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", token, orderRequest(
+		gin.H{"productId": shirt.ID, "quantity": 2},
+		gin.H{"productId": jeans.ID, "quantity": 1},
+	), http.StatusCreated, &created)
+
+	if created.Order.ID == 0 {
+		t.Fatal("created order has no ID")
+	}
+	if created.Order.UserID != buyer.ID {
+		t.Errorf("order user = %d, want %d", created.Order.UserID, buyer.ID)
+	}
+	if created.Order.Total != usd(79) {
+		t.Errorf("order total = %v, want 79", created.Order.Total)
+	}
+	if len(created.Order.OrderItems) != 2 {
+		t.Fatalf("order items = %d, want 2", len(created.Order.OrderItems))
+	}
+
+	var product models.Product
+	env.db.First(&product, shirt.ID)
+	if product.Stock != 8 {
+		t.Errorf("shirt stock = %d, want 8", product.Stock)
+	}
+
+	var list struct {
+		Orders     []models.Order `json:"orders"`
+		Pagination struct {
+			Total int64 `json:"total"`
+		} `json:"pagination"`
+	}
+	env.do(http.MethodGet, "/api/orders", token, nil, http.StatusOK, &list)
+	if list.Pagination.Total != 1 || len(list.Orders) != 1 {
+		t.Fatalf("listed %d orders (total %d), want 1", len(list.Orders), list.Pagination.Total)
+	}
+	if list.Orders[0].ID != created.Order.ID {
+		t.Errorf("listed order %d, want %d", list.Orders[0].ID, created.Order.ID)
+	}
+
+	var fetched struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodGet, fmt.Sprintf("/api/orders/%d", created.Order.ID), token, nil, http.StatusOK, &fetched)
+	if len(fetched.Order.OrderItems) != 2 || fetched.Order.OrderItems[0].Product == nil {
+		t.Errorf("fetched order items not preloaded: %+v", fetched.Order.OrderItems)
+	}
+}
+
+func TestOrderRoutesRequireAuthentication(t *testing.T) {
+	env := newTestEnv(t)
+
+	env.do(http.MethodGet, "/api/orders", "", nil, http.StatusUnauthorized, nil)
+	env.do(http.MethodGet, "/api/orders/1", "", nil, http.StatusUnauthorized, nil)
+	env.do(http.MethodPost, "/api/orders", "", orderRequest(), http.StatusUnauthorized, nil)
+	env.do(http.MethodGet, "/api/invoices", "", nil, http.StatusUnauthorized, nil)
+	env.do(http.MethodGet, "/api/orders", "1_forged_123", nil, http.StatusUnauthorized, nil)
+}
+
+func TestGetOrderOfAnotherUserIsForbidden(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	other := env.createUser("other", models.Buyer)
+	product := env.createProduct(seller, "Book", 12, 5)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", env.login(buyer),
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+
+	otherToken := env.login(other)
+	env.do(http.MethodGet, fmt.Sprintf("/api/orders/%d", created.Order.ID), otherToken, nil, http.StatusForbidden, nil)
+
+	var list struct {
+		Orders []models.Order `json:"orders"`
+	}
+	env.do(http.MethodGet, "/api/orders", otherToken, nil, http.StatusOK, &list)
+	if len(list.Orders) != 0 {
+		t.Errorf("other user sees %d orders, want 0", len(list.Orders))
+	}
+}
+
+func TestCreateOrderRejectsInsufficientStock(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Headphones", 99, 1)
+
+	env.do(http.MethodPost, "/api/orders", env.login(buyer),
+		orderRequest(gin.H{"productId": product.ID, "quantity": 2}), http.StatusBadRequest, nil)
+
+	var reloaded models.Product
+	env.db.First(&reloaded, product.ID)
+	if reloaded.Stock != 1 {
+		t.Errorf("stock = %d after rejected order, want 1", reloaded.Stock)
+	}
+
+	var count int64
+	env.db.Model(&models.Order{}).Count(&count)
+	if count != 0 {
+		t.Errorf("orders = %d after rejected order, want 0", count)
+	}
+}
+
+func TestOrderStatusTransitions(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	otherSeller := env.createUser("other-seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Lamp", 30, 5)
+	env.createProduct(otherSeller, "Rug", 50, 5)
+	buyerToken := env.login(buyer)
+	sellerToken := env.login(seller)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+	orderPath := fmt.Sprintf("/api/orders/%d", created.Order.ID)
+
+	// Buyers can't ship and unrelated sellers can't touch the order
+	env.do(http.MethodPut, orderPath, buyerToken, gin.H{"status": models.Shipped}, http.StatusForbidden, nil)
+	env.do(http.MethodPut, orderPath, env.login(otherSeller), gin.H{"status": models.Shipped}, http.StatusForbidden, nil)
+
+	// Skipping a step is illegal
+	env.do(http.MethodPut, orderPath, sellerToken, gin.H{"status": models.Pending}, http.StatusConflict, nil)
+
+	// A paid order is given back through a return, which refunds it
+	env.do(http.MethodPut, orderPath, buyerToken, gin.H{"status": models.Cancelled}, http.StatusForbidden, nil)
+
+	env.do(http.MethodPut, orderPath, sellerToken, gin.H{"status": models.Shipped, "reason": "Sent by post"}, http.StatusOK, nil)
+
+	// Once shipped the buyer can no longer cancel
+	env.do(http.MethodPut, orderPath, buyerToken, gin.H{"status": models.Cancelled}, http.StatusConflict, nil)
+
+	env.do(http.MethodPut, orderPath, buyerToken, gin.H{"status": models.Delivered}, http.StatusOK, nil)
+
+	var history struct {
+		History []models.OrderStatusHistory `json:"history"`
+	}
+	env.do(http.MethodGet, orderPath+"/history", sellerToken, nil, http.StatusOK, &history)
+
+	want := []models.OrderStatus{models.Pending, models.Paid, models.Shipped, models.Delivered}
+	if len(history.History) != len(want) {
+		t.Fatalf("history has %d entries, want %d", len(history.History), len(want))
+	}
+	for i, entry := range history.History {
+		if entry.ToStatus != want[i] {
+			t.Errorf("history[%d] = %s, want %s", i, entry.ToStatus, want[i])
+		}
+	}
+	if history.History[2].Reason != "Sent by post" || *history.History[2].ChangedByID != seller.ID {
+		t.Errorf("shipping entry = %+v, want reason and seller recorded", history.History[2])
+	}
+}
+
+func TestCancelOrderRestocksInventory(t *testing.T) {
+	env := newTestEnv(t)
+	env.gateway.AutoConfirm = false
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	mug := env.createProduct(seller, "Mug", 8, 10)
+	plate := env.createProduct(seller, "Plate", 12, 4)
+	buyerToken := env.login(buyer)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken, orderRequest(
+		gin.H{"productId": mug.ID, "quantity": 3},
+		gin.H{"productId": plate.ID, "quantity": 4},
+	), http.StatusCreated, &created)
+
+	env.do(http.MethodPut, fmt.Sprintf("/api/orders/%d", created.Order.ID), buyerToken,
+		gin.H{"status": models.Cancelled, "reason": "Changed my mind"}, http.StatusOK, nil)
+
+	for _, tc := range []struct {
+		product *models.Product
+		stock   int
+		change  int
+	}{{mug, 10, 3}, {plate, 4, 4}} {
+		var product models.Product
+		env.db.First(&product, tc.product.ID)
+		if product.Stock != tc.stock {
+			t.Errorf("%s stock = %d after cancel, want %d", product.Name, product.Stock, tc.stock)
+		}
+
+		var movement models.InventoryMovement
+		if err := env.db.Where("product_id = ? AND type = ?", product.ID, models.MovementCancelRestock).
+			First(&movement).Error; err != nil {
+			t.Fatalf("no restock movement for %s: %v", product.Name, err)
+		}
+		if movement.Quantity != tc.change || movement.StockAfter != tc.stock || *movement.OrderID != created.Order.ID {
+			t.Errorf("%s movement = %+v", product.Name, movement)
+		}
+	}
+}
+
+func TestConcurrentOrdersDoNotOversell(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	product := env.createProduct(seller, "Limited Sneakers", 150, 5)
+
+	const buyers = 20
+	tokens := make([]string, buyers)
+	for i := range tokens {
+		tokens[i] = env.login(env.createUser(fmt.Sprintf("buyer%d", i), models.Buyer))
+	}
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, buyers)
+	for _, token := range tokens {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			body, _ := json.Marshal(orderRequest(gin.H{"productId": product.ID, "quantity": 1}))
+			req := httptest.NewRequest(http.MethodPost, "/api/orders", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			env.router.ServeHTTP(w, req)
+			statuses <- w.Code
+		}(token)
+	}
+	wg.Wait()
+	close(statuses)
+
+	created := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusBadRequest, http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if created != 5 {
+		t.Errorf("created %d orders, want 5", created)
+	}
+
+	var reloaded models.Product
+	env.db.First(&reloaded, product.ID)
+	if reloaded.Stock != 0 {
+		t.Errorf("stock = %d, want 0", reloaded.Stock)
+	}
+
+	var sold int64
+	env.db.Model(&models.OrderItem{}).Where("product_id = ?", product.ID).Select("COALESCE(SUM(quantity), 0)").Scan(&sold)
+	if sold != 5 {
+		t.Errorf("sold %d units, want 5", sold)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// unwantedPaymentRefundReason is given to the provider for payments refunded
+// because they were given up before they arrived, e.g. for a cancelled order
+// or an invoice paid another way
+const unwantedPaymentRefundReason = "Payment no longer due"
+
+// applyPaymentEvent stores a verified provider callback and settles the
+// payment it is about. Every event is stored once per provider event ID, so
+// redelivered callbacks are recognised and skipped. Events only ever settle
+// a pending payment, which makes late or out-of-order events harmless.
+func applyPaymentEvent(tx *gorm.DB, provider string, notification *payments.Notification) (*models.PaymentEvent, error) {
+	event := models.PaymentEvent{
+		Provider:   provider,
+		EventID:    notification.EventID,
+		Reference:  notification.Reference,
+		Status:     string(notification.Status),
+		Amount:     notification.Amount,
+		OccurredAt: notification.OccurredAt,
+		Payload:    string(notification.Raw),
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Already received; report how it was handled the first time
+		err := tx.Where("provider = ? AND event_id = ?", provider, notification.EventID).First(&event).Error
+		return &event, err
+	}
+
+	var payment models.Payment
+	err := tx.Where("provider = ? AND provider_reference = ?", provider, notification.Reference).
+		First(&payment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		event.Result = models.EventUnmatched
+		return &event, tx.Model(&event).Update("result", event.Result).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event.PaymentID = &payment.ID
+	event.Result, event.Detail, err = settleFromNotification(tx, &payment, notification)
+	if err != nil {
+		return nil, err
+	}
+	return &event, tx.Model(&event).Updates(map[string]interface{}{
+		"payment_id": event.PaymentID,
+		"result":     event.Result,
+		"detail":     event.Detail,
+	}).Error
+}
+
+// amountMatches reports whether the provider reported the amount of the
+// payment. Providers that don't report a currency are taken to mean the
+// payment's.
+func amountMatches(reported, amount money.Money) bool {
+	if reported.Currency != "" && reported.Currency != amount.Currency {
+		return false
+	}
+	return reported.Minor == amount.Minor
+}
+
+// settleFromNotification settles the payment with the outcome reported by
+// the provider and describes what came of it
+func settleFromNotification(tx *gorm.DB, payment *models.Payment, notification *payments.Notification) (models.PaymentEventResult, string, error) {
+	status := paymentStatusFor(notification.Status)
+	switch {
+	case status == models.PaymentPending:
+		return models.EventIgnored, "no final outcome yet", nil
+	case payment.Status == status:
+		return models.EventIgnored, "payment already " + string(status), nil
+	case status == models.PaymentSucceeded && !amountMatches(notification.Amount, payment.Amount):
+		return models.EventRejected, fmt.Sprintf("amount %s does not match payment amount %s", notification.Amount, payment.Amount), nil
+	case status == models.PaymentSucceeded && payment.Status == models.PaymentFailed:
+		// Paid after all, although the payment was given up when the order
+		// was cancelled or the invoice paid another way
+		return refundUnwantedPayment(tx, payment)
+	case payment.Status != models.PaymentPending:
+		return models.EventRejected, fmt.Sprintf("payment already %s, provider reports %s", payment.Status, status), nil
+	}
+
+	// Settle in a savepoint so the event is kept even if the invoice can't
+	// take the payment any more
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		return settlePayment(tx, payment, status, nil)
+	})
+	if errors.Is(err, errInvoiceVoid) && status == models.PaymentSucceeded {
+		return refundUnwantedPayment(tx, payment)
+	}
+	if errors.Is(err, errInvoiceVoid) || errors.Is(err, errOverpayment) {
+		return models.EventRejected, err.Error(), nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return models.EventApplied, "", nil
+}
+
+// refundUnwantedPayment records money the provider took for a payment that
+// is no longer wanted, e.g. because its order was cancelled, and books a
+// refund of all of it. The refund is sent to the provider once the event is
+// stored.
+func refundUnwantedPayment(tx *gorm.DB, payment *models.Payment) (models.PaymentEventResult, string, error) {
+	now := time.Now()
+	result := tx.Model(&models.Payment{}).
+		Where("id = ? AND status IN ?", payment.ID, []models.PaymentStatus{models.PaymentPending, models.PaymentFailed}).
+		Updates(map[string]interface{}{
+			"status":                   models.PaymentSucceeded,
+			"paid_at":                  now,
+			"amount_refunded_minor":    payment.Amount.Minor,
+			"amount_refunded_currency": payment.Amount.Currency,
+		})
+	if result.Error != nil {
+		return "", "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.EventIgnored, "payment already succeeded", nil
+	}
+
+	refund := models.PaymentRefund{
+		PaymentID:       payment.ID,
+		Amount:          payment.Amount,
+		Provider:        payment.Provider,
+		RefundReference: fmt.Sprintf("VOID-%d", payment.ID),
+		Status:          models.PaymentPending,
+	}
+	if err := tx.Create(&refund).Error; err != nil {
+		return "", "", err
+	}
+	return models.EventRefunded, "payment is no longer due and is refunded", nil
+}
+
+// Payment webhook handlers
+
+// receivePaymentWebhook handles callbacks from payment providers. Forged
+// callbacks are refused; everything else is acknowledged once stored, so
+// the provider stops redelivering it.
+func (a *app) receivePaymentWebhook(c *gin.Context) {
+	gateway, err := a.gateways.Get(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown payment provider"})
+		return
+	}
+
+	notification, err := gateway.VerifyCallback(c.Request)
+	switch {
+	case errors.Is(err, payments.ErrInvalidSignature):
+		log.Printf("Rejected %s callback with invalid signature from %s", gateway.Name(), c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid callback: " + err.Error()})
+		return
+	}
+
+	var event *models.PaymentEvent
+	err = withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			event, err = applyPaymentEvent(tx, gateway.Name(), notification)
+			return err
+		})
+	})
+	if err != nil {
+		// Not acknowledged, so the provider delivers it again later
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process callback: " + err.Error()})
+		return
+	}
+	if event.Result == models.EventRejected || event.Result == models.EventUnmatched || event.Result == models.EventRefunded {
+		log.Printf("Payment event %s/%s %s: %s", event.Provider, event.EventID, event.Result, event.Detail)
+	}
+
+	// Pay back money that arrived for a payment given up. Refunds the
+	// provider can't take now are sent again by the refund sweeper.
+	if event.Result == models.EventRefunded && event.PaymentID != nil {
+		var refunds []models.PaymentRefund
+		err := a.db.Where("payment_id = ? AND credit_note_id IS NULL AND status = ?", *event.PaymentID, models.PaymentPending).
+			Find(&refunds).Error
+		if err == nil {
+			err = a.sendRefunds(c.Request.Context(), refunds, unwantedPaymentRefundReason)
+		}
+		if err != nil {
+			log.Printf("Failed to refund payment %d: %v", *event.PaymentID, err)
+		}
+	}
+
+	if acknowledger, ok := gateway.(payments.CallbackAcknowledger); ok {
+		contentType, body := acknowledger.AcknowledgeCallback()
+		c.Data(http.StatusOK, contentType, body)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"received": true,
+		"result":   event.Result,
+	})
+}
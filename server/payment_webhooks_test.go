@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tobe_shop/server/models"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+)
+
+// placePendingOrder places an order through the API that waits for the fake
+// gateway to confirm its payment, returning it and the payment reference
+func (e *testEnv) placePendingOrder(buyer *models.User, product *models.Product, quantity int) (*models.Order, string) {
+	e.t.Helper()
+	e.gateway.AutoConfirm = false
+	defer func() { e.gateway.AutoConfirm = true }()
+
+	var created struct {
+		Order   models.Order `json:"order"`
+		Payment struct {
+			Reference string `json:"reference"`
+		} `json:"payment"`
+	}
+	e.do(http.MethodPost, "/api/orders", e.login(buyer),
+		orderRequest(gin.H{"productId": product.ID, "quantity": quantity}), http.StatusCreated, &created)
+	return &created.Order, created.Payment.Reference
+}
+
+// sendCallback delivers a fake gateway callback to the webhook
+func (e *testEnv) sendCallback(body []byte, signature string, wantStatus int) {
+	e.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/payments/webhook/fake", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(payments.FakeSignatureHeader, signature)
+
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	if w.Code != wantStatus {
+		e.t.Fatalf("callback: status = %d, want %d, body: %s", w.Code, wantStatus, w.Body.String())
+	}
+}
+
+func TestPaymentWebhookSettlesOrderOnce(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Blender", 45, 3)
+	order, reference := env.placePendingOrder(buyer, product, 2)
+	now := time.Now()
+
+	// Forged callbacks are refused and not stored
+	body, _ := env.gateway.Callback("evt-1", reference, payments.StatusSucceeded, usd(90), now)
+	env.sendCallback(body, env.gateway.Sign([]byte("something else")), http.StatusUnauthorized)
+
+	env.sendCallback(body, env.gateway.Sign(body), http.StatusOK)
+	// Redelivered
+	env.sendCallback(body, env.gateway.Sign(body), http.StatusOK)
+	// An older event arriving late doesn't undo the payment
+	late, signature := env.gateway.Callback("evt-0", reference, payments.StatusFailed, usd(90), now.Add(-time.Minute))
+	env.sendCallback(late, signature, http.StatusOK)
+
+	var reloaded models.Order
+	env.db.Preload("Invoice").First(&reloaded, order.ID)
+	if reloaded.Status != models.Paid {
+		t.Errorf("order status = %s, want paid", reloaded.Status)
+	}
+	if reloaded.Invoice.Status != models.FullyPaid || reloaded.Invoice.AmountPaid != usd(90) {
+		t.Errorf("invoice = %s with %s paid, want fully_paid with 90", reloaded.Invoice.Status, reloaded.Invoice.AmountPaid)
+	}
+
+	var events []models.PaymentEvent
+	env.db.Order("id").Find(&events)
+	if len(events) != 2 {
+		t.Fatalf("stored %d events, want 2", len(events))
+	}
+	if events[0].Result != models.EventApplied || events[0].Payload != string(body) {
+		t.Errorf("first event = %s with payload %q, want applied with the raw body", events[0].Result, events[0].Payload)
+	}
+	if events[1].Result != models.EventRejected {
+		t.Errorf("late failure event = %s, want rejected", events[1].Result)
+	}
+}
+
+func TestPaymentWebhookFailureAndMismatch(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Mixer", 60, 2)
+	now := time.Now()
+
+	// A payment for another amount is not accepted
+	order, reference := env.placePendingOrder(buyer, product, 1)
+	body, signature := env.gateway.Callback("evt-1", reference, payments.StatusSucceeded, usd(0.01), now)
+	env.sendCallback(body, signature, http.StatusOK)
+
+	var reloaded models.Order
+	env.db.First(&reloaded, order.ID)
+	if reloaded.Status != models.Pending {
+		t.Errorf("order status = %s after mismatched amount, want pending", reloaded.Status)
+	}
+
+	// A failed payment cancels the order and returns its stock
+	body, signature = env.gateway.Callback("evt-2", reference, payments.StatusFailed, usd(60), now)
+	env.sendCallback(body, signature, http.StatusOK)
+	env.db.First(&reloaded, order.ID)
+	if reloaded.Status != models.Cancelled {
+		t.Errorf("order status = %s after failed payment, want cancelled", reloaded.Status)
+	}
+	var restocked models.Product
+	env.db.First(&restocked, product.ID)
+	if restocked.Stock != 2 {
+		t.Errorf("stock = %d after failed payment, want 2", restocked.Stock)
+	}
+
+	// Callbacks for unknown charges are acknowledged and kept
+	body, signature = env.gateway.Callback("evt-3", "PAY-unknown", payments.StatusSucceeded, usd(60), now)
+	env.sendCallback(body, signature, http.StatusOK)
+	var event models.PaymentEvent
+	env.db.Where("event_id = ?", "evt-3").First(&event)
+	if event.Result != models.EventUnmatched {
+		t.Errorf("unknown charge event = %s, want unmatched", event.Result)
+	}
+
+	env.do(http.MethodPost, "/api/payments/webhook/nope", "", gin.H{}, http.StatusNotFound, nil)
+}
+
+func TestCancelledOrderClosesChargeAndRefundsLatePayment(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Toaster", 30, 5)
+	buyerToken := env.login(buyer)
+	ctx := context.Background()
+
+	// Cancelling closes the charge, so the buyer can't pay it any more
+	order, reference := env.placePendingOrder(buyer, product, 1)
+	env.do(http.MethodPut, fmt.Sprintf("/api/orders/%d", order.ID), buyerToken,
+		gin.H{"status": models.Cancelled}, http.StatusOK, nil)
+	charge, err := env.gateway.QueryCharge(ctx, reference)
+	if err != nil || charge.Status != payments.StatusFailed {
+		t.Errorf("charge = %+v, %v; want closed", charge, err)
+	}
+	var payment models.Payment
+	env.db.Where("provider_reference = ?", reference).First(&payment)
+	if payment.Status != models.PaymentFailed {
+		t.Errorf("payment status = %s, want failed", payment.Status)
+	}
+
+	// A buyer who paid just before cancelling gets the money back
+	order, reference = env.placePendingOrder(buyer, product, 1)
+	env.gateway.Complete(reference, payments.StatusSucceeded)
+	env.do(http.MethodPut, fmt.Sprintf("/api/orders/%d", order.ID), buyerToken,
+		gin.H{"status": models.Cancelled}, http.StatusOK, nil)
+	body, signature := env.gateway.Callback("evt-late", reference, payments.StatusSucceeded, usd(30), time.Now())
+	env.sendCallback(body, signature, http.StatusOK)
+
+	var event models.PaymentEvent
+	env.db.Where("event_id = ?", "evt-late").First(&event)
+	var paid models.Payment
+	env.db.Where("provider_reference = ?", reference).First(&paid)
+	if event.Result != models.EventRefunded || paid.Status != models.PaymentSucceeded || paid.AmountRefunded != usd(30) {
+		t.Errorf("event %s, payment %s with %s refunded; want refunded in full", event.Result, paid.Status, paid.AmountRefunded)
+	}
+	var refund models.PaymentRefund
+	env.db.Where("payment_id = ?", paid.ID).First(&refund)
+	if refund.Status != models.PaymentSucceeded || refund.Amount != usd(30) || refund.CreditNoteID != nil {
+		t.Errorf("refund = %+v, want 30 paid back without a credit note", refund)
+	}
+	sent, err := env.gateway.Refund(ctx, payments.RefundRequest{Reference: reference, RefundReference: refund.RefundReference, Amount: usd(30)})
+	if err != nil || sent.Amount != usd(30) {
+		t.Errorf("provider refund = %+v, %v; want the existing refund of 30", sent, err)
+	}
+
+	var reloaded models.Order
+	env.db.Preload("Invoice").First(&reloaded, order.ID)
+	if reloaded.Status != models.Cancelled || reloaded.Invoice.Status != models.Void {
+		t.Errorf("order %s with invoice %s, want cancelled and void", reloaded.Status, reloaded.Invoice.Status)
+	}
+}
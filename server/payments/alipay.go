@@ -0,0 +1,453 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"tobe_shop/server/money"
+)
+
+// AlipayGatewayURL is the production Alipay open platform gateway
+const AlipayGatewayURL = "https://openapi.alipay.com/gateway.do"
+
+// alipayTimeLayout is the time format of Alipay request and callback fields,
+// in China Standard Time
+const alipayTimeLayout = "2006-01-02 15:04:05"
+
+var alipayLocation = time.FixedZone("CST", 8*60*60)
+
+// alipayCurrency is the currency Alipay trades are priced and settled in
+const alipayCurrency = "CNY"
+
+// AlipayConfig configures an Alipay gateway
+type AlipayConfig struct {
+	AppID string
+	// PrivateKey signs requests; AlipayPublicKey verifies responses and
+	// callbacks. Both are PEM blocks or bare base64 DER as issued by Alipay.
+	PrivateKey      string
+	AlipayPublicKey string
+	// GatewayURL defaults to AlipayGatewayURL
+	GatewayURL string
+	NotifyURL  string
+	ReturnURL  string
+	HTTPClient *http.Client
+}
+
+// Alipay speaks the Alipay open platform protocol: RSA2-signed form
+// requests, hosted page payments (alipay.trade.page.pay), trade queries,
+// refunds and asynchronous notifications.
+type Alipay struct {
+	cfg        AlipayConfig
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+	client     *http.Client
+}
+
+// NewAlipay parses the keys in cfg and returns the gateway
+func NewAlipay(cfg AlipayConfig) (*Alipay, error) {
+	if cfg.AppID == "" {
+		return nil, errors.New("payments: Alipay app ID is required")
+	}
+	privateKey, err := parsePrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("payments: invalid Alipay private key: %w", err)
+	}
+	publicKey, err := parsePublicKey(cfg.AlipayPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("payments: invalid Alipay public key: %w", err)
+	}
+	if cfg.GatewayURL == "" {
+		cfg.GatewayURL = AlipayGatewayURL
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	return &Alipay{cfg: cfg, privateKey: privateKey, publicKey: publicKey, client: client}, nil
+}
+
+func (a *Alipay) Name() string {
+	return "alipay"
+}
+
+// CreateCharge builds a signed page payment URL. Nothing is sent to Alipay
+// until the buyer opens it, so the charge starts out pending.
+func (a *Alipay) CreateCharge(ctx context.Context, req ChargeRequest) (*Charge, error) {
+	amount, err := formatAlipayAmount(req.Amount)
+	if err != nil {
+		return nil, err
+	}
+	params, err := a.requestParams("alipay.trade.page.pay", map[string]string{
+		"out_trade_no": req.Reference,
+		"total_amount": amount,
+		"subject":      req.Subject,
+		"product_code": "FAST_INSTANT_TRADE_PAY",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.cfg.ReturnURL != "" {
+		params.Set("return_url", a.cfg.ReturnURL)
+	}
+	if err := a.sign(params); err != nil {
+		return nil, err
+	}
+
+	return &Charge{
+		Reference:  req.Reference,
+		Status:     StatusPending,
+		Amount:     req.Amount,
+		PaymentURL: a.cfg.GatewayURL + "?" + params.Encode(),
+	}, nil
+}
+
+func (a *Alipay) QueryCharge(ctx context.Context, reference string) (*Charge, error) {
+	var resp struct {
+		alipayResponse
+		TradeNo     string `json:"trade_no"`
+		OutTradeNo  string `json:"out_trade_no"`
+		TradeStatus string `json:"trade_status"`
+		TotalAmount string `json:"total_amount"`
+	}
+	if err := a.call(ctx, "alipay.trade.query", map[string]string{"out_trade_no": reference}, &resp); err != nil {
+		return nil, err
+	}
+	if resp.SubCode == "ACQ.TRADE_NOT_EXIST" {
+		// The buyer hasn't opened the payment page yet
+		return &Charge{Reference: reference, Status: StatusPending}, nil
+	}
+	if err := resp.err(); err != nil {
+		return nil, err
+	}
+
+	amount, _ := parseAlipayAmount(resp.TotalAmount)
+	return &Charge{
+		Reference:  resp.OutTradeNo,
+		ProviderID: resp.TradeNo,
+		Status:     alipayTradeStatus(resp.TradeStatus),
+		Amount:     amount,
+	}, nil
+}
+
+func (a *Alipay) CloseCharge(ctx context.Context, reference string) error {
+	var resp alipayResponse
+	if err := a.call(ctx, "alipay.trade.close", map[string]string{"out_trade_no": reference}, &resp); err != nil {
+		return err
+	}
+	switch resp.SubCode {
+	case "ACQ.TRADE_NOT_EXIST", "ACQ.TRADE_STATUS_ERROR":
+		// Not opened yet, or already paid or closed. Alipay only creates
+		// the trade when the buyer opens the payment page, so a payment made
+		// after all still arrives as a callback.
+		return nil
+	}
+	return resp.err()
+}
+
+func (a *Alipay) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	var resp struct {
+		alipayResponse
+		OutTradeNo string `json:"out_trade_no"`
+		RefundFee  string `json:"refund_fee"`
+		FundChange string `json:"fund_change"`
+	}
+	amount, err := formatAlipayAmount(req.Amount)
+	if err != nil {
+		return nil, err
+	}
+	biz := map[string]string{
+		"out_trade_no":   req.Reference,
+		"refund_amount":  amount,
+		"out_request_no": req.RefundReference,
+	}
+	if req.Reason != "" {
+		biz["refund_reason"] = req.Reason
+	}
+	if err := a.call(ctx, "alipay.trade.refund", biz, &resp); err != nil {
+		return nil, err
+	}
+	if err := resp.err(); err != nil {
+		return nil, err
+	}
+
+	return &Refund{
+		Reference:       req.Reference,
+		RefundReference: req.RefundReference,
+		Status:          StatusSucceeded,
+		Amount:          req.Amount,
+	}, nil
+}
+
+// VerifyCallback verifies an Alipay asynchronous notification, a form POST
+// signed with Alipay's key over its sorted parameters
+func (a *Alipay) VerifyCallback(r *http.Request) (*Notification, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, ErrMalformedCallback
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params.Get("sign"))
+	if err != nil || params.Get("sign_type") != "RSA2" {
+		return nil, ErrInvalidSignature
+	}
+	digest := sha256.Sum256([]byte(signingString(params, "sign", "sign_type")))
+	if err := rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	// A valid signature from another merchant's app is still not ours
+	if params.Get("app_id") != a.cfg.AppID {
+		return nil, ErrInvalidSignature
+	}
+	if params.Get("notify_id") == "" || params.Get("out_trade_no") == "" {
+		return nil, ErrMalformedCallback
+	}
+
+	amount, _ := parseAlipayAmount(params.Get("total_amount"))
+	occurredAt, _ := time.ParseInLocation(alipayTimeLayout, params.Get("notify_time"), alipayLocation)
+	return &Notification{
+		EventID:    params.Get("notify_id"),
+		Reference:  params.Get("out_trade_no"),
+		ProviderID: params.Get("trade_no"),
+		Status:     alipayTradeStatus(params.Get("trade_status")),
+		Amount:     amount,
+		OccurredAt: occurredAt,
+		Raw:        body,
+	}, nil
+}
+
+// AcknowledgeCallback returns the reply Alipay expects to a notification;
+// anything else makes it redeliver the notification for up to a day
+func (a *Alipay) AcknowledgeCallback() (string, []byte) {
+	return "text/plain; charset=utf-8", []byte("success")
+}
+
+// alipayResponse holds the result fields common to every API response
+type alipayResponse struct {
+	Code    string `json:"code"`
+	Msg     string `json:"msg"`
+	SubCode string `json:"sub_code"`
+	SubMsg  string `json:"sub_msg"`
+}
+
+func (r alipayResponse) err() error {
+	if r.Code == "10000" {
+		return nil
+	}
+	return fmt.Errorf("payments: Alipay error %s %s: %s", r.Code, r.SubCode, r.SubMsg)
+}
+
+// alipayTradeStatus maps an Alipay trade_status to a charge status. Closed
+// trades were never paid or were refunded in full.
+func alipayTradeStatus(status string) Status {
+	switch status {
+	case "TRADE_SUCCESS", "TRADE_FINISHED":
+		return StatusSucceeded
+	case "TRADE_CLOSED":
+		return StatusFailed
+	}
+	return StatusPending
+}
+
+// requestParams returns the common request parameters for method with biz
+// as its JSON biz_content
+func (a *Alipay) requestParams(method string, biz map[string]string) (url.Values, error) {
+	content, err := json.Marshal(biz)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("app_id", a.cfg.AppID)
+	params.Set("method", method)
+	params.Set("format", "JSON")
+	params.Set("charset", "utf-8")
+	params.Set("sign_type", "RSA2")
+	params.Set("timestamp", time.Now().In(alipayLocation).Format(alipayTimeLayout))
+	params.Set("version", "1.0")
+	params.Set("biz_content", string(content))
+	if a.cfg.NotifyURL != "" {
+		params.Set("notify_url", a.cfg.NotifyURL)
+	}
+	return params, nil
+}
+
+// sign adds the RSA2 signature of the parameters
+func (a *Alipay) sign(params url.Values) error {
+	digest := sha256.Sum256([]byte(signingString(params, "sign")))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	params.Set("sign", base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// call sends a signed API request and decodes the verified response object
+// into out
+func (a *Alipay) call(ctx context.Context, method string, biz map[string]string, out interface{}) error {
+	params, err := a.requestParams(method, biz)
+	if err != nil {
+		return err
+	}
+	if err := a.sign(params); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.GatewayURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("payments: Alipay returned HTTP %d", resp.StatusCode)
+	}
+
+	// The response object is signed exactly as it appears in the body,
+	// e.g. {"alipay_trade_query_response":{...},"sign":"..."}
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("payments: malformed Alipay response: %w", err)
+	}
+	content, ok := envelope[strings.ReplaceAll(method, ".", "_")+"_response"]
+	if !ok {
+		return errors.New("payments: malformed Alipay response")
+	}
+
+	var signature string
+	if raw, ok := envelope["sign"]; ok {
+		if err := json.Unmarshal(raw, &signature); err != nil {
+			return ErrInvalidSignature
+		}
+	}
+	if signature == "" {
+		// Alipay leaves some error responses unsigned; those can't report success
+		var result alipayResponse
+		if err := json.Unmarshal(content, &result); err != nil || result.Code == "10000" {
+			return ErrInvalidSignature
+		}
+		return json.Unmarshal(content, out)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	digest := sha256.Sum256(content)
+	if err := rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], decoded); err != nil {
+		return ErrInvalidSignature
+	}
+
+	return json.Unmarshal(content, out)
+}
+
+// signingString joins the non-empty parameters other than skip as sorted
+// key=value pairs, the string Alipay signs
+func signingString(params url.Values, skip ...string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		skipped := false
+		for _, s := range skip {
+			if key == s {
+				skipped = true
+			}
+		}
+		if !skipped && params.Get(key) != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(params.Get(key))
+	}
+	return b.String()
+}
+
+// formatAlipayAmount writes an amount in yuan. Alipay takes no currency
+// field, so amounts in any other currency are refused rather than charged
+// as the same number of yuan.
+func formatAlipayAmount(amount money.Money) (string, error) {
+	if amount.Currency != alipayCurrency {
+		return "", fmt.Errorf("%w: Alipay charges in %s, not %s", ErrUnsupportedCurrency, alipayCurrency, amount.Currency)
+	}
+	return amount.Decimal(), nil
+}
+
+// parseAlipayAmount reads an amount reported by Alipay, which is always in
+// yuan
+func parseAlipayAmount(amount string) (money.Money, error) {
+	return money.Parse(amount, alipayCurrency)
+}
+
+// decodeKey returns the DER bytes of a PEM block or bare base64 key
+func decodeKey(key string) ([]byte, error) {
+	if block, _ := pem.Decode([]byte(key)); block != nil {
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(key), ""))
+}
+
+func parsePrivateKey(key string) (*rsa.PrivateKey, error) {
+	der, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if parsed, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if rsaKey, ok := parsed.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("not an RSA key")
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+func parsePublicKey(key string) (*rsa.PublicKey, error) {
+	der, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
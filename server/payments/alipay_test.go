@@ -0,0 +1,276 @@
+package payments
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"tobe_shop/server/money"
+)
+
+// alipayStub is a local stand-in for the Alipay gateway. It checks request
+// signatures with the app's public key and signs its responses with its own
+// key, like Alipay does.
+type alipayStub struct {
+	t         *testing.T
+	appKey    *rsa.PublicKey
+	key       *rsa.PrivateKey
+	trades    map[string]string // out_trade_no to trade_status
+	refunded  map[string]bool   // out_request_no
+	lastQuery url.Values
+}
+
+func (s *alipayStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.t.Fatalf("parse form: %v", err)
+	}
+	params := r.PostForm
+	s.lastQuery = params
+
+	signature, _ := base64.StdEncoding.DecodeString(params.Get("sign"))
+	digest := sha256.Sum256([]byte(signingString(params, "sign")))
+	if rsa.VerifyPKCS1v15(s.appKey, crypto.SHA256, digest[:], signature) != nil {
+		s.respond(w, params.Get("method"), map[string]string{"code": "40002", "msg": "Invalid Arguments", "sub_code": "isv.invalid-signature"})
+		return
+	}
+
+	var biz map[string]string
+	json.Unmarshal([]byte(params.Get("biz_content")), &biz)
+	switch params.Get("method") {
+	case "alipay.trade.query":
+		status, ok := s.trades[biz["out_trade_no"]]
+		if !ok {
+			s.respond(w, "alipay.trade.query", map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_NOT_EXIST"})
+			return
+		}
+		s.respond(w, "alipay.trade.query", map[string]string{
+			"code": "10000", "msg": "Success", "trade_no": "2024" + biz["out_trade_no"],
+			"out_trade_no": biz["out_trade_no"], "trade_status": status, "total_amount": "88.80",
+		})
+	case "alipay.trade.close":
+		status, ok := s.trades[biz["out_trade_no"]]
+		switch {
+		case !ok:
+			s.respond(w, "alipay.trade.close", map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_NOT_EXIST"})
+		case status != "WAIT_BUYER_PAY":
+			s.respond(w, "alipay.trade.close", map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_STATUS_ERROR"})
+		default:
+			s.trades[biz["out_trade_no"]] = "TRADE_CLOSED"
+			s.respond(w, "alipay.trade.close", map[string]string{"code": "10000", "msg": "Success", "out_trade_no": biz["out_trade_no"]})
+		}
+	case "alipay.trade.refund":
+		s.refunded[biz["out_request_no"]] = true
+		s.respond(w, "alipay.trade.refund", map[string]string{
+			"code": "10000", "msg": "Success", "out_trade_no": biz["out_trade_no"], "refund_fee": biz["refund_amount"], "fund_change": "Y",
+		})
+	}
+}
+
+func (s *alipayStub) respond(w http.ResponseWriter, method string, fields map[string]string) {
+	content, _ := json.Marshal(fields)
+	digest := sha256.Sum256(content)
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	name := strings.ReplaceAll(method, ".", "_") + "_response"
+	fmt.Fprintf(w, `{"%s":%s,"sign":"%s"}`, name, content, base64.StdEncoding.EncodeToString(signature))
+}
+
+// signNotification signs callback parameters with the stub's key
+func (s *alipayStub) signNotification(params url.Values) string {
+	digest := sha256.Sum256([]byte(signingString(params, "sign", "sign_type")))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	params.Set("sign", base64.StdEncoding.EncodeToString(signature))
+	params.Set("sign_type", "RSA2")
+	return params.Encode()
+}
+
+func newAlipayTest(t *testing.T) (*Alipay, *alipayStub) {
+	t.Helper()
+	appKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alipayKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &alipayStub{t: t, appKey: &appKey.PublicKey, key: alipayKey, trades: map[string]string{}, refunded: map[string]bool{}}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	// The app key as a PEM block and Alipay's key as bare base64, the two
+	// forms keys are handed out in
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(appKey)
+	publicDER, _ := x509.MarshalPKIXPublicKey(&alipayKey.PublicKey)
+	gateway, err := NewAlipay(AlipayConfig{
+		AppID:           "2021000000000001",
+		PrivateKey:      string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		AlipayPublicKey: base64.StdEncoding.EncodeToString(publicDER),
+		GatewayURL:      server.URL,
+		NotifyURL:       "https://shop.example.com/api/payments/webhook/alipay",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gateway, stub
+}
+
+func TestAlipayChargeLifecycle(t *testing.T) {
+	gateway, stub := newAlipayTest(t)
+	ctx := context.Background()
+
+	charge, err := gateway.CreateCharge(ctx, ChargeRequest{Reference: "ORDER-1-100", Amount: money.New(8880, "CNY"), Subject: "TobeShop order #1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if charge.Status != StatusPending || !strings.HasPrefix(charge.PaymentURL, gateway.cfg.GatewayURL+"?") {
+		t.Fatalf("charge = %+v, want pending with a payment URL", charge)
+	}
+
+	// The payment page URL carries a valid signature over the order
+	pageURL, _ := url.Parse(charge.PaymentURL)
+	page := pageURL.Query()
+	signature, _ := base64.StdEncoding.DecodeString(page.Get("sign"))
+	digest := sha256.Sum256([]byte(signingString(page, "sign")))
+	if err := rsa.VerifyPKCS1v15(stub.appKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("payment URL signature: %v", err)
+	}
+	if page.Get("method") != "alipay.trade.page.pay" || !strings.Contains(page.Get("biz_content"), `"total_amount":"88.80"`) {
+		t.Errorf("payment URL parameters = %v", page)
+	}
+
+	// Not opened yet, then paid
+	charge, err = gateway.QueryCharge(ctx, "ORDER-1-100")
+	if err != nil || charge.Status != StatusPending {
+		t.Fatalf("query before payment = %+v, %v; want pending", charge, err)
+	}
+	stub.trades["ORDER-1-100"] = "TRADE_SUCCESS"
+	charge, err = gateway.QueryCharge(ctx, "ORDER-1-100")
+	if err != nil || charge.Status != StatusSucceeded || charge.Amount.Minor != 8880 || charge.ProviderID == "" {
+		t.Fatalf("query after payment = %+v, %v; want succeeded", charge, err)
+	}
+
+	refund, err := gateway.Refund(ctx, RefundRequest{Reference: "ORDER-1-100", RefundReference: "RMA-1", Amount: money.New(2000, "CNY")})
+	if err != nil || refund.Status != StatusSucceeded || !stub.refunded["RMA-1"] {
+		t.Fatalf("refund = %+v, %v; want succeeded", refund, err)
+	}
+}
+
+func TestAlipayCloseCharge(t *testing.T) {
+	gateway, stub := newAlipayTest(t)
+	ctx := context.Background()
+
+	// Opened but not paid
+	stub.trades["ORDER-6-100"] = "WAIT_BUYER_PAY"
+	if err := gateway.CloseCharge(ctx, "ORDER-6-100"); err != nil || stub.trades["ORDER-6-100"] != "TRADE_CLOSED" {
+		t.Errorf("close = %v with trade %s, want closed", err, stub.trades["ORDER-6-100"])
+	}
+
+	// Never opened, or paid already: nothing to close
+	stub.trades["ORDER-7-100"] = "TRADE_SUCCESS"
+	for _, reference := range []string{"ORDER-8-100", "ORDER-7-100"} {
+		if err := gateway.CloseCharge(ctx, reference); err != nil {
+			t.Errorf("close %s = %v, want nil", reference, err)
+		}
+	}
+	if stub.trades["ORDER-7-100"] != "TRADE_SUCCESS" {
+		t.Errorf("paid trade = %s, want it left paid", stub.trades["ORDER-7-100"])
+	}
+}
+
+func TestAlipayChargesOnlyYuan(t *testing.T) {
+	gateway, stub := newAlipayTest(t)
+	ctx := context.Background()
+
+	// 88.80 dollars must not go out as 88.80 yuan
+	if _, err := gateway.CreateCharge(ctx, ChargeRequest{Reference: "ORDER-4-100", Amount: money.New(8880, "USD")}); !errors.Is(err, ErrUnsupportedCurrency) {
+		t.Errorf("USD charge error = %v, want ErrUnsupportedCurrency", err)
+	}
+	if _, err := gateway.Refund(ctx, RefundRequest{Reference: "ORDER-4-100", RefundReference: "RMA-4", Amount: money.New(500, "EUR")}); !errors.Is(err, ErrUnsupportedCurrency) {
+		t.Errorf("EUR refund error = %v, want ErrUnsupportedCurrency", err)
+	}
+	if stub.refunded["RMA-4"] {
+		t.Error("EUR refund reached Alipay")
+	}
+
+	// Reported amounts are in yuan
+	stub.trades["ORDER-5-100"] = "TRADE_SUCCESS"
+	charge, err := gateway.QueryCharge(ctx, "ORDER-5-100")
+	if err != nil || charge.Amount != money.New(8880, "CNY") {
+		t.Errorf("query = %+v, %v; want 88.80 CNY", charge, err)
+	}
+}
+
+func TestAlipayRejectsForgedResponses(t *testing.T) {
+	gateway, stub := newAlipayTest(t)
+	stub.trades["ORDER-2-100"] = "TRADE_SUCCESS"
+
+	// A response signed by someone else
+	forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	stub.key = forger
+	if _, err := gateway.QueryCharge(context.Background(), "ORDER-2-100"); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("forged response error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestAlipayVerifyCallback(t *testing.T) {
+	gateway, stub := newAlipayTest(t)
+
+	notification := func() url.Values {
+		return url.Values{
+			"notify_id":    {"ac05099524730693a8b330c5ecf72da9786"},
+			"notify_time":  {"2024-03-01 12:30:00"},
+			"notify_type":  {"trade_status_sync"},
+			"app_id":       {gateway.cfg.AppID},
+			"out_trade_no": {"ORDER-3-100"},
+			"trade_no":     {"2024030122001"},
+			"trade_status": {"TRADE_SUCCESS"},
+			"total_amount": {"88.80"},
+		}
+	}
+	request := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/payments/webhook/alipay", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	got, err := gateway.VerifyCallback(request(stub.signNotification(notification())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EventID != "ac05099524730693a8b330c5ecf72da9786" || got.Reference != "ORDER-3-100" ||
+		got.Status != StatusSucceeded || got.Amount != money.New(8880, "CNY") || got.OccurredAt.IsZero() {
+		t.Errorf("notification = %+v", got)
+	}
+
+	// Changing a signed field breaks the signature
+	tampered, _ := url.ParseQuery(stub.signNotification(notification()))
+	tampered.Set("total_amount", "0.01")
+	if _, err := gateway.VerifyCallback(request(tampered.Encode())); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("tampered callback error = %v, want ErrInvalidSignature", err)
+	}
+
+	// So does leaving it out
+	if _, err := gateway.VerifyCallback(request(notification().Encode())); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("unsigned callback error = %v, want ErrInvalidSignature", err)
+	}
+
+	// Correctly signed callbacks for another app are rejected too
+	other := notification()
+	other.Set("app_id", "2021000000000002")
+	if _, err := gateway.VerifyCallback(request(stub.signNotification(other))); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("other app callback error = %v, want ErrInvalidSignature", err)
+	}
+}
@@ -0,0 +1,223 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"tobe_shop/server/money"
+)
+
+// FakeDeclineCode is the card security code the fake gateway declines, so
+// failed payments can be tried out locally
+const FakeDeclineCode = "000"
+
+// FakeSignatureHeader carries the signature of fake gateway callbacks
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// Fake is an in-process gateway for development and tests. Charges succeed
+// immediately when AutoConfirm is set and stay pending otherwise, to be
+// completed through Complete or a signed callback.
+type Fake struct {
+	AutoConfirm bool
+	// Secret signs callbacks
+	Secret []byte
+
+	mu      sync.Mutex
+	charges map[string]*Charge
+	refunds map[string]*Refund
+	nextID  int
+}
+
+// NewFake returns a fake gateway that signs callbacks with secret
+func NewFake(secret []byte, autoConfirm bool) *Fake {
+	return &Fake{
+		AutoConfirm: autoConfirm,
+		Secret:      secret,
+		charges:     make(map[string]*Charge),
+		refunds:     make(map[string]*Refund),
+	}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) CreateCharge(ctx context.Context, req ChargeRequest) (*Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if existing, ok := f.charges[req.Reference]; ok {
+		copied := *existing
+		return &copied, nil
+	}
+
+	f.nextID++
+	charge := &Charge{
+		Reference:  req.Reference,
+		ProviderID: fmt.Sprintf("FAKE-%06d", f.nextID),
+		Status:     StatusPending,
+		Amount:     req.Amount,
+	}
+	switch {
+	case req.VssCode == FakeDeclineCode:
+		charge.Status = StatusFailed
+	case f.AutoConfirm:
+		charge.Status = StatusSucceeded
+	}
+	f.charges[req.Reference] = charge
+
+	copied := *charge
+	return &copied, nil
+}
+
+func (f *Fake) QueryCharge(ctx context.Context, reference string) (*Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[reference]
+	if !ok {
+		return nil, ErrUnknownCharge
+	}
+	copied := *charge
+	return &copied, nil
+}
+
+func (f *Fake) CloseCharge(ctx context.Context, reference string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[reference]
+	if !ok {
+		return ErrUnknownCharge
+	}
+	if charge.Status == StatusPending {
+		charge.Status = StatusFailed
+	}
+	return nil
+}
+
+// Complete settles a pending charge as if the buyer had paid or given up
+func (f *Fake) Complete(reference string, status Status) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[reference]
+	if !ok {
+		return ErrUnknownCharge
+	}
+	charge.Status = status
+	return nil
+}
+
+func (f *Fake) Refund(ctx context.Context, req RefundRequest) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if existing, ok := f.refunds[req.RefundReference]; ok {
+		copied := *existing
+		return &copied, nil
+	}
+
+	charge, ok := f.charges[req.Reference]
+	if !ok {
+		return nil, ErrUnknownCharge
+	}
+	if charge.Status != StatusSucceeded {
+		return nil, fmt.Errorf("payments: charge %s has not succeeded", req.Reference)
+	}
+
+	refunded := money.Zero(charge.Amount.Currency)
+	for _, refund := range f.refunds {
+		if refund.Reference == req.Reference {
+			refunded = refunded.Add(refund.Amount)
+		}
+	}
+	if refunded.Add(req.Amount).Cmp(charge.Amount) > 0 {
+		return nil, fmt.Errorf("payments: refund exceeds the charged amount")
+	}
+
+	refund := &Refund{
+		Reference:       req.Reference,
+		RefundReference: req.RefundReference,
+		Status:          StatusSucceeded,
+		Amount:          req.Amount,
+	}
+	f.refunds[req.RefundReference] = refund
+
+	copied := *refund
+	return &copied, nil
+}
+
+// fakeCallback is the JSON body of a fake gateway callback
+type fakeCallback struct {
+	EventID    string      `json:"eventId"`
+	Reference  string      `json:"reference"`
+	ProviderID string      `json:"providerId"`
+	Status     Status      `json:"status"`
+	Amount     json.Number `json:"amount"`
+	Currency   string      `json:"currency"`
+	OccurredAt time.Time   `json:"occurredAt"`
+}
+
+// Sign returns the signature of a callback body
+func (f *Fake) Sign(body []byte) string {
+	return hex.EncodeToString(f.mac(body))
+}
+
+func (f *Fake) mac(body []byte) []byte {
+	mac := hmac.New(sha256.New, f.Secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Callback builds the signed body of a callback about a charge, as the fake
+// provider would send it
+func (f *Fake) Callback(eventID, reference string, status Status, amount money.Money, occurredAt time.Time) (body []byte, signature string) {
+	body, _ = json.Marshal(fakeCallback{
+		EventID:    eventID,
+		Reference:  reference,
+		Status:     status,
+		Amount:     json.Number(amount.Decimal()),
+		Currency:   amount.Currency,
+		OccurredAt: occurredAt,
+	})
+	return body, f.Sign(body)
+}
+
+func (f *Fake) VerifyCallback(r *http.Request) (*Notification, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(FakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, f.mac(body)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var callback fakeCallback
+	if err := json.Unmarshal(body, &callback); err != nil || callback.EventID == "" || callback.Reference == "" {
+		return nil, ErrMalformedCallback
+	}
+	amount, err := money.Parse(callback.Amount.String(), callback.Currency)
+	if err != nil {
+		return nil, ErrMalformedCallback
+	}
+
+	return &Notification{
+		EventID:    callback.EventID,
+		Reference:  callback.Reference,
+		ProviderID: callback.ProviderID,
+		Status:     callback.Status,
+		Amount:     amount,
+		OccurredAt: callback.OccurredAt,
+		Raw:        body,
+	}, nil
+}
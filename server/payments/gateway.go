@@ -0,0 +1,171 @@
+// Package payments talks to payment providers. Each provider implements
+// Gateway; the shop only deals in charges, refunds and callback
+// notifications and never sees provider-specific protocols.
+package payments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+	"tobe_shop/server/money"
+)
+
+// Status is the state of a charge or refund at the provider
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// IsFinal reports whether the status will not change any more
+func (s Status) IsFinal() bool {
+	return s == StatusSucceeded || s == StatusFailed
+}
+
+var (
+	ErrUnknownCharge     = errors.New("payments: unknown charge")
+	ErrInvalidSignature  = errors.New("payments: invalid callback signature")
+	ErrMalformedCallback = errors.New("payments: malformed callback")
+	ErrUnknownProvider   = errors.New("payments: unknown provider")
+	// ErrUnsupportedCurrency is returned for charges and refunds in a
+	// currency the provider doesn't settle in
+	ErrUnsupportedCurrency = errors.New("payments: unsupported currency")
+)
+
+// ChargeRequest asks a provider to collect Amount for an order
+type ChargeRequest struct {
+	// Reference is the shop's unique ID for the charge, used to look it up
+	// again and to match callbacks
+	Reference string
+	Amount    money.Money
+	Subject   string
+	// BankCode and VssCode are the card details entered at checkout, for
+	// providers that charge cards directly
+	BankCode string
+	VssCode  string
+}
+
+// Charge is the provider's view of a charge
+type Charge struct {
+	Reference string
+	// ProviderID is the provider's own ID for the charge, when it has one
+	ProviderID string
+	Status     Status
+	Amount     money.Money
+	// PaymentURL is where to send the buyer to complete a pending charge,
+	// for providers with a hosted payment page
+	PaymentURL string
+}
+
+// RefundRequest returns Amount of a succeeded charge to the buyer
+type RefundRequest struct {
+	Reference string
+	// RefundReference is the shop's unique ID for the refund; repeating a
+	// refund with the same reference does not refund twice
+	RefundReference string
+	Amount          money.Money
+	Reason          string
+}
+
+// Refund is the provider's view of a refund
+type Refund struct {
+	Reference       string
+	RefundReference string
+	Status          Status
+	Amount          money.Money
+}
+
+// Notification is a verified callback from a provider about a charge
+type Notification struct {
+	// EventID identifies the callback so repeated deliveries can be detected
+	EventID    string
+	Reference  string
+	ProviderID string
+	Status     Status
+	Amount     money.Money
+	OccurredAt time.Time
+	// Raw is the callback body exactly as received
+	Raw []byte
+}
+
+// Gateway is a payment provider
+type Gateway interface {
+	// Name identifies the provider, e.g. in webhook URLs
+	Name() string
+	// CreateCharge starts collecting a payment. Providers with a hosted
+	// payment page return a pending charge with a PaymentURL.
+	CreateCharge(ctx context.Context, req ChargeRequest) (*Charge, error)
+	// QueryCharge asks the provider for the current state of a charge
+	QueryCharge(ctx context.Context, reference string) (*Charge, error)
+	// CloseCharge stops a pending charge from being paid, e.g. when its
+	// order is cancelled. A charge paid in the meantime stays paid and is
+	// still reported through its callback.
+	CloseCharge(ctx context.Context, reference string) error
+	// Refund returns money of a succeeded charge
+	Refund(ctx context.Context, req RefundRequest) (*Refund, error)
+	// VerifyCallback checks the signature of a provider callback request
+	// and decodes it, returning ErrInvalidSignature for forged requests
+	VerifyCallback(r *http.Request) (*Notification, error)
+}
+
+// CallbackAcknowledger is implemented by gateways that expect a particular
+// reply before they stop redelivering a callback
+type CallbackAcknowledger interface {
+	AcknowledgeCallback() (contentType string, body []byte)
+}
+
+// Registry holds the configured gateways by name
+type Registry struct {
+	gateways    map[string]Gateway
+	defaultName string
+}
+
+// NewRegistry returns a registry of the gateways. The first one is used for
+// new charges unless SetDefault picks another.
+func NewRegistry(gateways ...Gateway) *Registry {
+	r := &Registry{gateways: make(map[string]Gateway)}
+	for _, gateway := range gateways {
+		if r.defaultName == "" {
+			r.defaultName = gateway.Name()
+		}
+		r.gateways[gateway.Name()] = gateway
+	}
+	return r
+}
+
+// SetDefault selects the gateway used for new charges
+func (r *Registry) SetDefault(name string) error {
+	if _, ok := r.gateways[name]; !ok {
+		return ErrUnknownProvider
+	}
+	r.defaultName = name
+	return nil
+}
+
+// Default returns the gateway used for new charges
+func (r *Registry) Default() Gateway {
+	return r.gateways[r.defaultName]
+}
+
+// Get returns the gateway called name
+func (r *Registry) Get(name string) (Gateway, error) {
+	gateway, ok := r.gateways[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return gateway, nil
+}
+
+// Names returns the names of the configured gateways in order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.gateways))
+	for name := range r.gateways {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,312 @@
+// Package pdf writes simple single-column PDF documents: text, lines and
+// filled rectangles on A4 pages. It has no dependencies and embeds no fonts.
+// Latin text is set in the standard Helvetica fonts and everything else in
+// STSong-Light, the Simplified Chinese font every PDF reader provides, so
+// documents can mix English and Chinese.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// A4 page size in points
+const (
+	PageWidth  = 595.0
+	PageHeight = 842.0
+)
+
+// Style selects the weight of text. Chinese text has no bold face and is
+// always set regular.
+type Style int
+
+const (
+	Regular Style = iota
+	Bold
+)
+
+// Font resource names used in page content streams
+const (
+	fontRegular = "F1"
+	fontBold    = "F2"
+	fontCJK     = "F3"
+)
+
+// Document is a PDF document being built page by page
+type Document struct {
+	Title string
+	pages []*Page
+}
+
+// New returns an empty document
+func New() *Document {
+	return &Document{}
+}
+
+// AddPage appends a blank A4 page and returns it
+func (d *Document) AddPage() *Page {
+	page := &Page{}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// Pages returns the pages added so far
+func (d *Document) Pages() []*Page {
+	return d.pages
+}
+
+// Page is one page of a document. Coordinates are in points with the origin
+// at the bottom left corner.
+type Page struct {
+	content bytes.Buffer
+}
+
+// Text draws s with its baseline starting at x, y
+func (p *Page) Text(x, y, size float64, style Style, s string) {
+	for _, run := range splitRuns(s) {
+		font := fontRegular
+		if style == Bold {
+			font = fontBold
+		}
+		var encoded string
+		if run.cjk {
+			font = fontCJK
+			encoded = encodeUCS2(run.text)
+		} else {
+			encoded = "(" + escapeLiteral(run.text) + ")"
+		}
+		fmt.Fprintf(&p.content, "BT /%s %s Tf %s %s Td %s Tj ET\n", font, num(size), num(x), num(y), encoded)
+		x += runWidth(run, size, style)
+	}
+}
+
+// TextRight draws s so that it ends at x
+func (p *Page) TextRight(x, y, size float64, style Style, s string) {
+	p.Text(x-TextWidth(s, size, style), y, size, style, s)
+}
+
+// Line draws a straight line of the given width
+func (p *Page) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n", num(width), num(x1), num(y1), num(x2), num(y2))
+}
+
+// FillRect fills a rectangle with a shade of grey, 0 being black and 1 white
+func (p *Page) FillRect(x, y, width, height, gray float64) {
+	fmt.Fprintf(&p.content, "%s g %s %s %s %s re f 0 g\n", num(gray), num(x), num(y), num(width), num(height))
+}
+
+// TextWidth returns the width of s in points when set at size
+func TextWidth(s string, size float64, style Style) float64 {
+	var width float64
+	for _, run := range splitRuns(s) {
+		width += runWidth(run, size, style)
+	}
+	return width
+}
+
+// WrapText breaks s into lines no wider than width, breaking at spaces where
+// possible and between any two Chinese characters
+func WrapText(s string, width, size float64, style Style) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range splitWords(paragraph) {
+			candidate := line + word
+			if line != "" && TextWidth(strings.TrimRight(candidate, " "), size, style) > width {
+				lines = append(lines, strings.TrimRight(line, " "))
+				candidate = strings.TrimLeft(word, " ")
+			}
+			line = candidate
+		}
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return lines
+}
+
+// splitWords splits s into words that keep their trailing space, with every
+// Chinese character a word of its own
+func splitWords(s string) []string {
+	var words []string
+	var word strings.Builder
+	for _, r := range s {
+		if !isLatin(r) {
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+			words = append(words, string(r))
+			continue
+		}
+		word.WriteRune(r)
+		if r == ' ' {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// run is a piece of text set in a single font
+type run struct {
+	text string
+	cjk  bool
+}
+
+func isLatin(r rune) bool {
+	return r >= 0x20 && r <= 0x7e
+}
+
+// splitRuns splits s into runs of printable ASCII, set in Helvetica, and runs
+// of anything else, set in the CJK font
+func splitRuns(s string) []run {
+	var runs []run
+	var current strings.Builder
+	cjk := false
+	for _, r := range s {
+		if r == '\t' || r == '\n' || r == '\r' {
+			r = ' '
+		}
+		if current.Len() > 0 && isLatin(r) == cjk {
+			runs = append(runs, run{current.String(), cjk})
+			current.Reset()
+		}
+		cjk = !isLatin(r)
+		current.WriteRune(r)
+	}
+	if current.Len() > 0 {
+		runs = append(runs, run{current.String(), cjk})
+	}
+	return runs
+}
+
+func runWidth(r run, size float64, style Style) float64 {
+	if r.cjk {
+		// Chinese glyphs are one em wide
+		return float64(len([]rune(r.text))) * size
+	}
+	widths := &helveticaWidths
+	if style == Bold {
+		widths = &helveticaBoldWidths
+	}
+	var units int
+	for i := 0; i < len(r.text); i++ {
+		units += widths[r.text[i]-0x20]
+	}
+	return float64(units) * size / 1000
+}
+
+// escapeLiteral escapes a PDF literal string
+func escapeLiteral(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
+
+// encodeUCS2 encodes s as a hex string of UCS-2 code units for the
+// UniGB-UCS2-H encoding. Characters outside the Basic Multilingual Plane
+// are replaced with a question mark.
+func encodeUCS2(s string) string {
+	var b strings.Builder
+	b.WriteByte('<')
+	for _, r := range s {
+		if r > 0xffff {
+			r = '?'
+		}
+		fmt.Fprintf(&b, "%04X", r)
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// encodeTextString encodes s as a PDF text string, used for metadata
+func encodeTextString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", unit)
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// num formats a coordinate with at most two decimals
+func num(f float64) string {
+	s := fmt.Sprintf("%.2f", f)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// WriteTo writes the document as a PDF file
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	pages := d.pages
+	if len(pages) == 0 {
+		pages = []*Page{{}}
+	}
+
+	// Fixed objects come first, followed by a page and a content stream
+	// object for every page
+	const (
+		catalogObj = iota + 1
+		pagesObj
+		infoObj
+		regularFontObj
+		boldFontObj
+		cjkFontObj
+		cidFontObj
+		fontDescriptorObj
+		firstPageObj
+	)
+
+	var objects []string
+	add := func(body string) {
+		objects = append(objects, body)
+	}
+
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPageObj+2*i)
+	}
+
+	add(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesObj))
+	add(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	add(fmt.Sprintf("<< /Title %s /Producer (TobeShop) >>", encodeTextString(d.Title)))
+	add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	add(fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H /DescendantFonts [%d 0 R] >>", cidFontObj))
+	add(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light "+
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >> "+
+		"/FontDescriptor %d 0 R /DW 1000 /W [1 95 500] >>", fontDescriptorObj))
+	add("<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880] " +
+		"/ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>")
+
+	resources := fmt.Sprintf("<< /Font << /%s %d 0 R /%s %d 0 R /%s %d 0 R >> >>",
+		fontRegular, regularFontObj, fontBold, boldFontObj, fontCJK, cjkFontObj)
+	for i, page := range pages {
+		add(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources %s /Contents %d 0 R >>",
+			pagesObj, num(PageWidth), num(PageHeight), resources, firstPageObj+2*i+1))
+		add(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.content.Len(), page.content.String()))
+	}
+
+	var out bytes.Buffer
+	// The binary comment marks the file as binary for transfer tools
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, body := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, body)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1, catalogObj, infoObj, xref)
+
+	return out.WriteTo(w)
+}
@@ -0,0 +1,65 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriteToProducesValidCrossReferenceTable(t *testing.T) {
+	doc := New()
+	doc.Title = "Invoice 发票"
+	doc.AddPage().Text(50, 800, 12, Bold, "Total 总计 (10%)")
+	doc.AddPage().Line(50, 50, 100, 50, 1)
+
+	var out bytes.Buffer
+	if _, err := doc.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	data := out.String()
+
+	if !strings.HasPrefix(data, "%PDF-1.4") || !strings.HasSuffix(data, "%%EOF\n") {
+		t.Fatal("missing PDF header or trailer")
+	}
+	if !strings.Contains(data, `(Total ) Tj`) || !strings.Contains(data, "<603B8BA1> Tj") || !strings.Contains(data, `( \(10%\)) Tj`) {
+		t.Errorf("text runs not encoded as expected:\n%s", data)
+	}
+
+	// Every xref entry must point at the start of its object
+	start, err := strconv.Atoi(regexp.MustCompile(`startxref\n(\d+)`).FindStringSubmatch(data)[1])
+	if err != nil || !strings.HasPrefix(data[start:], "xref\n") {
+		t.Fatalf("startxref does not point at the xref table")
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(data[start:], -1)
+	if len(entries) != 12 {
+		t.Fatalf("xref has %d objects, want 12", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(entry[1])
+		if want := fmt.Sprintf("%d 0 obj", i+1); !strings.HasPrefix(data[offset:], want) {
+			t.Errorf("xref entry %d points at %q", i+1, data[offset:offset+10])
+		}
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		text  string
+		width float64
+		want  []string
+	}{
+		{"short", 100, []string{"short"}},
+		{"one two three four", 50, []string{"one two", "three", "four"}},
+		{"上海市浦东新区", 30, []string{"上海市", "浦东新", "区"}},
+		{"line one\nline two", 200, []string{"line one", "line two"}},
+	}
+	for _, tt := range tests {
+		got := WrapText(tt.text, tt.width, 10, Regular)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("WrapText(%q, %v) = %q, want %q", tt.text, tt.width, got, tt.want)
+		}
+	}
+}
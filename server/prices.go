@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errSaleOverlaps = errors.New("sale overlaps another sale of the product")
+
+// effectivePriceSQL is the price a product sells at, in minor units, for
+// sorting product lists: the price of its running sale if that is lower.
+// Both placeholders take the current time.
+const effectivePriceSQL = `MIN(price_minor, COALESCE((SELECT sale_prices.price_minor FROM sale_prices
+	WHERE sale_prices.product_id = products.id AND sale_prices.deleted_at IS NULL
+	AND sale_prices.starts_at <= ? AND sale_prices.ends_at > ? LIMIT 1), price_minor))`
+
+// runningSales returns the sale running at now for each of the products
+// that has one
+func runningSales(tx *gorm.DB, productIDs []uint, now time.Time) (map[uint]models.SalePrice, error) {
+	sales := make(map[uint]models.SalePrice)
+	if len(productIDs) == 0 {
+		return sales, nil
+	}
+
+	var running []models.SalePrice
+	if err := tx.Where("product_id IN ? AND starts_at <= ? AND ends_at > ?", productIDs, now, now).
+		Find(&running).Error; err != nil {
+		return nil, err
+	}
+	for _, sale := range running {
+		sales[sale.ProductID] = sale
+	}
+	return sales, nil
+}
+
+// applySalePrices puts the products on the price of their sale running at
+// now, keeping the regular price in RegularPrice. A sale never raises a
+// price, so one above a since lowered regular price is ignored.
+func applySalePrices(tx *gorm.DB, products []models.Product, now time.Time) error {
+	ids := make([]uint, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+
+	sales, err := runningSales(tx, ids, now)
+	if err != nil {
+		return err
+	}
+
+	for i := range products {
+		product := &products[i]
+		sale, ok := sales[product.ID]
+		if !ok || sale.Price.Currency != product.Price.Currency || sale.Price.Cmp(product.Price) >= 0 {
+			continue
+		}
+		regular := product.Price
+		endsAt := sale.EndsAt
+		product.RegularPrice = &regular
+		product.SaleEndsAt = &endsAt
+		product.Price = sale.Price
+	}
+	return nil
+}
+
+// applySalePrice is applySalePrices for a single product
+func applySalePrice(tx *gorm.DB, product *models.Product, now time.Time) error {
+	products := []models.Product{*product}
+	if err := applySalePrices(tx, products, now); err != nil {
+		return err
+	}
+	*product = products[0]
+	return nil
+}
+
+// recordPriceChange adds an entry to the price history when price differs
+// from the product's current regular price
+func recordPriceChange(tx *gorm.DB, product *models.Product, price money.Money, actorID *uint) error {
+	if price == product.Price {
+		return nil
+	}
+	return tx.Create(&models.PriceHistory{
+		ProductID:     product.ID,
+		PreviousPrice: product.Price,
+		Price:         price,
+		ChangedByID:   actorID,
+	}).Error
+}
+
+// validateSalePrice returns a problem with the sale of a product priced at
+// regular, or an empty string if there is none
+func validateSalePrice(sale *models.SalePrice, regular money.Money, now time.Time) string {
+	switch {
+	case !sale.Price.IsPositive():
+		return "Sale price must be positive"
+	case sale.Price.Cmp(regular) >= 0:
+		return "Sale price must be below the regular price of " + regular.String()
+	case !sale.EndsAt.After(sale.StartsAt):
+		return "A sale must end after it starts"
+	case !sale.EndsAt.After(now):
+		return "A sale must end in the future"
+	}
+	return ""
+}
+
+// saleRequest is the body for scheduling a sale
+type saleRequest struct {
+	Price    money.Money `json:"price"`
+	StartsAt *time.Time  `json:"startsAt"`
+	EndsAt   time.Time   `json:"endsAt" binding:"required"`
+}
+
+// newSaleRequest returns a request reading the price in the currency of the
+// product
+func newSaleRequest(currency string) saleRequest {
+	return saleRequest{Price: money.Zero(currency)}
+}
+
+// Price handlers
+func (a *app) getPriceHistory(c *gin.Context) {
+	var product models.Product
+	if err := a.db.First(&product, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	var history []models.PriceHistory
+	if err := a.db.Where("product_id = ?", product.ID).
+		Order("created_at ASC, id ASC").Find(&history).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get price history"})
+		return
+	}
+
+	// Past, running and upcoming sales
+	var sales []models.SalePrice
+	if err := a.db.Where("product_id = ?", product.ID).
+		Order("starts_at ASC, id ASC").Find(&sales).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sales"})
+		return
+	}
+
+	if err := applySalePrice(a.db, &product, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get price"})
+		return
+	}
+	regular := product.Price
+	if product.RegularPrice != nil {
+		regular = *product.RegularPrice
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"productId":    product.ID,
+		"currency":     product.Price.Currency,
+		"price":        product.Price,
+		"regularPrice": regular,
+		"saleEndsAt":   product.SaleEndsAt,
+		"history":      history,
+		"sales":        sales,
+	})
+}
+
+func (a *app) createSalePrice(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, ok := a.loadManagedProduct(c, user)
+	if !ok {
+		return
+	}
+
+	saleRequest := newSaleRequest(product.Price.Currency)
+	if err := c.ShouldBindJSON(&saleRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	// Sales without a start begin right away
+	now := time.Now()
+	sale := models.SalePrice{
+		ProductID:   product.ID,
+		Price:       saleRequest.Price,
+		StartsAt:    now,
+		EndsAt:      saleRequest.EndsAt,
+		CreatedByID: &user.ID,
+	}
+	if saleRequest.StartsAt != nil {
+		sale.StartsAt = *saleRequest.StartsAt
+	}
+	if problem := validateSalePrice(&sale, product.Price, now); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	// Only one sale can be on at a time
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			var overlapping int64
+			if err := tx.Model(&models.SalePrice{}).
+				Where("product_id = ? AND starts_at < ? AND ends_at > ?", product.ID, sale.EndsAt, sale.StartsAt).
+				Count(&overlapping).Error; err != nil {
+				return err
+			}
+			if overlapping > 0 {
+				return errSaleOverlaps
+			}
+			return tx.Create(&sale).Error
+		})
+	})
+	if errors.Is(err, errSaleOverlaps) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The product already has a sale during that time"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule sale"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Sale scheduled successfully",
+		"sale":    sale,
+	})
+}
+
+// deleteSalePrice cancels an upcoming sale. A running sale is ended instead,
+// so that it stays in the product's price history.
+func (a *app) deleteSalePrice(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, ok := a.loadManagedProduct(c, user)
+	if !ok {
+		return
+	}
+
+	var sale models.SalePrice
+	if err := a.db.Where("id = ? AND product_id = ?", c.Param("saleId"), product.ID).First(&sale).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sale not found"})
+		return
+	}
+
+	now := time.Now()
+	var err error
+	switch {
+	case sale.RunsAt(now):
+		err = a.db.Model(&sale).Update("ends_at", now).Error
+	case sale.StartsAt.After(now):
+		err = a.db.Delete(&sale).Error
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "The sale has already ended"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel sale"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Sale cancelled successfully"})
+}
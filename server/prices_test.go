@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSalePriceIsHonored(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	other := env.createUser("other-seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	lamp := env.createProduct(seller, "Lamp", 40, 10)
+	env.createProduct(seller, "Rug", 35, 10)
+	sellerToken := env.login(seller)
+	buyerToken := env.login(buyer)
+	salesPath := fmt.Sprintf("/api/products/%d/sales", lamp.ID)
+
+	now := time.Now()
+	env.do(http.MethodPost, salesPath, buyerToken, gin.H{"price": 30, "endsAt": now.Add(time.Hour)}, http.StatusForbidden, nil)
+	env.do(http.MethodPost, salesPath, env.login(other), gin.H{"price": 30, "endsAt": now.Add(time.Hour)}, http.StatusForbidden, nil)
+	env.do(http.MethodPost, salesPath, sellerToken, gin.H{"price": 45, "endsAt": now.Add(time.Hour)}, http.StatusBadRequest, nil)
+	env.do(http.MethodPost, salesPath, sellerToken, gin.H{"price": 30, "endsAt": now.Add(-time.Hour)}, http.StatusBadRequest, nil)
+
+	// A sale running now and one later in the day, which can't overlap
+	var running struct {
+		Sale models.SalePrice `json:"sale"`
+	}
+	env.do(http.MethodPost, salesPath, sellerToken, gin.H{"price": 30, "endsAt": now.Add(time.Hour)}, http.StatusCreated, &running)
+	env.do(http.MethodPost, salesPath, sellerToken,
+		gin.H{"price": 35, "startsAt": now.Add(2 * time.Hour), "endsAt": now.Add(3 * time.Hour)}, http.StatusCreated, nil)
+	env.do(http.MethodPost, salesPath, sellerToken,
+		gin.H{"price": 25, "startsAt": now.Add(30 * time.Minute), "endsAt": now.Add(90 * time.Minute)}, http.StatusConflict, nil)
+
+	var fetched struct {
+		Product models.Product `json:"product"`
+	}
+	env.do(http.MethodGet, fmt.Sprintf("/api/products/%d", lamp.ID), "", nil, http.StatusOK, &fetched)
+	if fetched.Product.Price != usd(30) || fetched.Product.RegularPrice == nil || *fetched.Product.RegularPrice != usd(40) {
+		t.Errorf("product price %v regular %v, want 30 on sale from 40", fetched.Product.Price, fetched.Product.RegularPrice)
+	}
+
+	// Sorting goes by the sale price
+	var list struct {
+		Products []models.Product `json:"products"`
+	}
+	env.do(http.MethodGet, "/api/products?sort=priceLow", "", nil, http.StatusOK, &list)
+	if len(list.Products) != 2 || list.Products[0].ID != lamp.ID {
+		t.Errorf("cheapest product = %+v, want the lamp on sale", list.Products)
+	}
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken, orderRequest(gin.H{"productId": lamp.ID, "quantity": 2}), http.StatusCreated, &created)
+	if created.Order.Total != usd(60) || created.Order.OrderItems[0].Price != usd(30) {
+		t.Errorf("order total %v, want 2 at the sale price of 30", created.Order.Total)
+	}
+
+	// Changing the price is recorded; ending the sale restores the regular price
+	env.do(http.MethodPut, fmt.Sprintf("/api/products/%d", lamp.ID), sellerToken, gin.H{"price": 50}, http.StatusOK, nil)
+	env.do(http.MethodDelete, fmt.Sprintf("%s/%d", salesPath, running.Sale.ID), sellerToken, nil, http.StatusOK, nil)
+	env.do(http.MethodDelete, fmt.Sprintf("%s/%d", salesPath, running.Sale.ID), sellerToken, nil, http.StatusConflict, nil)
+
+	var history struct {
+		Price        float64               `json:"price"`
+		RegularPrice float64               `json:"regularPrice"`
+		History      []models.PriceHistory `json:"history"`
+		Sales        []models.SalePrice    `json:"sales"`
+	}
+	env.do(http.MethodGet, fmt.Sprintf("/api/products/%d/price-history", lamp.ID), "", nil, http.StatusOK, &history)
+	if history.Price != 50 || history.RegularPrice != 50 {
+		t.Errorf("price %v regular %v after the sale, want 50", history.Price, history.RegularPrice)
+	}
+	if len(history.History) != 1 || history.History[0].PreviousPrice != usd(40) || history.History[0].Price != usd(50) {
+		t.Errorf("history = %+v, want one change from 40 to 50", history.History)
+	}
+	if len(history.Sales) != 2 || !history.Sales[0].EndsAt.Before(time.Now()) {
+		t.Errorf("sales = %+v, want the ended sale and the upcoming one", history.Sales)
+	}
+}
+
+func TestCreatedProductStartsPriceHistory(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	env.createProduct(seller, "Mug", 8, 10)
+	token := env.login(seller)
+
+	var created struct {
+		Product models.Product `json:"product"`
+	}
+	env.do(http.MethodPost, "/api/products", token, gin.H{"name": "Teapot", "price": 24, "stock": 3}, http.StatusCreated, &created)
+	env.do(http.MethodPut, fmt.Sprintf("/api/products/%d", created.Product.ID), token, gin.H{"price": 24}, http.StatusOK, nil)
+
+	var history struct {
+		History []models.PriceHistory `json:"history"`
+	}
+	env.do(http.MethodGet, fmt.Sprintf("/api/products/%d/price-history", created.Product.ID), "", nil, http.StatusOK, &history)
+	if len(history.History) != 1 || history.History[0].Price != usd(24) || !history.History[0].PreviousPrice.IsZero() {
+		t.Errorf("history = %+v, want only the opening price of 24", history.History)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultReservationMinutes = 15
+	maxReservationMinutes     = 60
+)
+
+// activeHolds returns the quantity held per product by unexpired active
+// reservations, leaving out the reservation excludeID (0 counts them all)
+func activeHolds(db *gorm.DB, productIDs []uint, excludeID uint, now time.Time) (map[uint]int, error) {
+	return heldQuantities(db, "product_id", productIDs, excludeID, now)
+}
+
+// activeVariantHolds is activeHolds per variant
+func activeVariantHolds(db *gorm.DB, variantIDs []uint, excludeID uint, now time.Time) (map[uint]int, error) {
+	return heldQuantities(db, "variant_id", variantIDs, excludeID, now)
+}
+
+// heldQuantities sums the quantity held by unexpired active reservations by
+// the given reservation item column
+func heldQuantities(db *gorm.DB, column string, ids []uint, excludeID uint, now time.Time) (map[uint]int, error) {
+	holds := make(map[uint]int)
+	if len(ids) == 0 {
+		return holds, nil
+	}
+
+	var rows []struct {
+		HeldID uint
+		Held   int
+	}
+	query := db.Table("reservation_items").
+		Select("reservation_items."+column+" AS held_id, SUM(reservation_items.quantity) AS held").
+		Joins("JOIN reservations ON reservations.id = reservation_items.reservation_id").
+		Where("reservations.status = ? AND reservations.expires_at > ?", models.ReservationActive, now).
+		Where("reservation_items."+column+" IN ?", ids)
+	if excludeID != 0 {
+		query = query.Where("reservations.id <> ?", excludeID)
+	}
+	if err := query.Group("reservation_items." + column).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		holds[row.HeldID] = row.Held
+	}
+	return holds, nil
+}
+
+// fillAvailableStock sets AvailableStock on each product to its stock minus
+// the quantity held by active reservations
+func fillAvailableStock(db *gorm.DB, products []models.Product) error {
+	ids := make([]uint, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+
+	holds, err := activeHolds(db, ids, 0, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for i := range products {
+		products[i].AvailableStock = products[i].Stock - holds[products[i].ID]
+		if products[i].AvailableStock < 0 {
+			products[i].AvailableStock = 0
+		}
+	}
+	return nil
+}
+
+// expireReservations marks active reservations past their expiry as expired
+func expireReservations(db *gorm.DB, now time.Time) (int64, error) {
+	result := db.Model(&models.Reservation{}).
+		Where("status = ? AND expires_at <= ?", models.ReservationActive, now).
+		Update("status", models.ReservationExpired)
+	return result.RowsAffected, result.Error
+}
+
+// startReservationSweeper releases expired reservations every interval until
+// ctx is cancelled. Holds stop counting as soon as they expire; the sweeper
+// keeps the stored status in line with that.
+func startReservationSweeper(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				expired, err := expireReservations(db, now)
+				if err != nil {
+					log.Printf("Failed to expire reservations: %v", err)
+				} else if expired > 0 {
+					log.Printf("Released %d expired reservation(s)", expired)
+				}
+			}
+		}
+	}()
+}
+
+// loadHoldingReservation loads a reservation of the user that still holds
+// its stock
+func loadHoldingReservation(tx *gorm.DB, user *models.User, reservationID uint, now time.Time) (*models.Reservation, error) {
+	var reservation models.Reservation
+	if err := tx.Preload("Items").First(&reservation, reservationID).Error; err != nil || reservation.UserID != user.ID {
+		return nil, &orderError{http.StatusBadRequest, "Reservation not found"}
+	}
+	if !reservation.IsHolding(now) {
+		return nil, &orderError{http.StatusConflict, "Reservation has expired or was already used"}
+	}
+	return &reservation, nil
+}
+
+// consumeReservation checks that the reservation covers the requested
+// quantities of each product and variant and marks it consumed by the order
+func consumeReservation(tx *gorm.DB, reservation *models.Reservation, requested map[stockKey]int, orderID uint) error {
+	reserved := make(map[stockKey]int)
+	for _, item := range reservation.Items {
+		key := stockKey{ProductID: item.ProductID}
+		if item.VariantID != nil {
+			key.VariantID = *item.VariantID
+		}
+		reserved[key] += item.Quantity
+	}
+	for key, quantity := range requested {
+		if quantity > reserved[key] {
+			if key.VariantID != 0 {
+				return &orderError{http.StatusBadRequest, fmt.Sprintf("Order exceeds the reserved quantity for product %d variant %d", key.ProductID, key.VariantID)}
+			}
+			return &orderError{http.StatusBadRequest, fmt.Sprintf("Order exceeds the reserved quantity for product %d", key.ProductID)}
+		}
+	}
+
+	result := tx.Model(&models.Reservation{}).
+		Where("id = ? AND status = ?", reservation.ID, models.ReservationActive).
+		Updates(map[string]interface{}{"status": models.ReservationConsumed, "order_id": orderID})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &orderError{http.StatusConflict, "Reservation has expired or was already used"}
+	}
+	return nil
+}
+
+func (a *app) createReservation(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var reservationRequest struct {
+		Items   []orderItemRequest `json:"items" binding:"required"`
+		Minutes int                `json:"minutes"`
+	}
+	if err := c.ShouldBindJSON(&reservationRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	if len(reservationRequest.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reservation must contain at least one item"})
+		return
+	}
+
+	minutes := reservationRequest.Minutes
+	if minutes == 0 {
+		minutes = defaultReservationMinutes
+	}
+	if minutes < 1 || minutes > maxReservationMinutes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Minutes must be between 1 and %d", maxReservationMinutes)})
+		return
+	}
+
+	// Merge repeated lines for the same product and variant
+	requested := make(map[stockKey]int)
+	var keys []stockKey
+	var productIDs, variantIDs []uint
+	for _, item := range reservationRequest.Items {
+		if item.Quantity <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity must be at least 1"})
+			return
+		}
+		key := stockKey{item.ProductID, item.VariantID}
+		if _, seen := requested[key]; !seen {
+			keys = append(keys, key)
+			productIDs = append(productIDs, item.ProductID)
+			if item.VariantID != 0 {
+				variantIDs = append(variantIDs, item.VariantID)
+			}
+		}
+		requested[key] += item.Quantity
+	}
+
+	var reservation models.Reservation
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			now := time.Now()
+
+			// A buyer checks out one cart at a time, so a new reservation
+			// replaces any earlier one
+			if err := tx.Model(&models.Reservation{}).
+				Where("user_id = ? AND status = ?", user.ID, models.ReservationActive).
+				Update("status", models.ReservationReleased).Error; err != nil {
+				return err
+			}
+
+			holds, err := activeHolds(tx, productIDs, 0, now)
+			if err != nil {
+				return err
+			}
+			variantHolds, err := activeVariantHolds(tx, variantIDs, 0, now)
+			if err != nil {
+				return err
+			}
+
+			reservation = models.Reservation{
+				UserID:    user.ID,
+				Status:    models.ReservationActive,
+				ExpiresAt: now.Add(time.Duration(minutes) * time.Minute),
+			}
+			for _, key := range keys {
+				var product models.Product
+				if err := tx.First(&product, key.ProductID).Error; err != nil {
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						return &orderError{http.StatusBadRequest, "Product not found: " + strconv.FormatUint(uint64(key.ProductID), 10)}
+					}
+					return err
+				}
+				variant, err := loadOrderVariant(tx, &product, key.VariantID)
+				if err != nil {
+					return err
+				}
+
+				// Products sold by variant are held per variant
+				item := models.ReservationItem{ProductID: product.ID, Quantity: requested[key]}
+				available := product.Stock - holds[product.ID]
+				if variant != nil {
+					item.VariantID = &variant.ID
+					available = variant.Stock - variantHolds[variant.ID]
+				}
+				if available < 0 {
+					available = 0
+				}
+				if available < item.Quantity {
+					return &orderError{http.StatusConflict, fmt.Sprintf("Not enough stock for product %s. Available: %d, Requested: %d",
+						stockName(&product, variant), available, item.Quantity)}
+				}
+
+				reservation.Items = append(reservation.Items, item)
+			}
+
+			return tx.Create(&reservation).Error
+		})
+	})
+	if err != nil {
+		var orderErr *orderError
+		if errors.As(err, &orderErr) {
+			c.JSON(orderErr.status, gin.H{"error": orderErr.message})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reservation"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "Stock reserved successfully",
+		"reservation": reservation,
+	})
+}
+
+// loadOwnReservation loads the reservation in the :id parameter if it belongs
+// to the user or the user is an admin. It writes the error response itself.
+func (a *app) loadOwnReservation(c *gin.Context, user *models.User) (*models.Reservation, bool) {
+	var reservation models.Reservation
+	if err := a.db.Preload("Items").Preload("Items.Product").First(&reservation, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return nil, false
+	}
+	if reservation.UserID != user.ID && user.Role != models.Admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to access this reservation"})
+		return nil, false
+	}
+	return &reservation, true
+}
+
+func (a *app) getReservation(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	reservation, ok := a.loadOwnReservation(c, user)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reservation": reservation})
+}
+
+func (a *app) releaseReservation(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	reservation, ok := a.loadOwnReservation(c, user)
+	if !ok {
+		return
+	}
+
+	if err := a.db.Model(&models.Reservation{}).
+		Where("id = ? AND status = ?", reservation.ID, models.ReservationActive).
+		Update("status", models.ReservationReleased).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release reservation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reservation released successfully"})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReservationHoldsStockForCheckout(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	alice := env.createUser("alice", models.Buyer)
+	bob := env.createUser("bob", models.Buyer)
+	product := env.createProduct(seller, "Concert Ticket", 80, 3)
+	aliceToken := env.login(alice)
+	bobToken := env.login(bob)
+
+	var reserved struct {
+		Reservation models.Reservation `json:"reservation"`
+	}
+	env.do(http.MethodPost, "/api/reservations", aliceToken,
+		gin.H{"items": []gin.H{{"productId": product.ID, "quantity": 2}}, "minutes": 10}, http.StatusCreated, &reserved)
+
+	var fetched struct {
+		Product models.Product `json:"product"`
+	}
+	env.do(http.MethodGet, fmt.Sprintf("/api/products/%d", product.ID), "", nil, http.StatusOK, &fetched)
+	if fetched.Product.Stock != 3 || fetched.Product.AvailableStock != 1 {
+		t.Errorf("stock = %d, available = %d; want 3 and 1", fetched.Product.Stock, fetched.Product.AvailableStock)
+	}
+
+	// Bob can't buy or reserve what Alice holds
+	env.do(http.MethodPost, "/api/orders", bobToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 2}), http.StatusBadRequest, nil)
+	env.do(http.MethodPost, "/api/reservations", bobToken,
+		gin.H{"items": []gin.H{{"productId": product.ID, "quantity": 2}}}, http.StatusConflict, nil)
+
+	// Nor use her reservation
+	request := orderRequest(gin.H{"productId": product.ID, "quantity": 2})
+	request["reservationId"] = reserved.Reservation.ID
+	env.do(http.MethodPost, "/api/orders", bobToken, request, http.StatusBadRequest, nil)
+
+	env.do(http.MethodPost, "/api/orders", aliceToken, request, http.StatusCreated, nil)
+
+	var reservation models.Reservation
+	env.db.First(&reservation, reserved.Reservation.ID)
+	if reservation.Status != models.ReservationConsumed || reservation.OrderID == nil {
+		t.Errorf("reservation = %s (order %v), want consumed with order", reservation.Status, reservation.OrderID)
+	}
+
+	// A consumed reservation can't be used twice
+	env.do(http.MethodPost, "/api/orders", aliceToken, request, http.StatusConflict, nil)
+
+	env.do(http.MethodPost, "/api/orders", bobToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, nil)
+}
+
+func TestExpiredReservationsAreReleased(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Vinyl", 30, 1)
+
+	reservation := models.Reservation{
+		UserID:    buyer.ID,
+		Status:    models.ReservationActive,
+		ExpiresAt: time.Now().Add(-time.Minute),
+		Items:     []models.ReservationItem{{ProductID: product.ID, Quantity: 1}},
+	}
+	env.db.Create(&reservation)
+
+	// Expired holds stop counting before the sweeper runs
+	env.do(http.MethodPost, "/api/reservations", env.login(buyer),
+		gin.H{"items": []gin.H{{"productId": product.ID, "quantity": 1}}}, http.StatusCreated, nil)
+
+	stale := models.Reservation{
+		UserID:    seller.ID,
+		Status:    models.ReservationActive,
+		ExpiresAt: time.Now().Add(-time.Second),
+	}
+	env.db.Create(&stale)
+
+	expired, err := expireReservations(env.db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 1 {
+		t.Errorf("expired %d reservations, want 1", expired)
+	}
+	env.db.First(&stale, stale.ID)
+	if stale.Status != models.ReservationExpired {
+		t.Errorf("stale reservation status = %s, want expired", stale.Status)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const busyRetryAttempts = 10
+
+// withBusyRetry runs fn again while SQLite reports the database busy or
+// locked by another connection, backing off a little longer each time
+func withBusyRetry(fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= busyRetryAttempts; attempt++ {
+		err = fn()
+		if err == nil || !isBusyError(err) {
+			return err
+		}
+		backoff := time.Duration(attempt*5+rand.Intn(10)) * time.Millisecond
+		time.Sleep(backoff)
+	}
+	return err
+}
+
+// isBusyError reports whether err is SQLITE_BUSY or SQLITE_LOCKED
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return err != nil && strings.Contains(err.Error(), "database is locked")
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errReturnConflict    = errors.New("return was changed by another request")
+	errReturnQuantity    = errors.New("more items returned than were ordered")
+	errRefundExceedsPaid = errors.New("refund exceeds what was paid")
+)
+
+// orderAcceptsReturns reports whether items of an order in status can be
+// returned: the order must have been paid and not refunded already
+func orderAcceptsReturns(status models.OrderStatus) bool {
+	switch status {
+	case models.Paid, models.Shipped, models.Delivered:
+		return true
+	}
+	return false
+}
+
+// returnedQuantity returns how many of the order item are covered by returns
+// that haven't been rejected
+func returnedQuantity(tx *gorm.DB, orderItemID uint) (int, error) {
+	var quantity int
+	err := tx.Model(&models.ReturnRequest{}).
+		Select("COALESCE(SUM(quantity), 0)").
+		Where("order_item_id = ? AND status <> ?", orderItemID, models.ReturnRejected).
+		Scan(&quantity).Error
+	return quantity, err
+}
+
+// isProductSeller reports whether the user owns the shop selling the product
+func (a *app) isProductSeller(user *models.User, productID uint) (bool, error) {
+	var count int64
+	err := a.db.Unscoped().Table("products").
+		Joins("JOIN shops ON shops.id = products.shop_id").
+		Where("products.id = ? AND shops.user_id = ?", productID, user.ID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// planRefunds spreads a refund over the invoice's succeeded payments, oldest
+// first, without giving back more of any payment than it brought in
+func planRefunds(tx *gorm.DB, invoiceID uint, amount money.Money, returnID uint) ([]models.PaymentRefund, error) {
+	var paid []models.Payment
+	if err := tx.Where("invoice_id = ? AND status = ?", invoiceID, models.PaymentSucceeded).
+		Order("id").Find(&paid).Error; err != nil {
+		return nil, err
+	}
+
+	var refunds []models.PaymentRefund
+	remaining := amount
+	for _, payment := range paid {
+		if !remaining.IsPositive() {
+			break
+		}
+		available := payment.Amount.Sub(payment.AmountRefunded)
+		if !available.IsPositive() {
+			continue
+		}
+		refund := available.Min(remaining)
+		status := models.PaymentPending
+		if payment.Provider == "" {
+			// Paid by hand, so it is paid back by hand too
+			status = models.PaymentSucceeded
+		}
+		refunds = append(refunds, models.PaymentRefund{
+			PaymentID:       payment.ID,
+			Amount:          refund,
+			Provider:        payment.Provider,
+			RefundReference: fmt.Sprintf("RMA-%d-%d", returnID, payment.ID),
+			Status:          status,
+		})
+		remaining = remaining.Sub(refund)
+	}
+	if remaining.IsPositive() {
+		return nil, errRefundExceedsPaid
+	}
+	return refunds, nil
+}
+
+// sendRefunds asks the providers to pay back the pending refunds and settles
+// each from the outcome. Refund references are fixed per return and payment,
+// so sending them again after a failure doesn't refund twice.
+func (a *app) sendRefunds(ctx context.Context, refunds []models.PaymentRefund, reason string) error {
+	for i := range refunds {
+		refund := &refunds[i]
+		if refund.Status != models.PaymentPending {
+			continue
+		}
+		var payment models.Payment
+		if err := a.db.First(&payment, refund.PaymentID).Error; err != nil {
+			return err
+		}
+		gateway, err := a.gateways.Get(refund.Provider)
+		if err != nil {
+			return fmt.Errorf("payment provider %s is not configured", refund.Provider)
+		}
+		result, err := gateway.Refund(ctx, payments.RefundRequest{
+			Reference:       payment.ProviderReference,
+			RefundReference: refund.RefundReference,
+			Amount:          refund.Amount,
+			Reason:          reason,
+		})
+		if err != nil {
+			return err
+		}
+		err = withBusyRetry(func() error {
+			return settleRefund(a.db, refund, paymentStatusFor(result.Status))
+		})
+		if err != nil {
+			return err
+		}
+		if refund.Status == models.PaymentFailed {
+			return fmt.Errorf("refund %s was declined", refund.RefundReference)
+		}
+	}
+	return nil
+}
+
+// settleRefund records the provider's outcome for a pending refund. A
+// declined refund no longer counts as given back on its payment, so the
+// money can still be paid back another way.
+func settleRefund(db *gorm.DB, refund *models.PaymentRefund, status models.PaymentStatus) error {
+	if status == models.PaymentPending {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PaymentRefund{}).
+			Where("id = ? AND status = ?", refund.ID, models.PaymentPending).
+			Update("status", status)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return tx.First(refund, refund.ID).Error
+		}
+		refund.Status = status
+		if status != models.PaymentFailed {
+			return nil
+		}
+		return tx.Model(&models.Payment{}).Where("id = ?", refund.PaymentID).
+			Update("amount_refunded_minor", gorm.Expr("amount_refunded_minor - ?", refund.Amount.Minor)).Error
+	})
+}
+
+// resendPendingRefunds sends the refunds still waiting for their provider
+// again, e.g. when it couldn't be reached when the return was refunded. It
+// returns how many of them were settled.
+func (a *app) resendPendingRefunds(ctx context.Context) (int, error) {
+	var pending []models.PaymentRefund
+	if err := a.db.Where("status = ?", models.PaymentPending).Order("id").Find(&pending).Error; err != nil {
+		return 0, err
+	}
+
+	settled := 0
+	for i := range pending {
+		reason := unwantedPaymentRefundReason
+		if pending[i].CreditNoteID != nil {
+			var note models.CreditNote
+			if err := a.db.Select("id", "reason").First(&note, *pending[i].CreditNoteID).Error; err != nil {
+				return settled, err
+			}
+			reason = note.Reason
+		}
+		if err := a.sendRefunds(ctx, pending[i:i+1], reason); err != nil {
+			log.Printf("Failed to send refund %s: %v", pending[i].RefundReference, err)
+		}
+		if pending[i].Status != models.PaymentPending {
+			settled++
+		}
+	}
+	return settled, nil
+}
+
+// startRefundSweeper sends pending refunds again every interval until ctx is
+// cancelled
+func (a *app) startRefundSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				settled, err := a.resendPendingRefunds(ctx)
+				if err != nil {
+					log.Printf("Failed to resend refunds: %v", err)
+				} else if settled > 0 {
+					log.Printf("Settled %d pending refund(s)", settled)
+				}
+			}
+		}
+	}()
+}
+
+// creditReturn books a refunded return inside tx: the payments are marked
+// as refunded, a credit note is issued against the invoice and the order is
+// marked refunded once its invoice is credited in full
+func creditReturn(tx *gorm.DB, ret *models.ReturnRequest, order *models.Order, refunds []models.PaymentRefund, actor *models.User, now time.Time) error {
+	for _, refund := range refunds {
+		result := tx.Model(&models.Payment{}).
+			Where("id = ? AND amount_refunded_minor + ? <= amount_minor", refund.PaymentID, refund.Amount.Minor).
+			Updates(map[string]interface{}{
+				"amount_refunded_minor":    gorm.Expr("amount_refunded_minor + ?", refund.Amount.Minor),
+				"amount_refunded_currency": refund.Amount.Currency,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefundExceedsPaid
+		}
+	}
+
+	note := models.CreditNote{
+		InvoiceID:       order.InvoiceID,
+		ReturnRequestID: &ret.ID,
+		Amount:          ret.RefundAmount,
+		Reason:          ret.Reason,
+		IssueDate:       now,
+		Refunds:         refunds,
+	}
+	if err := tx.Create(&note).Error; err != nil {
+		return err
+	}
+	// Number credit notes like invoices, e.g. CN-20240131-000007
+	note.Number = fmt.Sprintf("CN-%s-%06d", now.Format("20060102"), note.ID)
+	if err := tx.Model(&note).Update("number", note.Number).Error; err != nil {
+		return err
+	}
+	ret.CreditNoteID = &note.ID
+	ret.CreditNote = &note
+
+	if err := tx.Model(&models.Invoice{}).Where("id = ?", order.InvoiceID).
+		Updates(map[string]interface{}{
+			"amount_credited_minor":    gorm.Expr("amount_credited_minor + ?", note.Amount.Minor),
+			"amount_credited_currency": note.Amount.Currency,
+		}).Error; err != nil {
+		return err
+	}
+	var invoice models.Invoice
+	if err := tx.First(&invoice, order.InvoiceID).Error; err != nil {
+		return err
+	}
+	if invoice.AmountCredited.Cmp(invoice.TotalAmount) < 0 {
+		return nil
+	}
+	if err := tx.Model(&invoice).Update("status", models.Credited).Error; err != nil {
+		return err
+	}
+	if !order.Status.CanTransitionTo(models.Refunded) {
+		return nil
+	}
+	return changeOrderStatus(tx, order, models.Refunded, actor, "Refunded through returns")
+}
+
+// loadReturn loads the return named by the :id parameter with its item and
+// order, checking that the user may see it. It writes the error response
+// itself.
+func (a *app) loadReturn(c *gin.Context, user *models.User) (*models.ReturnRequest, *models.Order, bool) {
+	returnID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid return ID"})
+		return nil, nil, false
+	}
+
+	var ret models.ReturnRequest
+	if err := a.db.Preload("OrderItem").Preload("OrderItem.Product").
+		Preload("CreditNote").Preload("CreditNote.Refunds").
+		First(&ret, returnID).Error; err != nil || ret.OrderItem == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Return not found"})
+		return nil, nil, false
+	}
+	var order models.Order
+	if err := a.db.First(&order, ret.OrderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return nil, nil, false
+	}
+
+	canView, err := a.canViewOrder(user, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check return permissions"})
+		return nil, nil, false
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this return"})
+		return nil, nil, false
+	}
+	return &ret, &order, true
+}
+
+// Return handlers
+
+func (a *app) createReturn(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var returnRequest struct {
+		OrderItemID uint   `json:"orderItemId" binding:"required"`
+		Quantity    int    `json:"quantity" binding:"required"`
+		Reason      string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&returnRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if returnRequest.Quantity <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity must be at least 1"})
+		return
+	}
+
+	var order models.Order
+	if err := a.db.First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if order.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the buyer can return items of an order"})
+		return
+	}
+	if !orderAcceptsReturns(order.Status) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Items of a %s order can't be returned", order.Status)})
+		return
+	}
+
+	var item models.OrderItem
+	if err := a.db.Where("id = ? AND order_id = ?", returnRequest.OrderItemID, order.ID).First(&item).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Order item not found in this order"})
+		return
+	}
+
+	var ret models.ReturnRequest
+	err = withBusyRetry(func() error {
+		ret = models.ReturnRequest{
+			OrderID:      order.ID,
+			OrderItemID:  item.ID,
+			UserID:       user.ID,
+			Quantity:     returnRequest.Quantity,
+			Reason:       returnRequest.Reason,
+			Status:       models.ReturnRequested,
+			RefundAmount: item.ChargedFor(returnRequest.Quantity),
+		}
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			returned, err := returnedQuantity(tx, item.ID)
+			if err != nil {
+				return err
+			}
+			if returned+ret.Quantity > item.Quantity {
+				return errReturnQuantity
+			}
+			return tx.Create(&ret).Error
+		})
+	})
+	if errors.Is(err, errReturnQuantity) {
+		c.JSON(http.StatusConflict, gin.H{"error": "More items returned than were ordered"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create return: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Return requested successfully",
+		"return":  ret,
+	})
+}
+
+func (a *app) getOrderReturns(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var order models.Order
+	if err := a.db.First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	canView, err := a.canViewOrder(user, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check order permissions"})
+		return
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this order"})
+		return
+	}
+
+	var returns []models.ReturnRequest
+	if err := a.db.Preload("OrderItem").Preload("OrderItem.Product").
+		Preload("CreditNote").Preload("CreditNote.Refunds").
+		Where("order_id = ?", order.ID).Order("id").Find(&returns).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get returns"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"returns": returns})
+}
+
+func (a *app) getReturn(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	ret, _, ok := a.loadReturn(c, user)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"return": ret})
+}
+
+// updateReturn moves a return along its workflow. Sellers of the returned
+// product and admins approve or reject it, record the goods as received
+// (optionally putting them back in stock) and refund it, which pays the
+// money back through the payment provider and issues a credit note.
+func (a *app) updateReturn(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var statusRequest struct {
+		Status       models.ReturnStatus `json:"status" binding:"required"`
+		Note         string              `json:"note"`
+		Restock      bool                `json:"restock"`
+		RefundAmount json.Number         `json:"refundAmount"`
+	}
+	if err := c.ShouldBindJSON(&statusRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if !statusRequest.Status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown return status: " + string(statusRequest.Status)})
+		return
+	}
+
+	ret, order, ok := a.loadReturn(c, user)
+	if !ok {
+		return
+	}
+
+	if user.Role != models.Admin {
+		isSeller, err := a.isProductSeller(user, ret.OrderItem.ProductID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check return permissions"})
+			return
+		}
+		if !isSeller {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the seller of the product can handle this return"})
+			return
+		}
+	}
+
+	from := ret.Status
+	if !from.CanTransitionTo(statusRequest.Status) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":           fmt.Sprintf("Cannot change return status from %s to %s", from, statusRequest.Status),
+			"currentStatus":   from,
+			"allowedStatuses": from.NextStatuses(),
+		})
+		return
+	}
+
+	// Sellers may refund less than was paid, e.g. for used goods
+	if statusRequest.RefundAmount != "" {
+		if statusRequest.Status != models.ReturnApproved {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The refund amount is set when approving a return"})
+			return
+		}
+		amount, err := money.Parse(statusRequest.RefundAmount.String(), ret.RefundAmount.Currency)
+		if err != nil || !amount.IsPositive() || amount.Cmp(ret.RefundAmount) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Refund amount must be between 0 and %s", ret.RefundAmount.Decimal())})
+			return
+		}
+		ret.RefundAmount = amount
+	}
+
+	now := time.Now()
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			updates := map[string]interface{}{
+				"status":                 statusRequest.Status,
+				"refund_amount_minor":    ret.RefundAmount.Minor,
+				"refund_amount_currency": ret.RefundAmount.Currency,
+				"resolved_by_id":         user.ID,
+			}
+			if statusRequest.Note != "" {
+				updates["seller_note"] = statusRequest.Note
+			}
+
+			switch statusRequest.Status {
+			case models.ReturnReceived:
+				if statusRequest.Restock {
+					movement := models.InventoryMovement{
+						Type:      models.MovementReturnRestock,
+						OrderID:   &order.ID,
+						VariantID: ret.OrderItem.VariantID,
+						ActorID:   &user.ID,
+						Note:      fmt.Sprintf("Return #%d received", ret.ID),
+					}
+					if _, err := adjustStock(tx, ret.OrderItem.ProductID, ret.Quantity, movement); err != nil {
+						return err
+					}
+					updates["restocked"] = true
+				}
+			case models.ReturnRefunded:
+				// The refunds are booked as pending and only paid back once
+				// the booking is committed
+				refunds, err := planRefunds(tx, order.InvoiceID, ret.RefundAmount, ret.ID)
+				if err != nil {
+					return err
+				}
+				if err := creditReturn(tx, ret, order, refunds, user, now); err != nil {
+					return err
+				}
+				updates["credit_note_id"] = ret.CreditNoteID
+			}
+
+			// Only update if nobody moved the return on since we read it
+			result := tx.Model(&models.ReturnRequest{}).
+				Where("id = ? AND status = ?", ret.ID, from).
+				Updates(updates)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errReturnConflict
+			}
+			return nil
+		})
+	})
+	switch {
+	case errors.Is(err, errReturnConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "Return was changed by another request, please reload"})
+		return
+	case errors.Is(err, errRefundExceedsPaid):
+		c.JSON(http.StatusConflict, gin.H{"error": "Refund exceeds what is left of the payments"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update return: " + err.Error()})
+		return
+	}
+
+	// Refunds the provider couldn't take stay pending and are sent again
+	// by the refund sweeper
+	if statusRequest.Status == models.ReturnRefunded {
+		if err := a.sendRefunds(c.Request.Context(), ret.CreditNote.Refunds, ret.Reason); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Refund booked, but paying it back failed: " + err.Error()})
+			return
+		}
+	}
+
+	ret, _, ok = a.loadReturn(c, user)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Return updated successfully",
+		"return":  ret,
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+	"tobe_shop/server/payments"
+
+	"github.com/gin-gonic/gin"
+)
+
+type returnResponse struct {
+	Return models.ReturnRequest `json:"return"`
+}
+
+func TestPartialReturnWithRestock(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	otherSeller := env.createUser("other-seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Mug", 10, 5)
+	env.createProduct(otherSeller, "Bowl", 10, 5)
+	buyerToken := env.login(buyer)
+	sellerToken := env.login(seller)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 3}), http.StatusCreated, &created)
+	returnsPath := fmt.Sprintf("/api/orders/%d/returns", created.Order.ID)
+	itemID := created.Order.OrderItems[0].ID
+
+	var requested returnResponse
+	env.do(http.MethodPost, returnsPath, buyerToken,
+		gin.H{"orderItemId": itemID, "quantity": 2, "reason": "Chipped"}, http.StatusCreated, &requested)
+	if requested.Return.Status != models.ReturnRequested || requested.Return.RefundAmount != usd(20) {
+		t.Errorf("return = %s for %s, want requested for 20", requested.Return.Status, requested.Return.RefundAmount)
+	}
+
+	// Only one mug is left to return
+	env.do(http.MethodPost, returnsPath, buyerToken,
+		gin.H{"orderItemId": itemID, "quantity": 2, "reason": "Chipped too"}, http.StatusConflict, nil)
+
+	// Only the product's seller handles the return, in order
+	returnPath := fmt.Sprintf("/api/returns/%d", requested.Return.ID)
+	env.do(http.MethodPut, returnPath, buyerToken, gin.H{"status": models.ReturnApproved}, http.StatusForbidden, nil)
+	env.do(http.MethodPut, returnPath, env.login(otherSeller), gin.H{"status": models.ReturnApproved}, http.StatusForbidden, nil)
+	env.do(http.MethodPut, returnPath, sellerToken, gin.H{"status": models.ReturnRefunded}, http.StatusConflict, nil)
+
+	env.do(http.MethodPut, returnPath, sellerToken,
+		gin.H{"status": models.ReturnApproved, "refundAmount": 15, "note": "Partial refund, one mug is fine"}, http.StatusOK, nil)
+	env.do(http.MethodPut, returnPath, sellerToken, gin.H{"status": models.ReturnReceived, "restock": true}, http.StatusOK, nil)
+
+	var stocked models.Product
+	env.db.First(&stocked, product.ID)
+	if stocked.Stock != 4 {
+		t.Errorf("stock = %d after restocking the return, want 4", stocked.Stock)
+	}
+
+	var refunded returnResponse
+	env.do(http.MethodPut, returnPath, sellerToken, gin.H{"status": models.ReturnRefunded}, http.StatusOK, &refunded)
+	note := refunded.Return.CreditNote
+	if refunded.Return.Status != models.ReturnRefunded || note == nil || note.Amount != usd(15) || len(note.Refunds) != 1 {
+		t.Fatalf("refunded return = %+v, want a credit note of 15 with one refund", refunded.Return)
+	}
+
+	// The refund went through the provider, and asking again doesn't pay twice
+	sent, err := env.gateway.Refund(context.Background(), payments.RefundRequest{
+		Reference:       created.Order.PaymentID,
+		RefundReference: note.Refunds[0].RefundReference,
+		Amount:          usd(15),
+	})
+	if err != nil || sent.Amount != usd(15) {
+		t.Errorf("provider refund = %+v, %v; want the existing refund of 15", sent, err)
+	}
+
+	var invoice models.Invoice
+	env.db.First(&invoice, created.Order.InvoiceID)
+	if invoice.AmountCredited != usd(15) || invoice.Status != models.FullyPaid {
+		t.Errorf("invoice = %s with %s credited, want fully_paid with 15", invoice.Status, invoice.AmountCredited)
+	}
+	var order models.Order
+	env.db.First(&order, created.Order.ID)
+	if order.Status != models.Paid {
+		t.Errorf("order status = %s after partial refund, want paid", order.Status)
+	}
+}
+
+func TestFullRefundMarksOrderRefunded(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Vase", 40, 2)
+	buyerToken := env.login(buyer)
+	sellerToken := env.login(seller)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+	orderPath := fmt.Sprintf("/api/orders/%d", created.Order.ID)
+
+	// Refunding by status change would skip paying the money back
+	env.do(http.MethodPut, orderPath, sellerToken, gin.H{"status": models.Refunded}, http.StatusConflict, nil)
+
+	var requested returnResponse
+	env.do(http.MethodPost, orderPath+"/returns", buyerToken,
+		gin.H{"orderItemId": created.Order.OrderItems[0].ID, "quantity": 1, "reason": "Arrived broken"}, http.StatusCreated, &requested)
+	returnPath := fmt.Sprintf("/api/returns/%d", requested.Return.ID)
+
+	// Not worth sending back, so refunded without receiving it
+	env.do(http.MethodPut, returnPath, sellerToken, gin.H{"status": models.ReturnApproved}, http.StatusOK, nil)
+	env.do(http.MethodPut, returnPath, sellerToken, gin.H{"status": models.ReturnRefunded}, http.StatusOK, nil)
+
+	var order models.Order
+	env.db.Preload("Invoice").First(&order, created.Order.ID)
+	if order.Status != models.Refunded || order.Invoice.Status != models.Credited {
+		t.Errorf("order %s with invoice %s, want refunded and credited", order.Status, order.Invoice.Status)
+	}
+
+	// Refunded orders take no more returns and weren't restocked
+	env.do(http.MethodPost, orderPath+"/returns", buyerToken,
+		gin.H{"orderItemId": created.Order.OrderItems[0].ID, "quantity": 1, "reason": "Again"}, http.StatusConflict, nil)
+	var reloaded models.Product
+	env.db.First(&reloaded, product.ID)
+	if reloaded.Stock != 1 {
+		t.Errorf("stock = %d, want 1", reloaded.Stock)
+	}
+
+	var returns struct {
+		Returns []models.ReturnRequest `json:"returns"`
+	}
+	env.do(http.MethodGet, orderPath+"/returns", buyerToken, nil, http.StatusOK, &returns)
+	if len(returns.Returns) != 1 || returns.Returns[0].CreditNote == nil {
+		t.Errorf("returns = %+v, want one with a credit note", returns.Returns)
+	}
+}
+
+// unreachableRefunds is a gateway whose refunds fail as if the provider
+// couldn't be reached
+type unreachableRefunds struct {
+	payments.Gateway
+}
+
+func (unreachableRefunds) Refund(ctx context.Context, req payments.RefundRequest) (*payments.Refund, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRefundIsBookedBeforeProviderPaysIt(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Kettle", 25, 2)
+	buyerToken := env.login(buyer)
+	sellerToken := env.login(seller)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+	var requested returnResponse
+	env.do(http.MethodPost, fmt.Sprintf("/api/orders/%d/returns", created.Order.ID), buyerToken,
+		gin.H{"orderItemId": created.Order.OrderItems[0].ID, "quantity": 1, "reason": "Leaks"}, http.StatusCreated, &requested)
+	returnPath := fmt.Sprintf("/api/returns/%d", requested.Return.ID)
+	env.do(http.MethodPut, returnPath, sellerToken, gin.H{"status": models.ReturnApproved}, http.StatusOK, nil)
+
+	env.app.gateways = payments.NewRegistry(unreachableRefunds{env.gateway})
+	env.do(http.MethodPut, returnPath, sellerToken, gin.H{"status": models.ReturnRefunded}, http.StatusBadGateway, nil)
+
+	// The refund is booked and waits for the provider
+	var ret models.ReturnRequest
+	env.db.First(&ret, requested.Return.ID)
+	var refund models.PaymentRefund
+	env.db.First(&refund)
+	if ret.Status != models.ReturnRefunded || ret.CreditNoteID == nil || refund.Status != models.PaymentPending {
+		t.Fatalf("return %s with refund %s, want refunded with a pending refund", ret.Status, refund.Status)
+	}
+	var payment models.Payment
+	env.db.First(&payment, refund.PaymentID)
+	if payment.AmountRefunded != usd(25) {
+		t.Errorf("payment refunded %s, want 25 held for the pending refund", payment.AmountRefunded)
+	}
+
+	// Once the provider is back the sweeper pays it
+	env.app.gateways = payments.NewRegistry(env.gateway)
+	settled, err := env.app.resendPendingRefunds(context.Background())
+	if err != nil || settled != 1 {
+		t.Fatalf("resendPendingRefunds = %d, %v; want 1 settled", settled, err)
+	}
+	env.db.First(&refund, refund.ID)
+	if refund.Status != models.PaymentSucceeded {
+		t.Errorf("refund status = %s, want succeeded", refund.Status)
+	}
+	if settled, _ := env.app.resendPendingRefunds(context.Background()); settled != 0 {
+		t.Errorf("resent %d refunds, want none left", settled)
+	}
+}
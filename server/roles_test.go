@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// status sends a JSON request and returns the response status, for checks
+// that only care whether the request got past the role middleware
+func (e *testEnv) status(method, path, token string, body interface{}) int {
+	e.t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			e.t.Fatalf("encode body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRouteRoles(t *testing.T) {
+	env := newTestEnv(t)
+	buyer := env.createUser("buyer", models.Buyer)
+	other := env.createUser("other", models.Buyer)
+	seller := env.createUser("seller", models.Seller)
+	admin := env.createUser("admin", models.Admin)
+	product := env.createProduct(seller, "Lamp", 20, 5)
+
+	tokens := map[models.Role]string{
+		models.Buyer:  env.login(buyer),
+		models.Seller: env.login(seller),
+		models.Admin:  env.login(admin),
+	}
+	productPath := fmt.Sprintf("/api/products/%d", product.ID)
+	otherPath := fmt.Sprintf("/api/users/%d", other.ID)
+	shopPath := fmt.Sprintf("/api/shops/%d", seller.ShopID)
+	newProduct := gin.H{"name": "Desk", "price": 50, "stock": 1}
+	coupon := gin.H{"code": "SITE10", "type": "percent", "percent": 10}
+
+	routes := []struct {
+		method, path string
+		body         interface{}
+		// denied lists the roles turned away with 403
+		denied []models.Role
+	}{
+		{http.MethodPost, "/api/products", newProduct, []models.Role{models.Buyer}},
+		{http.MethodPut, productPath, gin.H{"name": "Desk lamp"}, []models.Role{models.Buyer}},
+		{http.MethodPost, productPath + "/stock-adjustments", gin.H{"delta": 1, "reason": "restock"}, []models.Role{models.Buyer}},
+		{http.MethodGet, productPath + "/stock-history", nil, []models.Role{models.Buyer}},
+		{http.MethodPut, shopPath, gin.H{"name": "Lamps"}, []models.Role{models.Buyer}},
+		{http.MethodPut, otherPath, gin.H{"username": "other", "email": other.Email, "firstName": "Mallory"}, []models.Role{models.Buyer, models.Seller}},
+		{http.MethodGet, otherPath, nil, []models.Role{models.Buyer, models.Seller}},
+		{http.MethodGet, otherPath + "/shops", nil, []models.Role{models.Buyer, models.Seller}},
+		{http.MethodGet, otherPath + "/addresses", nil, []models.Role{models.Buyer, models.Seller}},
+		{http.MethodGet, "/api/coupons", nil, []models.Role{models.Buyer, models.Seller}},
+		{http.MethodPost, "/api/coupons", coupon, []models.Role{models.Buyer, models.Seller}},
+	}
+	for _, route := range routes {
+		name := route.method + " " + route.path
+
+		// Without a token the caller isn't authenticated, which is not the
+		// same as being refused
+		if got := env.status(route.method, route.path, "", route.body); got != http.StatusUnauthorized {
+			t.Errorf("%s without a token: status = %d, want 401", name, got)
+		}
+
+		for _, role := range []models.Role{models.Buyer, models.Seller, models.Admin} {
+			got := env.status(route.method, route.path, tokens[role], route.body)
+			wantDenied := false
+			for _, denied := range route.denied {
+				wantDenied = wantDenied || denied == role
+			}
+			switch {
+			case wantDenied && got != http.StatusForbidden:
+				t.Errorf("%s as %s: status = %d, want 403", name, role, got)
+			case !wantDenied && (got == http.StatusUnauthorized || got == http.StatusForbidden):
+				t.Errorf("%s as %s: status = %d, want the request let through", name, role, got)
+			}
+		}
+	}
+
+	// Buyers may still change their own account
+	env.do(http.MethodPut, fmt.Sprintf("/api/users/%d", buyer.ID), tokens[models.Buyer], gin.H{"username": "buyer", "email": buyer.Email, "firstName": "Bea"}, http.StatusOK, nil)
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+	"tobe_shop/server/money"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -46,7 +47,7 @@ type Product struct {
 	gorm.Model
 	Name        string        `gorm:"size:100;not null" json:"name"`
 	Description string        `gorm:"size:500" json:"description"`
-	Price       float64       `gorm:"not null" json:"price"`
+	Price       money.Money   `gorm:"embedded;embeddedPrefix:price_" json:"price"`
 	Stock       int           `gorm:"not null" json:"stock"`
 	Image       string        `gorm:"size:255" json:"image"`
 	Category    string        `gorm:"size:50" json:"category"`
@@ -332,7 +333,7 @@ func main() {
 			product := Product{
 				Name:        p.Name,
 				Description: p.Description,
-				Price:       p.Price,
+				Price:       money.FromFloat(p.Price, money.DefaultCurrency),
 				Stock:       p.Stock,
 				Image:       p.Image,
 				Category:    p.Category,
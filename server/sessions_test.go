@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionLogin is the token pair handed out by login and refresh
+type sessionLogin struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// loginSession logs the user in and returns both tokens
+func (e *testEnv) loginSession(user *models.User) sessionLogin {
+	e.t.Helper()
+	var tokens sessionLogin
+	e.do(http.MethodPost, "/api/login", "", gin.H{"email": user.Email, "password": testPassword}, http.StatusOK, &tokens)
+	return tokens
+}
+
+// refresh exchanges a refresh token, expecting wantStatus
+func (e *testEnv) refresh(refreshToken string, wantStatus int) (sessionLogin, string) {
+	e.t.Helper()
+	var resp struct {
+		sessionLogin
+		Code string `json:"code"`
+	}
+	e.do(http.MethodPost, "/api/token/refresh", "", gin.H{"refreshToken": refreshToken}, wantStatus, &resp)
+	return resp.sessionLogin, resp.Code
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	env := newTestEnv(t)
+	buyer := env.createUser("buyer", models.Buyer)
+	profile := fmt.Sprintf("/api/users/%d", buyer.ID)
+	first := env.loginSession(buyer)
+
+	second, _ := env.refresh(first.RefreshToken, http.StatusOK)
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken || second.Token == "" {
+		t.Fatalf("refresh = %+v, want a new token pair", second)
+	}
+	env.do(http.MethodGet, profile, second.Token, nil, http.StatusOK, nil)
+
+	// The rotated token is spent
+	if _, code := env.refresh(first.RefreshToken, http.StatusUnauthorized); code != "refresh_token_reused" {
+		t.Errorf("reusing a rotated token gave %q, want refresh_token_reused", code)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	env := newTestEnv(t)
+	buyer := env.createUser("buyer", models.Buyer)
+	profile := fmt.Sprintf("/api/users/%d", buyer.ID)
+	stolen := env.loginSession(buyer)
+	other := env.loginSession(buyer)
+
+	current, _ := env.refresh(stolen.RefreshToken, http.StatusOK)
+	env.refresh(stolen.RefreshToken, http.StatusUnauthorized)
+
+	// Every token of the family is dead, including the newest one
+	if _, code := env.refresh(current.RefreshToken, http.StatusUnauthorized); code != "session_revoked" {
+		t.Errorf("refreshing after reuse gave %q, want session_revoked", code)
+	}
+	env.do(http.MethodGet, profile, current.Token, nil, http.StatusUnauthorized, nil)
+
+	var sessions []models.Session
+	env.db.Where("user_id = ? AND revoked_reason = ?", buyer.ID, "reuse_detected").Find(&sessions)
+	if len(sessions) != 1 {
+		t.Errorf("%d sessions revoked for reuse, want the current one", len(sessions))
+	}
+
+	// Other logins carry on
+	env.do(http.MethodGet, profile, other.Token, nil, http.StatusOK, nil)
+	env.refresh(other.RefreshToken, http.StatusOK)
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	env := newTestEnv(t)
+	buyer := env.createUser("buyer", models.Buyer)
+	profile := fmt.Sprintf("/api/users/%d", buyer.ID)
+	session := env.loginSession(buyer)
+	other := env.loginSession(buyer)
+
+	env.do(http.MethodPost, "/api/logout", session.Token, nil, http.StatusOK, nil)
+
+	// The access token is refused straight away, before it expires
+	var refused struct {
+		Code string `json:"code"`
+	}
+	env.do(http.MethodGet, profile, session.Token, nil, http.StatusUnauthorized, &refused)
+	if refused.Code != "session_revoked" {
+		t.Errorf("code = %q, want session_revoked", refused.Code)
+	}
+	env.refresh(session.RefreshToken, http.StatusUnauthorized)
+
+	env.do(http.MethodGet, profile, other.Token, nil, http.StatusOK, nil)
+}
+
+func TestLogoutAllRevokesEverySession(t *testing.T) {
+	env := newTestEnv(t)
+	buyer := env.createUser("buyer", models.Buyer)
+	seller := env.createUser("seller", models.Seller)
+	laptop := env.loginSession(buyer)
+	phone := env.loginSession(buyer)
+	phone, _ = env.refresh(phone.RefreshToken, http.StatusOK)
+	bystander := env.loginSession(seller)
+
+	var loggedOut struct {
+		RevokedSessions int64 `json:"revokedSessions"`
+	}
+	env.do(http.MethodPost, "/api/logout-all", laptop.Token, nil, http.StatusOK, &loggedOut)
+	if loggedOut.RevokedSessions != 2 {
+		t.Errorf("revoked %d sessions, want 2", loggedOut.RevokedSessions)
+	}
+
+	for _, session := range []sessionLogin{laptop, phone} {
+		env.do(http.MethodGet, fmt.Sprintf("/api/users/%d", buyer.ID), session.Token, nil, http.StatusUnauthorized, nil)
+		env.refresh(session.RefreshToken, http.StatusUnauthorized)
+	}
+
+	// Other users stay logged in
+	env.do(http.MethodGet, fmt.Sprintf("/api/users/%d", seller.ID), bystander.Token, nil, http.StatusOK, nil)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// shipmentDetails is what a seller enters when shipping a shop order
+type shipmentDetails struct {
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"trackingNumber"`
+}
+
+// trackShopOrder keeps the shipment of a shop order in step with its
+// status: shipping creates the shipment and delivery closes it
+func trackShopOrder(tx *gorm.DB, group *models.ShopOrder, to models.OrderStatus, details shipmentDetails, now time.Time) error {
+	switch to {
+	case models.Shipped:
+		_, err := createShipment(tx, group, details, now)
+		return err
+	case models.Delivered:
+		return tx.Model(&models.Shipment{}).
+			Where("shop_order_id = ? AND delivered_at IS NULL", group.ID).
+			Update("delivered_at", now).Error
+	}
+	return nil
+}
+
+// applyShipmentDetails puts the details entered when shipping a whole order
+// on the shipments created for it, leaving parcels shops already sent with
+// their own tracking number alone
+func applyShipmentDetails(tx *gorm.DB, orderID uint, to models.OrderStatus, details shipmentDetails) error {
+	if to != models.Shipped {
+		return nil
+	}
+	updates := make(map[string]interface{})
+	if details.Carrier != "" {
+		updates["carrier"] = details.Carrier
+	}
+	if details.TrackingNumber != "" {
+		updates["tracking_number"] = details.TrackingNumber
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return tx.Model(&models.Shipment{}).
+		Where("order_id = ? AND tracking_number = ?", orderID, "").
+		Updates(updates).Error
+}
+
+// createShipment records the parcel sent for a shop order together with its
+// first tracking event. The carrier defaults to the one of the shipping
+// method chosen at checkout.
+func createShipment(tx *gorm.DB, group *models.ShopOrder, details shipmentDetails, now time.Time) (*models.Shipment, error) {
+	carrier := details.Carrier
+	if carrier == "" && group.ShippingMethodID != nil {
+		// The shop may have deleted the method since
+		var carriers []string
+		if err := tx.Unscoped().Model(&models.ShippingMethod{}).
+			Where("id = ?", *group.ShippingMethodID).Pluck("carrier", &carriers).Error; err != nil {
+			return nil, err
+		}
+		if len(carriers) > 0 {
+			carrier = carriers[0]
+		}
+	}
+
+	shipment := models.Shipment{
+		OrderID:        group.OrderID,
+		ShopOrderID:    group.ID,
+		Carrier:        carrier,
+		TrackingNumber: details.TrackingNumber,
+		ShippedAt:      now,
+		Events: []models.TrackingEvent{{
+			Status:      models.TrackingShipped,
+			Description: "Handed over to the carrier",
+			OccurredAt:  now,
+		}},
+	}
+	if err := tx.Create(&shipment).Error; err != nil {
+		return nil, err
+	}
+	group.Shipment = &shipment
+	return &shipment, nil
+}
+
+// Shipment handlers
+
+func (a *app) getOrderShipments(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var order models.Order
+	if err := a.db.First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	canView, err := a.canViewOrder(user, &order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check order permissions"})
+		return
+	}
+	if !canView {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to view this order"})
+		return
+	}
+
+	var shipments []models.Shipment
+	if err := a.db.Preload("Events", func(db *gorm.DB) *gorm.DB {
+		return db.Order("occurred_at ASC, id ASC")
+	}).Where("order_id = ?", order.ID).Order("id").Find(&shipments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shipments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shipments": shipments})
+}
+
+// addTrackingEvent lets the seller record progress of a shipment. A
+// delivered event delivers the shop order.
+func (a *app) addTrackingEvent(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var eventRequest struct {
+		Status      models.TrackingStatus `json:"status" binding:"required"`
+		Location    string                `json:"location"`
+		Description string                `json:"description"`
+		OccurredAt  *time.Time            `json:"occurredAt"`
+	}
+	if err := c.ShouldBindJSON(&eventRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if !eventRequest.Status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tracking status: " + string(eventRequest.Status)})
+		return
+	}
+
+	var shipment models.Shipment
+	if err := a.db.First(&shipment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return
+	}
+	var group models.ShopOrder
+	if err := a.db.Preload("Shop").First(&group, shipment.ShopOrderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return
+	}
+	if group.Shop == nil || (group.Shop.UserID != user.ID && user.Role != models.Admin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the shop that sent the shipment can track it"})
+		return
+	}
+	var order models.Order
+	if err := a.db.First(&order, shipment.OrderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	event := models.TrackingEvent{
+		ShipmentID:  shipment.ID,
+		Status:      eventRequest.Status,
+		Location:    eventRequest.Location,
+		Description: eventRequest.Description,
+		OccurredAt:  time.Now(),
+	}
+	if eventRequest.OccurredAt != nil {
+		event.OccurredAt = *eventRequest.OccurredAt
+	}
+
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&event).Error; err != nil {
+				return err
+			}
+			if event.Status != models.TrackingDelivered || group.Status != models.Shipped {
+				return nil
+			}
+			return changeShopOrderStatus(tx, &group, &order, models.Delivered, shipmentDetails{}, user, "Delivered by the carrier")
+		})
+	})
+	if errors.Is(err, errStatusConflict) || errors.Is(err, errIllegalTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order status was changed by another request, please reload"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add tracking event"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Tracking event added successfully",
+		"event":   event,
+	})
+}
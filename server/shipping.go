@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// shopParcel is what one shop ships for an order
+type shopParcel struct {
+	ShopID   uint
+	Subtotal money.Money
+	// Weight is in kilograms
+	Weight float64
+}
+
+// shippingChoice is the shipping picked for one shop's parcel
+type shippingChoice struct {
+	Method *models.ShippingMethod
+	Cost   money.Money
+}
+
+// activeShippingMethods returns the active shipping methods of the shops,
+// by shop
+func activeShippingMethods(tx *gorm.DB, shopIDs []uint) (map[uint][]models.ShippingMethod, error) {
+	var methods []models.ShippingMethod
+	if err := tx.Where("shop_id IN ? AND active = ?", shopIDs, true).Order("id").Find(&methods).Error; err != nil {
+		return nil, err
+	}
+	byShop := make(map[uint][]models.ShippingMethod)
+	for _, method := range methods {
+		byShop[method.ShopID] = append(byShop[method.ShopID], method)
+	}
+	return byShop, nil
+}
+
+// chooseShipping works out the shipping of each shop's parcel. selected maps
+// shops to the method the buyer picked; shops without a pick ship with their
+// cheapest method, and shops that haven't set up shipping ship for free.
+func chooseShipping(tx *gorm.DB, parcels map[uint]*shopParcel, selected map[uint]uint) (map[uint]shippingChoice, error) {
+	shopIDs := make([]uint, 0, len(parcels))
+	for shopID := range parcels {
+		shopIDs = append(shopIDs, shopID)
+	}
+	methods, err := activeShippingMethods(tx, shopIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	choices := make(map[uint]shippingChoice, len(parcels))
+	for shopID, parcel := range parcels {
+		var choice shippingChoice
+		for i := range methods[shopID] {
+			method := &methods[shopID][i]
+			cost := method.Cost(parcel.Subtotal, parcel.Weight)
+			if want := selected[shopID]; want != 0 {
+				if method.ID == want {
+					choice = shippingChoice{method, cost}
+				}
+				continue
+			}
+			if choice.Method == nil || cost.Cmp(choice.Cost) < 0 {
+				choice = shippingChoice{method, cost}
+			}
+		}
+		if want := selected[shopID]; want != 0 && choice.Method == nil {
+			return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("Shipping method %d is not available for shop %d", want, shopID)}
+		}
+		choices[shopID] = choice
+	}
+	return choices, nil
+}
+
+// validateShippingMethod checks the settings of a shipping method
+func validateShippingMethod(method *models.ShippingMethod) string {
+	switch {
+	case method.Name == "":
+		return "Name is required"
+	case !method.RateType.IsValid():
+		return "Unknown rate type: " + string(method.RateType)
+	case method.BaseRate.IsNegative() || method.PerKgRate.IsNegative() || method.FreeOverAmount.IsNegative():
+		return "Rates can't be negative"
+	case method.RateType == models.RateFreeOver && !method.FreeOverAmount.IsPositive():
+		return "Free shipping needs a threshold amount"
+	}
+	return ""
+}
+
+// shippingMethodRequest is the body for creating or updating a shipping method
+type shippingMethodRequest struct {
+	Name           string                  `json:"name"`
+	Carrier        string                  `json:"carrier"`
+	RateType       models.ShippingRateType `json:"rateType"`
+	BaseRate       money.Money             `json:"baseRate"`
+	PerKgRate      money.Money             `json:"perKgRate"`
+	FreeOverAmount money.Money             `json:"freeOverAmount"`
+	EstimatedDays  int                     `json:"estimatedDays"`
+	Active         *bool                   `json:"active"`
+}
+
+// newShippingMethodRequest returns a request for rates in currency
+func newShippingMethodRequest(currency string) shippingMethodRequest {
+	zero := money.Zero(currency)
+	return shippingMethodRequest{BaseRate: zero, PerKgRate: zero, FreeOverAmount: zero}
+}
+
+// apply copies the request onto the method
+func (r *shippingMethodRequest) apply(method *models.ShippingMethod) {
+	method.Name = r.Name
+	method.Carrier = r.Carrier
+	method.RateType = r.RateType
+	method.BaseRate = r.BaseRate
+	method.PerKgRate = r.PerKgRate
+	method.FreeOverAmount = r.FreeOverAmount
+	method.EstimatedDays = r.EstimatedDays
+	if r.Active != nil {
+		method.Active = *r.Active
+	}
+}
+
+// Shipping handlers
+
+func (a *app) getShippingMethods(c *gin.Context) {
+	var methods []models.ShippingMethod
+	if err := a.db.Where("shop_id = ? AND active = ?", c.Param("id"), true).
+		Order("id").Find(&methods).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shipping methods"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shippingMethods": methods})
+}
+
+func (a *app) createShippingMethod(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+
+	// Rates are compared with the shop's prices, so they are in its currency
+	methodRequest := newShippingMethodRequest(shop.Currency)
+	if err := c.ShouldBindJSON(&methodRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	method := models.ShippingMethod{ShopID: shop.ID, Active: true}
+	methodRequest.apply(&method)
+	if problem := validateShippingMethod(&method); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	if err := a.db.Create(&method).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shipping method"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":        "Shipping method created successfully",
+		"shippingMethod": method,
+	})
+}
+
+func (a *app) updateShippingMethod(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+
+	var method models.ShippingMethod
+	if err := a.db.Where("id = ? AND shop_id = ?", c.Param("methodId"), shop.ID).First(&method).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipping method not found"})
+		return
+	}
+
+	methodRequest := newShippingMethodRequest(shop.Currency)
+	if err := c.ShouldBindJSON(&methodRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	methodRequest.apply(&method)
+	if problem := validateShippingMethod(&method); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	// Orders keep the cost they were quoted, so changing rates is safe
+	if err := a.db.Save(&method).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update shipping method"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Shipping method updated successfully",
+		"shippingMethod": method,
+	})
+}
+
+func (a *app) deleteShippingMethod(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+
+	result := a.db.Where("id = ? AND shop_id = ?", c.Param("methodId"), shop.ID).Delete(&models.ShippingMethod{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete shipping method"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipping method not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Shipping method deleted successfully"})
+}
+
+// shippingQuote is the shipping offered for one shop's part of an order
+type shippingQuote struct {
+	ShopID   uint        `json:"shopId"`
+	ShopName string      `json:"shopName"`
+	Subtotal money.Money `json:"subtotal"`
+	Weight   float64     `json:"weight"`
+	Methods  []gin.H     `json:"methods"`
+	// Cheapest is the method used when the buyer doesn't pick one, 0 if the
+	// shop ships for free
+	Cheapest uint `json:"cheapest"`
+}
+
+// quoteShipping prices the shipping methods for the items before an order
+// is placed, split by the shop shipping them
+func (a *app) quoteShipping(c *gin.Context) {
+	var quoteRequest struct {
+		OrderItems []orderItemRequest `json:"orderItems"`
+	}
+	if err := c.ShouldBindJSON(&quoteRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if len(quoteRequest.OrderItems) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one item is required"})
+		return
+	}
+
+	// Group the items into a parcel per shop
+	parcels := make(map[uint]*shopParcel)
+	var shopIDs []uint
+	for _, item := range quoteRequest.OrderItems {
+		var product models.Product
+		if err := a.db.First(&product, item.ProductID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product not found: " + strconv.FormatUint(uint64(item.ProductID), 10)})
+			return
+		}
+		if err := applySalePrice(a.db, &product, time.Now()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sale prices"})
+			return
+		}
+		variant, err := loadOrderVariant(a.db, &product, item.VariantID)
+		if err != nil {
+			respondOrderError(c, err)
+			return
+		}
+		parcel, ok := parcels[product.ShopID]
+		if !ok {
+			parcel = &shopParcel{ShopID: product.ShopID, Subtotal: money.Zero(product.Price.Currency)}
+			parcels[product.ShopID] = parcel
+			shopIDs = append(shopIDs, product.ShopID)
+		}
+		parcel.Subtotal = parcel.Subtotal.Add(variantPrice(&product, variant).Times(item.Quantity))
+		parcel.Weight += product.Weight * float64(item.Quantity)
+	}
+
+	methods, err := activeShippingMethods(a.db, shopIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get shipping methods"})
+		return
+	}
+	cheapest, err := chooseShipping(a.db, parcels, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to quote shipping"})
+		return
+	}
+
+	// Shops charge shipping in their own currency, so the total is given
+	// per currency
+	quotes := make([]shippingQuote, 0, len(shopIDs))
+	shippingTotals := make(map[string]money.Money)
+	for _, shopID := range shopIDs {
+		parcel := parcels[shopID]
+		var shop models.Shop
+		if err := a.db.Select("id", "name").First(&shop, shopID).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load shop"})
+			return
+		}
+
+		quote := shippingQuote{
+			ShopID:   shopID,
+			ShopName: shop.Name,
+			Subtotal: parcel.Subtotal,
+			Weight:   parcel.Weight,
+			Methods:  []gin.H{},
+		}
+		for _, method := range methods[shopID] {
+			quote.Methods = append(quote.Methods, gin.H{
+				"id":            method.ID,
+				"name":          method.Name,
+				"carrier":       method.Carrier,
+				"rateType":      method.RateType,
+				"cost":          method.Cost(parcel.Subtotal, parcel.Weight),
+				"estimatedDays": method.EstimatedDays,
+			})
+		}
+		if choice := cheapest[shopID]; choice.Method != nil {
+			quote.Cheapest = choice.Method.ID
+			currency := choice.Cost.Currency
+			shippingTotals[currency] = shippingTotals[currency].Add(choice.Cost)
+		}
+		quotes = append(quotes, quote)
+	}
+
+	response := gin.H{
+		"quotes":         quotes,
+		"shippingTotals": shippingTotals,
+	}
+	// While there is only one currency the total is also given on its own
+	if len(shippingTotals) == 1 {
+		for currency, total := range shippingTotals {
+			response["shippingTotal"] = total
+			response["currency"] = currency
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestShippingMethodCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   models.ShippingMethod
+		subtotal float64
+		weight   float64
+		want     float64
+	}{
+		{"flat", models.ShippingMethod{RateType: models.RateFlat, BaseRate: usd(5)}, 100, 3, 5},
+		{"weight rounds up to started kilos", models.ShippingMethod{RateType: models.RateWeight, BaseRate: usd(2), PerKgRate: usd(1.5)}, 10, 2.2, 6.5},
+		{"weightless parcel", models.ShippingMethod{RateType: models.RateWeight, BaseRate: usd(2), PerKgRate: usd(1.5)}, 10, 0, 2},
+		{"below free threshold", models.ShippingMethod{RateType: models.RateFreeOver, BaseRate: usd(4.99), FreeOverAmount: usd(50)}, 49.99, 1, 4.99},
+		{"at free threshold", models.ShippingMethod{RateType: models.RateFreeOver, BaseRate: usd(4.99), FreeOverAmount: usd(50)}, 50, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.method.Cost(usd(tt.subtotal), tt.weight); got != usd(tt.want) {
+				t.Errorf("Cost(%v, %v) = %v, want %v", tt.subtotal, tt.weight, got, tt.want)
+			}
+		})
+	}
+}
+
+type shippingMethodResponse struct {
+	ShippingMethod models.ShippingMethod `json:"shippingMethod"`
+}
+
+func TestShippingQuoteAndOrderTotal(t *testing.T) {
+	env := newTestEnv(t)
+	potter := env.createUser("potter", models.Seller)
+	weaver := env.createUser("weaver", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	cup := env.createProduct(potter, "Cup", 12, 10)
+	rug := env.createProduct(weaver, "Rug", 80, 2)
+	env.db.Model(cup).Update("weight", 0.4)
+	potterToken := env.login(potter)
+	methodsPath := fmt.Sprintf("/api/shops/%d/shipping-methods", potter.ShopID)
+
+	var standard, express shippingMethodResponse
+	env.do(http.MethodPost, methodsPath, potterToken, gin.H{
+		"name": "Standard", "carrier": "PostNL", "rateType": models.RateFreeOver, "baseRate": 4.5, "freeOverAmount": 100,
+	}, http.StatusCreated, &standard)
+	env.do(http.MethodPost, methodsPath, potterToken, gin.H{
+		"name": "Express", "carrier": "DHL", "rateType": models.RateWeight, "baseRate": 6, "perKgRate": 2,
+	}, http.StatusCreated, &express)
+	env.do(http.MethodPost, methodsPath, potterToken, gin.H{"name": "Broken", "rateType": "teleport"}, http.StatusBadRequest, nil)
+	env.do(http.MethodPost, methodsPath, env.login(weaver), gin.H{"name": "Sneaky", "rateType": models.RateFlat}, http.StatusForbidden, nil)
+
+	// The quote prices every method per shop; the weaver ships for free
+	items := []gin.H{{"productId": cup.ID, "quantity": 3}, {"productId": rug.ID, "quantity": 1}}
+	var quoted struct {
+		Quotes        []shippingQuote `json:"quotes"`
+		ShippingTotal float64         `json:"shippingTotal"`
+	}
+	env.do(http.MethodPost, "/api/shipping/quote", "", gin.H{"orderItems": items}, http.StatusOK, &quoted)
+	if len(quoted.Quotes) != 2 || len(quoted.Quotes[0].Methods) != 2 || len(quoted.Quotes[1].Methods) != 0 {
+		t.Fatalf("quotes = %+v, want two methods for the potter and none for the weaver", quoted.Quotes)
+	}
+	if quoted.Quotes[0].Cheapest != standard.ShippingMethod.ID || quoted.ShippingTotal != 4.5 {
+		t.Errorf("cheapest = %d costing %v, want standard at 4.5", quoted.Quotes[0].Cheapest, quoted.ShippingTotal)
+	}
+
+	// Picking express charges 6 plus 2 per started kilo of 1.2kg
+	request := orderRequest(items...)
+	request["shippingMethods"] = gin.H{fmt.Sprint(potter.ShopID): express.ShippingMethod.ID}
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", env.login(buyer), request, http.StatusCreated, &created)
+	if created.Order.ShippingCost != usd(10) || created.Order.Total != usd(126) {
+		t.Errorf("order shipping %v total %v, want 10 and 126", created.Order.ShippingCost, created.Order.Total)
+	}
+	var parts []models.ShopOrder
+	env.db.Where("order_id = ?", created.Order.ID).Order("id").Find(&parts)
+	if parts[0].ShippingMethod != "Express" || parts[0].Total != usd(46) || parts[1].ShippingCost != usd(0) {
+		t.Errorf("shop orders = %+v, want express shipping on the potter's part only", parts)
+	}
+
+	var invoice models.Invoice
+	env.db.First(&invoice, created.Order.InvoiceID)
+	if invoice.TotalAmount != usd(126) {
+		t.Errorf("invoice total = %v, want shipping included", invoice.TotalAmount)
+	}
+
+	// Another shop's method can't be picked
+	request["shippingMethods"] = gin.H{fmt.Sprint(rug.ShopID): express.ShippingMethod.ID}
+	env.do(http.MethodPost, "/api/orders", env.login(buyer), request, http.StatusBadRequest, nil)
+
+	// Deleted methods are no longer offered
+	env.do(http.MethodDelete, fmt.Sprintf("%s/%d", methodsPath, express.ShippingMethod.ID), potterToken, nil, http.StatusOK, nil)
+	var listed struct {
+		ShippingMethods []models.ShippingMethod `json:"shippingMethods"`
+	}
+	env.do(http.MethodGet, methodsPath, "", nil, http.StatusOK, &listed)
+	if len(listed.ShippingMethods) != 1 {
+		t.Errorf("listed %d shipping methods, want 1", len(listed.ShippingMethods))
+	}
+}
+
+func TestShippingMethodsInShopCurrency(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	shop := models.Shop{Name: "Euro shop", UserID: seller.ID, Currency: "EUR"}
+	env.db.Create(&shop)
+	seller.ShopID = shop.ID
+	env.db.Save(seller)
+	lamp := models.Product{Name: "Lamp", Price: money.New(2000, "EUR"), Stock: 5, Status: models.Available, ShopID: shop.ID}
+	env.db.Create(&lamp)
+	sellerToken := env.login(seller)
+	shopPath := fmt.Sprintf("/api/shops/%d", shop.ID)
+
+	var created shippingMethodResponse
+	env.do(http.MethodPost, shopPath+"/shipping-methods", sellerToken, gin.H{
+		"name": "Standard", "rateType": models.RateFreeOver, "baseRate": 5, "freeOverAmount": 50,
+	}, http.StatusCreated, &created)
+	var method models.ShippingMethod
+	env.db.First(&method, created.ShippingMethod.ID)
+	if method.BaseRate != money.New(500, "EUR") || method.FreeOverAmount != money.New(5000, "EUR") {
+		t.Errorf("rates = %v free over %v, want 5 EUR free over 50 EUR", method.BaseRate, method.FreeOverAmount)
+	}
+
+	// Rates are compared with the shop's prices
+	for _, tc := range []struct {
+		quantity int
+		cost     float64
+	}{{1, 5}, {3, 0}} {
+		var quoted struct {
+			Quotes []shippingQuote `json:"quotes"`
+		}
+		env.do(http.MethodPost, "/api/shipping/quote", "", gin.H{"orderItems": []gin.H{{"productId": lamp.ID, "quantity": tc.quantity}}}, http.StatusOK, &quoted)
+		if cost := quoted.Quotes[0].Methods[0]["cost"]; cost != tc.cost {
+			t.Errorf("shipping %d lamps = %v, want %v", tc.quantity, cost, tc.cost)
+		}
+	}
+
+	// Shipping from shops in other currencies is totalled per currency
+	dollarSeller := env.createUser("dollar-seller", models.Seller)
+	mug := env.createProduct(dollarSeller, "Mug", 8, 5)
+	env.do(http.MethodPost, fmt.Sprintf("/api/shops/%d/shipping-methods", dollarSeller.ShopID), env.login(dollarSeller),
+		gin.H{"name": "Post", "rateType": models.RateFlat, "baseRate": 3}, http.StatusCreated, nil)
+	var mixed struct {
+		ShippingTotals map[string]float64 `json:"shippingTotals"`
+		ShippingTotal  *float64           `json:"shippingTotal"`
+	}
+	env.do(http.MethodPost, "/api/shipping/quote", "", gin.H{"orderItems": []gin.H{
+		{"productId": lamp.ID, "quantity": 1}, {"productId": mug.ID, "quantity": 1},
+	}}, http.StatusOK, &mixed)
+	if len(mixed.ShippingTotals) != 2 || mixed.ShippingTotals["EUR"] != 5 || mixed.ShippingTotals["USD"] != 3 || mixed.ShippingTotal != nil {
+		t.Errorf("totals = %v and %v, want 5 EUR and 3 USD without a single total", mixed.ShippingTotals, mixed.ShippingTotal)
+	}
+
+	// A shop with shipping rates keeps its currency
+	env.db.Delete(&lamp)
+	env.do(http.MethodPut, shopPath, sellerToken, gin.H{"currency": "USD"}, http.StatusConflict, nil)
+}
+
+func TestShipmentTracking(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Lamp", 40, 5)
+	sellerToken := env.login(seller)
+	buyerToken := env.login(buyer)
+
+	env.do(http.MethodPost, fmt.Sprintf("/api/shops/%d/shipping-methods", seller.ShopID), sellerToken, gin.H{
+		"name": "Standard", "carrier": "PostNL", "rateType": models.RateFlat, "baseRate": 5,
+	}, http.StatusCreated, nil)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+	part := created.Order.ShopOrders[0]
+
+	// Shipping creates the shipment with the method's carrier
+	var shipped struct {
+		Order models.ShopOrder `json:"order"`
+	}
+	env.do(http.MethodPut, fmt.Sprintf("/api/shops/%d/orders/%d", seller.ShopID, part.ID), sellerToken,
+		gin.H{"status": models.Shipped, "trackingNumber": "3S123"}, http.StatusOK, &shipped)
+	shipment := shipped.Order.Shipment
+	if shipment == nil || shipment.Carrier != "PostNL" || shipment.TrackingNumber != "3S123" {
+		t.Fatalf("shipment = %+v, want PostNL tracking 3S123", shipment)
+	}
+
+	eventsPath := fmt.Sprintf("/api/shipments/%d/events", shipment.ID)
+	env.do(http.MethodPost, eventsPath, buyerToken, gin.H{"status": models.TrackingInTransit}, http.StatusForbidden, nil)
+	env.do(http.MethodPost, eventsPath, sellerToken, gin.H{"status": "lost_in_space"}, http.StatusBadRequest, nil)
+	env.do(http.MethodPost, eventsPath, sellerToken,
+		gin.H{"status": models.TrackingInTransit, "location": "Utrecht"}, http.StatusCreated, nil)
+	env.do(http.MethodPost, eventsPath, sellerToken,
+		gin.H{"status": models.TrackingDelivered, "location": "Amsterdam"}, http.StatusCreated, nil)
+
+	// The delivered event delivers the order
+	var order models.Order
+	env.db.First(&order, created.Order.ID)
+	if order.Status != models.Delivered {
+		t.Errorf("order status = %s after delivery, want delivered", order.Status)
+	}
+
+	var listed struct {
+		Shipments []models.Shipment `json:"shipments"`
+	}
+	env.do(http.MethodGet, fmt.Sprintf("/api/orders/%d/shipments", order.ID), buyerToken, nil, http.StatusOK, &listed)
+	if len(listed.Shipments) != 1 || len(listed.Shipments[0].Events) != 3 || listed.Shipments[0].DeliveredAt == nil {
+		t.Errorf("shipments = %+v, want one delivered shipment with three events", listed.Shipments)
+	}
+}
+
+func TestShippingWholeOrderCreatesShipments(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	product := env.createProduct(seller, "Vase", 30, 5)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", env.login(buyer),
+		orderRequest(gin.H{"productId": product.ID, "quantity": 1}), http.StatusCreated, &created)
+	env.do(http.MethodPut, fmt.Sprintf("/api/orders/%d", created.Order.ID), env.login(seller),
+		gin.H{"status": models.Shipped, "carrier": "UPS", "trackingNumber": "1Z999"}, http.StatusOK, nil)
+
+	var shipment models.Shipment
+	if err := env.db.Preload("Events").Where("order_id = ?", created.Order.ID).First(&shipment).Error; err != nil {
+		t.Fatalf("load shipment: %v", err)
+	}
+	if shipment.Carrier != "UPS" || shipment.TrackingNumber != "1Z999" || len(shipment.Events) != 1 {
+		t.Errorf("shipment = %+v, want UPS 1Z999 with its first event", shipment)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// splitOrderByShop groups the items of a newly created order into one shop
+// order per shop, in the order the shops first appear. productShops maps
+// each product to its shop and shipping holds the shipping chosen per shop.
+func splitOrderByShop(tx *gorm.DB, order *models.Order, productShops map[uint]uint, shipping map[uint]shippingChoice) error {
+	index := make(map[uint]int)
+	var groups []models.ShopOrder
+	for _, item := range order.OrderItems {
+		shopID := productShops[item.ProductID]
+		i, ok := index[shopID]
+		if !ok {
+			i = len(groups)
+			index[shopID] = i
+			zero := money.Zero(order.Total.Currency)
+			groups = append(groups, models.ShopOrder{
+				OrderID:      order.ID,
+				ShopID:       shopID,
+				Status:       order.Status,
+				Subtotal:     zero,
+				ShippingCost: zero,
+				Tax:          zero,
+				Discount:     zero,
+				Total:        zero,
+			})
+		}
+		groups[i].Subtotal = groups[i].Subtotal.Add(item.TotalPrice)
+		groups[i].Tax = groups[i].Tax.Add(item.Tax)
+		groups[i].Discount = groups[i].Discount.Add(item.Discount)
+		// Tax added on top of the prices is part of the shop's total
+		if !item.TaxInclusive {
+			groups[i].Total = groups[i].Total.Add(item.Tax)
+		}
+	}
+
+	for i := range groups {
+		if choice := shipping[groups[i].ShopID]; choice.Method != nil {
+			groups[i].ShippingMethodID = &choice.Method.ID
+			groups[i].ShippingMethod = choice.Method.Name
+			groups[i].ShippingCost = choice.Cost
+		}
+		groups[i].Total = groups[i].Total.Add(groups[i].Subtotal).Sub(groups[i].Discount).Add(groups[i].ShippingCost)
+		if err := tx.Create(&groups[i]).Error; err != nil {
+			return err
+		}
+	}
+
+	for i, item := range order.OrderItems {
+		shopOrderID := groups[index[productShops[item.ProductID]]].ID
+		if err := tx.Model(&order.OrderItems[i]).Update("shop_order_id", shopOrderID).Error; err != nil {
+			return err
+		}
+		order.OrderItems[i].ShopOrderID = &shopOrderID
+	}
+	order.ShopOrders = groups
+	return nil
+}
+
+// backfillShopOrders splits orders placed before shop orders existed
+func backfillShopOrders(db *gorm.DB) error {
+	var orders []models.Order
+	err := db.Preload("OrderItems").
+		Where("NOT EXISTS (SELECT 1 FROM shop_orders WHERE shop_orders.order_id = orders.id)").
+		Find(&orders).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range orders {
+		order := &orders[i]
+		err := db.Transaction(func(tx *gorm.DB) error {
+			productShops := make(map[uint]uint)
+			for _, item := range order.OrderItems {
+				// Products may have been deleted since
+				var product models.Product
+				if err := tx.Unscoped().Select("id", "shop_id").First(&product, item.ProductID).Error; err != nil {
+					return err
+				}
+				productShops[product.ID] = product.ShopID
+			}
+			return splitOrderByShop(tx, order, productShops, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(orders) > 0 {
+		log.Printf("Split %d order(s) into shop orders", len(orders))
+	}
+	return nil
+}
+
+// shopOrderUpdates returns the columns to set when a shop order moves to status
+func shopOrderUpdates(status models.OrderStatus, now time.Time) map[string]interface{} {
+	updates := map[string]interface{}{"status": status}
+	switch status {
+	case models.Shipped:
+		updates["shipped_at"] = now
+	case models.Delivered:
+		updates["delivered_at"] = now
+	}
+	return updates
+}
+
+// cascadeShopOrders moves the shop orders of an order along with a status
+// change of the whole order, e.g. when it is paid or cancelled. Shop orders
+// that are already past the status are left alone.
+func cascadeShopOrders(tx *gorm.DB, orderID uint, to models.OrderStatus) error {
+	var groups []models.ShopOrder
+	if err := tx.Where("order_id = ?", orderID).Find(&groups).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range groups {
+		group := &groups[i]
+		if !group.Status.CanTransitionTo(to) {
+			continue
+		}
+		if err := tx.Model(&models.ShopOrder{}).
+			Where("id = ? AND status = ?", group.ID, group.Status).
+			Updates(shopOrderUpdates(to, now)).Error; err != nil {
+			return err
+		}
+		if err := trackShopOrder(tx, group, to, shipmentDetails{}, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasShippedShopOrders reports whether any shop of the order has shipped its part
+func hasShippedShopOrders(tx *gorm.DB, orderID uint) (bool, error) {
+	var count int64
+	err := tx.Model(&models.ShopOrder{}).
+		Where("order_id = ? AND status IN ?", orderID, []models.OrderStatus{models.Shipped, models.Delivered}).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// shopOrdersStatus returns the status the order reaches through its shop
+// orders: shipped once every shop has shipped and delivered once every
+// shop has delivered. It returns "" while the shops are not that far.
+func shopOrdersStatus(statuses []models.OrderStatus) models.OrderStatus {
+	if len(statuses) == 0 {
+		return ""
+	}
+	delivered := true
+	for _, status := range statuses {
+		switch status {
+		case models.Delivered:
+		case models.Shipped:
+			delivered = false
+		default:
+			return ""
+		}
+	}
+	if delivered {
+		return models.Delivered
+	}
+	return models.Shipped
+}
+
+// changeShopOrderStatus moves one shop's part of the order to status inside
+// tx and records the change in the order history. Shipping creates the
+// shipment from details. The order itself follows once all of its shop
+// orders have moved on.
+func changeShopOrderStatus(tx *gorm.DB, group *models.ShopOrder, order *models.Order, to models.OrderStatus, details shipmentDetails, actor *models.User, reason string) error {
+	from := group.Status
+	if !from.CanTransitionTo(to) {
+		return errIllegalTransition
+	}
+
+	now := time.Now()
+	result := tx.Model(&models.ShopOrder{}).
+		Where("id = ? AND status = ?", group.ID, from).
+		Updates(shopOrderUpdates(to, now))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errStatusConflict
+	}
+	if err := trackShopOrder(tx, group, to, details, now); err != nil {
+		return err
+	}
+
+	history := models.OrderStatusHistory{
+		OrderID:     order.ID,
+		ShopOrderID: &group.ID,
+		FromStatus:  from,
+		ToStatus:    to,
+		ChangedByID: &actor.ID,
+		Reason:      reason,
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		return err
+	}
+	group.Status = to
+
+	var statuses []models.OrderStatus
+	if err := tx.Model(&models.ShopOrder{}).Where("order_id = ?", order.ID).Pluck("status", &statuses).Error; err != nil {
+		return err
+	}
+	target := shopOrdersStatus(statuses)
+	if target == "" || !order.Status.CanTransitionTo(target) {
+		return nil
+	}
+	return changeOrderStatus(tx, order, target, actor, fmt.Sprintf("All shops %s", target))
+}
+
+// sellsWholeOrder reports whether every item of the order comes from the
+// user's shops, so they may change the status of the whole order
+func (a *app) sellsWholeOrder(user *models.User, orderID uint) (bool, error) {
+	var others int64
+	err := a.db.Model(&models.ShopOrder{}).
+		Joins("JOIN shops ON shops.id = shop_orders.shop_id").
+		Where("shop_orders.order_id = ? AND shops.user_id <> ?", orderID, user.ID).
+		Count(&others).Error
+	if err != nil || others > 0 {
+		return false, err
+	}
+	return a.isOrderSeller(user, orderID)
+}
+
+// loadManagedShop loads the shop in the :id parameter and checks that the
+// user owns it or is an admin. It writes the error response itself.
+func (a *app) loadManagedShop(c *gin.Context, user *models.User) (*models.Shop, bool) {
+	var shop models.Shop
+	if err := a.db.First(&shop, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shop not found"})
+		return nil, false
+	}
+	if shop.UserID != user.ID && user.Role != models.Admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only manage your own shop"})
+		return nil, false
+	}
+	return &shop, true
+}
+
+// Shop order handlers
+
+func (a *app) getShopOrders(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+
+	// Parse pagination parameters
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+
+	// Calculate offset
+	offset := (page - 1) * limit
+
+	query := a.db.Model(&models.ShopOrder{}).Where("shop_orders.shop_id = ?", shop.ID)
+
+	// Apply filters
+	if status := c.Query("status"); status != "" {
+		if !models.OrderStatus(status).IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status: " + status})
+			return
+		}
+		query = query.Where("shop_orders.status = ?", status)
+	}
+	if from := c.Query("from"); from != "" {
+		date, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date like 2006-01-02"})
+			return
+		}
+		query = query.Where("shop_orders.created_at >= ?", date)
+	}
+	if to := c.Query("to"); to != "" {
+		date, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date like 2006-01-02"})
+			return
+		}
+		query = query.Where("shop_orders.created_at < ?", date.AddDate(0, 0, 1))
+	}
+
+	// Count total shop orders
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count orders"})
+		return
+	}
+
+	// Get paginated shop orders with their items, shipment and the order they
+	// belong to
+	var orders []models.ShopOrder
+	if err := query.Preload("Items").Preload("Items.Product").Preload("Order").Preload("Shipment").
+		Offset(offset).Limit(limit).
+		Order("shop_orders.created_at DESC, shop_orders.id DESC").
+		Find(&orders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get orders"})
+		return
+	}
+
+	// Calculate total pages
+	totalPages := int(math.Ceil(float64(total) / float64(limit)))
+
+	// Return shop orders with pagination info
+	c.JSON(http.StatusOK, gin.H{
+		"orders": orders,
+		"pagination": gin.H{
+			"total":      total,
+			"totalPages": totalPages,
+			"page":       page,
+			"limit":      limit,
+		},
+	})
+}
+
+// updateShopOrder lets a seller ship or deliver their shop's part of an order
+func (a *app) updateShopOrder(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	shop, ok := a.loadManagedShop(c, user)
+	if !ok {
+		return
+	}
+
+	var statusRequest struct {
+		Status models.OrderStatus `json:"status" binding:"required"`
+		shipmentDetails
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&statusRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if statusRequest.Status != models.Shipped && statusRequest.Status != models.Delivered {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shops can only mark their orders as shipped or delivered"})
+		return
+	}
+
+	var group models.ShopOrder
+	if err := a.db.Where("id = ? AND shop_id = ?", c.Param("shopOrderId"), shop.ID).First(&group).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	var order models.Order
+	if err := a.db.First(&order, group.OrderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	if !group.Status.CanTransitionTo(statusRequest.Status) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":           fmt.Sprintf("Cannot change order status from %s to %s", group.Status, statusRequest.Status),
+			"currentStatus":   group.Status,
+			"allowedStatuses": group.Status.NextStatuses(),
+		})
+		return
+	}
+
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			return changeShopOrderStatus(tx, &group, &order, statusRequest.Status, statusRequest.shipmentDetails, user, statusRequest.Reason)
+		})
+	})
+	if errors.Is(err, errStatusConflict) || errors.Is(err, errIllegalTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order status was changed by another request, please reload"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+		return
+	}
+
+	// Reload the shop order with its items and shipment
+	a.db.Preload("Items").Preload("Items.Product").Preload("Order").Preload("Shipment").First(&group, group.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Order status updated successfully",
+		"order":   group,
+	})
+}
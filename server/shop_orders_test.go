@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMultiShopOrderIsFulfilledPerShop(t *testing.T) {
+	env := newTestEnv(t)
+	potter := env.createUser("potter", models.Seller)
+	weaver := env.createUser("weaver", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	admin := env.createUser("admin", models.Admin)
+	cup := env.createProduct(potter, "Cup", 12, 10)
+	plate := env.createProduct(potter, "Plate", 20, 10)
+	rug := env.createProduct(weaver, "Rug", 80, 2)
+	buyerToken := env.login(buyer)
+	potterToken := env.login(potter)
+	weaverToken := env.login(weaver)
+
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken, orderRequest(
+		gin.H{"productId": cup.ID, "quantity": 2},
+		gin.H{"productId": rug.ID, "quantity": 1},
+		gin.H{"productId": plate.ID, "quantity": 1},
+	), http.StatusCreated, &created)
+	orderPath := fmt.Sprintf("/api/orders/%d", created.Order.ID)
+
+	// The buyer sees one order made up of a part per shop
+	var viewed struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodGet, orderPath, buyerToken, nil, http.StatusOK, &viewed)
+	if len(viewed.Order.ShopOrders) != 2 {
+		t.Fatalf("order has %d shop orders, want 2", len(viewed.Order.ShopOrders))
+	}
+	potterPart, weaverPart := viewed.Order.ShopOrders[0], viewed.Order.ShopOrders[1]
+	if potterPart.Subtotal != usd(44) || weaverPart.Subtotal != usd(80) || potterPart.Status != models.Paid {
+		t.Errorf("shop orders = %+v, want paid parts of 44 and 80", viewed.Order.ShopOrders)
+	}
+
+	// Each seller sees only their own part
+	potterOrders := fmt.Sprintf("/api/shops/%d/orders", potterPart.ShopID)
+	var listed struct {
+		Orders []models.ShopOrder `json:"orders"`
+	}
+	env.do(http.MethodGet, potterOrders, potterToken, nil, http.StatusOK, &listed)
+	if len(listed.Orders) != 1 || len(listed.Orders[0].Items) != 2 {
+		t.Fatalf("potter sees %+v, want one order with two items", listed.Orders)
+	}
+	env.do(http.MethodGet, potterOrders, weaverToken, nil, http.StatusForbidden, nil)
+
+	// A seller can't ship the other shop's items with the whole order
+	env.do(http.MethodPut, orderPath, potterToken, gin.H{"status": models.Shipped}, http.StatusForbidden, nil)
+
+	env.do(http.MethodPut, fmt.Sprintf("%s/%d", potterOrders, potterPart.ID), potterToken,
+		gin.H{"status": models.Shipped, "trackingNumber": "TRACK-1"}, http.StatusOK, nil)
+	env.do(http.MethodPut, fmt.Sprintf("/api/shops/%d/orders/%d", weaverPart.ShopID, potterPart.ID), weaverToken,
+		gin.H{"status": models.Shipped}, http.StatusNotFound, nil)
+
+	var order models.Order
+	env.db.First(&order, created.Order.ID)
+	if order.Status != models.Paid {
+		t.Errorf("order status = %s with one shop shipped, want paid", order.Status)
+	}
+
+	// Once a shop has shipped, the order can't be cancelled and restocked
+	env.do(http.MethodPut, orderPath, env.login(admin), gin.H{"status": models.Cancelled}, http.StatusConflict, nil)
+	var stocked models.Product
+	env.db.First(&stocked, cup.ID)
+	if stocked.Stock != 8 {
+		t.Errorf("cup stock = %d after the refused cancel, want 8", stocked.Stock)
+	}
+
+	env.do(http.MethodPut, fmt.Sprintf("/api/shops/%d/orders/%d", weaverPart.ShopID, weaverPart.ID), weaverToken,
+		gin.H{"status": models.Shipped}, http.StatusOK, nil)
+	env.db.First(&order, created.Order.ID)
+	if order.Status != models.Shipped {
+		t.Errorf("order status = %s with every shop shipped, want shipped", order.Status)
+	}
+
+	env.do(http.MethodGet, potterOrders+"?status=shipped", potterToken, nil, http.StatusOK, &listed)
+	if len(listed.Orders) != 1 || listed.Orders[0].Shipment == nil || listed.Orders[0].Shipment.TrackingNumber != "TRACK-1" || listed.Orders[0].ShippedAt == nil {
+		t.Errorf("shipped orders = %+v, want the tracked one", listed.Orders)
+	}
+	env.do(http.MethodGet, potterOrders+"?status=paid", potterToken, nil, http.StatusOK, &listed)
+	if len(listed.Orders) != 0 {
+		t.Errorf("paid orders = %d, want 0", len(listed.Orders))
+	}
+
+	// Confirming delivery of the order delivers every part
+	env.do(http.MethodPut, orderPath, buyerToken, gin.H{"status": models.Delivered}, http.StatusOK, nil)
+	var parts []models.ShopOrder
+	env.db.Where("order_id = ?", created.Order.ID).Find(&parts)
+	for _, part := range parts {
+		if part.Status != models.Delivered || part.DeliveredAt == nil {
+			t.Errorf("shop order %d = %s, want delivered", part.ID, part.Status)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"gorm.io/gorm"
+)
+
+// taxLine is an order line to work out the tax of: what the buyer is charged
+// for it before any exclusive tax, and the product category
+type taxLine struct {
+	Category string
+	Amount   money.Money
+}
+
+// lineTax is the tax on one order line. Rate is 0 when no rule applies.
+type lineTax struct {
+	Rate      float64
+	Inclusive bool
+	Net       money.Money
+	Tax       money.Money
+	Gross     money.Money
+}
+
+// orderTax is the tax of a whole order, line by line
+type orderTax struct {
+	Lines []lineTax
+	// Tax is the total tax, Added the part of it added on top of the prices
+	Tax   money.Money
+	Added money.Money
+}
+
+// loadTaxRules returns every tax rule
+func loadTaxRules(tx *gorm.DB) ([]models.TaxRule, error) {
+	var rules []models.TaxRule
+	err := tx.Order("id").Find(&rules).Error
+	return rules, err
+}
+
+// matchTaxRule returns the most specific rule for goods of category shipped
+// to country and region, or nil when none applies. Of equally specific
+// rules the first one wins.
+func matchTaxRule(rules []models.TaxRule, country, region, category string) *models.TaxRule {
+	var best *models.TaxRule
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Matches(country, region, category) {
+			continue
+		}
+		if best == nil || rule.Specificity() > best.Specificity() {
+			best = rule
+		}
+	}
+	return best
+}
+
+// calculateTax works out the tax on each line of an order shipped to
+// country and region, in the currency of the order. Every line is rounded
+// on its own, so the order's tax is the sum of its lines' tax.
+func calculateTax(rules []models.TaxRule, country, region, currency string, lines []taxLine) orderTax {
+	result := orderTax{
+		Lines: make([]lineTax, len(lines)),
+		Tax:   money.Zero(currency),
+		Added: money.Zero(currency),
+	}
+	for i, line := range lines {
+		lt := lineTax{Net: line.Amount, Tax: money.Zero(currency), Gross: line.Amount}
+		if rule := matchTaxRule(rules, country, region, line.Category); rule != nil {
+			lt.Rate = rule.Rate
+			lt.Inclusive = rule.Inclusive
+			lt.Net, lt.Tax = rule.Split(line.Amount)
+			if !rule.Inclusive {
+				lt.Gross = line.Amount.Add(lt.Tax)
+				result.Added = result.Added.Add(lt.Tax)
+			}
+		}
+		result.Tax = result.Tax.Add(lt.Tax)
+		result.Lines[i] = lt
+	}
+	return result
+}
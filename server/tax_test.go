@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testTaxRules mixes inclusive VAT with exclusive sales tax by region
+func testTaxRules() []models.TaxRule {
+	return []models.TaxRule{
+		{ID: 1, Name: "VAT", Country: "NL", Rate: 0.21, Inclusive: true},
+		{ID: 2, Name: "VAT", Country: "NL", Category: "Books", Rate: 0.09, Inclusive: true},
+		{ID: 3, Name: "Sales tax", Country: "US", Region: "NY", Rate: 0.04},
+		{ID: 4, Name: "Sales tax", Country: "US", Region: "NY", Category: "Clothing", Rate: 0},
+		{ID: 5, Name: "Sales tax", Country: "US", Region: "CA", Rate: 0.0725},
+		{ID: 6, Name: "Book tax", Country: "US", Category: "Books", Rate: 0.01},
+	}
+}
+
+func TestMatchTaxRule(t *testing.T) {
+	tests := []struct {
+		name                      string
+		country, region, category string
+		wantID                    uint
+	}{
+		{"country rule", "NL", "", "Electronics", 1},
+		{"category beats country", "NL", "", "Books", 2},
+		{"case and spaces are ignored", " nl ", "", "books", 2},
+		{"region rule", "US", "NY", "Electronics", 3},
+		{"region and category beat region", "US", "NY", "Clothing", 4},
+		{"region beats category", "US", "CA", "Books", 5},
+		{"category without region", "US", "TX", "Books", 6},
+		{"no rule for the country", "FR", "", "Books", 0},
+		{"no rule for the region", "US", "TX", "Toys & Games", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := matchTaxRule(testTaxRules(), tt.country, tt.region, tt.category)
+			var gotID uint
+			if rule != nil {
+				gotID = rule.ID
+			}
+			if gotID != tt.wantID {
+				t.Errorf("matchTaxRule(%q, %q, %q) = rule %d, want %d", tt.country, tt.region, tt.category, gotID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestTaxRuleSplit(t *testing.T) {
+	tests := []struct {
+		name             string
+		rule             models.TaxRule
+		amount           float64
+		wantNet, wantTax float64
+	}{
+		{"exclusive", models.TaxRule{Rate: 0.04}, 100, 100, 4},
+		{"exclusive rounds half up", models.TaxRule{Rate: 0.0725}, 9.99, 9.99, 0.72},
+		{"inclusive", models.TaxRule{Rate: 0.21, Inclusive: true}, 121, 100, 21},
+		{"inclusive rounds to cents", models.TaxRule{Rate: 0.21, Inclusive: true}, 10, 8.26, 1.74},
+		{"zero rate", models.TaxRule{Rate: 0}, 50, 50, 0},
+		{"zero amount", models.TaxRule{Rate: 0.21, Inclusive: true}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			net, tax := tt.rule.Split(usd(tt.amount))
+			if net != usd(tt.wantNet) || tax != usd(tt.wantTax) {
+				t.Errorf("Split(%v) = %v, %v, want %v, %v", tt.amount, net, tax, tt.wantNet, tt.wantTax)
+			}
+		})
+	}
+}
+
+func TestCalculateTax(t *testing.T) {
+	tests := []struct {
+		name            string
+		country, region string
+		lines           []taxLine
+		wantTax         float64
+		wantAdded       float64
+		wantGross       []float64
+	}{
+		{
+			name:    "inclusive lines add nothing",
+			country: "NL",
+			lines:   []taxLine{{"Electronics", usd(121)}, {"Books", usd(10.9)}},
+			wantTax: 21.9, wantAdded: 0, wantGross: []float64{121, 10.9},
+		},
+		{
+			name:    "exclusive lines are added on top",
+			country: "US", region: "NY",
+			lines:   []taxLine{{"Electronics", usd(50)}, {"Clothing", usd(30)}},
+			wantTax: 2, wantAdded: 2, wantGross: []float64{52, 30},
+		},
+		{
+			// 3 x 0.0725 rounds to 0.22 per line, 0.65 for the sum
+			name:    "each line is rounded on its own",
+			country: "US", region: "CA",
+			lines:   []taxLine{{"Toys & Games", usd(3)}, {"Toys & Games", usd(3)}, {"Toys & Games", usd(3)}},
+			wantTax: 0.66, wantAdded: 0.66, wantGross: []float64{3.22, 3.22, 3.22},
+		},
+		{
+			name:    "untaxed destination",
+			country: "FR",
+			lines:   []taxLine{{"Books", usd(20)}},
+			wantTax: 0, wantAdded: 0, wantGross: []float64{20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := calculateTax(testTaxRules(), tt.country, tt.region, money.DefaultCurrency, tt.lines)
+			if got.Tax != usd(tt.wantTax) || got.Added != usd(tt.wantAdded) {
+				t.Errorf("tax = %v added %v, want %v added %v", got.Tax, got.Added, tt.wantTax, tt.wantAdded)
+			}
+			for i, line := range got.Lines {
+				if line.Gross != usd(tt.wantGross[i]) {
+					t.Errorf("line %d gross = %v, want %v", i, line.Gross, tt.wantGross[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOrderChargesTax(t *testing.T) {
+	env := newTestEnv(t)
+	for _, rule := range testTaxRules() {
+		rule := rule
+		if err := env.db.Create(&rule).Error; err != nil {
+			t.Fatalf("create tax rule: %v", err)
+		}
+	}
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	jacket := env.createProduct(seller, "Jacket", 60, 5)
+	radio := env.createProduct(seller, "Radio", 25, 5)
+	env.db.Model(jacket).Update("category", "Clothing")
+	env.db.Model(radio).Update("category", "Electronics")
+
+	// Shipped to New York, clothing is exempt and the radios pay 4% on top
+	request := orderRequest(gin.H{"productId": jacket.ID, "quantity": 1}, gin.H{"productId": radio.ID, "quantity": 2})
+	address := testShippingDetails()
+	address["country"] = "US"
+	address["state"] = "NY"
+	request["shippingDetails"] = address
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", env.login(buyer), request, http.StatusCreated, &created)
+
+	order := created.Order
+	if order.Tax != usd(2) || order.Total != usd(112) {
+		t.Errorf("order tax %v total %v, want 2 and 112", order.Tax, order.Total)
+	}
+	if item := order.OrderItems[1]; item.TaxRate != 0.04 || item.Tax != usd(2) || item.TaxInclusive {
+		t.Errorf("radio line = %+v, want 2 tax at 4%% on top", item)
+	}
+
+	var invoice models.Invoice
+	env.db.First(&invoice, order.InvoiceID)
+	if invoice.Amount != usd(110) || invoice.Tax != usd(2) || invoice.TotalAmount != usd(112) {
+		t.Errorf("invoice = %v + %v tax = %v, want 110 + 2 = 112", invoice.Amount, invoice.Tax, invoice.TotalAmount)
+	}
+
+	var part models.ShopOrder
+	env.db.Where("order_id = ?", order.ID).First(&part)
+	if part.Tax != usd(2) || part.Total != usd(112) {
+		t.Errorf("shop order tax %v total %v, want 2 and 112", part.Tax, part.Total)
+	}
+
+	// Returning a radio refunds its tax too
+	var returned struct {
+		Return models.ReturnRequest `json:"return"`
+	}
+	env.do(http.MethodPost, fmt.Sprintf("/api/orders/%d/returns", order.ID), env.login(buyer),
+		gin.H{"orderItemId": order.OrderItems[1].ID, "quantity": 1, "reason": "Broken"}, http.StatusCreated, &returned)
+	if returned.Return.RefundAmount != usd(26) {
+		t.Errorf("refund amount = %v, want 26 including tax", returned.Return.RefundAmount)
+	}
+}
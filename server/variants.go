@@ -0,0 +1,496 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"tobe_shop/server/middleware"
+	"tobe_shop/server/models"
+	"tobe_shop/server/money"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errSKUTaken      = errors.New("SKU already exists")
+	errVariantExists = errors.New("variant already exists")
+	errOptionsInUse  = errors.New("options in use by variants")
+)
+
+// stockKey identifies the stock an order line takes: a product's, or that
+// of one of its variants
+type stockKey struct {
+	ProductID uint
+	VariantID uint
+}
+
+// loadOrderVariant loads the variant of product an order line names.
+// Products with variants are only sold by variant, so the line has to name
+// one of them; for other products it returns nil.
+func loadOrderVariant(tx *gorm.DB, product *models.Product, variantID uint) (*models.ProductVariant, error) {
+	if variantID == 0 {
+		var count int64
+		if err := tx.Model(&models.ProductVariant{}).Where("product_id = ?", product.ID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, &orderError{http.StatusBadRequest, "Choose a variant of product " + product.Name}
+		}
+		return nil, nil
+	}
+
+	var variant models.ProductVariant
+	if err := tx.Where("id = ? AND product_id = ?", variantID, product.ID).First(&variant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &orderError{http.StatusBadRequest, "Variant not found: " + strconv.FormatUint(uint64(variantID), 10)}
+		}
+		return nil, err
+	}
+	return &variant, nil
+}
+
+// variantPrice returns what the variant of product sells at: its own price
+// if it has one, else the product's. variant may be nil.
+func variantPrice(product *models.Product, variant *models.ProductVariant) money.Money {
+	if variant == nil || variant.PriceOverride.IsZero() {
+		return product.Price
+	}
+	return variant.PriceOverride
+}
+
+// stockName names a product, or its variant, in stock messages
+func stockName(product *models.Product, variant *models.ProductVariant) string {
+	if variant == nil {
+		return product.Name
+	}
+	return fmt.Sprintf("%s (%s)", product.Name, variant.Title())
+}
+
+// adjustVariantStock changes a variant's stock by delta inside tx, for
+// adjustStock to change its product's stock along with it. Decrements are
+// conditional on enough stock being left.
+func adjustVariantStock(tx *gorm.DB, productID, variantID uint, delta int) error {
+	// Variants may have been deleted since the order was placed
+	query := tx.Unscoped().Model(&models.ProductVariant{}).Where("id = ? AND product_id = ?", variantID, productID)
+	if delta < 0 {
+		query = query.Where("stock >= ?", -delta)
+	}
+	result := query.Update("stock", gorm.Expr("stock + ?", delta))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		if err := tx.Unscoped().Model(&models.ProductVariant{}).Where("id = ? AND product_id = ?", variantID, productID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errInsufficientStock
+		}
+		return fmt.Errorf("variant %d of product %d not found", variantID, productID)
+	}
+	return nil
+}
+
+// hasVariants reports whether the product is sold by variant
+func hasVariants(tx *gorm.DB, productID uint) (bool, error) {
+	var count int64
+	err := tx.Model(&models.ProductVariant{}).Where("product_id = ?", productID).Count(&count).Error
+	return count > 0, err
+}
+
+// fillVariants loads the product's options and variants, filling in the
+// values of each option and the price and available stock of each variant.
+// The product's price must already be its sale price.
+func fillVariants(tx *gorm.DB, product *models.Product, now time.Time) error {
+	if err := tx.Where("product_id = ?", product.ID).Order("position").Find(&product.Options).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("product_id = ?", product.ID).Order("id").Find(&product.Variants).Error; err != nil {
+		return err
+	}
+
+	variantIDs := make([]uint, len(product.Variants))
+	for i, variant := range product.Variants {
+		variantIDs[i] = variant.ID
+	}
+	holds, err := activeVariantHolds(tx, variantIDs, 0, now)
+	if err != nil {
+		return err
+	}
+
+	for i := range product.Options {
+		product.Options[i].Values = []string{}
+	}
+	for i := range product.Variants {
+		variant := &product.Variants[i]
+		variant.Price = variantPrice(product, variant)
+		variant.AvailableStock = variant.Stock - holds[variant.ID]
+		if variant.AvailableStock < 0 {
+			variant.AvailableStock = 0
+		}
+
+		// The option matrix lists each value once, in the order the
+		// variants bring them up
+		for j, value := range variant.Options() {
+			if j >= len(product.Options) {
+				break
+			}
+			option := &product.Options[j]
+			if !containsString(option.Values, value) {
+				option.Values = append(option.Values, value)
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateVariant returns a problem with a variant of a product with the
+// given number of options, or an empty string if there is none
+func validateVariant(variant *models.ProductVariant, options int) string {
+	switch {
+	case options == 0:
+		return "Set the product's options before adding variants"
+	case variant.SKU == "":
+		return "SKU is required"
+	case len(variant.Options()) != options:
+		return fmt.Sprintf("A variant needs a value for each of the product's %d option(s)", options)
+	case variant.PriceOverride.IsNegative():
+		return "Price cannot be negative"
+	}
+	return ""
+}
+
+// variantRequest is the body for adding or changing a variant. Options are
+// the variant's values in the order of the product's options.
+type variantRequest struct {
+	SKU           string      `json:"sku"`
+	Options       []string    `json:"options"`
+	PriceOverride money.Money `json:"priceOverride"`
+	Stock         *int        `json:"stock"`
+	Image         string      `json:"image"`
+}
+
+// newVariantRequest returns a request reading the price in the currency of
+// the product
+func newVariantRequest(currency string) variantRequest {
+	return variantRequest{PriceOverride: money.Zero(currency)}
+}
+
+func (r *variantRequest) apply(variant *models.ProductVariant) {
+	variant.SKU = strings.TrimSpace(r.SKU)
+	values := make([]string, len(r.Options))
+	for i, value := range r.Options {
+		values[i] = strings.TrimSpace(value)
+	}
+	variant.SetOptions(values)
+	variant.PriceOverride = r.PriceOverride
+	variant.Image = r.Image
+}
+
+// saveVariant binds the request onto a variant of product and stores it,
+// booking a stock change in the inventory ledger. It writes the response
+// itself.
+func (a *app) saveVariant(c *gin.Context, user *models.User, product *models.Product, variant *models.ProductVariant, status int) {
+	variantRequest := newVariantRequest(product.Price.Currency)
+	if err := c.ShouldBindJSON(&variantRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if len(variantRequest.Options) > models.MaxProductOptions {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A product has at most %d options", models.MaxProductOptions)})
+		return
+	}
+	variantRequest.apply(variant)
+
+	// The stock is booked separately, through the ledger
+	stock := variant.Stock
+	if variantRequest.Stock != nil {
+		stock = *variantRequest.Stock
+	}
+	if stock < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stock cannot be negative"})
+		return
+	}
+
+	var options int64
+	if err := a.db.Model(&models.ProductOption{}).Where("product_id = ?", product.ID).Count(&options).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get product options"})
+		return
+	}
+	if problem := validateVariant(variant, int(options)); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			// SKUs stay taken by deleted variants, which orders still name
+			var taken int64
+			if err := tx.Unscoped().Model(&models.ProductVariant{}).
+				Where("sku = ? AND id <> ?", variant.SKU, variant.ID).Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return errSKUTaken
+			}
+
+			var same int64
+			if err := tx.Model(&models.ProductVariant{}).
+				Where("product_id = ? AND option1 = ? AND option2 = ? AND option3 = ? AND id <> ?",
+					product.ID, variant.Option1, variant.Option2, variant.Option3, variant.ID).
+				Count(&same).Error; err != nil {
+				return err
+			}
+			if same > 0 {
+				return errVariantExists
+			}
+
+			// Once a product has variants its stock is theirs, so stock it
+			// had of its own is booked out with the first one
+			if variant.ID == 0 {
+				sold, err := hasVariants(tx, product.ID)
+				if err != nil {
+					return err
+				}
+				if !sold {
+					if _, err := setStock(tx, product.ID, 0, models.InventoryMovement{
+						Type:    models.MovementCorrection,
+						ActorID: &user.ID,
+						Note:    "Stock is kept per variant",
+					}); err != nil {
+						return err
+					}
+				}
+			}
+
+			// Stock only changes through the ledger, against the stock
+			// stored now
+			variant.ProductID = product.ID
+			save := tx
+			if variant.ID != 0 {
+				save = tx.Omit("stock")
+				var stored models.ProductVariant
+				if err := tx.Select("id", "stock").First(&stored, variant.ID).Error; err != nil {
+					return err
+				}
+				variant.Stock = stored.Stock
+			}
+			if err := save.Save(variant).Error; err != nil {
+				return err
+			}
+			if stock == variant.Stock {
+				return nil
+			}
+			if _, err := adjustStock(tx, product.ID, stock-variant.Stock, models.InventoryMovement{
+				Type:      models.MovementCorrection,
+				VariantID: &variant.ID,
+				ActorID:   &user.ID,
+				Note:      "Stock edited on variant " + variant.SKU,
+			}); err != nil {
+				return err
+			}
+			variant.Stock = stock
+			return nil
+		})
+	})
+	switch {
+	case errors.Is(err, errSKUTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "SKU already exists: " + variant.SKU})
+		return
+	case errors.Is(err, errVariantExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "The product already has a variant " + variant.Title()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save variant"})
+		return
+	}
+
+	variant.Price = variantPrice(product, variant)
+	variant.AvailableStock = variant.Stock
+	c.JSON(status, gin.H{
+		"message": "Variant saved successfully",
+		"variant": variant,
+	})
+}
+
+// Variant handlers
+func (a *app) setProductOptions(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, ok := a.loadManagedProduct(c, user)
+	if !ok {
+		return
+	}
+
+	var optionsRequest struct {
+		Options []string `json:"options"`
+	}
+	if err := c.ShouldBindJSON(&optionsRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if len(optionsRequest.Options) > models.MaxProductOptions {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A product has at most %d options", models.MaxProductOptions)})
+		return
+	}
+	options := make([]models.ProductOption, len(optionsRequest.Options))
+	for i, name := range optionsRequest.Options {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Option names are required"})
+			return
+		}
+		for _, option := range options[:i] {
+			if strings.EqualFold(option.Name, name) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicate option: " + name})
+				return
+			}
+		}
+		options[i] = models.ProductOption{ProductID: product.ID, Position: i + 1, Name: name}
+	}
+
+	// Options can be renamed at any time, but the variants have a value for
+	// each of them
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			var current int64
+			if err := tx.Model(&models.ProductOption{}).Where("product_id = ?", product.ID).Count(&current).Error; err != nil {
+				return err
+			}
+			sold, err := hasVariants(tx, product.ID)
+			if err != nil {
+				return err
+			}
+			if sold && int(current) != len(options) {
+				return errOptionsInUse
+			}
+
+			if err := tx.Where("product_id = ?", product.ID).Delete(&models.ProductOption{}).Error; err != nil {
+				return err
+			}
+			if len(options) == 0 {
+				return nil
+			}
+			return tx.Create(&options).Error
+		})
+	})
+	if errors.Is(err, errOptionsInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Options can't be added or removed while the product has variants"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save options"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Options saved successfully",
+		"options": options,
+	})
+}
+
+func (a *app) createProductVariant(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, ok := a.loadManagedProduct(c, user)
+	if !ok {
+		return
+	}
+
+	a.saveVariant(c, user, product, &models.ProductVariant{}, http.StatusCreated)
+}
+
+// loadManagedVariant loads the variant in the :variantId parameter of the
+// product in :id, which the user must manage. It writes the error response
+// itself.
+func (a *app) loadManagedVariant(c *gin.Context, user *models.User) (*models.Product, *models.ProductVariant, bool) {
+	product, ok := a.loadManagedProduct(c, user)
+	if !ok {
+		return nil, nil, false
+	}
+
+	var variant models.ProductVariant
+	if err := a.db.Where("id = ? AND product_id = ?", c.Param("variantId"), product.ID).First(&variant).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+		return nil, nil, false
+	}
+	return product, &variant, true
+}
+
+func (a *app) updateProductVariant(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, variant, ok := a.loadManagedVariant(c, user)
+	if !ok {
+		return
+	}
+
+	a.saveVariant(c, user, product, variant, http.StatusOK)
+}
+
+// deleteProductVariant books the variant's stock out and deletes it. Orders
+// keep the SKU and option values they were placed with.
+func (a *app) deleteProductVariant(c *gin.Context) {
+	// Get user from context (set by auth middleware)
+	user, exists := middleware.CurrentUser(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	product, variant, ok := a.loadManagedVariant(c, user)
+	if !ok {
+		return
+	}
+
+	err := withBusyRetry(func() error {
+		return a.db.Transaction(func(tx *gorm.DB) error {
+			if variant.Stock != 0 {
+				if _, err := adjustStock(tx, product.ID, -variant.Stock, models.InventoryMovement{
+					Type:      models.MovementCorrection,
+					VariantID: &variant.ID,
+					ActorID:   &user.ID,
+					Note:      "Variant " + variant.SKU + " deleted",
+				}); err != nil {
+					return err
+				}
+			}
+			return tx.Delete(variant).Error
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete variant"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Variant deleted successfully"})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"tobe_shop/server/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createVariant adds a variant through the API and returns it
+func (e *testEnv) createVariant(token string, product *models.Product, body gin.H) models.ProductVariant {
+	e.t.Helper()
+	var created struct {
+		Variant models.ProductVariant `json:"variant"`
+	}
+	e.do(http.MethodPost, fmt.Sprintf("/api/products/%d/variants", product.ID), token, body, http.StatusCreated, &created)
+	return created.Variant
+}
+
+func TestProductVariants(t *testing.T) {
+	env := newTestEnv(t)
+	env.gateway.AutoConfirm = false
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	shirt := env.createProduct(seller, "T-Shirt", 20, 5)
+	if err := backfillInventoryLedger(env.db); err != nil {
+		t.Fatalf("backfill ledger: %v", err)
+	}
+	sellerToken := env.login(seller)
+	buyerToken := env.login(buyer)
+	productPath := fmt.Sprintf("/api/products/%d", shirt.ID)
+
+	env.do(http.MethodPost, productPath+"/variants", sellerToken,
+		gin.H{"sku": "TS-S-RED", "options": []string{"S"}}, http.StatusBadRequest, nil)
+	env.do(http.MethodPut, productPath+"/options", sellerToken, gin.H{"options": []string{"Size", "Colour"}}, http.StatusOK, nil)
+
+	small := env.createVariant(sellerToken, shirt, gin.H{"sku": "TS-S-RED", "options": []string{"S", "Red"}, "stock": 3})
+	medium := env.createVariant(sellerToken, shirt, gin.H{"sku": "TS-M-RED", "options": []string{"M", "Red"}, "stock": 2, "priceOverride": 25})
+	env.createVariant(sellerToken, shirt, gin.H{"sku": "TS-M-BLUE", "options": []string{"M", "Blue"}})
+	env.do(http.MethodPost, productPath+"/variants", sellerToken,
+		gin.H{"sku": "TS-S-RED", "options": []string{"L", "Red"}}, http.StatusConflict, nil)
+	env.do(http.MethodPost, productPath+"/variants", sellerToken,
+		gin.H{"sku": "TS-M-RED-2", "options": []string{"M", "Red"}}, http.StatusConflict, nil)
+	env.do(http.MethodPost, productPath+"/variants", sellerToken,
+		gin.H{"sku": "TS-L", "options": []string{"L"}}, http.StatusBadRequest, nil)
+	env.do(http.MethodPut, productPath+"/options", sellerToken, gin.H{"options": []string{"Size"}}, http.StatusConflict, nil)
+
+	// The product's own stock gave way to that of its variants
+	var fetched struct {
+		Product models.Product `json:"product"`
+	}
+	env.do(http.MethodGet, productPath, "", nil, http.StatusOK, &fetched)
+	product := fetched.Product
+	if product.Stock != 5 || len(product.Variants) != 3 || len(product.Options) != 2 {
+		t.Fatalf("product stock %d with %d variants and %d options, want 5, 3 and 2", product.Stock, len(product.Variants), len(product.Options))
+	}
+	if fmt.Sprint(product.Options[0].Values, product.Options[1].Values) != "[S M] [Red Blue]" {
+		t.Errorf("option values = %v and %v", product.Options[0].Values, product.Options[1].Values)
+	}
+	for i, want := range []float64{20, 25, 20} {
+		if product.Variants[i].Price != usd(want) {
+			t.Errorf("%s price = %v, want %v", product.Variants[i].SKU, product.Variants[i].Price, want)
+		}
+	}
+
+	// Orders name the variant and take its stock
+	env.do(http.MethodPost, "/api/orders", buyerToken, orderRequest(gin.H{"productId": shirt.ID, "quantity": 1}), http.StatusBadRequest, nil)
+	env.do(http.MethodPost, "/api/orders", buyerToken,
+		orderRequest(gin.H{"productId": shirt.ID, "variantId": medium.ID, "quantity": 3}), http.StatusBadRequest, nil)
+	var created struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/orders", buyerToken, orderRequest(
+		gin.H{"productId": shirt.ID, "variantId": small.ID, "quantity": 2},
+		gin.H{"productId": shirt.ID, "variantId": medium.ID, "quantity": 1},
+	), http.StatusCreated, &created)
+	if created.Order.Total != usd(65) {
+		t.Errorf("order total = %v, want 65", created.Order.Total)
+	}
+	if item := created.Order.OrderItems[1]; item.SKU != "TS-M-RED" || item.VariantTitle != "M / Red" || *item.VariantID != medium.ID {
+		t.Errorf("order item = %+v, want the medium red shirt", item)
+	}
+
+	stocks := func() (int, int, int) {
+		var reloaded models.Product
+		var s, m models.ProductVariant
+		env.db.First(&reloaded, shirt.ID)
+		env.db.First(&s, small.ID)
+		env.db.First(&m, medium.ID)
+		return reloaded.Stock, s.Stock, m.Stock
+	}
+	if product, s, m := stocks(); product != 2 || s != 1 || m != 1 {
+		t.Errorf("stock %d, small %d, medium %d after the order, want 2, 1 and 1", product, s, m)
+	}
+
+	env.do(http.MethodPut, fmt.Sprintf("/api/orders/%d", created.Order.ID), buyerToken,
+		gin.H{"status": models.Cancelled}, http.StatusOK, nil)
+	if product, s, m := stocks(); product != 5 || s != 3 || m != 2 {
+		t.Errorf("stock %d, small %d, medium %d after cancelling, want 5, 3 and 2", product, s, m)
+	}
+
+	var history struct {
+		InSync bool `json:"inSync"`
+	}
+	env.do(http.MethodGet, productPath+"/stock-history", sellerToken, nil, http.StatusOK, &history)
+	if !history.InSync {
+		t.Error("stock is out of sync with the inventory ledger")
+	}
+	env.do(http.MethodPut, productPath, sellerToken, gin.H{"stock": 10}, http.StatusBadRequest, nil)
+}
+
+func TestCartKeepsVariantsApart(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	jeans := env.createProduct(seller, "Jeans", 40, 0)
+	sellerToken := env.login(seller)
+	token := env.login(buyer)
+
+	env.do(http.MethodPut, fmt.Sprintf("/api/products/%d/options", jeans.ID), sellerToken, gin.H{"options": []string{"Waist"}}, http.StatusOK, nil)
+	narrow := env.createVariant(sellerToken, jeans, gin.H{"sku": "JN-30", "options": []string{"30"}, "stock": 4})
+	wide := env.createVariant(sellerToken, jeans, gin.H{"sku": "JN-34", "options": []string{"34"}, "stock": 1, "priceOverride": 45})
+
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": jeans.ID}, http.StatusBadRequest, nil)
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": jeans.ID, "variantId": wide.ID, "quantity": 2}, http.StatusConflict, nil)
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": jeans.ID, "variantId": narrow.ID, "quantity": 2}, http.StatusOK, nil)
+	var cart cartResponse
+	env.do(http.MethodPost, "/api/cart/items", token, gin.H{"productId": jeans.ID, "variantId": wide.ID}, http.StatusOK, &cart)
+	if len(cart.Cart.Items) != 2 || cart.Cart.Subtotal != usd(125) || !cart.Cart.CanCheckout {
+		t.Fatalf("cart = %+v, want two lines totalling 125", cart.Cart)
+	}
+
+	var placed struct {
+		Order models.Order `json:"order"`
+	}
+	env.do(http.MethodPost, "/api/cart/checkout", token, gin.H{"shippingDetails": testShippingDetails()}, http.StatusCreated, &placed)
+	if placed.Order.Total != usd(125) || len(placed.Order.OrderItems) != 2 {
+		t.Errorf("order = %+v, want two lines totalling 125", placed.Order)
+	}
+
+	var variant models.ProductVariant
+	env.db.First(&variant, wide.ID)
+	if variant.Stock != 0 {
+		t.Errorf("wide stock = %d, want 0", variant.Stock)
+	}
+}
+
+func TestReservationHoldsOneVariant(t *testing.T) {
+	env := newTestEnv(t)
+	seller := env.createUser("seller", models.Seller)
+	buyer := env.createUser("buyer", models.Buyer)
+	boots := env.createProduct(seller, "Boots", 90, 0)
+	sellerToken := env.login(seller)
+	token := env.login(buyer)
+
+	env.do(http.MethodPut, fmt.Sprintf("/api/products/%d/options", boots.ID), sellerToken, gin.H{"options": []string{"Size"}}, http.StatusOK, nil)
+	small := env.createVariant(sellerToken, boots, gin.H{"sku": "BT-40", "options": []string{"40"}, "stock": 2})
+	large := env.createVariant(sellerToken, boots, gin.H{"sku": "BT-44", "options": []string{"44"}, "stock": 2})
+
+	var reserved struct {
+		Reservation models.Reservation `json:"reservation"`
+	}
+	env.do(http.MethodPost, "/api/reservations", token,
+		gin.H{"items": []gin.H{{"productId": boots.ID, "variantId": small.ID, "quantity": 1}}}, http.StatusCreated, &reserved)
+
+	// The reservation holds the small boots, not any size of them
+	request := orderRequest(gin.H{"productId": boots.ID, "variantId": large.ID, "quantity": 1})
+	request["reservationId"] = reserved.Reservation.ID
+	env.do(http.MethodPost, "/api/orders", token, request, http.StatusBadRequest, nil)
+
+	request = orderRequest(gin.H{"productId": boots.ID, "variantId": small.ID, "quantity": 1})
+	request["reservationId"] = reserved.Reservation.ID
+	env.do(http.MethodPost, "/api/orders", token, request, http.StatusCreated, nil)
+
+	var reservation models.Reservation
+	env.db.First(&reservation, reserved.Reservation.ID)
+	if reservation.Status != models.ReservationConsumed {
+		t.Errorf("reservation = %s, want consumed", reservation.Status)
+	}
+}